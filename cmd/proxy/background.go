@@ -0,0 +1,70 @@
+package main
+
+import (
+	"context"
+	"log/slog"
+	"sort"
+	"sync"
+)
+
+// background runs the proxy's long-lived goroutines (SIGHUP reloads, model
+// loading, LLM warmup, ...) under one root context, so shutdown can cancel them together
+// and wait for them to return instead of leaving them to die with the
+// process.
+type background struct {
+	ctx    context.Context
+	cancel context.CancelFunc
+	wg     sync.WaitGroup
+
+	mu      sync.Mutex
+	running map[string]int // task name -> instances still running
+}
+
+func newBackground() *background {
+	ctx, cancel := context.WithCancel(context.Background())
+	return &background{ctx: ctx, cancel: cancel, running: make(map[string]int)}
+}
+
+// Go runs fn in its own goroutine. fn must return soon after ctx is done.
+func (b *background) Go(name string, fn func(ctx context.Context)) {
+	b.mu.Lock()
+	b.running[name]++
+	b.mu.Unlock()
+	b.wg.Add(1)
+	go func() {
+		defer b.wg.Done()
+		defer func() {
+			b.mu.Lock()
+			if b.running[name]--; b.running[name] == 0 {
+				delete(b.running, name)
+			}
+			b.mu.Unlock()
+		}()
+		fn(b.ctx)
+	}()
+}
+
+// stop cancels every task and waits for them to return, or for ctx to end,
+// in which case it logs the tasks still running and returns ctx's error.
+func (b *background) stop(ctx context.Context) error {
+	b.cancel()
+	done := make(chan struct{})
+	go func() {
+		b.wg.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+		return nil
+	case <-ctx.Done():
+		b.mu.Lock()
+		names := make([]string, 0, len(b.running))
+		for name := range b.running {
+			names = append(names, name)
+		}
+		b.mu.Unlock()
+		sort.Strings(names)
+		slog.Warn("background tasks did not stop in time", "tasks", names)
+		return ctx.Err()
+	}
+}
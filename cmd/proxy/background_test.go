@@ -0,0 +1,69 @@
+package main
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/api"
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
+)
+
+func TestBackgroundStopCancelsTasks(t *testing.T) {
+	bg := newBackground()
+	bg.Go("wallet-reload", (&walletReloader{}).onSIGHUP)
+	cancelled := make(chan struct{})
+	bg.Go("loop", func(ctx context.Context) {
+		<-ctx.Done()
+		close(cancelled)
+	})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 2*time.Second)
+	defer cancel()
+	if err := bg.stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+	select {
+	case <-cancelled:
+	default:
+		t.Fatal("task context was not cancelled")
+	}
+}
+
+func TestBackgroundStopGivesUpAfterDeadline(t *testing.T) {
+	bg := newBackground()
+	release := make(chan struct{})
+	defer close(release)
+	bg.Go("stuck", func(context.Context) { <-release })
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+	if err := bg.stop(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("stop = %v, want %v", err, context.DeadlineExceeded)
+	}
+}
+
+func TestBackgroundStopCancelsModelLoad(t *testing.T) {
+	s, err := signer.New("4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318")
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := wallet.NewPool([]wallet.Wallet{{Signer: s, Address: "gonka1requester"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// No endpoints were discovered, so every attempt fails and, under the
+	// readiness gate, the load would retry forever.
+	handler := api.NewWithOptions(upstream.New("http://127.0.0.1:0", pool), nil, api.Options{ReadinessGate: true})
+	bg := newBackground()
+	bg.Go("model-load", handler.Start)
+	time.Sleep(50 * time.Millisecond) // let the first attempt fail
+
+	ctx, cancel := context.WithTimeout(context.Background(), time.Second)
+	defer cancel()
+	if err := bg.stop(ctx); err != nil {
+		t.Fatalf("stop: %v", err)
+	}
+}
@@ -10,17 +10,28 @@ import (
 	"time"
 
 	"github.com/gonkalabs/gonka-proxy-go/internal/api"
+	"github.com/gonkalabs/gonka-proxy-go/internal/compression"
 	"github.com/gonkalabs/gonka-proxy-go/internal/config"
+	"github.com/gonkalabs/gonka-proxy-go/internal/idempotency"
 	"github.com/gonkalabs/gonka-proxy-go/internal/quality"
+	"github.com/gonkalabs/gonka-proxy-go/internal/ratelimit"
 	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
 	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize/llmclassifier"
 	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize/ner"
 	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/toolsim"
 	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
 	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
 )
 
+// version is set at build time with -ldflags "-X main.version=...".
+var version = "dev"
+
 func main() {
+	if len(os.Args) > 1 && os.Args[1] == "sign-test" {
+		os.Exit(runSignTest(os.Args[2:]))
+	}
+
 	slog.SetDefault(slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: slog.LevelInfo})))
 
 	cfg, err := config.Load()
@@ -29,76 +40,325 @@ func main() {
 		os.Exit(1)
 	}
 
-	var wallets []wallet.Wallet
-	for i, wc := range cfg.Wallets {
-		s, err := signer.New(wc.PrivateKey)
-		if err != nil {
-			slog.Error("signer error", "wallet", i+1, "err", err)
-			os.Exit(1)
-		}
-		wallets = append(wallets, wallet.Wallet{
-			Signer:  s,
-			Address: wc.Address,
-		})
+	signerOpts := signer.Options{Format: signer.Format(cfg.SignerSigFormat)}
+	wallets, err := buildWallets(cfg.Wallets, signerOpts)
+	if err != nil {
+		slog.Error("signer error", "err", err)
+		os.Exit(1)
 	}
 
-	pool, err := wallet.NewPool(wallets)
+	pool, err := wallet.NewPoolWithOptions(wallets, wallet.Options{
+		RejectDuplicates:  cfg.RejectDuplicateWallets,
+		RequestsPerMinute: cfg.WalletRateLimitPerMinute,
+		Burst:             cfg.WalletRateLimitBurst,
+	})
 	if err != nil {
 		slog.Error("wallet pool error", "err", err)
 		os.Exit(1)
 	}
+	if err := checkModelWallets(pool.All(), cfg.ModelWallets); err != nil {
+		slog.Error("wallet pool error", "err", err)
+		os.Exit(1)
+	}
+	// Every long-lived goroutine runs under bg, which shutdown cancels.
+	bg := newBackground()
+	reload := &walletReloader{pool: pool, modelWallets: cfg.ModelWallets, signerOpts: signerOpts}
+	bg.Go("wallet-reload", reload.onSIGHUP)
 
-	client := upstream.New(cfg.SourceURL, pool)
+	userAgent := cfg.UpstreamUserAgent
+	if userAgent == "" {
+		userAgent = "opengnk/" + version
+	}
+	staticEndpoints := make([]upstream.Endpoint, 0, len(cfg.Endpoints))
+	for _, ep := range cfg.Endpoints {
+		staticEndpoints = append(staticEndpoints, upstream.Endpoint{URL: ep.URL, Address: ep.Address})
+	}
+	client := upstream.NewWithOptions(cfg.SourceURL, pool, upstream.Options{
+		DisableWhitelist:  cfg.DisableWhitelist,
+		NetworkWhitelist:  cfg.NetworkWhitelist,
+		EndpointBlocklist: cfg.EndpointBlocklist,
+		StaticEndpoints:   staticEndpoints,
+		ModelWallets:      cfg.ModelWallets,
+		ModelsPath:        cfg.UpstreamModelsPath,
+		UserAgent:         userAgent,
+		InstanceID:        cfg.InstanceID,
+		FallbackURL:       cfg.FallbackURL,
+		FallbackAPIKey:    cfg.FallbackAPIKey,
+		VerifySignedBody:  cfg.UpstreamVerifySignedBody,
+		HedgeDelay:        cfg.HedgeDelay,
+		HedgeMax:          cfg.HedgeMax,
+	})
 
 	ctx, cancel := context.WithTimeout(context.Background(), 30*time.Second)
 	if err := client.DiscoverEndpoints(ctx); err != nil {
-		slog.Error("endpoint discovery failed", "err", err)
-		cancel()
-		os.Exit(1)
+		if cfg.FallbackURL == "" {
+			slog.Error("endpoint discovery failed", "err", err)
+			cancel()
+			os.Exit(1)
+		}
+		slog.Warn("endpoint discovery failed; serving every request from the fallback upstream", "err", err)
 	}
 	cancel()
 
+	if cfg.EndpointProbe != "off" {
+		ctx, cancel := context.WithTimeout(context.Background(), cfg.EndpointProbeTimeout+5*time.Second)
+		_, err := client.ProbeEndpoints(ctx, cfg.EndpointProbeTimeout)
+		cancel()
+		if err != nil {
+			if cfg.EndpointProbe == "require" {
+				slog.Error("endpoint probe failed", "err", err)
+				os.Exit(1)
+			}
+			slog.Warn("endpoint probe failed; starting anyway", "err", err)
+		}
+	}
+
 	var san *sanitize.Sanitizer
+	var llmBreaker *sanitize.Breaker
+	var latency *sanitize.LatencyRecorder
+	var shadow *sanitize.Shadow
+	var auditSink sanitize.AuditSink
+	var closeAudit func(context.Context) error // flushes and closes the audit sink
+	var closeSamples func() error              // closes the sample file
 	if cfg.SanitizeEnabled {
 		var classifiers []sanitize.Classifier
+		var llmLayer sanitize.Classifier
+		layers := make(map[string]sanitize.Classifier) // by SANITIZE_REQUIRED_CLASSIFIERS name
 
 		if cfg.SanitizeNER {
-			classifiers = append(classifiers, ner.New(cfg.SanitizeNERURL))
-			slog.Info("sanitize: NER layer enabled", "url", cfg.SanitizeNERURL)
+			if cfg.SanitizeNERProto == "grpc" {
+				c, err := ner.NewGRPC(cfg.SanitizeNERURL)
+				if err != nil {
+					slog.Error("sanitize: NER layer", "err", err)
+					os.Exit(1)
+				}
+				layers["ner"] = c
+			} else {
+				layers["ner"] = ner.New(cfg.SanitizeNERURL)
+			}
+			classifiers = append(classifiers, layers["ner"])
+			slog.Info("sanitize: NER layer enabled", "url", cfg.SanitizeNERURL, "proto", cfg.SanitizeNERProto)
+		}
+		if cfg.SanitizeWebhookURL != "" {
+			layers["webhook"] = ner.NewWebhook(cfg.SanitizeWebhookURL, cfg.SanitizeWebhookToken, cfg.SanitizeWebhookTimeout)
+			classifiers = append(classifiers, layers["webhook"])
+			slog.Info("sanitize: webhook layer enabled", "url", cfg.SanitizeWebhookURL, "timeout", cfg.SanitizeWebhookTimeout)
 		}
 		if cfg.SanitizeLLM {
-			classifiers = append(classifiers, llmclassifier.New(
-				cfg.SanitizeLLMURL,
-				cfg.SanitizeLLMModel,
-				cfg.SanitizeLLMThreshold,
-			))
+			llmOpts := llmclassifier.Options{
+				ReasoningFallback: cfg.SanitizeLLMReasoningFallback,
+				MaxTokens:         cfg.SanitizeLLMMaxTokens,
+				RetryMaxTokens:    cfg.SanitizeLLMRetryMaxTokens,
+				WindowSize:        cfg.SanitizeLLMWindow,
+			}
+			llmURL, llmModel := cfg.SanitizeLLMURL, cfg.SanitizeLLMModel
+			if cfg.SanitizeLLMViaGonka != "" {
+				llmURL, llmModel = "gonka", cfg.SanitizeLLMViaGonka
+				llmOpts.Upstream = gonkaUpstream(client, llmModel)
+				slog.Warn("sanitize: LLM classifier runs on the Gonka network; the text it classifies is sent there unredacted", "model", llmModel)
+			}
+			llm := llmclassifier.NewWithOptions(cfg.SanitizeLLMURL, llmModel, llmOpts)
+			llmLayer = llm
+			if cfg.SanitizeLLMBreakerFailures > 0 {
+				llmBreaker = sanitize.NewBreaker("llm", llm, cfg.SanitizeLLMBreakerFailures, cfg.SanitizeLLMBreakerCooldown)
+				llmLayer = llmBreaker
+			}
+			if cfg.SanitizeLLMPrescreen != "" {
+				llmLayer = sanitize.NewPrescreen(llmLayer, sanitize.PrescreenMode(cfg.SanitizeLLMPrescreen))
+			}
+			layers["llm"] = llmLayer
+			classifiers = append(classifiers, llmLayer)
 			slog.Info("sanitize: LLM layer enabled",
-				"url", cfg.SanitizeLLMURL,
-				"model", cfg.SanitizeLLMModel,
+				"url", llmURL,
+				"model", llmModel,
+				"breakerFailures", cfg.SanitizeLLMBreakerFailures,
+				"prescreen", cfg.SanitizeLLMPrescreen,
 			)
+			if cfg.SanitizeLLMWarmup && cfg.SanitizeLLMViaGonka == "" {
+				bg.Go("llm-warmup", func(ctx context.Context) { warmupLLM(ctx, llm, llmModel) })
+			}
+		}
+
+		var sampleSink sanitize.SampleSink
+		if cfg.SanitizeSampleRate > 0 {
+			sink, err := sanitize.NewFileSampleSink(cfg.SanitizeSampleFile)
+			if err != nil {
+				slog.Error("sanitize: sampling disabled", "err", err)
+				os.Exit(1)
+			}
+			sampleSink = sink
+			closeSamples = sink.Close
+			slog.Info("sanitize: sampling classifier outputs", "rate", cfg.SanitizeSampleRate, "file", cfg.SanitizeSampleFile)
+		}
+
+		switch {
+		case cfg.SanitizeAuditFile != "":
+			sink, err := sanitize.NewFileAuditSink(cfg.SanitizeAuditFile)
+			if err != nil {
+				slog.Error("sanitize: audit", "err", err)
+				os.Exit(1)
+			}
+			auditSink = sink
+			closeAudit = func(context.Context) error { return sink.Close() }
+			slog.Info("sanitize: auditing redactions", "file", cfg.SanitizeAuditFile)
+		case cfg.SanitizeAuditWebhook != "":
+			sink := sanitize.NewWebhookAuditSink(cfg.SanitizeAuditWebhook, cfg.SanitizeAuditWebhookToken)
+			closeAudit = sink.Close
+			auditSink = sink
+			slog.Info("sanitize: auditing redactions to webhook")
+		}
+
+		if cfg.SanitizeShadowModel != "" {
+			candidate := llmclassifier.NewWithOptions(cfg.SanitizeShadowURL, cfg.SanitizeShadowModel, llmclassifier.Options{
+				ReasoningFallback: cfg.SanitizeLLMReasoningFallback,
+				MaxTokens:         cfg.SanitizeLLMMaxTokens,
+				RetryMaxTokens:    cfg.SanitizeLLMRetryMaxTokens,
+				WindowSize:        cfg.SanitizeLLMWindow,
+			})
+			// Compared with the active LLM layer, or with everything
+			// redacted when there is none.
+			shadow = sanitize.NewShadow("shadow", candidate, llmLayer, cfg.SanitizeShadowConcurrency)
+			slog.Info("sanitize: shadow LLM classifier enabled; its findings are reported, not applied",
+				"url", cfg.SanitizeShadowURL, "model", cfg.SanitizeShadowModel)
+		}
+
+		var required []string
+		for _, layer := range cfg.SanitizeRequired {
+			required = append(required, sanitize.ClassifierName(layers[layer]))
 		}
 
-		san = sanitize.NewWithClassifiers(classifiers)
-		slog.Info("sanitization enabled", "classifiers", len(classifiers))
+		latency = sanitize.NewLatencyRecorder(0)
+		san = sanitize.NewWithOptions(classifiers, sanitize.Options{
+			MinSpanLen:    cfg.SanitizeMinSpanLen,
+			MaxRedactions: cfg.SanitizeMaxRedactions,
+			SampleRate:    cfg.SanitizeSampleRate,
+			SampleSink:    sampleSink,
+			CrossMessage:  cfg.SanitizeCrossMessage,
+			TypedTokens:   cfg.SanitizeTypedTokens,
+			TokenNonce:    cfg.SanitizeTokenNonce,
+			Normalize:     cfg.SanitizeNormalize,
+			JSONContent:   cfg.SanitizeJSONContent,
+			Required:      required,
+			LLM:           llmLayer,
+			CodeBlocks:    sanitize.CodeBlockMode(cfg.SanitizeCodeBlocks),
+			Latency:       latency,
+			Shadow:        shadow,
+		})
+		slog.Info("sanitization enabled", "classifiers", len(classifiers), "required", cfg.SanitizeRequired)
+	}
+
+	var idem *idempotency.Cache
+	if cfg.Idempotency {
+		idem = idempotency.New(cfg.IdempotencyTTL, cfg.IdempotencyMaxEntries)
+		slog.Info("idempotency cache enabled", "ttl", cfg.IdempotencyTTL, "maxEntries", cfg.IdempotencyMaxEntries)
+	}
+
+	var limiter *ratelimit.Limiter
+	if cfg.RateLimitPerMinute > 0 {
+		limiter = ratelimit.New(cfg.RateLimitPerMinute, cfg.RateLimitBurst)
+		slog.Info("rate limiting enabled", "perMinute", cfg.RateLimitPerMinute, "burst", cfg.RateLimitBurst)
+	}
+	var userLimiter *ratelimit.Limiter
+	if cfg.RateLimitUserPerMinute > 0 {
+		userLimiter = ratelimit.New(cfg.RateLimitUserPerMinute, cfg.RateLimitUserBurst)
+		slog.Info("per-user rate limiting enabled", "perMinute", cfg.RateLimitUserPerMinute, "burst", cfg.RateLimitUserBurst)
+	}
+
+	var gate *ratelimit.Gate
+	if cfg.MaxConcurrentRequests > 0 {
+		gate = ratelimit.NewGate(cfg.MaxConcurrentRequests, cfg.QueueMaxWait)
+		slog.Info("concurrency limit enabled", "max", cfg.MaxConcurrentRequests, "queueMaxWait", cfg.QueueMaxWait)
 	}
 
-	handler := api.New(client, cfg.SimulateToolCalls, cfg.NativeToolCalls, san)
+	var modelSplits map[string]api.ModelSplit
+	for model, sc := range cfg.ModelSplits {
+		if modelSplits == nil {
+			modelSplits = make(map[string]api.ModelSplit)
+		}
+		modelSplits[model] = api.ModelSplit{Target: sc.Target, Percent: sc.Percent}
+	}
+
+	handler := api.NewWithOptions(client, san, api.Options{
+		SimulateToolCalls: cfg.SimulateToolCalls,
+		NativeToolCalls:   cfg.NativeToolCalls,
+		ToolSim: toolsim.Options{
+			SystemPrompt:   toolsim.SystemPromptMode(cfg.ToolSimSystemPrompt),
+			Content:        toolsim.ContentMode(cfg.ToolSimContent),
+			DuplicateTools: toolsim.DuplicateToolsMode(cfg.ToolSimDuplicateTools),
+			ResponseText:   toolsim.ResponseTextMode(cfg.ToolSimResponseText),
+			EmptyContent:   cfg.ToolSimEmptyContent,
+		},
+		RouteBySeed:        cfg.RouteBySeed,
+		StreamErrorsAsSSE:  cfg.StreamErrorsAsSSE,
+		StreamBufferBytes:  cfg.StreamBufferBytes,
+		NormalizeSSE:       cfg.StreamNormalize,
+		Validation:         api.ValidationMode(cfg.RequestValidation),
+		MaxPromptTokens:    cfg.MaxPromptTokens,
+		MaxTokensCeiling:   cfg.MaxTokensCeiling,
+		MaxRequestTimeout:  cfg.MaxRequestTimeout,
+		RetryBudget:        upstream.RetryBudget{Attempts: cfg.RetryBudget, Time: cfg.RetryBudgetTime},
+		ModelAliases:       cfg.ModelAliases,
+		DropRequestFields:  cfg.DropRequestFields,
+		AllowModelOverride: cfg.AllowModelOverride,
+		ModelOverrideToken: cfg.AdminToken,
+		ModelSplits:        modelSplits,
+		SanitizeModels:     cfg.SanitizeModels,
+		SanitizeBodyReport: cfg.SanitizeBodyReport,
+		SanitizeFailClosed: cfg.SanitizeFailClosed,
+		SanitizeProgress:   cfg.SanitizeProgress,
+		AuditSink:          auditSink,
+		ReadinessGate:      cfg.ReadinessGate,
+		ForwardHeaders:     cfg.ForwardHeaders,
+		WalletAffinity:     cfg.WalletAffinity,
+		UsageLog:           cfg.UsageLog,
+		RateLimiter:        limiter,
+		UserRateLimiter:    userLimiter,
+		Gate:               gate,
+		Idempotency:        idem,
+	})
+	bg.Go("model-load", handler.Start)
 
 	qm := quality.New()
 
 	mux := http.NewServeMux()
 	handler.Register(mux)
 	mux.Handle("GET /quality/stats", qm.StatsHandler())
+	if latency != nil {
+		mux.Handle("GET /sanitize/latency", latency.StatusHandler())
+	}
+	if llmBreaker != nil {
+		mux.Handle("GET /sanitize/llm", llmBreaker.StatusHandler())
+	}
+	if shadow != nil {
+		mux.Handle("GET /sanitize/shadow", shadow.StatusHandler())
+	}
+	if gate != nil {
+		mux.Handle("GET /queue/stats", gate.StatusHandler())
+	}
+	if cfg.AdminToken != "" {
+		mux.Handle("POST /admin/reload", requireAdmin(cfg.AdminToken, reload.handler()))
+		mux.Handle("GET /admin/models", requireAdmin(cfg.AdminToken, handler.AdminModelsHandler()))
+		if cfg.DryRun {
+			mux.Handle("POST /admin/dry-run", requireAdmin(cfg.AdminToken, handler.DryRunHandler()))
+		}
+	}
+
+	var root http.Handler = mux
+	if cfg.ResponseCompression {
+		root = compression.Gzip(root)
+		slog.Info("response compression enabled")
+	}
 
 	srv := &http.Server{
 		Addr:         cfg.ListenAddr,
-		Handler:      qm.Wrap(mux),
+		Handler:      qm.Wrap(root),
 		ReadTimeout:  30 * time.Second,
 		WriteTimeout: 300 * time.Second,
 		IdleTimeout:  120 * time.Second,
 	}
 
 	// Graceful shutdown
+	shutdownDone := make(chan struct{})
 	go func() {
 		sigCh := make(chan os.Signal, 1)
 		signal.Notify(sigCh, syscall.SIGINT, syscall.SIGTERM)
@@ -108,13 +368,35 @@ func main() {
 		shutCtx, shutCancel := context.WithTimeout(context.Background(), 10*time.Second)
 		defer shutCancel()
 
+		// Stop background work first: a warmup still loading the model must
+		// not hold the grace period.
+		bgDone := make(chan struct{})
+		go func() {
+			_ = bg.stop(shutCtx)
+			close(bgDone)
+		}()
+
 		if err := srv.Shutdown(shutCtx); err != nil {
 			slog.Error("shutdown error", "err", err)
 		}
+		// In-flight requests are done; deliver their audit records.
+		if closeAudit != nil {
+			if err := closeAudit(shutCtx); err != nil {
+				slog.Error("sanitize: audit", "err", err)
+			}
+		}
+		if closeSamples != nil {
+			if err := closeSamples(); err != nil {
+				slog.Error("sanitize: sample file", "err", err)
+			}
+		}
+		<-bgDone
+		close(shutdownDone)
 	}()
 
 	slog.Info("starting proxy server",
 		"addr", cfg.ListenAddr,
+		"version", version,
 		"wallets", pool.Len(),
 		"toolSim", cfg.SimulateToolCalls,
 		"nativeToolCalls", cfg.NativeToolCalls,
@@ -124,4 +406,37 @@ func main() {
 		slog.Error("server error", "err", err)
 		os.Exit(1)
 	}
+	<-shutdownDone
+}
+
+// gonkaUpstream sends LLM classifier requests for model through the proxy's
+// own Gonka client, so they are signed, routed and retried like client
+// requests.
+func gonkaUpstream(client *upstream.Client, model string) llmclassifier.Upstream {
+	return func(ctx context.Context, body []byte) (int, []byte, error) {
+		resp, err := client.Do(upstream.WithModel(ctx, model), http.MethodPost, "/chat/completions", body)
+		if err != nil {
+			return 0, nil, err
+		}
+		return resp.StatusCode, resp.Body, nil
+	}
+}
+
+// warmupLLM loads the classifier model in the background so the first user
+// request does not pay the model-load cost. Shutdown cancels it through ctx.
+func warmupLLM(ctx context.Context, llm *llmclassifier.Classifier, model string) {
+	ctx, cancel := context.WithTimeout(ctx, 5*time.Minute)
+	defer cancel()
+
+	start := time.Now()
+	slog.Info("sanitize: warming up LLM classifier", "model", model)
+	if err := llm.Warmup(ctx); err != nil {
+		if ctx.Err() == context.Canceled {
+			slog.Info("sanitize: LLM warmup cancelled", "model", model)
+			return
+		}
+		slog.Warn("sanitize: LLM warmup failed", "model", model, "err", err)
+		return
+	}
+	slog.Info("sanitize: LLM classifier ready", "model", model, "took", time.Since(start).Round(time.Millisecond))
 }
@@ -0,0 +1,130 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"os/signal"
+	"sync"
+	"syscall"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/config"
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
+)
+
+// requireAdmin lets through only requests presenting token as a bearer token.
+func requireAdmin(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got := []byte(r.Header.Get("Authorization"))
+		if subtle.ConstantTimeCompare(got, []byte("Bearer "+token)) != 1 {
+			w.Header().Set("Content-Type", "application/json")
+			w.WriteHeader(http.StatusUnauthorized)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": "unauthorized"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+// buildWallets creates a signer for each configured wallet.
+func buildWallets(cfgs []config.WalletCfg, opts signer.Options) ([]wallet.Wallet, error) {
+	wallets := make([]wallet.Wallet, 0, len(cfgs))
+	for i, wc := range cfgs {
+		s, err := signer.NewWithOptions(wc.PrivateKey, opts)
+		if err != nil {
+			return nil, fmt.Errorf("wallet %d: %w", i+1, err)
+		}
+		wallets = append(wallets, wallet.Wallet{
+			Signer:  s,
+			Address: wc.Address,
+		})
+	}
+	return wallets, nil
+}
+
+// checkModelWallets verifies every MODEL_WALLET_MAP address is in wallets.
+func checkModelWallets(wallets []wallet.Wallet, modelWallets map[string]string) error {
+	for model, addr := range modelWallets {
+		found := false
+		for _, w := range wallets {
+			if w.Address == addr {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return fmt.Errorf("MODEL_WALLET_MAP references an unknown wallet: model %s, address %s", model, addr)
+		}
+	}
+	return nil
+}
+
+// walletReloader re-reads the wallet configuration into a running pool, on
+// SIGHUP or via POST /admin/reload. A reload that fails leaves the current
+// wallets in place.
+type walletReloader struct {
+	mu           sync.Mutex // serialises reloads
+	pool         *wallet.Pool
+	modelWallets map[string]string
+	signerOpts   signer.Options
+}
+
+// reload rebuilds the wallets and swaps them into the pool, returning the new
+// wallet count.
+func (wr *walletReloader) reload() (int, error) {
+	wr.mu.Lock()
+	defer wr.mu.Unlock()
+
+	cfgs, err := config.ReloadWallets()
+	if err != nil {
+		return 0, err
+	}
+	wallets, err := buildWallets(cfgs, wr.signerOpts)
+	if err != nil {
+		return 0, err
+	}
+	if err := checkModelWallets(wallets, wr.modelWallets); err != nil {
+		return 0, err
+	}
+	if err := wr.pool.Replace(wallets); err != nil {
+		return 0, err
+	}
+	return len(wallets), nil
+}
+
+// onSIGHUP reloads the wallets on every SIGHUP until ctx is done.
+func (wr *walletReloader) onSIGHUP(ctx context.Context) {
+	ch := make(chan os.Signal, 1)
+	signal.Notify(ch, syscall.SIGHUP)
+	defer signal.Stop(ch)
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ch:
+			if _, err := wr.reload(); err != nil {
+				slog.Error("wallet reload failed; keeping current wallets", "err", err)
+			}
+		}
+	}
+}
+
+// handler serves POST /admin/reload.
+func (wr *walletReloader) handler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		n, err := wr.reload()
+		if err != nil {
+			slog.Error("wallet reload failed; keeping current wallets", "err", err)
+			w.WriteHeader(http.StatusUnprocessableEntity)
+			_ = json.NewEncoder(w).Encode(map[string]string{"error": err.Error()})
+			return
+		}
+		_ = json.NewEncoder(w).Encode(map[string]int{"wallets": n})
+	})
+}
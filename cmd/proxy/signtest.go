@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"flag"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/joho/godotenv"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
+)
+
+// runSignTest implements `proxy sign-test`: it discovers an endpoint, sends a
+// one-token signed chat completion with the given key, and prints whether
+// the node accepted it. It returns the process exit code.
+func runSignTest(args []string) int {
+	// Best-effort, like config.Load, so flags can default to .env values.
+	_ = godotenv.Load()
+
+	fs := flag.NewFlagSet("sign-test", flag.ContinueOnError)
+	source := fs.String("source", envOr("GONKA_SOURCE_URL", "http://node2.gonka.ai:8000"), "source node URL used for endpoint discovery")
+	key := fs.String("key", os.Getenv("GONKA_PRIVATE_KEY"), "hex secp256k1 private key")
+	address := fs.String("address", os.Getenv("GONKA_ADDRESS"), "bech32 requester address")
+	sigFormat := fs.String("sig-format", envOr("SIGNER_SIG_FORMAT", "raw"), "signature encoding: raw (r||s) or der")
+	model := fs.String("model", "Qwen/Qwen3-235B-A22B-Instruct-2507-FP8", "model used for the probe request")
+	timeout := fs.Duration("timeout", 60*time.Second, "overall timeout")
+	fs.SetOutput(os.Stderr)
+	fs.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: proxy sign-test [flags]")
+		fmt.Fprintln(os.Stderr, "\nSends one signed probe request to a discovered node and reports the result.")
+		fmt.Fprintln(os.Stderr, "Flags default to GONKA_SOURCE_URL, GONKA_PRIVATE_KEY and GONKA_ADDRESS.")
+		fmt.Fprintln(os.Stderr)
+		fs.PrintDefaults()
+	}
+	if err := fs.Parse(args); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return 0
+		}
+		return 2
+	}
+	if *key == "" {
+		fmt.Fprintln(os.Stderr, "sign-test: --key (or GONKA_PRIVATE_KEY) is required")
+		return 2
+	}
+
+	// Keep the library logging out of the way of the report.
+	slog.SetDefault(slog.New(slog.NewTextHandler(io.Discard, nil)))
+
+	fail := func(step string, err error) int {
+		fmt.Printf("FAIL  %s: %v\n", step, err)
+		return 1
+	}
+
+	s, err := signer.NewWithOptions(*key, signer.Options{Format: signer.Format(strings.ToLower(*sigFormat))})
+	if err != nil {
+		return fail("load key", err)
+	}
+	fmt.Printf("ok    key loaded (address %s)\n", orNone(*address))
+
+	pool, err := wallet.NewPool([]wallet.Wallet{{Signer: s, Address: *address}})
+	if err != nil {
+		return fail("wallet", err)
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), *timeout)
+	defer cancel()
+
+	src := strings.TrimSuffix(strings.TrimRight(*source, "/"), "/v1")
+	client := upstream.New(src, pool)
+	if err := client.DiscoverEndpoints(ctx); err != nil {
+		return fail("discover endpoints from "+src, err)
+	}
+	fmt.Printf("ok    endpoints discovered from %s\n", src)
+
+	probe, _ := json.Marshal(map[string]any{
+		"model":      *model,
+		"messages":   []map[string]string{{"role": "user", "content": "ping"}},
+		"max_tokens": 1,
+	})
+	start := time.Now()
+	resp, err := client.Do(ctx, http.MethodPost, "/chat/completions", probe)
+	if err != nil {
+		return fail("send probe", err)
+	}
+	took := time.Since(start).Round(time.Millisecond)
+	if resp.StatusCode >= 400 {
+		fmt.Printf("FAIL  node %s rejected signed request: HTTP %d after %s\n", resp.Endpoint, resp.StatusCode, took)
+		fmt.Printf("      %s\n", strings.TrimSpace(string(resp.Body)))
+		return 1
+	}
+	fmt.Printf("ok    node %s accepted signed request: HTTP %d after %s\n", resp.Endpoint, resp.StatusCode, took)
+	return 0
+}
+
+func envOr(name, def string) string {
+	if v := strings.TrimSpace(os.Getenv(name)); v != "" {
+		return v
+	}
+	return def
+}
+
+func orNone(s string) string {
+	if s == "" {
+		return "<none>"
+	}
+	return s
+}
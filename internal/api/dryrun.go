@@ -0,0 +1,98 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"io"
+	"log/slog"
+	"net/http"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/toolsim"
+)
+
+// dryRunResult is the diagnostic answer of DryRunHandler.
+type dryRunResult struct {
+	ToolSimulation bool              `json:"tool_simulation"`
+	Method         string            `json:"method"`
+	URL            string            `json:"url"`
+	Endpoint       string            `json:"endpoint"`
+	Wallet         string            `json:"wallet"`
+	Headers        map[string]string `json:"headers"`
+	Body           string            `json:"body"` // the bytes that would be signed and sent, verbatim
+}
+
+// DryRunHandler takes a chat completions request, runs it through the same
+// rewrite pipeline as /v1/chat/completions (model override and splits,
+// aliasing, sanitization, content normalization, custom transformers, tool
+// simulation, validation) and answers with the final upstream body and the
+// signed headers it would be sent with, instead of forwarding it. Nothing is
+// sent upstream, no per-wallet quota is taken and no audit record is written;
+// classifiers still run.
+//
+// The headers include a valid signature, so the handler must be mounted
+// behind admin authentication.
+func (h *Handler) DryRunHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		body, err := io.ReadAll(r.Body)
+		if err != nil {
+			writeErr(w, http.StatusBadRequest, "failed to read body: "+err.Error())
+			return
+		}
+		defer r.Body.Close()
+		if !json.Valid(body) {
+			writeInvalidRequest(w, "request body is not valid JSON")
+			return
+		}
+
+		if h.opts.AllowModelOverride || len(h.opts.ModelSplits) > 0 {
+			body = h.overrideModel(r, body)
+		}
+		ctx := context.WithValue(r.Context(), dryRunCtx, true)
+		ctx, body, err = h.transformRequest(ctx, body)
+		if err != nil {
+			var re *RequestError
+			if errors.As(err, &re) {
+				writeRequestError(w, re)
+				return
+			}
+			writeInvalidRequest(w, err.Error())
+			return
+		}
+
+		simulate := !h.opts.NativeToolCalls && h.opts.SimulateToolCalls && toolsim.NeedsSimulation(body)
+		if simulate {
+			body, _, _, err = toolsim.RewriteRequestWithOptions(body, h.opts.ToolSim)
+			if err != nil {
+				writeToolSimErr(w, err)
+				return
+			}
+		}
+		if re := validateChatRequest(body, h.opts.Validation); re != nil {
+			writeRequestError(w, re)
+			return
+		}
+
+		req, by, err := h.client.Prepare(ctx, http.MethodPost, "/chat/completions", body)
+		if err != nil {
+			writeErr(w, http.StatusBadGateway, "upstream error: "+err.Error())
+			return
+		}
+		headers := make(map[string]string, len(req.Header))
+		for name := range req.Header {
+			headers[name] = req.Header.Get(name)
+		}
+		slog.Info("dry run", "bodyLen", len(body), "endpoint", by.Endpoint, "wallet", by.Wallet, "toolsim", simulate)
+
+		setSanitizeHeader(w, tokenMapFrom(ctx))
+		writeJSON(w, http.StatusOK, dryRunResult{
+			ToolSimulation: simulate,
+			Method:         req.Method,
+			URL:            req.URL.String(),
+			Endpoint:       by.Endpoint,
+			Wallet:         by.Wallet,
+			Headers:        headers,
+			Body:           string(body),
+		})
+	})
+}
@@ -2,44 +2,224 @@ package api
 
 import (
 	"context"
+	"crypto/sha256"
 	"encoding/base64"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log/slog"
+	"net"
 	"net/http"
+	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
+	"github.com/gonkalabs/gonka-proxy-go/internal/idempotency"
+	"github.com/gonkalabs/gonka-proxy-go/internal/ratelimit"
 	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
 	"github.com/gonkalabs/gonka-proxy-go/internal/toolsim"
 	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
 )
 
 // Handler implements all HTTP endpoints.
 type Handler struct {
-	client            *upstream.Client
-	simulateToolCalls bool
-	nativeToolCalls   bool
-	sanitizer         *sanitize.Sanitizer // nil when sanitization is disabled
+	client    *upstream.Client
+	opts      Options
+	sanitizer *sanitize.Sanitizer // nil when sanitization is disabled
 
-	mu     sync.RWMutex
-	models []json.RawMessage // cached raw model objects from upstream
+	mu        sync.RWMutex
+	models    []json.RawMessage // cached raw model objects from upstream
+	modelList *modelList        // /v1/models response built from models
+
+	ready atomic.Bool // set after the first successful model load
+
+	// Transformer chains, built from opts by buildChains.
+	requestChain  []RequestTransformer
+	responseChain []ResponseTransformer
+	streamChain   []StreamTransformer
 }
 
-// New creates a Handler and kicks off initial model loading.
+// Options toggles optional request handling features.
+type Options struct {
+	SimulateToolCalls bool // rewrite tool-call requests into plain prompts
+	NativeToolCalls   bool // forward tool_calls natively, flattening array content
+
+	// ToolSim tunes how tool-call requests are rewritten and responses
+	// parsed when simulating.
+	ToolSim toolsim.Options
+
+	// RouteBySeed sends requests that carry a "seed" to an endpoint derived
+	// from the seed value, so repeated seeded requests hit the same node.
+	RouteBySeed bool
+
+	// SanitizeBodyReport additionally injects the redaction list into
+	// successful non-streaming JSON responses under "_gonka_sanitize".
+	SanitizeBodyReport bool
+
+	// SanitizeFailClosed rejects a request with 503 instead of forwarding it
+	// when any classifier errors or misses the budget.
+	SanitizeFailClosed bool
+
+	// AuditSink receives the redactions (originals included) of every
+	// sanitized request, with its request ID (X-Request-Id or generated).
+	// nil disables auditing.
+	AuditSink sanitize.AuditSink
+
+	// SanitizeModels limits sanitization by model. Plain entries form an
+	// allowlist (only those models are sanitized); entries prefixed with "!"
+	// are never sanitized. A model matches by the name the client sent or
+	// the upstream model it is aliased to. Empty sanitizes every model.
+	SanitizeModels []string
+
+	// ReadinessGate makes /v1/models and /v1/chat/completions answer 503 with
+	// Retry-After, and /health report "starting", until the first successful
+	// model load. Model loading then retries until it succeeds.
+	ReadinessGate bool
+
+	// ModelAliases maps a client-facing model name to the upstream model it
+	// is served by. Responses report the alias the client asked for.
+	ModelAliases map[string]string
+
+	// StreamErrorsAsSSE answers a streaming request whose upstream attempts
+	// all failed with a 200 event stream carrying an OpenAI-style error event
+	// and [DONE], instead of a plain 502 JSON body.
+	StreamErrorsAsSSE bool
+
+	// StreamBufferBytes is the read buffer used when relaying a streamed
+	// response; each filled read is written and flushed to the client. Larger
+	// buffers mean fewer writes but can hold bytes back slightly longer.
+	// Zero means 4096.
+	StreamBufferBytes int
+
+	// SanitizeProgress, when positive, reports on sanitization that is still
+	// running after this long for streamed requests: the SSE response starts
+	// early with a ": redacting... N spans found" comment every interval.
+	// Headers set after that point are lost, except the X-Sanitize-* ones,
+	// which are sent as trailers. Zero disables it.
+	SanitizeProgress time.Duration
+
+	// NormalizeSSE re-frames streamed responses that arrive as
+	// newline-delimited JSON objects instead of SSE into "data:" events
+	// ending with [DONE], for nodes that do not frame their streams.
+	// Proper SSE passes through unchanged.
+	NormalizeSSE bool
+
+	// Validation rejects structurally invalid requests with 400 before they
+	// are signed, checking the body as it will be forwarded. Empty means
+	// ValidateOff.
+	Validation ValidationMode
+
+	// MaxPromptTokens rejects requests whose estimated prompt size exceeds it
+	// with 400 before anything is signed or sent. Zero disables the check.
+	MaxPromptTokens int
+
+	// MaxTokensCeiling caps max_tokens (and max_completion_tokens) in chat
+	// requests; a request without either is left alone. A lowered value is
+	// reported in the X-Max-Tokens-Clamped response header, which carries
+	// the client's value. Zero disables the cap.
+	MaxTokensCeiling int
+
+	// MaxRequestTimeout is the largest deadline a client may set with the
+	// X-Request-Timeout header; larger values are rejected with 400. Zero
+	// ignores the header.
+	MaxRequestTimeout time.Duration
+
+	// RetryBudget bounds the upstream attempts of one chat request across
+	// every call the handler makes for it. The zero value leaves each call
+	// its own 3 attempts.
+	RetryBudget upstream.RetryBudget
+
+	// RateLimiter throttles chat completions per client: its API key, else
+	// its address. nil disables rate limiting.
+	RateLimiter *ratelimit.Limiter
+
+	// UserRateLimiter throttles chat completions per end user within a
+	// client, as named by the request's "user" field, on top of
+	// RateLimiter. Requests without a user field are not counted. nil
+	// disables it.
+	UserRateLimiter *ratelimit.Limiter
+
+	// Gate bounds the chat completions served at once, across all clients.
+	// A request over the limit waits in its queue for a slot, or is
+	// answered 503 with Retry-After once the gate gives up. nil serves
+	// every request at once.
+	Gate *ratelimit.Gate
+
+	// UsageLog emits one "request completed" log line per chat request with
+	// its request ID (X-Request-Id or generated), completion ID, model,
+	// serving endpoint and signing wallet, token usage, and latency.
+	UsageLog bool
+
+	// DropRequestFields lists top-level request fields removed before
+	// forwarding, for clients that send parameters some nodes reject.
+	DropRequestFields []string
+
+	// AllowModelOverride honours an X-Model-Override header that replaces the
+	// request's model, from callers whose bearer token is ModelOverrideToken.
+	AllowModelOverride bool
+	ModelOverrideToken string
+
+	// ModelSplits sends a percentage of each listed model's traffic to
+	// another model, for A/B tests. Clients are assigned to an arm by a hash
+	// of their client key, so each keeps seeing the same model.
+	ModelSplits map[string]ModelSplit
+
+	// WalletAffinity signs each client's requests with the same wallet,
+	// chosen by a hash of the client key (the "user" field, else the API key,
+	// else the address), instead of round-robin.
+	WalletAffinity bool
+
+	// ForwardHeaders lists upstream response headers copied to the client.
+	// Names are case-insensitive; a trailing "*" matches a prefix (e.g.
+	// "X-Gonka-*"). Empty forwards none.
+	ForwardHeaders []string
+
+	// Idempotency caches non-streaming responses by Idempotency-Key header.
+	// nil disables idempotency handling.
+	Idempotency *idempotency.Cache
+
+	// RequestTransformers run after the built-in request steps (aliasing,
+	// sanitization, content normalization), so they see the body exactly as
+	// it will be signed. ResponseTransformers run before the built-in response
+	// steps; those that also implement StreamTransformer apply to streams.
+	RequestTransformers  []RequestTransformer
+	ResponseTransformers []ResponseTransformer
+}
+
+// New creates a Handler. Models are loaded once Start runs.
 // Pass a non-nil sanitizer to enable request/response sanitization.
 func New(client *upstream.Client, simulateToolCalls bool, nativeToolCalls bool, san *sanitize.Sanitizer) *Handler {
+	return NewWithOptions(client, san, Options{
+		SimulateToolCalls: simulateToolCalls,
+		NativeToolCalls:   nativeToolCalls,
+	})
+}
+
+// NewWithOptions is like New but takes the full set of handler options.
+func NewWithOptions(client *upstream.Client, san *sanitize.Sanitizer, opts Options) *Handler {
 	h := &Handler{
-		client:            client,
-		simulateToolCalls: simulateToolCalls,
-		nativeToolCalls:   nativeToolCalls,
-		sanitizer:         san,
+		client:    client,
+		opts:      opts,
+		sanitizer: san,
 	}
-	go h.loadModels()
+	h.setModels(nil)
+	h.buildChains()
 	return h
 }
 
+// Start loads the model list, retrying until it succeeds, gives up, or ctx
+// is done, and then returns. Until it succeeds the fallback model list is
+// served, or nothing under Options.ReadinessGate. Run it in its own
+// goroutine.
+func (h *Handler) Start(ctx context.Context) {
+	h.loadModels(ctx)
+}
+
 // Register mounts routes on the given mux.
 func (h *Handler) Register(mux *http.ServeMux) {
 	mux.HandleFunc("GET /health", h.health)
@@ -52,51 +232,48 @@ func (h *Handler) Register(mux *http.ServeMux) {
 
 func (h *Handler) health(w http.ResponseWriter, _ *http.Request) {
 	w.Header().Set("Content-Type", "application/json")
+	if !h.isReady() {
+		w.WriteHeader(http.StatusServiceUnavailable)
+		_, _ = w.Write([]byte(`{"status":"starting"}`))
+		return
+	}
 	_, _ = w.Write([]byte(`{"status":"ok"}`))
 }
 
-func (h *Handler) listModels(w http.ResponseWriter, _ *http.Request) {
-	h.mu.RLock()
-	models := h.models
-	h.mu.RUnlock()
+// isReady reports whether traffic should be served. It is always true when
+// the readiness gate is disabled.
+func (h *Handler) isReady() bool {
+	return !h.opts.ReadinessGate || h.ready.Load()
+}
 
-	type modelEntry struct {
-		ID      string `json:"id"`
-		Object  string `json:"object"`
-		Created int64  `json:"created"`
-		OwnedBy string `json:"owned_by"`
+// rejectIfNotReady writes a 503 and returns true while the handler is still
+// starting up behind the readiness gate.
+func (h *Handler) rejectIfNotReady(w http.ResponseWriter) bool {
+	if h.isReady() {
+		return false
 	}
+	w.Header().Set("Retry-After", "5")
+	writeErr(w, http.StatusServiceUnavailable, "proxy is starting up, models not loaded yet")
+	return true
+}
 
-	var entries []modelEntry
-	for _, raw := range models {
-		var m struct {
-			ID string `json:"id"`
-		}
-		if json.Unmarshal(raw, &m) == nil && m.ID != "" {
-			entries = append(entries, modelEntry{
-				ID:      m.ID,
-				Object:  "model",
-				Created: 1677610602,
-				OwnedBy: "gonka",
-			})
-		}
-	}
-	if len(entries) == 0 {
-		entries = []modelEntry{{
-			ID:      "gonka-model",
-			Object:  "model",
-			Created: 1677610602,
-			OwnedBy: "gonka",
-		}}
+func (h *Handler) listModels(w http.ResponseWriter, r *http.Request) {
+	if h.rejectIfNotReady(w) {
+		return
 	}
-
-	writeJSON(w, http.StatusOK, map[string]any{
-		"object": "list",
-		"data":   entries,
-	})
+	h.mu.RLock()
+	list := h.modelList
+	h.mu.RUnlock()
+	list.serve(w, r)
 }
 
 func (h *Handler) chatCompletions(w http.ResponseWriter, r *http.Request) {
+	if h.rejectIfNotReady(w) {
+		return
+	}
+	if h.opts.UsageLog || h.opts.AuditSink != nil {
+		r = withRequestMeta(r, h.opts.UsageLog)
+	}
 	body, err := io.ReadAll(r.Body)
 	if err != nil {
 		writeErr(w, http.StatusBadRequest, "failed to read body: "+err.Error())
@@ -104,26 +281,125 @@ func (h *Handler) chatCompletions(w http.ResponseWriter, r *http.Request) {
 	}
 	defer r.Body.Close()
 
-	// Redact sensitive data from outgoing messages.
-	var tm *sanitize.TokenMap
-	if h.sanitizer != nil {
-		body, tm = h.sanitizer.RedactMessages(body)
-		if tm != nil && !tm.IsEmpty() {
-			slog.Info("sanitize: redacted tokens in request", "count", tm.Count())
+	// A client-chosen deadline bounds classifiers and the upstream call alike.
+	if raw := r.Header.Get("X-Request-Timeout"); raw != "" && h.opts.MaxRequestTimeout > 0 {
+		timeout, err := parseRequestTimeout(raw, h.opts.MaxRequestTimeout)
+		if err != nil {
+			writeInvalidRequest(w, err.Error())
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), timeout)
+		defer cancel()
+		r = r.WithContext(ctx)
+	}
+	r = r.WithContext(upstream.WithRetryBudget(r.Context(), h.opts.RetryBudget))
+
+	// Reject malformed JSON before anything else touches it; otherwise the
+	// sanitizer would fall back to redacting the raw bytes and forward them.
+	if !json.Valid(body) {
+		writeInvalidRequest(w, "request body is not valid JSON")
+		return
+	}
+
+	if meta := requestMetaFrom(r.Context()); meta != nil {
+		meta.user = requestUser(body)
+	}
+
+	// The user bucket first, so one end user over their limit does not use
+	// up the limit the client's other users share. A user token taken for a
+	// request the API-key limit then rejects is given back.
+	var userKey string
+	if h.opts.UserRateLimiter != nil && requestUser(body) != "" {
+		userKey = clientKey(r, body)
+		if ok, wait := h.opts.UserRateLimiter.Allow(userKey); !ok {
+			slog.Warn("user rate limit exceeded", "key", userKey)
+			writeRateLimited(w, wait)
+			return
+		}
+	}
+	if h.opts.RateLimiter != nil {
+		key := callerKey(r)
+		if ok, wait := h.opts.RateLimiter.Allow(key); !ok {
+			if userKey != "" {
+				h.opts.UserRateLimiter.Refund(userKey)
+			}
+			slog.Warn("rate limit exceeded", "key", key)
+			writeRateLimited(w, wait)
+			return
 		}
 	}
 
-	// Native tool calling: normalize array content so Gonka nodes receive plain strings.
-	// When enabled, tool_calls are forwarded as-is and simulation is skipped.
-	if h.nativeToolCalls {
-		var normErr error
-		body, normErr = normalizeMessageContent(body)
-		if normErr != nil {
-			slog.Warn("normalizeMessageContent failed, forwarding original body", "err", normErr)
+	if h.opts.Gate != nil {
+		release, err := h.opts.Gate.Acquire(r.Context())
+		if err != nil {
+			slog.Warn("concurrency limit reached, rejecting request", "err", err)
+			writeOverloaded(w)
+			return
 		}
-	} else if h.simulateToolCalls && toolsim.NeedsSimulation(body) {
-		// Check if tool simulation is needed.
-		h.toolSimResponse(w, r, body, tm)
+		defer release()
+	}
+
+	if h.opts.WalletAffinity {
+		r = r.WithContext(upstream.WithWalletKey(r.Context(), clientKey(r, body)))
+	}
+
+	received := body // before overrides, which may pick a model at random
+	if h.opts.AllowModelOverride || len(h.opts.ModelSplits) > 0 {
+		body = h.overrideModel(r, body)
+	}
+
+	if key := r.Header.Get("Idempotency-Key"); key != "" && h.opts.Idempotency != nil && !isStream(body) {
+		h.serveIdempotent(w, r, body, received, key)
+		return
+	}
+	h.serveChat(w, r, body)
+}
+
+// serveChat runs the sanitize / tool-call / forwarding pipeline for an
+// already-read chat completions request body.
+func (h *Handler) serveChat(w http.ResponseWriter, r *http.Request, body []byte) {
+	// Long redactions of streamed requests may report progress first.
+	var pw *progressWriter
+	if h.opts.SanitizeProgress > 0 && h.sanitizer != nil && isStream(body) {
+		var ctx context.Context
+		ctx, pw = h.startProgress(r.Context(), w)
+		r = r.WithContext(ctx)
+	}
+
+	// Run the request chain (seed routing, aliasing, sanitization, ...). Its
+	// per-request state travels on the context to the response side.
+	ctx, body, err := h.transformRequest(r.Context(), body)
+	if pw != nil && pw.end() {
+		w = pw
+		defer pw.finish()
+	}
+	if err != nil {
+		var re *RequestError
+		if errors.As(err, &re) {
+			writeRequestError(w, re)
+			return
+		}
+		writeInvalidRequest(w, err.Error())
+		return
+	}
+	r = r.WithContext(ctx)
+	if h.opts.AllowModelOverride || len(h.opts.ModelSplits) > 0 {
+		// After aliasing: the model upstream is actually asked for.
+		w.Header().Set("X-Effective-Model", requestModel(body))
+	}
+	if n := clampedTokensFrom(ctx); n > 0 {
+		w.Header().Set("X-Max-Tokens-Clamped", strconv.Itoa(n))
+	}
+
+	// Native tool calling forwards tool_calls as-is, so simulation is skipped.
+	if !h.opts.NativeToolCalls && h.opts.SimulateToolCalls && toolsim.NeedsSimulation(body) {
+		h.toolSimResponse(w, r, body)
+		return
+	}
+
+	if re := validateChatRequest(body, h.opts.Validation); re != nil {
+		slog.Info("rejecting invalid chat request", "param", re.Param, "reason", re.Message)
+		writeRequestError(w, re)
 		return
 	}
 
@@ -133,34 +409,58 @@ func (h *Handler) chatCompletions(w http.ResponseWriter, r *http.Request) {
 	}
 	_ = json.Unmarshal(body, &peek)
 
-	slog.Info("chat completions", "stream", peek.Stream, "bodyLen", len(body))
+	slog.Info("chat completions", "stream", peek.Stream, "bodyLen", len(body), "user", requestUser(body))
 
 	if peek.Stream {
-		h.streamResponse(w, r, body, tm)
+		h.streamResponse(w, r, body)
 	} else {
-		h.nonStreamResponse(w, r, body, tm)
+		h.nonStreamResponse(w, r, body)
 	}
 }
 
+// writeToolSimErr reports a failed tool simulation rewrite: a rejected
+// duplicate tool name as an invalid_request_error naming the tool, anything
+// else as a plain 400.
+func writeToolSimErr(w http.ResponseWriter, err error) {
+	var de *toolsim.DuplicateToolError
+	if errors.As(err, &de) {
+		writeRequestError(w, &RequestError{Message: de.Error(), Param: de.Param})
+		return
+	}
+	writeErr(w, http.StatusBadRequest, "tool simulation rewrite failed: "+err.Error())
+}
+
 // toolSimResponse handles requests with tools by rewriting the prompt,
 // sending a non-stream request, and converting the response back.
-func (h *Handler) toolSimResponse(w http.ResponseWriter, r *http.Request, body []byte, tm *sanitize.TokenMap) {
-	rewritten, tools, _, err := toolsim.RewriteRequest(body)
+func (h *Handler) toolSimResponse(w http.ResponseWriter, r *http.Request, body []byte) {
+	rewritten, tools, wasStream, err := toolsim.RewriteRequestWithOptions(body, h.opts.ToolSim)
 	if err != nil {
 		slog.Error("toolsim rewrite error", "err", err)
-		writeErr(w, http.StatusBadRequest, "tool simulation rewrite failed: "+err.Error())
+		writeToolSimErr(w, err)
+		return
+	}
+
+	if re := validateChatRequest(rewritten, h.opts.Validation); re != nil {
+		slog.Info("rejecting invalid chat request", "param", re.Param, "reason", re.Message)
+		writeRequestError(w, re)
 		return
 	}
 
 	slog.Info("toolsim: sending rewritten request", "bodyLen", len(rewritten))
 
 	// Always use non-streaming for tool simulation so we can parse the full response.
-	respBody, status, err := h.client.Do(r.Context(), http.MethodPost, "/chat/completions", rewritten)
+	resp, err := h.client.Do(r.Context(), http.MethodPost, "/chat/completions", rewritten)
 	if err != nil {
 		slog.Error("toolsim upstream error", "err", err)
+		if writeWalletsLimited(w, err) {
+			return
+		}
 		writeErr(w, http.StatusBadGateway, "upstream error: "+err.Error())
 		return
 	}
+	respBody, status := resp.Body, resp.StatusCode
+	logUsage(r.Context(), requestModel(rewritten), resp.Served, status, wasStream, completionInfoOf(respBody))
+	h.forwardHeaders(w, resp.Header)
 
 	if status >= 400 {
 		slog.Error("toolsim upstream status", "code", status, "body", string(respBody))
@@ -177,49 +477,81 @@ func (h *Handler) toolSimResponse(w http.ResponseWriter, r *http.Request, body [
 	_ = json.Unmarshal(body, &peek)
 
 	// Try to parse tool calls from the response.
-	result := toolsim.ParseResponse(respBody, tools, peek.Model)
+	result := toolsim.ParseResponseWithOptions(respBody, tools, peek.Model, h.opts.ToolSim)
+	if toolsim.UsesLegacyFunctions(body) {
+		result = toolsim.LegacyFunctionCall(result)
+	}
 
 	// Restore any redacted tokens before returning to the client.
-	if h.sanitizer != nil && tm != nil {
-		result = h.sanitizer.RestoreBytes(result, tm)
+	result = h.transformResponse(r.Context(), http.StatusOK, result)
+
+	setSanitizeHeader(w, tokenMapFrom(r.Context()))
+
+	// The client asked for a stream: replay the parsed response as SSE so it
+	// is not handed a JSON body it cannot frame.
+	if wasStream {
+		chunks, err := toolsim.StreamChunks(result)
+		if err == nil {
+			writeSSEChunks(w, chunks)
+			return
+		}
+		slog.Warn("toolsim: cannot convert response to stream, returning JSON", "err", err)
 	}
 
-	setSanitizeHeader(w, tm)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusOK)
 	_, _ = w.Write(result)
 }
 
-func (h *Handler) nonStreamResponse(w http.ResponseWriter, r *http.Request, body []byte, tm *sanitize.TokenMap) {
-	respBody, status, err := h.client.Do(r.Context(), http.MethodPost, "/chat/completions", body)
+func (h *Handler) nonStreamResponse(w http.ResponseWriter, r *http.Request, body []byte) {
+	resp, err := h.client.Do(r.Context(), http.MethodPost, "/chat/completions", body)
 	if err != nil {
 		slog.Error("upstream error", "err", err)
+		if writeWalletsLimited(w, err) {
+			return
+		}
 		writeErr(w, http.StatusBadGateway, "upstream error: "+err.Error())
 		return
 	}
+	respBody, status := resp.Body, resp.StatusCode
+	logUsage(r.Context(), requestModel(body), resp.Served, status, false, completionInfoOf(respBody))
+	h.forwardHeaders(w, resp.Header)
 
 	// Restore any redacted tokens before returning to the client.
-	if h.sanitizer != nil && tm != nil {
-		respBody = h.sanitizer.RestoreBytes(respBody, tm)
-	}
+	respBody = h.transformResponse(r.Context(), status, respBody)
 
-	setSanitizeHeader(w, tm)
+	setSanitizeHeader(w, tokenMapFrom(r.Context()))
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(status)
 	_, _ = w.Write(respBody)
 }
 
-func (h *Handler) streamResponse(w http.ResponseWriter, r *http.Request, body []byte, tm *sanitize.TokenMap) {
+func (h *Handler) streamResponse(w http.ResponseWriter, r *http.Request, body []byte) {
 	resp, err := h.client.DoStream(r.Context(), http.MethodPost, "/chat/completions", body)
 	if err != nil {
 		slog.Error("upstream stream error", "err", err)
+		if writeWalletsLimited(w, err) {
+			return
+		}
+		if h.opts.StreamErrorsAsSSE {
+			writeStreamErr(w, "upstream error: "+err.Error())
+			return
+		}
 		writeErr(w, http.StatusBadGateway, "upstream error: "+err.Error())
 		return
 	}
+	// Closing the body before it is read to the end aborts the upstream
+	// request (the HTTP/1 connection is closed, an HTTP/2 stream reset), so
+	// when the client goes away mid-stream the node stops generating as soon
+	// as this returns.
 	defer resp.Body.Close()
+	h.forwardHeaders(w, resp.Header)
+
+	by := resp.Served
 
 	if resp.StatusCode >= 400 {
 		errBody, _ := io.ReadAll(resp.Body)
+		logUsage(r.Context(), requestModel(body), by, resp.StatusCode, true, completionInfo{})
 		slog.Error("upstream stream status", "code", resp.StatusCode, "body", string(errBody))
 		w.Header().Set("Content-Type", "application/json")
 		w.WriteHeader(resp.StatusCode)
@@ -228,7 +560,7 @@ func (h *Handler) streamResponse(w http.ResponseWriter, r *http.Request, body []
 	}
 
 	// SSE headers
-	setSanitizeHeader(w, tm)
+	setSanitizeHeader(w, tokenMapFrom(r.Context()))
 	w.Header().Set("Content-Type", "text/event-stream")
 	w.Header().Set("Cache-Control", "no-cache")
 	w.Header().Set("Connection", "keep-alive")
@@ -240,10 +572,26 @@ func (h *Handler) streamResponse(w http.ResponseWriter, r *http.Request, body []
 		slog.Warn("response writer does not support flushing")
 	}
 
-	// Wrap the response body with a restoring reader when sanitization is on.
-	src := sanitize.NewRestoringReader(resp.Body, tm)
+	// Restore redacted tokens and apply the other response rewrites.
+	isSSE := strings.HasPrefix(resp.Header.Get("Content-Type"), "text/event-stream")
+	var src io.Reader = resp.Body
+	if h.opts.NormalizeSSE {
+		src, isSSE = newSSEFramer(src), true
+	}
+	if meta := requestMetaFrom(r.Context()); meta != nil && meta.usage {
+		var info completionInfo
+		if isSSE {
+			src = tapUsage(src, &info)
+		}
+		defer func() { logUsage(r.Context(), requestModel(body), by, http.StatusOK, true, info) }()
+	}
+	src = h.transformStream(r.Context(), src, isSSE)
 
-	buf := make([]byte, 4096)
+	size := h.opts.StreamBufferBytes
+	if size <= 0 {
+		size = 4096
+	}
+	buf := make([]byte, size)
 	for {
 		n, readErr := src.Read(buf)
 		if n > 0 {
@@ -277,8 +625,13 @@ func (h *Handler) serveUI(w http.ResponseWriter, r *http.Request) {
 // response header so the web UI can display what was redacted and restored.
 // The JSON is base64-encoded so UTF-8 characters (like «TOKEN») survive
 // HTTP header transmission without corruption.
-// It is a no-op when tm is nil or empty.
+// X-Sanitize-Degraded: true is added when a classifier failed or timed out, so
+// clients know the redaction was best-effort.
+// It is a no-op when tm is nil, or empty and not degraded.
 func setSanitizeHeader(w http.ResponseWriter, tm *sanitize.TokenMap) {
+	if tm.Degraded() {
+		w.Header().Set("X-Sanitize-Degraded", "true")
+	}
 	if tm == nil || tm.IsEmpty() {
 		return
 	}
@@ -289,19 +642,199 @@ func setSanitizeHeader(w http.ResponseWriter, tm *sanitize.TokenMap) {
 	w.Header().Set("X-Sanitize-Redactions", base64.StdEncoding.EncodeToString(b))
 }
 
+// forwardHeaders copies the upstream response headers allowed by
+// Options.ForwardHeaders to w. Framing headers are never copied; the proxy
+// sets its own.
+func (h *Handler) forwardHeaders(w http.ResponseWriter, src http.Header) {
+	if len(h.opts.ForwardHeaders) == 0 {
+		return
+	}
+	for name, values := range src {
+		switch name {
+		case "Content-Type", "Content-Length", "Content-Encoding", "Transfer-Encoding", "Connection":
+			continue
+		}
+		if headerAllowed(name, h.opts.ForwardHeaders) {
+			w.Header()[name] = append([]string(nil), values...)
+		}
+	}
+}
+
+// headerAllowed reports whether name matches one of patterns, compared
+// case-insensitively; a pattern ending in "*" matches by prefix.
+func headerAllowed(name string, patterns []string) bool {
+	for _, p := range patterns {
+		if prefix, ok := strings.CutSuffix(p, "*"); ok {
+			if len(name) >= len(prefix) && strings.EqualFold(name[:len(prefix)], prefix) {
+				return true
+			}
+		} else if strings.EqualFold(name, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// sanitizeReportKey is the non-standard top-level response field used by
+// addSanitizeReport. The prefix keeps it clear of any OpenAI field name.
+const sanitizeReportKey = "_gonka_sanitize"
+
+// addSanitizeReport injects the redaction list into a JSON object response
+// body (Options.SanitizeBodyReport). It is for clients that cannot read the
+// X-Sanitize-Redactions header. Error responses, non-object bodies, and
+// requests with no redactions are returned unchanged.
+func addSanitizeReport(body []byte, status int, tm *sanitize.TokenMap) []byte {
+	if tm == nil || tm.IsEmpty() || status < 200 || status >= 300 {
+		return body
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body
+	}
+	report, err := json.Marshal(map[string]any{"redactions": tm.Redactions()})
+	if err != nil {
+		return body
+	}
+	obj[sanitizeReportKey] = report
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
 // ---------- helpers ----------
 
-func (h *Handler) loadModels() {
-	for attempt := 1; attempt <= 3; attempt++ {
-		models, err := h.client.FetchModels(context.Background())
+// setModelField replaces the top-level "model" of a JSON object with model.
+// Bodies without a model field, non-objects, and an empty model are returned
+// unchanged.
+func setModelField(body []byte, model string) []byte {
+	if model == "" {
+		return body
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(body, &obj); err != nil {
+		return body
+	}
+	if _, ok := obj["model"]; !ok {
+		return body
+	}
+	obj["model"], _ = json.Marshal(model)
+	out, err := json.Marshal(obj)
+	if err != nil {
+		return body
+	}
+	return out
+}
+
+// parseRequestTimeout parses an X-Request-Timeout value, either whole seconds
+// ("90") or a Go duration ("90s", "2m"), and checks it against max.
+func parseRequestTimeout(raw string, max time.Duration) (time.Duration, error) {
+	raw = strings.TrimSpace(raw)
+	d, err := time.ParseDuration(raw)
+	if err != nil {
+		secs, convErr := strconv.Atoi(raw)
+		if convErr != nil {
+			return 0, fmt.Errorf("X-Request-Timeout must be seconds or a duration like 90s, got %q", raw)
+		}
+		d = time.Duration(secs) * time.Second
+	}
+	if d <= 0 {
+		return 0, fmt.Errorf("X-Request-Timeout must be positive, got %q", raw)
+	}
+	if d > max {
+		return 0, fmt.Errorf("X-Request-Timeout %s exceeds the maximum of %s", d, max)
+	}
+	return d, nil
+}
+
+// isStream reports whether the request body asks for a streamed response.
+func isStream(body []byte) bool {
+	var peek struct {
+		Stream bool `json:"stream"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	return peek.Stream
+}
+
+// seedRoutingKey returns a routing key derived from the request's model and
+// seed, or "" when the request carries no seed.
+func seedRoutingKey(body []byte) string {
+	var peek struct {
+		Model string          `json:"model"`
+		Seed  json.RawMessage `json:"seed"`
+	}
+	if json.Unmarshal(body, &peek) != nil || len(peek.Seed) == 0 || string(peek.Seed) == "null" {
+		return ""
+	}
+	return "seed:" + peek.Model + ":" + string(peek.Seed)
+}
+
+// requestUser returns the OpenAI "user" field of a request body, or "".
+func requestUser(body []byte) string {
+	var peek struct {
+		User string `json:"user"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	return peek.User
+}
+
+// clientKey identifies who a request comes from, for rate limiting, wallet
+// affinity and idempotency: the caller (see callerKey) plus the "user" field
+// when the client sets it, so end users sharing an API key are told apart but
+// a user name chosen under one key never matches another key's. The key is
+// safe to log.
+func clientKey(r *http.Request, body []byte) string {
+	if user := requestUser(body); user != "" {
+		return callerKey(r) + "/user:" + user
+	}
+	return callerKey(r)
+}
+
+// callerKey identifies the client that sent r: a fingerprint of its bearer
+// token, otherwise its remote host.
+func callerKey(r *http.Request) string {
+	if token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok && token != "" {
+		sum := sha256.Sum256([]byte(token))
+		return "key:" + hex.EncodeToString(sum[:8])
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		host = r.RemoteAddr
+	}
+	return "ip:" + host
+}
+
+// requestModel returns the top-level "model" of a request body, or "".
+func requestModel(body []byte) string {
+	var peek struct {
+		Model string `json:"model"`
+	}
+	_ = json.Unmarshal(body, &peek)
+	return peek.Model
+}
+
+// loadModels fetches the model list, retrying with backoff. Without the
+// readiness gate it gives up after three attempts and the fallback model list
+// is served; with the gate it keeps trying, since nothing is served until it
+// succeeds. It stops early when ctx is done.
+func (h *Handler) loadModels(ctx context.Context) {
+	for attempt := 1; h.opts.ReadinessGate || attempt <= 3; attempt++ {
+		models, err := h.client.FetchModels(ctx)
 		if err != nil {
+			if ctx.Err() != nil {
+				return
+			}
 			slog.Warn("model load failed", "attempt", attempt, "err", err)
-			time.Sleep(time.Duration(attempt) * 2 * time.Second)
+			select {
+			case <-ctx.Done():
+				return
+			case <-time.After(min(time.Duration(attempt)*2*time.Second, 30*time.Second)):
+			}
 			continue
 		}
-		h.mu.Lock()
-		h.models = models
-		h.mu.Unlock()
+		h.setModels(models)
+		h.ready.Store(true)
 		slog.Info("models loaded", "count", len(models))
 		return
 	}
@@ -318,6 +851,126 @@ func writeErr(w http.ResponseWriter, status int, msg string) {
 	writeJSON(w, status, map[string]string{"error": msg})
 }
 
+// writeStreamErr reports an error to a streaming client as a single SSE
+// event in OpenAI's streamed error shape, followed by the [DONE] sentinel.
+// It must be called before any response headers are written.
+func writeStreamErr(w http.ResponseWriter, msg string) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	_, _ = w.Write(streamErrEvent(msg, "upstream_error", http.StatusBadGateway))
+}
+
+// streamErrEvent is the SSE error event of writeStreamErr and the [DONE]
+// sentinel after it.
+func streamErrEvent(msg, typ string, code int) []byte {
+	event, _ := json.Marshal(map[string]any{
+		"error": map[string]any{
+			"message": msg,
+			"type":    typ,
+			"param":   nil,
+			"code":    code,
+		},
+	})
+	return []byte("data: " + string(event) + "\n\ndata: [DONE]\n\n")
+}
+
+// writeSSEChunks sends payloads as a complete event stream ending in [DONE].
+func writeSSEChunks(w http.ResponseWriter, chunks [][]byte) {
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher, _ := w.(http.Flusher)
+	for _, c := range chunks {
+		_, _ = w.Write([]byte("data: "))
+		_, _ = w.Write(c)
+		_, _ = w.Write([]byte("\n\n"))
+		if flusher != nil {
+			flusher.Flush()
+		}
+	}
+	_, _ = w.Write([]byte("data: [DONE]\n\n"))
+}
+
+// writeWalletsLimited writes a 429 with Retry-After when err is because every
+// wallet is over its local quota (wallet.Options.RequestsPerMinute), and
+// reports whether it did.
+func writeWalletsLimited(w http.ResponseWriter, err error) bool {
+	var limited *wallet.LimitedError
+	if !errors.As(err, &limited) {
+		return false
+	}
+	writeRateLimited(w, limited.RetryAfter)
+	return true
+}
+
+// writeOverloaded writes a 503 in the OpenAI error format for a request the
+// concurrency gate turned away.
+func writeOverloaded(w http.ResponseWriter) {
+	w.Header().Set("Retry-After", "1")
+	writeJSON(w, http.StatusServiceUnavailable, map[string]any{
+		"error": map[string]any{
+			"message": "too many requests in flight, retry later",
+			"type":    "server_error",
+			"param":   nil,
+			"code":    "server_overloaded",
+		},
+	})
+}
+
+// writeRateLimited writes a 429 in the OpenAI error format with a
+// Retry-After of wait, rounded up to whole seconds.
+func writeRateLimited(w http.ResponseWriter, wait time.Duration) {
+	w.Header().Set("Retry-After", strconv.Itoa(int((wait+time.Second-1)/time.Second)))
+	writeJSON(w, http.StatusTooManyRequests, map[string]any{
+		"error": map[string]any{
+			"message": "rate limit exceeded, retry later",
+			"type":    "requests",
+			"param":   nil,
+			"code":    "rate_limit_exceeded",
+		},
+	})
+}
+
+// writeInvalidRequest writes a 400 in the OpenAI error format so SDKs surface
+// it as a BadRequestError rather than a generic failure.
+func writeInvalidRequest(w http.ResponseWriter, msg string) {
+	writeInvalidRequestCode(w, msg, "")
+}
+
+// writeInvalidRequestCode is like writeInvalidRequest with an OpenAI error
+// code such as "context_length_exceeded". An empty code is sent as null.
+func writeInvalidRequestCode(w http.ResponseWriter, msg, code string) {
+	writeRequestError(w, &RequestError{Message: msg, Code: code})
+}
+
+// writeRequestError writes re as a 400 invalid_request_error. Empty code and
+// param are sent as null.
+func writeRequestError(w http.ResponseWriter, re *RequestError) {
+	var code, param any
+	if re.Code != "" {
+		code = re.Code
+	}
+	if re.Param != "" {
+		param = re.Param
+	}
+	status, typ := http.StatusBadRequest, "invalid_request_error"
+	if re.Status != 0 {
+		status = re.Status
+	}
+	if status >= 500 {
+		typ = "server_error"
+	}
+	writeJSON(w, status, map[string]any{
+		"error": map[string]any{
+			"message": re.Message,
+			"type":    typ,
+			"param":   param,
+			"code":    code,
+		},
+	})
+}
+
 // normalizeMessageContent flattens messages[].content from OpenAI array format
 // ([{"type":"text","text":"..."}]) to plain strings, which Gonka nodes require.
 // All messages are normalized — including those with tool_calls or role "tool" —
@@ -0,0 +1,1701 @@
+package api_test
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"reflect"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/api"
+	"github.com/gonkalabs/gonka-proxy-go/internal/idempotency"
+	"github.com/gonkalabs/gonka-proxy-go/internal/ratelimit"
+	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/toolsim"
+	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
+)
+
+const (
+	testKey      = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	testEndpoint = "gonka1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le"
+)
+
+// capture records what the fake upstream received on /chat/completions.
+type capture struct {
+	mu    sync.Mutex
+	body  []byte
+	sig   string
+	ts    string
+	addr  string
+	calls int
+}
+
+func (c *capture) get() ([]byte, string, string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.body, c.sig, c.ts
+}
+
+// newUpstream starts a fake Gonka node that serves discovery, models, and
+// chat completions, and returns an upstream client already pointed at it.
+func newUpstream(t testing.TB, chatResp string, stream bool) (*upstream.Client, *signer.Signer, *capture) {
+	t.Helper()
+	return newUpstreamFunc(t, func([]byte) string { return chatResp }, stream)
+}
+
+// newUpstreamFunc is like newUpstream but builds each chat response from the
+// forwarded request body.
+func newUpstreamFunc(t testing.TB, respond func(body []byte) string, stream bool) (*upstream.Client, *signer.Signer, *capture) {
+	t.Helper()
+	return newUpstreamWith(t, respond, stream, upstream.Options{}, "gonka1requester")
+}
+
+// newUpstreamWith is like newUpstreamFunc but builds the client with opts and
+// one wallet per requester address, all sharing the test key.
+func newUpstreamWith(t testing.TB, respond func(body []byte) string, stream bool, opts upstream.Options, addrs ...string) (*upstream.Client, *signer.Signer, *capture) {
+	t.Helper()
+	cp := &capture{}
+
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/epochs/current/participants":
+			_, _ = io.WriteString(w, `{"active_participants":{"participants":[{"index":"`+testEndpoint+`","inference_url":"`+srvURL+`"}]}}`)
+		case "/v1/models":
+			_, _ = io.WriteString(w, `{"models":[]}`)
+		case "/v1/chat/completions":
+			b, _ := io.ReadAll(r.Body)
+			cp.mu.Lock()
+			cp.body = b
+			cp.calls++
+			cp.sig = r.Header.Get("Authorization")
+			cp.ts = r.Header.Get("X-Timestamp")
+			cp.addr = r.Header.Get("X-Requester-Address")
+			cp.mu.Unlock()
+			w.Header().Set("X-Gonka-Node-Version", "0.2.9")
+			w.Header().Set("X-Internal-Trace", "abc")
+			if stream {
+				w.Header().Set("Content-Type", "text/event-stream")
+			} else {
+				w.Header().Set("Content-Type", "application/json")
+			}
+			_, _ = io.WriteString(w, respond(b))
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+
+	s, err := signer.New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var wallets []wallet.Wallet
+	for _, addr := range addrs {
+		wallets = append(wallets, wallet.Wallet{Signer: s, Address: addr})
+	}
+	pool, err := wallet.NewPool(wallets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := upstream.NewWithOptions(srv.URL, pool, opts)
+	if err := client.DiscoverEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return client, s, cp
+}
+
+// assertSignedForwarded checks that the signature the upstream received was
+// computed over exactly the bytes the upstream received.
+func assertSignedForwarded(t *testing.T, s *signer.Signer, cp *capture) []byte {
+	t.Helper()
+	body, sig, tsRaw := cp.get()
+	if body == nil {
+		t.Fatal("upstream received no request")
+	}
+	ts, err := strconv.ParseInt(tsRaw, 10, 64)
+	if err != nil {
+		t.Fatalf("bad X-Timestamp %q: %v", tsRaw, err)
+	}
+	if want := s.SignAt(body, testEndpoint, ts); sig != want {
+		t.Fatalf("signature does not cover forwarded body:\n got  %s\n want %s", sig, want)
+	}
+	return body
+}
+
+// secretClassifier flags every occurrence of "hunter2".
+type secretClassifier struct{}
+
+func (secretClassifier) Classify(text string) ([]sanitize.Span, error) {
+	var spans []sanitize.Span
+	start := 0
+	for {
+		idx := strings.Index(text[start:], "hunter2")
+		if idx < 0 {
+			return spans, nil
+		}
+		abs := start + idx
+		spans = append(spans, sanitize.Span{Start: abs, End: abs + len("hunter2"), Label: "CREDENTIAL", Score: 1})
+		start = abs + len("hunter2")
+	}
+}
+
+const chatOK = `{"id":"x","object":"chat.completion","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}]}`
+
+func post(t testing.TB, h *api.Handler, body string) *httptest.ResponseRecorder {
+	t.Helper()
+	return do(t, h, httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body)))
+}
+
+func do(t testing.TB, h *api.Handler, r *http.Request) *httptest.ResponseRecorder {
+	t.Helper()
+	mux := http.NewServeMux()
+	h.Register(mux)
+	w := httptest.NewRecorder()
+	mux.ServeHTTP(w, r)
+	return w
+}
+
+func TestSignedBytesPassthrough(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	h := api.New(client, false, false, nil)
+
+	// Unusual key order and whitespace must survive untouched.
+	in := `{ "messages": [{"content":"hi","role":"user"}],  "model":"m" }`
+	if w := post(t, h, in); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	got := assertSignedForwarded(t, s, cp)
+	if !bytes.Equal(got, []byte(in)) {
+		t.Fatalf("passthrough body was modified:\n got  %s\n want %s", got, in)
+	}
+}
+
+func TestSignedBytesSanitize(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	h := api.New(client, false, false, san)
+
+	in := `{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`
+	if w := post(t, h, in); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	got := assertSignedForwarded(t, s, cp)
+	if bytes.Contains(got, []byte("hunter2")) {
+		t.Fatalf("secret leaked upstream: %s", got)
+	}
+}
+
+func TestSignedBytesToolSim(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	h := api.New(client, true, false, nil)
+
+	in := `{"model":"m","messages":[{"role":"user","content":"weather?"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`
+	if w := post(t, h, in); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	got := assertSignedForwarded(t, s, cp)
+	var fwd map[string]json.RawMessage
+	if err := json.Unmarshal(got, &fwd); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := fwd["tools"]; ok {
+		t.Fatal("tools should be stripped in simulation mode")
+	}
+}
+
+func TestSignedBytesStream(t *testing.T) {
+	client, s, cp := newUpstream(t, "data: [DONE]\n\n", true)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	h := api.New(client, false, true, san)
+
+	in := `{"model":"m","stream":true,"messages":[{"role":"user","content":[{"type":"text","text":"hunter2"}]}]}`
+	if w := post(t, h, in); w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	assertSignedForwarded(t, s, cp)
+}
+
+func TestIdempotencyKeyReplay(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{Idempotency: idempotency.New(time.Minute, 10)})
+
+	in := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	for i := 0; i < 2; i++ {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(in))
+		r.Header.Set("Idempotency-Key", "abc")
+		w := do(t, h, r)
+		if w.Code != http.StatusOK || w.Body.String() != chatOK {
+			t.Fatalf("attempt %d: got %d %s", i+1, w.Code, w.Body.String())
+		}
+		if replayed := w.Header().Get("Idempotent-Replayed") == "true"; replayed != (i == 1) {
+			t.Fatalf("attempt %d: Idempotent-Replayed=%v", i+1, replayed)
+		}
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.calls != 1 {
+		t.Fatalf("want 1 upstream call, got %d", cp.calls)
+	}
+}
+
+func TestIdempotencyKeyScope(t *testing.T) {
+	var fail atomic.Bool
+	fail.Store(true)
+	client, _, cp := newUpstreamFunc(t, func([]byte) string {
+		if fail.Load() {
+			panic(http.ErrAbortHandler) // the proxy answers 502
+		}
+		return chatOK
+	}, false)
+	h := api.NewWithOptions(client, nil, api.Options{Idempotency: idempotency.New(time.Minute, 10)})
+	calls := func() int {
+		cp.mu.Lock()
+		defer cp.mu.Unlock()
+		return cp.calls
+	}
+	send := func(apiKey, body string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body))
+		r.Header.Set("Idempotency-Key", "abc")
+		r.Header.Set("Authorization", "Bearer "+apiKey)
+		return do(t, h, r)
+	}
+	in := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+
+	// A failure is not cached: the retry goes upstream.
+	if w := send("alice", in); w.Code != http.StatusBadGateway {
+		t.Fatalf("failing upstream: got %d", w.Code)
+	}
+	fail.Store(false)
+	before := calls()
+	if w := send("alice", in); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("retry after failure: got %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if calls() != before+1 {
+		t.Fatal("retry after failure not sent upstream")
+	}
+
+	// Another client reusing the key gets its own response.
+	if w := send("bob", in); w.Code != http.StatusOK || w.Header().Get("Idempotent-Replayed") != "" {
+		t.Fatalf("other client: got %d, replayed %q", w.Code, w.Header().Get("Idempotent-Replayed"))
+	}
+	if calls() != before+2 {
+		t.Fatal("other client's request answered from alice's cache")
+	}
+
+	// The same client reusing the key for a different request is refused.
+	w := send("alice", `{"model":"m","messages":[{"role":"user","content":"something else"}]}`)
+	if w.Code != http.StatusUnprocessableEntity || !strings.Contains(w.Body.String(), "idempotency_key_reused") {
+		t.Fatalf("different body under a cached key: got %d %s", w.Code, w.Body.String())
+	}
+	if w := send("alice", in); w.Header().Get("Idempotent-Replayed") != "true" || calls() != before+2 {
+		t.Fatalf("same request not replayed: %d upstream calls", calls()-before)
+	}
+}
+
+func TestIdempotencyKeyConcurrentRequestsServedOnce(t *testing.T) {
+	client, _, cp := newUpstreamFunc(t, func([]byte) string {
+		time.Sleep(20 * time.Millisecond)
+		return chatOK
+	}, false)
+	h := api.NewWithOptions(client, nil, api.Options{Idempotency: idempotency.New(time.Minute, 10)})
+
+	in := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+	var wg sync.WaitGroup
+	var replayed atomic.Int32
+	for i := 0; i < 4; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(in))
+			r.Header.Set("Idempotency-Key", "abc")
+			w := do(t, h, r)
+			if w.Code != http.StatusOK || w.Body.String() != chatOK {
+				t.Errorf("got %d %s", w.Code, w.Body.String())
+			}
+			if w.Header().Get("Idempotent-Replayed") == "true" {
+				replayed.Add(1)
+			}
+		}()
+	}
+	wg.Wait()
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.calls != 1 || replayed.Load() != 3 {
+		t.Fatalf("%d upstream calls and %d replays, want 1 and 3", cp.calls, replayed.Load())
+	}
+}
+
+func TestMalformedJSONRejected(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	h := api.New(client, false, false, san)
+
+	w := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hunter2`)
+	if w.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d", w.Code)
+	}
+	var resp struct {
+		Error struct {
+			Type string `json:"type"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &resp); err != nil || resp.Error.Type != "invalid_request_error" {
+		t.Fatalf("want invalid_request_error, got %s", w.Body.String())
+	}
+	if body, _, _ := cp.get(); body != nil {
+		t.Fatalf("malformed body was forwarded upstream: %s", body)
+	}
+}
+
+func TestModelAliasStream(t *testing.T) {
+	upstreamSSE := "data: {\"id\":\"1\",\"model\":\"Qwen/Real\",\"choices\":[]}\n\ndata: [DONE]\n\n"
+	client, _, cp := newUpstream(t, upstreamSSE, true)
+	h := api.NewWithOptions(client, nil, api.Options{ModelAliases: map[string]string{"gpt-4o": "Qwen/Real"}})
+
+	w := post(t, h, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	if body, _, _ := cp.get(); !bytes.Contains(body, []byte(`"model":"Qwen/Real"`)) {
+		t.Fatalf("alias not resolved upstream: %s", body)
+	}
+	want := "data: {\"choices\":[],\"id\":\"1\",\"model\":\"gpt-4o\"}\n\ndata: [DONE]\n\n"
+	if got := w.Body.String(); got != want {
+		t.Fatalf("stream not rewritten:\n got  %q\n want %q", got, want)
+	}
+}
+
+func TestNormalizeSSEKeepsTruncatedStreamIncomplete(t *testing.T) {
+	client := newStreamingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/x-ndjson")
+		_, _ = io.WriteString(w, `{"choices":[{"delta":{"content":"partial"}}]}`+"\n")
+		w.(http.Flusher).Flush()
+		panic(http.ErrAbortHandler) // the connection drops mid-stream
+	})
+	h := api.NewWithOptions(client, nil, api.Options{NormalizeSSE: true})
+
+	w := post(t, h, `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if !strings.Contains(w.Body.String(), "partial") {
+		t.Fatalf("chunk before the error not forwarded: %q", w.Body.String())
+	}
+	if strings.Contains(w.Body.String(), "[DONE]") {
+		t.Fatalf("truncated stream ends with [DONE]: %q", w.Body.String())
+	}
+}
+
+func TestNormalizeSSEFramesNDJSONStream(t *testing.T) {
+	fixture, err := os.ReadFile("testdata/ndjson-stream.txt")
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, _, _ := newUpstream(t, string(fixture), true)
+	h := api.NewWithOptions(client, nil, api.Options{
+		NormalizeSSE: true,
+		ModelAliases: map[string]string{"gpt-4o": "Qwen/Real"},
+	})
+
+	w := post(t, h, `{"model":"gpt-4o","stream":true,"messages":[{"role":"user","content":"hi"}]}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d", w.Code)
+	}
+	events := strings.Split(strings.TrimSuffix(w.Body.String(), "\n\n"), "\n\n")
+	if len(events) != 5 {
+		t.Fatalf("want 4 chunks and [DONE], got %d events: %q", len(events), w.Body.String())
+	}
+	var content string
+	for _, ev := range events[:4] {
+		payload, ok := strings.CutPrefix(ev, "data: ")
+		if !ok {
+			t.Fatalf("event not framed as SSE: %q", ev)
+		}
+		var chunk struct {
+			Model   string `json:"model"`
+			Choices []struct {
+				Delta struct {
+					Content string `json:"content"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("bad chunk %q: %v", payload, err)
+		}
+		if chunk.Model != "gpt-4o" {
+			t.Fatalf("chunk not rewritten: %q", payload)
+		}
+		content += chunk.Choices[0].Delta.Content
+	}
+	if content != "Hello there" {
+		t.Fatalf("content = %q", content)
+	}
+	if events[4] != "data: [DONE]" {
+		t.Fatalf("stream not terminated with [DONE]: %q", events[4])
+	}
+
+	// A proper SSE stream is relayed unchanged.
+	sse := "data: {\"id\":\"1\",\"choices\":[]}\n\n: keep-alive\n\ndata: [DONE]\n\n"
+	client, _, _ = newUpstream(t, sse, true)
+	h = api.NewWithOptions(client, nil, api.Options{NormalizeSSE: true})
+	if w := post(t, h, `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`); w.Body.String() != sse {
+		t.Fatalf("SSE stream altered:\n got  %q\n want %q", w.Body.String(), sse)
+	}
+}
+
+// disconnectingWriter fails every write after the first, like a client that
+// hung up mid-stream.
+type disconnectingWriter struct {
+	header http.Header
+	writes int
+}
+
+func (w *disconnectingWriter) Header() http.Header { return w.header }
+func (w *disconnectingWriter) WriteHeader(int)     {}
+func (w *disconnectingWriter) Write(b []byte) (int, error) {
+	if w.writes++; w.writes > 1 {
+		return 0, io.ErrClosedPipe
+	}
+	return len(b), nil
+}
+
+// newStreamingUpstream returns a client for a single endpoint whose chat
+// completions are served by chat, for tests that need control over how a
+// response is written.
+func newStreamingUpstream(t *testing.T, chat http.HandlerFunc) *upstream.Client {
+	t.Helper()
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/epochs/current/participants":
+			_, _ = io.WriteString(w, `{"active_participants":{"participants":[{"index":"`+testEndpoint+`","inference_url":"`+srvURL+`"}]}}`)
+		case "/v1/chat/completions":
+			chat(w, r)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	t.Cleanup(srv.Close)
+	srvURL = srv.URL
+
+	s, err := signer.New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := wallet.NewPool([]wallet.Wallet{{Signer: s, Address: "gonka1requester"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := upstream.New(srv.URL, pool)
+	if err := client.DiscoverEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	return client
+}
+
+// The handler relies on closing the upstream body to abort the request when
+// the client goes away; this catches a change that leaves it open or drains it.
+func TestStreamClientDisconnectCancelsUpstream(t *testing.T) {
+	cancelled := make(chan struct{})
+	client := newStreamingUpstream(t, func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "text/event-stream")
+		for {
+			_, _ = io.WriteString(w, "data: {\"choices\":[{\"delta\":{\"content\":\"tok\"}}]}\n\n")
+			w.(http.Flusher).Flush()
+			select {
+			case <-r.Context().Done():
+				close(cancelled)
+				return
+			case <-time.After(5 * time.Millisecond):
+			}
+		}
+	})
+	h := api.NewWithOptions(client, nil, api.Options{StreamBufferBytes: 16})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`))
+	mux := http.NewServeMux()
+	h.Register(mux)
+	done := make(chan struct{})
+	go func() {
+		mux.ServeHTTP(&disconnectingWriter{header: http.Header{}}, req)
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("handler kept streaming after the client went away")
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(5 * time.Second):
+		t.Fatal("upstream request was not cancelled")
+	}
+}
+
+func TestStreamToolCallRestoreAcrossChunks(t *testing.T) {
+	tokenRe := regexp.MustCompile(`«TOKEN_\d+»`)
+	respond := func(body []byte) string {
+		tok := []rune(string(tokenRe.Find(body)))
+		frags := []string{`{"password":"` + string(tok[:3]), string(tok[3:9]), string(tok[9:]) + `"}`}
+		var sb strings.Builder
+		for i, f := range frags {
+			var finish any
+			if i == len(frags)-1 {
+				finish = "tool_calls"
+			}
+			chunk, _ := json.Marshal(map[string]any{
+				"model": "m",
+				"choices": []any{map[string]any{
+					"index": 0,
+					"delta": map[string]any{"tool_calls": []any{map[string]any{
+						"index":    0,
+						"function": map[string]any{"arguments": f},
+					}}},
+					"finish_reason": finish,
+				}},
+			})
+			sb.WriteString("data: " + string(chunk) + "\n\n")
+		}
+		sb.WriteString("data: [DONE]\n\n")
+		return sb.String()
+	}
+	client, _, cp := newUpstreamFunc(t, respond, true)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	h := api.NewWithOptions(client, san, api.Options{NativeToolCalls: true})
+
+	in := `{"model":"m","stream":true,"stream_options":{"include_usage":true},` +
+		`"messages":[{"role":"user","content":"log in with hunter2"}],` +
+		`"tools":[{"type":"function","function":{"name":"login"}}]}`
+	w := post(t, h, in)
+	if w.Code != http.StatusOK {
+		t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+	}
+	if body, _, _ := cp.get(); !bytes.Contains(body, []byte(`"stream_options":{"include_usage":true}`)) {
+		t.Fatalf("stream_options not passed through: %s", body)
+	}
+
+	var args string
+	for _, line := range strings.Split(w.Body.String(), "\n") {
+		payload, ok := strings.CutPrefix(line, "data: ")
+		if !ok || payload == "[DONE]" {
+			continue
+		}
+		var chunk struct {
+			Choices []struct {
+				Delta struct {
+					ToolCalls []struct {
+						Function struct {
+							Arguments string `json:"arguments"`
+						} `json:"function"`
+					} `json:"tool_calls"`
+				} `json:"delta"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(payload), &chunk); err != nil {
+			t.Fatalf("bad chunk %q: %v", payload, err)
+		}
+		args += chunk.Choices[0].Delta.ToolCalls[0].Function.Arguments
+	}
+	if args != `{"password":"hunter2"}` {
+		t.Fatalf("want restored arguments, got %q", args)
+	}
+}
+
+func TestToolSimDropsStreamOptions(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.New(client, true, false, nil)
+
+	in := `{"model":"m","stream":true,"stream_options":{"include_usage":true},` +
+		`"messages":[{"role":"user","content":"hi"}],"tools":[{"type":"function","function":{"name":"f"}}]}`
+	post(t, h, in)
+	if body, _, _ := cp.get(); bytes.Contains(body, []byte("stream_options")) {
+		t.Fatalf("stream_options must be dropped when simulation forces stream=false: %s", body)
+	}
+}
+
+func TestModelWalletPinning(t *testing.T) {
+	client, _, cp := newUpstreamWith(t, func([]byte) string { return chatOK }, false,
+		upstream.Options{ModelWallets: map[string]string{"big-model": "gonka1billing"}},
+		"gonka1default", "gonka1billing")
+	h := api.NewWithOptions(client, nil, api.Options{
+		ModelAliases: map[string]string{"big": "big-model"},
+	})
+
+	requester := func(model string) string {
+		t.Helper()
+		rec := post(t, h, `{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+		}
+		cp.mu.Lock()
+		defer cp.mu.Unlock()
+		return cp.addr
+	}
+
+	// The pinned model always goes to its wallet, including via an alias.
+	for i := 0; i < 3; i++ {
+		if got := requester("big-model"); got != "gonka1billing" {
+			t.Fatalf("big-model signed by %q, want gonka1billing", got)
+		}
+	}
+	if got := requester("big"); got != "gonka1billing" {
+		t.Fatalf("aliased big-model signed by %q, want gonka1billing", got)
+	}
+
+	// Other models keep round-robin across the whole pool.
+	seen := map[string]bool{}
+	for i := 0; i < 4; i++ {
+		seen[requester("small-model")] = true
+	}
+	if !seen["gonka1default"] || !seen["gonka1billing"] {
+		t.Fatalf("unmapped model not round-robined across wallets: %v", seen)
+	}
+}
+
+// defaultTemperature sets "temperature" on requests that do not carry one and
+// records the response body it is handed.
+type defaultTemperature struct {
+	seen []byte
+}
+
+func (d *defaultTemperature) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ctx, body, err
+	}
+	if _, ok := req["temperature"]; !ok {
+		req["temperature"] = json.RawMessage(`0.2`)
+	}
+	out, err := json.Marshal(req)
+	return ctx, out, err
+}
+
+func (d *defaultTemperature) TransformResponse(_ context.Context, _ int, body []byte) []byte {
+	d.seen = append([]byte(nil), body...)
+	return body
+}
+
+func TestCustomTransformers(t *testing.T) {
+	client, s, cp := newUpstreamFunc(t, func(b []byte) string {
+		// Echo the redacted prompt back so restoration is observable.
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		_ = json.Unmarshal(b, &req)
+		content, _ := json.Marshal(req.Messages[0].Content)
+		return `{"id":"x","object":"chat.completion","model":"m","choices":[{"index":0,"message":{"role":"assistant","content":` + string(content) + `},"finish_reason":"stop"}]}`
+	}, false)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	dt := &defaultTemperature{}
+	h := api.NewWithOptions(client, san, api.Options{
+		RequestTransformers:  []api.RequestTransformer{dt},
+		ResponseTransformers: []api.ResponseTransformer{dt},
+	})
+
+	rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+
+	// The custom step runs after sanitization and before signing.
+	fwd := assertSignedForwarded(t, s, cp)
+	if !bytes.Contains(fwd, []byte(`"temperature":0.2`)) {
+		t.Fatalf("default not applied to forwarded body: %s", fwd)
+	}
+	if bytes.Contains(fwd, []byte("hunter2")) {
+		t.Fatalf("secret forwarded upstream: %s", fwd)
+	}
+
+	// The custom response step sees the upstream body before restoration,
+	// and the client still gets the original back.
+	if bytes.Contains(dt.seen, []byte("hunter2")) {
+		t.Fatalf("custom response transformer saw restored body: %s", dt.seen)
+	}
+	if !strings.Contains(rec.Body.String(), "hunter2") {
+		t.Fatalf("secret not restored for client: %s", rec.Body.String())
+	}
+}
+
+func TestRequestTransformerErrorRejects(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{
+		RequestTransformers: []api.RequestTransformer{&defaultTemperature{}},
+	})
+
+	rec := post(t, h, `["not","an","object"]`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body.String())
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.calls != 0 {
+		t.Fatalf("rejected request was forwarded upstream")
+	}
+}
+
+func TestToolSimStreamingClientGetsSSE(t *testing.T) {
+	resp := `{"id":"x","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,` +
+		`"message":{"role":"assistant","content":"[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]"},"finish_reason":"stop"}]}`
+	client, _, _ := newUpstream(t, resp, false)
+	h := api.New(client, true, false, nil)
+
+	in := `{"model":"m","stream":true,"messages":[{"role":"user","content":"weather?"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`
+	rec := post(t, h, in)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if ct := rec.Header().Get("Content-Type"); ct != "text/event-stream" {
+		t.Fatalf("Content-Type %q, want text/event-stream", ct)
+	}
+
+	var events []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	if len(events) != 3 || events[2] != "[DONE]" {
+		t.Fatalf("want two chunks and [DONE], got %q", events)
+	}
+
+	var first, last struct {
+		Object  string `json:"object"`
+		Choices []struct {
+			Delta struct {
+				ToolCalls []struct {
+					Index    int `json:"index"`
+					Function struct {
+						Name      string `json:"name"`
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+			FinishReason *string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal([]byte(events[0]), &first); err != nil {
+		t.Fatal(err)
+	}
+	if err := json.Unmarshal([]byte(events[1]), &last); err != nil {
+		t.Fatal(err)
+	}
+	if first.Object != "chat.completion.chunk" {
+		t.Fatalf("object %q, want chat.completion.chunk", first.Object)
+	}
+	tcs := first.Choices[0].Delta.ToolCalls
+	if len(tcs) != 1 || tcs[0].Function.Name != "get_weather" || tcs[0].Function.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("unexpected tool call delta: %s", events[0])
+	}
+	if fr := last.Choices[0].FinishReason; fr == nil || *fr != "tool_calls" {
+		t.Fatalf("final chunk must carry finish_reason tool_calls: %s", events[1])
+	}
+}
+
+func TestRequestTimeoutHeader(t *testing.T) {
+	client, _, cp := newUpstreamFunc(t, func([]byte) string {
+		time.Sleep(500 * time.Millisecond)
+		return chatOK
+	}, false)
+	h := api.NewWithOptions(client, nil, api.Options{MaxRequestTimeout: time.Minute})
+	in := `{"model":"m","messages":[{"role":"user","content":"hi"}]}`
+
+	send := func(timeout string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(in))
+		req.Header.Set("X-Request-Timeout", timeout)
+		return do(t, h, req)
+	}
+
+	// Above the ceiling or malformed: rejected before anything is forwarded.
+	for _, v := range []string{"2m", "120", "soon", "-5s"} {
+		if rec := send(v); rec.Code != http.StatusBadRequest {
+			t.Fatalf("X-Request-Timeout %q: status %d, want 400", v, rec.Code)
+		}
+	}
+	cp.mu.Lock()
+	calls := cp.calls
+	cp.mu.Unlock()
+	if calls != 0 {
+		t.Fatalf("rejected requests reached upstream %d times", calls)
+	}
+
+	// A short deadline cuts the slow upstream call off.
+	start := time.Now()
+	if rec := send("100ms"); rec.Code != http.StatusBadGateway {
+		t.Fatalf("short timeout: status %d, want 502: %s", rec.Code, rec.Body.String())
+	}
+	if took := time.Since(start); took >= 500*time.Millisecond {
+		t.Fatalf("request outlived its X-Request-Timeout: took %s", took)
+	}
+
+	// A generous one lets it finish.
+	if rec := send("30"); rec.Code != http.StatusOK {
+		t.Fatalf("long timeout: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+// failingClassifier always errors, like an unreachable NER sidecar.
+type failingClassifier struct{}
+
+func (failingClassifier) Classify(string) ([]sanitize.Span, error) {
+	return nil, errors.New("sidecar unreachable")
+}
+
+func TestSanitizeDegradedHeader(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	in := `{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`
+
+	healthy := api.New(client, false, false, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}}))
+	if rec := post(t, healthy, in); rec.Header().Get("X-Sanitize-Degraded") != "" {
+		t.Fatal("X-Sanitize-Degraded set although every classifier answered")
+	}
+
+	degraded := api.New(client, false, false, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}, failingClassifier{}}))
+	rec := post(t, degraded, in)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if got := rec.Header().Get("X-Sanitize-Degraded"); got != "true" {
+		t.Fatalf("X-Sanitize-Degraded = %q, want true", got)
+	}
+}
+
+func TestMaxPromptTokensRejectsBeforeUpstream(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{MaxPromptTokens: 50})
+
+	long := strings.Repeat("word ", 100) // ~125 estimated tokens
+	rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"`+long+`"}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("status %d, want 400: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Error struct {
+			Code string `json:"code"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error.Code != "context_length_exceeded" {
+		t.Fatalf("want code context_length_exceeded, got %s", rec.Body.String())
+	}
+	cp.mu.Lock()
+	calls := cp.calls
+	cp.mu.Unlock()
+	if calls != 0 {
+		t.Fatal("oversized prompt was sent upstream")
+	}
+
+	if rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); rec.Code != http.StatusOK {
+		t.Fatalf("small prompt: status %d: %s", rec.Code, rec.Body.String())
+	}
+}
+
+func TestRateLimitPerUser(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{
+		RateLimiter:     ratelimit.New(3, 3),
+		UserRateLimiter: ratelimit.New(1, 1),
+	})
+
+	send := func(key, user string) *httptest.ResponseRecorder {
+		body := `{"model":"m","messages":[{"role":"user","content":"hi"}]`
+		if user != "" {
+			body += `,"user":"` + user + `"`
+		}
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(body+"}"))
+		req.Header.Set("Authorization", "Bearer "+key)
+		return do(t, h, req)
+	}
+
+	if rec := send("shared-key", "alice"); rec.Code != http.StatusOK {
+		t.Fatalf("alice first request: status %d", rec.Code)
+	}
+	rec := send("shared-key", "alice")
+	if rec.Code != http.StatusTooManyRequests || rec.Header().Get("Retry-After") == "" {
+		t.Fatalf("alice second request: status %d, Retry-After %q", rec.Code, rec.Header().Get("Retry-After"))
+	}
+
+	// Bob shares the API key but is limited on his own.
+	if rec := send("shared-key", "bob"); rec.Code != http.StatusOK {
+		t.Fatalf("bob throttled by alice's usage: status %d", rec.Code)
+	}
+	// An alice under another key is someone else.
+	if rec := send("other-key", "alice"); rec.Code != http.StatusOK {
+		t.Fatalf("alice on another key throttled: status %d", rec.Code)
+	}
+
+	// A new user name does not get around the key's own limit: alice's
+	// rejected request was not counted, so one request is left.
+	if rec := send("shared-key", "carol"); rec.Code != http.StatusOK {
+		t.Fatalf("carol: status %d", rec.Code)
+	}
+	for _, user := range []string{"dave", ""} {
+		if rec := send("shared-key", user); rec.Code != http.StatusTooManyRequests {
+			t.Fatalf("user %q over the key's limit: status %d", user, rec.Code)
+		}
+	}
+}
+
+func TestRateLimitPerKeyRejectionKeepsUserToken(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	users := ratelimit.New(1, 1)
+	h := api.NewWithOptions(client, nil, api.Options{
+		RateLimiter:     ratelimit.New(1, 1),
+		UserRateLimiter: users,
+	})
+	send := func(user string) *httptest.ResponseRecorder {
+		req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}],"user":"`+user+`"}`))
+		req.Header.Set("Authorization", "Bearer shared-key")
+		return do(t, h, req)
+	}
+
+	if rec := send("alice"); rec.Code != http.StatusOK {
+		t.Fatalf("alice: status %d", rec.Code)
+	}
+	// The API key's bucket is now empty, so bob is turned away by it.
+	if rec := send("bob"); rec.Code != http.StatusTooManyRequests {
+		t.Fatalf("bob over the key's limit: status %d", rec.Code)
+	}
+	// Bob's own token was not spent on the rejected request. The key is
+	// the handler's caller key for the bearer token, plus the user.
+	sum := sha256.Sum256([]byte("shared-key"))
+	if ok, _ := users.Allow("key:" + hex.EncodeToString(sum[:8]) + "/user:bob"); !ok {
+		t.Fatal("bob's token was used up by a request the API-key limit rejected")
+	}
+}
+
+func TestForwardUpstreamHeaders(t *testing.T) {
+	for _, stream := range []bool{false, true} {
+		resp := chatOK
+		if stream {
+			resp = "data: {\"choices\":[{\"delta\":{\"content\":\"hi\"}}]}\n\ndata: [DONE]\n\n"
+		}
+		client, _, _ := newUpstream(t, resp, stream)
+
+		h := api.NewWithOptions(client, nil, api.Options{ForwardHeaders: []string{"x-gonka-*"}})
+		rec := post(t, h, `{"model":"m","stream":`+strconv.FormatBool(stream)+`,"messages":[{"role":"user","content":"hi"}]}`)
+		if got := rec.Header().Get("X-Gonka-Node-Version"); got != "0.2.9" {
+			t.Errorf("stream=%v: allowlisted header = %q, want 0.2.9", stream, got)
+		}
+		if got := rec.Header().Get("X-Internal-Trace"); got != "" {
+			t.Errorf("stream=%v: header outside the allowlist forwarded: %q", stream, got)
+		}
+
+		rec = post(t, api.NewWithOptions(client, nil, api.Options{}), `{"model":"m","stream":`+strconv.FormatBool(stream)+`,"messages":[{"role":"user","content":"hi"}]}`)
+		if got := rec.Header().Get("X-Gonka-Node-Version"); got != "" {
+			t.Errorf("stream=%v: forwarded %q with no allowlist", stream, got)
+		}
+	}
+}
+
+func BenchmarkStreamRelay(b *testing.B) {
+	var sse strings.Builder
+	for i := 0; i < 2000; i++ {
+		sse.WriteString(`data: {"choices":[{"index":0,"delta":{"content":"token "}}]}` + "\n\n")
+	}
+	sse.WriteString("data: [DONE]\n\n")
+	client, _, _ := newUpstream(b, sse.String(), true)
+	body := `{"model":"m","stream":true,"messages":[{"role":"user","content":"hi"}]}`
+
+	for _, size := range []int{1024, 4096, 16384, 65536} {
+		b.Run(strconv.Itoa(size), func(b *testing.B) {
+			h := api.NewWithOptions(client, nil, api.Options{StreamBufferBytes: size})
+			b.SetBytes(int64(sse.Len()))
+			for i := 0; i < b.N; i++ {
+				if w := post(b, h, body); w.Code != http.StatusOK {
+					b.Fatalf("status %d", w.Code)
+				}
+			}
+		})
+	}
+}
+
+func TestSanitizeModelsFilter(t *testing.T) {
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{sanitize.StaticClassifier{Values: []string{"secret"}}})
+	for _, tc := range []struct {
+		filter []string
+		model  string
+		want   bool // redacted
+	}{
+		{nil, "any", true},
+		{[]string{"!internal"}, "internal", false},
+		{[]string{"!internal"}, "public", true},
+		{[]string{"public"}, "public", true},
+		{[]string{"public"}, "other", false},
+		{[]string{"public"}, "alias", true}, // alias resolves to public
+	} {
+		client, _, cp := newUpstream(t, chatOK, false)
+		h := api.NewWithOptions(client, san, api.Options{
+			SanitizeModels: tc.filter,
+			ModelAliases:   map[string]string{"alias": "public"},
+		})
+		if w := post(t, h, `{"model":"`+tc.model+`","messages":[{"role":"user","content":"my secret"}]}`); w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body.String())
+		}
+		body, _, _ := cp.get()
+		if redacted := !bytes.Contains(body, []byte("my secret")); redacted != tc.want {
+			t.Errorf("filter %v, model %q: redacted = %v, want %v", tc.filter, tc.model, redacted, tc.want)
+		}
+	}
+}
+
+func TestRequestValidation(t *testing.T) {
+	tests := []struct {
+		name  string
+		mode  api.ValidationMode
+		body  string
+		param string // "" means the request is accepted
+	}{
+		{"valid", api.ValidateStrict, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`, ""},
+		{"missing model", api.ValidateBasic, `{"messages":[{"role":"user","content":"hi"}]}`, "model"},
+		{"empty model", api.ValidateBasic, `{"model":"","messages":[{"role":"user","content":"hi"}]}`, "model"},
+		{"no messages", api.ValidateBasic, `{"model":"m"}`, "messages"},
+		{"empty messages", api.ValidateBasic, `{"model":"m","messages":[]}`, "messages"},
+		{"messages not array", api.ValidateBasic, `{"model":"m","messages":"hi"}`, "messages"},
+		{"missing role", api.ValidateBasic, `{"model":"m","messages":[{"content":"hi"}]}`, "messages[0].role"},
+		{"unknown role basic", api.ValidateBasic, `{"model":"m","messages":[{"role":"bot","content":"hi"}]}`, ""},
+		{"unknown role strict", api.ValidateStrict, `{"model":"m","messages":[{"role":"user","content":"a"},{"role":"bot","content":"hi"}]}`, "messages[1].role"},
+		{"tool without id", api.ValidateStrict, `{"model":"m","messages":[{"role":"tool","content":"42"}]}`, "messages[0].tool_call_id"},
+		{"missing content", api.ValidateStrict, `{"model":"m","messages":[{"role":"user"}]}`, "messages[0].content"},
+		{"assistant tool call without content", api.ValidateStrict, `{"model":"m","messages":[{"role":"user","content":"q"},{"role":"assistant","content":null,"tool_calls":[{"id":"c","type":"function","function":{"name":"f","arguments":"{}"}}]},{"role":"tool","tool_call_id":"c","content":"1"}]}`, ""},
+		{"off", api.ValidateOff, `{"messages":[]}`, ""},
+	}
+	for _, tc := range tests {
+		t.Run(tc.name, func(t *testing.T) {
+			client, _, cp := newUpstream(t, chatOK, false)
+			h := api.NewWithOptions(client, nil, api.Options{Validation: tc.mode})
+			w := post(t, h, tc.body)
+			if tc.param == "" {
+				if w.Code != http.StatusOK {
+					t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+				}
+				return
+			}
+			if w.Code != http.StatusBadRequest {
+				t.Fatalf("want 400, got %d: %s", w.Code, w.Body.String())
+			}
+			var resp struct {
+				Error struct {
+					Type  string `json:"type"`
+					Param string `json:"param"`
+				} `json:"error"`
+			}
+			_ = json.Unmarshal(w.Body.Bytes(), &resp)
+			if resp.Error.Type != "invalid_request_error" || resp.Error.Param != tc.param {
+				t.Fatalf("got %s, want invalid_request_error for %s", w.Body.String(), tc.param)
+			}
+			if cp.calls != 0 {
+				t.Fatal("invalid request was forwarded upstream")
+			}
+		})
+	}
+}
+
+func TestUsageLog(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewJSONHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	const withUsage = `{"id":"chatcmpl-1","choices":[{"index":0,"message":{"role":"assistant","content":"ok"},"finish_reason":"stop"}],"usage":{"prompt_tokens":7,"completion_tokens":3,"total_tokens":10}}`
+	client, _, _ := newUpstream(t, withUsage, false)
+	h := api.NewWithOptions(client, nil, api.Options{UsageLog: true})
+
+	req := httptest.NewRequest(http.MethodPost, "/v1/chat/completions", strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"hi"}],"user":"alice"}`))
+	req.Header.Set("X-Request-Id", "req-42")
+	if w := do(t, h, req); w.Code != http.StatusOK {
+		t.Fatalf("status %d", w.Code)
+	}
+
+	var entry map[string]any
+	for _, line := range strings.Split(logs.String(), "\n") {
+		if strings.Contains(line, `"msg":"request completed"`) {
+			_ = json.Unmarshal([]byte(line), &entry)
+		}
+	}
+	if entry == nil {
+		t.Fatalf("no request completed line in:\n%s", logs.String())
+	}
+	want := map[string]any{
+		"request_id":    "req-42",
+		"completion_id": "chatcmpl-1",
+		"model":         "m",
+		"endpoint":      testEndpoint,
+		"wallet":        "gonka1requester",
+		"total_tokens":  float64(10),
+		"user":          "alice",
+	}
+	for k, v := range want {
+		if entry[k] != v {
+			t.Errorf("%s = %v, want %v", k, entry[k], v)
+		}
+	}
+}
+
+func TestListModelsETag(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{})
+
+	get := func(hdr, val string) *httptest.ResponseRecorder {
+		r := httptest.NewRequest(http.MethodGet, "/v1/models", nil)
+		if hdr != "" {
+			r.Header.Set(hdr, val)
+		}
+		return do(t, h, r)
+	}
+
+	first := get("", "")
+	etag := first.Header().Get("ETag")
+	if first.Code != http.StatusOK || etag == "" || first.Header().Get("Last-Modified") == "" {
+		t.Fatalf("GET /v1/models: %d, ETag %q, Last-Modified %q", first.Code, etag, first.Header().Get("Last-Modified"))
+	}
+	if !strings.Contains(first.Body.String(), `"object":"list"`) {
+		t.Fatalf("unexpected body %s", first.Body)
+	}
+
+	for _, inm := range []string{etag, "W/" + etag, `"other", ` + etag, "*"} {
+		if w := get("If-None-Match", inm); w.Code != http.StatusNotModified || w.Body.Len() != 0 {
+			t.Fatalf("If-None-Match %s: %d %q, want empty 304", inm, w.Code, w.Body)
+		}
+	}
+	if w := get("If-None-Match", `"stale"`); w.Code != http.StatusOK || w.Body.String() != first.Body.String() {
+		t.Fatalf("stale If-None-Match: %d, body changed: %v", w.Code, w.Body.String() != first.Body.String())
+	}
+	future := time.Now().Add(time.Hour).UTC().Format(http.TimeFormat)
+	if w := get("If-Modified-Since", future); w.Code != http.StatusNotModified {
+		t.Fatalf("If-Modified-Since in the future: %d, want 304", w.Code)
+	}
+	if w := get("If-Modified-Since", "Mon, 01 Jan 2001 00:00:00 GMT"); w.Code != http.StatusOK {
+		t.Fatalf("old If-Modified-Since: %d, want 200", w.Code)
+	}
+}
+
+func TestModelOverrideAndSplit(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{
+		AllowModelOverride: true,
+		ModelOverrideToken: "s3cret",
+		ModelSplits: map[string]api.ModelSplit{
+			"model-a": {Target: "model-b", Percent: 100},
+			"model-c": {Target: "model-d", Percent: 0},
+		},
+	})
+
+	send := func(model, token, override string) string {
+		t.Helper()
+		r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+			strings.NewReader(`{"model":"`+model+`","messages":[{"role":"user","content":"hi"}]}`))
+		if token != "" {
+			r.Header.Set("Authorization", "Bearer "+token)
+		}
+		if override != "" {
+			r.Header.Set("X-Model-Override", override)
+		}
+		w := do(t, h, r)
+		if w.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", w.Code, w.Body)
+		}
+		body, _, _ := cp.get()
+		got := struct{ Model string }{}
+		_ = json.Unmarshal(body, &got)
+		if eff := w.Header().Get("X-Effective-Model"); eff != got.Model {
+			t.Fatalf("X-Effective-Model %q, upstream saw %q", eff, got.Model)
+		}
+		return got.Model
+	}
+
+	if got := send("m", "s3cret", "forced"); got != "forced" {
+		t.Fatalf("authorized override forwarded %q", got)
+	}
+	if got := send("m", "wrong", "forced"); got != "m" {
+		t.Fatalf("unauthorized override forwarded %q, want m", got)
+	}
+	if got := send("m", "", "forced"); got != "m" {
+		t.Fatalf("override without token forwarded %q, want m", got)
+	}
+	if got := send("model-a", "", ""); got != "model-b" {
+		t.Fatalf("100%% split forwarded %q, want model-b", got)
+	}
+	if got := send("model-c", "", ""); got != "model-c" {
+		t.Fatalf("0%% split forwarded %q, want model-c", got)
+	}
+}
+
+func TestAdminModelsListsOwningEndpoints(t *testing.T) {
+	var srvURL string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/v1/epochs/current/participants":
+			_, _ = io.WriteString(w, `{"active_participants":{"participants":[
+				{"index":"`+testEndpoint+`","inference_url":"`+srvURL+`","models":["m1","m3"]},
+				{"index":"gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp","inference_url":"`+srvURL+`"}]}}`)
+		case "/v1/models":
+			_, _ = io.WriteString(w, `{"models":[{"id":"m1"},{"id":"m2"}]}`)
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer srv.Close()
+	srvURL = srv.URL
+
+	s, err := signer.New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pool, err := wallet.NewPool([]wallet.Wallet{{Signer: s, Address: "gonka1requester"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	client := upstream.New(srv.URL, pool)
+	if err := client.DiscoverEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	h := api.NewWithOptions(client, nil, api.Options{ReadinessGate: true})
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go h.Start(ctx)
+	for i := 0; do(t, h, httptest.NewRequest(http.MethodGet, "/health", nil)).Code != http.StatusOK; i++ {
+		if i > 100 {
+			t.Fatal("models never loaded")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+
+	w := httptest.NewRecorder()
+	h.AdminModelsHandler().ServeHTTP(w, httptest.NewRequest(http.MethodGet, "/admin/models", nil))
+	var got struct {
+		Data []struct {
+			ID        string
+			Listed    bool
+			Endpoints []struct{ Address string }
+		}
+		EndpointsWithoutModels []struct{ Address string } `json:"endpoints_without_models"`
+	}
+	if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+		t.Fatalf("%v: %s", err, w.Body)
+	}
+	summary := map[string]string{}
+	for _, m := range got.Data {
+		var addrs []string
+		for _, ep := range m.Endpoints {
+			addrs = append(addrs, ep.Address)
+		}
+		summary[m.ID] = fmt.Sprintf("listed=%v endpoints=%v", m.Listed, addrs)
+	}
+	want := map[string]string{
+		"m1": "listed=true endpoints=[" + testEndpoint + "]",
+		"m2": "listed=true endpoints=[]",
+		"m3": "listed=false endpoints=[" + testEndpoint + "]",
+	}
+	if !reflect.DeepEqual(summary, want) {
+		t.Fatalf("got %v, want %v", summary, want)
+	}
+	if len(got.EndpointsWithoutModels) != 1 || got.EndpointsWithoutModels[0].Address != "gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp" {
+		t.Fatalf("endpoints_without_models = %+v", got.EndpointsWithoutModels)
+	}
+}
+
+func TestMaxTokensCeilingClamps(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{MaxTokensCeiling: 4096})
+
+	tests := []struct {
+		name, extra string
+		want        string // max_tokens forwarded
+		header      string
+	}{
+		{"too large", `,"max_tokens":32000`, "4096", "32000"},
+		{"small", `,"max_tokens":256`, "256", ""},
+		{"absent stays unset", ``, "", ""},
+	}
+	for _, tt := range tests {
+		w := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}]`+tt.extra+`}`)
+		if w.Code != http.StatusOK {
+			t.Fatalf("%s: status %d: %s", tt.name, w.Code, w.Body)
+		}
+		var got map[string]json.RawMessage
+		if err := json.Unmarshal(assertSignedForwarded(t, s, cp), &got); err != nil {
+			t.Fatal(err)
+		}
+		if string(got["max_tokens"]) != tt.want {
+			t.Errorf("%s: forwarded max_tokens %s, want %s", tt.name, got["max_tokens"], tt.want)
+		}
+		if h := w.Header().Get("X-Max-Tokens-Clamped"); h != tt.header {
+			t.Errorf("%s: X-Max-Tokens-Clamped %q, want %q", tt.name, h, tt.header)
+		}
+	}
+
+	w := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}],"max_completion_tokens":10000}`)
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(assertSignedForwarded(t, s, cp), &got); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := got["max_tokens"]; ok || string(got["max_completion_tokens"]) != "4096" {
+		t.Errorf("max_completion_tokens not clamped in place: %v", got)
+	}
+	if h := w.Header().Get("X-Max-Tokens-Clamped"); h != "10000" {
+		t.Errorf("X-Max-Tokens-Clamped %q, want 10000", h)
+	}
+}
+
+func TestDropRequestFields(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{DropRequestFields: []string{"parallel_tool_calls", "logit_bias", "absent"}})
+
+	w := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}],"parallel_tool_calls":false,"logit_bias":{"50256":-100},"temperature":0.2,"x_vendor":{"a":1}}`)
+	if w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	var got map[string]json.RawMessage
+	if err := json.Unmarshal(assertSignedForwarded(t, s, cp), &got); err != nil {
+		t.Fatal(err)
+	}
+	for _, f := range []string{"parallel_tool_calls", "logit_bias"} {
+		if _, ok := got[f]; ok {
+			t.Errorf("%s was forwarded", f)
+		}
+	}
+	for _, f := range []string{"model", "messages", "temperature", "x_vendor"} {
+		if _, ok := got[f]; !ok {
+			t.Errorf("%s was dropped", f)
+		}
+	}
+}
+
+func TestSanitizeFailClosed(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	in := `{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`
+	opts := api.Options{SanitizeFailClosed: true}
+
+	healthy := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}}), opts)
+	if rec := post(t, healthy, in); rec.Code != http.StatusOK {
+		t.Fatalf("healthy classifiers: status %d: %s", rec.Code, rec.Body)
+	}
+	cp.mu.Lock()
+	calls := cp.calls
+	cp.mu.Unlock()
+
+	sink := &auditRecorder{}
+	opts.AuditSink = sink
+	failing := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}, failingClassifier{}}), opts)
+	rec := post(t, failing, in)
+	if rec.Code != http.StatusServiceUnavailable || !strings.Contains(rec.Body.String(), `"code":"sanitization_failed"`) {
+		t.Fatalf("failing classifier: status %d: %s", rec.Code, rec.Body)
+	}
+	cp.mu.Lock()
+	defer cp.mu.Unlock()
+	if cp.calls != calls {
+		t.Fatal("request was forwarded although a classifier failed")
+	}
+	// hunter2 was redacted, but the request was never sent: no audit record.
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.recs) != 0 {
+		t.Fatalf("rejected request wrote %d audit records", len(sink.recs))
+	}
+}
+
+// slowClassifier delays a classifier's answer.
+type slowClassifier struct {
+	sanitize.Classifier
+	delay time.Duration
+}
+
+func (c slowClassifier) Classify(text string) ([]sanitize.Span, error) {
+	time.Sleep(c.delay)
+	return c.Classifier.Classify(text)
+}
+
+func TestSanitizeProgressStreamsComments(t *testing.T) {
+	client, _, _ := newUpstream(t, "data: {\"choices\":[{\"delta\":{\"content\":\"ok\"}}]}\n\ndata: [DONE]\n\n", true)
+	in := `{"model":"m","stream":true,"messages":[{"role":"user","content":"my password is hunter2"}]}`
+	opts := api.Options{SanitizeProgress: 10 * time.Millisecond, SanitizeFailClosed: true}
+
+	fast := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}}), opts)
+	rec := post(t, fast, in)
+	if strings.HasPrefix(rec.Body.String(), ":") || rec.Header().Get("X-Sanitize-Redactions") == "" {
+		t.Fatalf("fast redaction reported progress: headers %v, body %q", rec.Header(), rec.Body)
+	}
+
+	slow := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{
+		slowClassifier{secretClassifier{}, 100 * time.Millisecond},
+	}), opts)
+	rec = post(t, slow, in)
+	body := rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(body, ": redacting...") {
+		t.Fatalf("status %d, body %q", rec.Code, body)
+	}
+	if !strings.Contains(body, ": redaction done, 1 spans found") || !strings.HasSuffix(body, `"content":"ok"}}]}`+"\n\ndata: [DONE]\n\n") {
+		t.Fatalf("body %q", body)
+	}
+	if rec.Result().Trailer.Get("X-Sanitize-Redactions") == "" {
+		t.Fatalf("redactions not sent as a trailer: %v", rec.Result().Trailer)
+	}
+
+	failing := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{
+		slowClassifier{failingClassifier{}, 100 * time.Millisecond},
+	}), opts)
+	rec = post(t, failing, in)
+	body = rec.Body.String()
+	if rec.Code != http.StatusOK || !strings.HasPrefix(body, ": redacting...") ||
+		!strings.Contains(body, `data: {"error":{`) || !strings.Contains(body, `"code":"sanitization_failed"`) ||
+		!strings.HasSuffix(body, "data: [DONE]\n\n") {
+		t.Fatalf("status %d, body %q", rec.Code, body)
+	}
+}
+
+type auditRecorder struct {
+	mu   sync.Mutex
+	recs []sanitize.AuditRecord
+}
+
+func (a *auditRecorder) Record(r sanitize.AuditRecord) {
+	a.mu.Lock()
+	defer a.mu.Unlock()
+	a.recs = append(a.recs, r)
+}
+
+func TestAuditSinkReceivesRedactions(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	sink := &auditRecorder{}
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	h := api.NewWithOptions(client, san, api.Options{AuditSink: sink})
+
+	r := httptest.NewRequest(http.MethodPost, "/v1/chat/completions",
+		strings.NewReader(`{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`))
+	r.Header.Set("X-Request-Id", "req-42")
+	if w := do(t, h, r); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+	// Nothing redacted, nothing audited.
+	if w := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}]}`); w.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", w.Code, w.Body)
+	}
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.recs) != 1 {
+		t.Fatalf("got %d audit records, want 1", len(sink.recs))
+	}
+	rec := sink.recs[0]
+	if rec.RequestID != "req-42" || rec.Model != "m" || len(rec.Redactions) != 1 || rec.Redactions[0].Original != "hunter2" {
+		t.Fatalf("audit record = %+v", rec)
+	}
+}
+
+func TestToolSimStreamingProseIsStreamedAsDeltas(t *testing.T) {
+	prose := "I don't need a tool for that: Paris is sunny today."
+	resp := `{"id":"x","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,` +
+		`"message":{"role":"assistant","content":` + strconv.Quote(prose) + `},"finish_reason":"stop"}]}`
+	client, _, _ := newUpstream(t, resp, false)
+	h := api.New(client, true, false, nil)
+
+	in := `{"model":"m","stream":true,"messages":[{"role":"user","content":"weather?"}],"tools":[{"type":"function","function":{"name":"get_weather"}}]}`
+	rec := post(t, h, in)
+	if rec.Code != http.StatusOK || rec.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("status %d, Content-Type %q: %s", rec.Code, rec.Header().Get("Content-Type"), rec.Body)
+	}
+
+	var events []string
+	for _, line := range strings.Split(rec.Body.String(), "\n") {
+		if data, ok := strings.CutPrefix(line, "data: "); ok {
+			events = append(events, data)
+		}
+	}
+	if n := len(events); n < 4 || events[n-1] != "[DONE]" {
+		t.Fatalf("want several content chunks, a finish chunk and [DONE], got %q", events)
+	}
+
+	var text strings.Builder
+	var finish string
+	for i, ev := range events[:len(events)-1] {
+		var chunk struct {
+			Object  string `json:"object"`
+			Choices []struct {
+				Delta struct {
+					Role      string          `json:"role"`
+					Content   *string         `json:"content"`
+					ToolCalls json.RawMessage `json:"tool_calls"`
+				} `json:"delta"`
+				FinishReason *string `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal([]byte(ev), &chunk); err != nil {
+			t.Fatal(err)
+		}
+		d := chunk.Choices[0].Delta
+		if chunk.Object != "chat.completion.chunk" || d.ToolCalls != nil {
+			t.Fatalf("chunk %d = %s", i, ev)
+		}
+		if (i == 0) != (d.Role == "assistant") {
+			t.Fatalf("role must be set on the first chunk only, chunk %d = %s", i, ev)
+		}
+		if d.Content != nil {
+			text.WriteString(*d.Content)
+		}
+		if f := chunk.Choices[0].FinishReason; f != nil {
+			finish = *f
+		}
+	}
+	if text.String() != prose || finish != "stop" {
+		t.Fatalf("streamed %q (finish %q), want %q", text.String(), finish, prose)
+	}
+}
+
+func TestSanitizeHeaderReportsLabels(t *testing.T) {
+	client, _, _ := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}}), api.Options{})
+	rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"my password is hunter2"}]}`)
+	raw, err := base64.StdEncoding.DecodeString(rec.Header().Get("X-Sanitize-Redactions"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got []sanitize.Redaction
+	if err := json.Unmarshal(raw, &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || got[0].Original != "hunter2" || got[0].Label != "CREDENTIAL" {
+		t.Fatalf("X-Sanitize-Redactions = %s", raw)
+	}
+}
+
+func TestDryRunReturnsFinalBodyWithoutSending(t *testing.T) {
+	client, s, cp := newUpstream(t, chatOK, false)
+	san := sanitize.NewWithClassifiers([]sanitize.Classifier{secretClassifier{}})
+	sink := &auditRecorder{}
+	h := api.NewWithOptions(client, san, api.Options{
+		SimulateToolCalls: true,
+		ModelAliases:      map[string]string{"gpt-4o": "Qwen/Real"},
+		AuditSink:         sink,
+	})
+
+	for _, tc := range []struct {
+		in      string
+		toolsim bool
+	}{
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"my password is hunter2"}]}`, false},
+		{`{"model":"gpt-4o","messages":[{"role":"user","content":"hunter2"}],"tools":[{"type":"function","function":{"name":"f"}}]}`, true},
+	} {
+		w := httptest.NewRecorder()
+		h.DryRunHandler().ServeHTTP(w, httptest.NewRequest(http.MethodPost, "/admin/dry-run", strings.NewReader(tc.in)))
+		if w.Code != http.StatusOK {
+			t.Fatalf("want 200, got %d: %s", w.Code, w.Body.String())
+		}
+		var got struct {
+			ToolSimulation bool              `json:"tool_simulation"`
+			Endpoint       string            `json:"endpoint"`
+			Wallet         string            `json:"wallet"`
+			Headers        map[string]string `json:"headers"`
+			Body           string            `json:"body"`
+		}
+		if err := json.Unmarshal(w.Body.Bytes(), &got); err != nil {
+			t.Fatal(err)
+		}
+		if got.ToolSimulation != tc.toolsim || got.Endpoint != testEndpoint || got.Wallet != "gonka1requester" {
+			t.Fatalf("unexpected result: %s", w.Body.String())
+		}
+		if strings.Contains(got.Body, "hunter2") || !strings.Contains(got.Body, `"Qwen/Real"`) {
+			t.Fatalf("body not rewritten: %s", got.Body)
+		}
+		if tc.toolsim && strings.Contains(got.Body, `"tools"`) {
+			t.Fatalf("tools not simulated: %s", got.Body)
+		}
+		ts, err := strconv.ParseInt(got.Headers["X-Timestamp"], 10, 64)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if want := s.SignAt([]byte(got.Body), testEndpoint, ts); got.Headers["Authorization"] != want {
+			t.Fatal("signature does not cover the returned body")
+		}
+		if w.Header().Get("X-Sanitize-Redactions") == "" {
+			t.Fatal("redactions not reported")
+		}
+	}
+	if cp.calls != 0 {
+		t.Fatalf("dry run reached the upstream %d times", cp.calls)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.recs) != 0 {
+		t.Fatalf("dry run wrote %d audit records", len(sink.recs))
+	}
+}
+
+func TestToolSimRejectsDuplicateToolNames(t *testing.T) {
+	client, _, cp := newUpstream(t, chatOK, false)
+	h := api.NewWithOptions(client, nil, api.Options{
+		SimulateToolCalls: true,
+		ToolSim:           toolsim.Options{DuplicateTools: toolsim.RejectDuplicateTools},
+	})
+
+	rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"hi"}],"tools":[`+
+		`{"type":"function","function":{"name":"search"}},{"type":"function","function":{"name":"search"}}]}`)
+	if rec.Code != http.StatusBadRequest {
+		t.Fatalf("want 400, got %d: %s", rec.Code, rec.Body.String())
+	}
+	var resp struct {
+		Error struct {
+			Type  string `json:"type"`
+			Param string `json:"param"`
+		} `json:"error"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &resp); err != nil || resp.Error.Type != "invalid_request_error" || resp.Error.Param != "tools[1].function.name" {
+		t.Fatalf("want invalid_request_error on tools[1].function.name, got %s", rec.Body.String())
+	}
+	if body, _, _ := cp.get(); body != nil {
+		t.Fatalf("request forwarded upstream: %s", body)
+	}
+}
+
+func TestToolSimLegacyFunctions(t *testing.T) {
+	resp := `{"id":"x","object":"chat.completion","created":1,"model":"m","choices":[{"index":0,` +
+		`"message":{"role":"assistant","content":"[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}]"},"finish_reason":"stop"}]}`
+	client, _, cp := newUpstream(t, resp, false)
+	h := api.New(client, true, false, nil)
+
+	rec := post(t, h, `{"model":"m","messages":[{"role":"user","content":"weather?"}],"functions":[{"name":"get_weather"}]}`)
+	if rec.Code != http.StatusOK {
+		t.Fatalf("status %d: %s", rec.Code, rec.Body.String())
+	}
+	if fwd, _, _ := cp.get(); bytes.Contains(fwd, []byte(`"functions"`)) {
+		t.Fatalf("functions forwarded upstream: %s", fwd)
+	}
+	var got struct {
+		Choices []struct {
+			Message struct {
+				FunctionCall struct {
+					Name      string `json:"name"`
+					Arguments string `json:"arguments"`
+				} `json:"function_call"`
+				ToolCalls json.RawMessage `json:"tool_calls"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	c := got.Choices[0]
+	if c.FinishReason != "function_call" || c.Message.ToolCalls != nil ||
+		c.Message.FunctionCall.Name != "get_weather" || c.Message.FunctionCall.Arguments != `{"city":"Paris"}` {
+		t.Fatalf("want a legacy function_call, got %s", rec.Body.String())
+	}
+}
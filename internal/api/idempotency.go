@@ -0,0 +1,97 @@
+package api
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"log/slog"
+	"net/http"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/idempotency"
+)
+
+// serveIdempotent answers a non-streaming request from the idempotency cache
+// when key has been seen before, and otherwise serves it normally and caches
+// a successful response for later retries of the same key. Keys are scoped
+// to the client (clientKey), so one client cannot replay another's response
+// by reusing its key, and bound to the request as received: a different
+// request under a cached key is rejected with 422. Concurrent requests with
+// the same key are served once; the others wait and replay.
+func (h *Handler) serveIdempotent(w http.ResponseWriter, r *http.Request, body, received []byte, key string) {
+	cache := h.opts.Idempotency
+	sum := sha256.Sum256(received)
+	reqHash := hex.EncodeToString(sum[:])
+	cacheKey := clientKey(r, received) + "\x00" + key
+	cached, ok, done, err := cache.Claim(r.Context(), cacheKey)
+	if err != nil {
+		slog.Info("idempotency: client gone while waiting for a request with the same key", "key", key, "err", err)
+		return
+	}
+	if ok {
+		if cached.RequestHash != reqHash {
+			slog.Warn("idempotency: key reused for a different request", "key", key)
+			writeJSON(w, http.StatusUnprocessableEntity, map[string]any{
+				"error": map[string]any{
+					"message": "Idempotency-Key was already used for a different request",
+					"type":    "invalid_request_error",
+					"param":   nil,
+					"code":    "idempotency_key_reused",
+				},
+			})
+			return
+		}
+		slog.Info("idempotency: replaying cached response", "key", key, "status", cached.Status)
+		for k, v := range cached.Header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("Idempotent-Replayed", "true")
+		w.WriteHeader(cached.Status)
+		_, _ = w.Write(cached.Body)
+		return
+	}
+
+	defer done()
+
+	bw := &bufferedWriter{header: http.Header{}, status: http.StatusOK}
+	h.serveChat(bw, r, body)
+
+	// Only successes are cached; a failed attempt should be retryable.
+	if bw.status >= 200 && bw.status < 300 {
+		cache.Put(cacheKey, idempotency.Response{
+			Status:      bw.status,
+			Header:      bw.header.Clone(),
+			Body:        bw.buf.Bytes(),
+			RequestHash: reqHash,
+		})
+	}
+
+	for k, v := range bw.header {
+		w.Header()[k] = v
+	}
+	w.WriteHeader(bw.status)
+	_, _ = w.Write(bw.buf.Bytes())
+}
+
+// bufferedWriter is an http.ResponseWriter that holds the whole response in
+// memory so it can be cached before being sent to the client.
+type bufferedWriter struct {
+	header http.Header
+	status int
+	wrote  bool
+	buf    bytes.Buffer
+}
+
+func (b *bufferedWriter) Header() http.Header { return b.header }
+
+func (b *bufferedWriter) WriteHeader(code int) {
+	if b.wrote {
+		return
+	}
+	b.status = code
+	b.wrote = true
+}
+
+func (b *bufferedWriter) Write(p []byte) (int, error) {
+	b.wrote = true
+	return b.buf.Write(p)
+}
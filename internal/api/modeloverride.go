@@ -0,0 +1,49 @@
+package api
+
+import (
+	"crypto/subtle"
+	"hash/fnv"
+	"log/slog"
+	"net/http"
+	"strings"
+)
+
+// ModelSplit sends Percent of a model's traffic to Target (Options.ModelSplits).
+type ModelSplit struct {
+	Target  string
+	Percent int // 0-100
+}
+
+// overrideModel applies the X-Model-Override header, or failing that the
+// configured A/B split, to body. The header is honoured only when Options.AllowModelOverride
+// is set and the caller's bearer token is Options.ModelOverrideToken. A split
+// is chosen by hashing the client key, so each client stays in one arm.
+func (h *Handler) overrideModel(r *http.Request, body []byte) []byte {
+	model := requestModel(body)
+	if o := strings.TrimSpace(r.Header.Get("X-Model-Override")); o != "" && h.opts.AllowModelOverride {
+		if !h.overrideAuthorized(r) {
+			slog.Warn("ignoring X-Model-Override from unauthenticated caller")
+		} else if o != model {
+			slog.Info("model overridden by header", "model", model, "override", o)
+			return setModelField(body, o)
+		}
+	}
+	if split, ok := h.opts.ModelSplits[model]; ok && inSplit(clientKey(r, body)+"\x00"+model, split.Percent) {
+		slog.Info("model split", "model", model, "target", split.Target, "percent", split.Percent)
+		return setModelField(body, split.Target)
+	}
+	return body
+}
+
+func (h *Handler) overrideAuthorized(r *http.Request) bool {
+	token, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+	return ok && h.opts.ModelOverrideToken != "" &&
+		subtle.ConstantTimeCompare([]byte(token), []byte(h.opts.ModelOverrideToken)) == 1
+}
+
+// inSplit reports whether key falls in the first percent of 100 hash buckets.
+func inSplit(key string, percent int) bool {
+	hash := fnv.New32a()
+	_, _ = hash.Write([]byte(key))
+	return int(hash.Sum32()%100) < percent
+}
@@ -0,0 +1,170 @@
+package api
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// modelList is the serialized /v1/models response, rebuilt only when the
+// upstream model list is refreshed so polling clients get the same bytes and
+// can revalidate with If-None-Match or If-Modified-Since.
+type modelList struct {
+	body     []byte
+	etag     string
+	modified time.Time
+}
+
+// setModels caches models and rebuilds the /v1/models response from them.
+func (h *Handler) setModels(models []json.RawMessage) {
+	list := buildModelList(models, time.Now())
+	h.mu.Lock()
+	h.models = models
+	h.modelList = list
+	h.mu.Unlock()
+}
+
+func buildModelList(models []json.RawMessage, now time.Time) *modelList {
+	type modelEntry struct {
+		ID      string `json:"id"`
+		Object  string `json:"object"`
+		Created int64  `json:"created"`
+		OwnedBy string `json:"owned_by"`
+	}
+
+	var entries []modelEntry
+	for _, raw := range models {
+		var m struct {
+			ID string `json:"id"`
+		}
+		if json.Unmarshal(raw, &m) == nil && m.ID != "" {
+			entries = append(entries, modelEntry{
+				ID:      m.ID,
+				Object:  "model",
+				Created: 1677610602,
+				OwnedBy: "gonka",
+			})
+		}
+	}
+	if len(entries) == 0 {
+		entries = []modelEntry{{
+			ID:      "gonka-model",
+			Object:  "model",
+			Created: 1677610602,
+			OwnedBy: "gonka",
+		}}
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"object": "list",
+		"data":   entries,
+	})
+	body = append(body, '\n')
+	sum := sha256.Sum256(body)
+	return &modelList{
+		body:     body,
+		etag:     `"` + hex.EncodeToString(sum[:8]) + `"`,
+		modified: now.UTC().Truncate(time.Second),
+	}
+}
+
+// serve writes the list, or 304 Not Modified when the client's cached copy is
+// current.
+func (l *modelList) serve(w http.ResponseWriter, r *http.Request) {
+	w.Header().Set("ETag", l.etag)
+	w.Header().Set("Last-Modified", l.modified.Format(http.TimeFormat))
+	if l.notModified(r) {
+		w.WriteHeader(http.StatusNotModified)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	_, _ = w.Write(l.body)
+}
+
+// notModified applies the conditional request headers. If-None-Match takes
+// precedence over If-Modified-Since, as in RFC 9110.
+func (l *modelList) notModified(r *http.Request) bool {
+	if inm := r.Header.Get("If-None-Match"); inm != "" {
+		for _, tag := range strings.Split(inm, ",") {
+			tag = strings.TrimPrefix(strings.TrimSpace(tag), "W/")
+			if tag == "*" || tag == l.etag {
+				return true
+			}
+		}
+		return false
+	}
+	if ims := r.Header.Get("If-Modified-Since"); ims != "" {
+		t, err := http.ParseTime(ims)
+		return err == nil && !l.modified.After(t)
+	}
+	return false
+}
+
+// AdminModelsHandler serves the model list with the endpoints that advertise
+// each model, for diagnosing why a model is not found. Unlike /v1/models it is
+// not OpenAI-compatible and should be mounted behind admin authentication.
+// Models are listed from the cached upstream list plus any model an endpoint
+// advertises; endpoints whose participant entry lists no models appear under
+// "endpoints_without_models".
+func (h *Handler) AdminModelsHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, _ *http.Request) {
+		type endpointInfo struct {
+			Address string `json:"address"`
+			URL     string `json:"url"`
+			Version string `json:"version,omitempty"`
+		}
+		type modelInfo struct {
+			ID        string         `json:"id"`
+			Listed    bool           `json:"listed"` // in the upstream model list
+			Endpoints []endpointInfo `json:"endpoints"`
+		}
+
+		h.mu.RLock()
+		models := h.models
+		h.mu.RUnlock()
+
+		byID := make(map[string]*modelInfo)
+		var order []string
+		get := func(id string) *modelInfo {
+			m, ok := byID[id]
+			if !ok {
+				m = &modelInfo{ID: id, Endpoints: []endpointInfo{}}
+				byID[id] = m
+				order = append(order, id)
+			}
+			return m
+		}
+		for _, raw := range models {
+			var m struct {
+				ID string `json:"id"`
+			}
+			if json.Unmarshal(raw, &m) == nil && m.ID != "" {
+				get(m.ID).Listed = true
+			}
+		}
+		unknown := []endpointInfo{}
+		for _, ep := range h.client.Endpoints() {
+			info := endpointInfo{Address: ep.Address, URL: ep.URL, Version: ep.Version}
+			if len(ep.Models) == 0 {
+				unknown = append(unknown, info)
+				continue
+			}
+			for _, id := range ep.Models {
+				m := get(id)
+				m.Endpoints = append(m.Endpoints, info)
+			}
+		}
+
+		data := make([]*modelInfo, 0, len(order))
+		for _, id := range order {
+			data = append(data, byID[id])
+		}
+		writeJSON(w, http.StatusOK, map[string]any{
+			"data":                     data,
+			"endpoints_without_models": unknown,
+		})
+	})
+}
@@ -0,0 +1,138 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
+)
+
+// progressWriter reports redaction progress to a streaming client while its
+// request is sanitized (Options.SanitizeProgress). Fast requests never notice
+// it: only when redaction is still running after the first interval does it
+// start the SSE response early and send comment lines such as
+// ": redacting... 3 spans found (4s)".
+//
+// Once started, the status is fixed at 200 and headers are out, so the rest
+// of the request is relayed through it: the upstream stream as is, an error
+// response as a final SSE error event (see finish), and the X-Sanitize-*
+// headers as trailers.
+type progressWriter struct {
+	http.ResponseWriter
+	progress *sanitize.Progress
+	interval time.Duration
+	stop     chan struct{}
+	done     chan struct{}
+	started  bool // owned by run until done is closed
+
+	status int          // status the handler asked for after the start
+	errBuf bytes.Buffer // body of an error response after the start
+}
+
+// startProgress begins watching the redaction run under the returned context.
+func (h *Handler) startProgress(ctx context.Context, w http.ResponseWriter) (context.Context, *progressWriter) {
+	pw := &progressWriter{
+		ResponseWriter: w,
+		progress:       &sanitize.Progress{},
+		interval:       h.opts.SanitizeProgress,
+		stop:           make(chan struct{}),
+		done:           make(chan struct{}),
+	}
+	go pw.run()
+	return sanitize.WithProgress(ctx, pw.progress), pw
+}
+
+func (pw *progressWriter) run() {
+	defer close(pw.done)
+	start := time.Now()
+	t := time.NewTicker(pw.interval)
+	defer t.Stop()
+	for {
+		select {
+		case <-pw.stop:
+			if pw.started {
+				pw.comment(fmt.Sprintf("redaction done, %d spans found (%s)", pw.progress.Spans(), time.Since(start).Round(time.Second)))
+			}
+			return
+		case <-t.C:
+			if !pw.started {
+				pw.begin()
+			}
+			pw.comment(fmt.Sprintf("redacting... %d spans found (%s)", pw.progress.Spans(), time.Since(start).Round(time.Second)))
+		}
+	}
+}
+
+// begin sends the SSE response headers.
+func (pw *progressWriter) begin() {
+	pw.started = true
+	h := pw.ResponseWriter.Header()
+	h.Set("Trailer", "X-Sanitize-Degraded, X-Sanitize-Redactions")
+	h.Set("Content-Type", "text/event-stream")
+	h.Set("Cache-Control", "no-cache")
+	h.Set("X-Accel-Buffering", "no")
+	pw.ResponseWriter.WriteHeader(http.StatusOK)
+}
+
+func (pw *progressWriter) comment(text string) {
+	_, _ = pw.ResponseWriter.Write([]byte(": " + text + "\n\n"))
+	pw.Flush()
+}
+
+// end stops reporting once redaction is over and says whether the response
+// was started, in which case the rest of the request must be written to pw
+// and finished with finish.
+func (pw *progressWriter) end() bool {
+	close(pw.stop)
+	<-pw.done
+	return pw.started
+}
+
+// WriteHeader records status; the real one has been sent already.
+func (pw *progressWriter) WriteHeader(status int) {
+	if pw.status == 0 {
+		pw.status = status
+	}
+}
+
+// Write relays the stream, or holds back an error body for finish.
+func (pw *progressWriter) Write(b []byte) (int, error) {
+	if pw.status >= 400 {
+		return pw.errBuf.Write(b)
+	}
+	return pw.ResponseWriter.Write(b)
+}
+
+func (pw *progressWriter) Flush() {
+	if f, ok := pw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+// finish sends an error response the handler wrote after the start as the
+// last event of the stream, in OpenAI's streamed error shape.
+func (pw *progressWriter) finish() {
+	if pw.status < 400 {
+		return
+	}
+	var body struct {
+		Error json.RawMessage `json:"error"`
+	}
+	_ = json.Unmarshal(pw.errBuf.Bytes(), &body)
+	if len(body.Error) > 0 && body.Error[0] == '{' {
+		// Already an OpenAI error object.
+		_, _ = pw.ResponseWriter.Write([]byte("data: {\"error\":" + string(body.Error) + "}\n\ndata: [DONE]\n\n"))
+		return
+	}
+	msg := pw.errBuf.String()
+	_ = json.Unmarshal(body.Error, &msg)
+	typ := "upstream_error"
+	if pw.status < 500 {
+		typ = "invalid_request_error"
+	}
+	_, _ = pw.ResponseWriter.Write(streamErrEvent(msg, typ, pw.status))
+}
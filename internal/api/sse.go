@@ -0,0 +1,128 @@
+package api
+
+import (
+	"bufio"
+	"bytes"
+	"io"
+)
+
+// sseRewriter wraps an SSE stream and passes the payload of every "data:"
+// line through fn before handing it to the reader. Lines are processed whole,
+// so fn always sees a complete JSON event. The "[DONE]" sentinel and non-data
+// lines are passed through unchanged.
+type sseRewriter struct {
+	src *bufio.Reader
+	fn  func(payload []byte) []byte
+	out []byte // rewritten bytes not yet returned to the caller
+	err error  // sticky error from src, returned once out is drained
+}
+
+// newSSERewriter returns a reader that applies fn to each SSE data payload.
+func newSSERewriter(src io.Reader, fn func(payload []byte) []byte) io.Reader {
+	return &sseRewriter{src: bufio.NewReader(src), fn: fn}
+}
+
+func (r *sseRewriter) Read(p []byte) (int, error) {
+	for len(r.out) == 0 {
+		if r.err != nil {
+			return 0, r.err
+		}
+		line, err := r.src.ReadBytes('\n')
+		r.err = err
+		r.out = r.rewriteLine(line)
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+func (r *sseRewriter) rewriteLine(line []byte) []byte {
+	rest, ok := bytes.CutPrefix(line, []byte("data:"))
+	if !ok {
+		return line
+	}
+	body := bytes.TrimRight(rest, "\r\n")
+	eol := rest[len(body):]
+	payload := bytes.TrimPrefix(body, []byte(" "))
+	if len(payload) == 0 || bytes.Equal(payload, []byte("[DONE]")) {
+		return line
+	}
+
+	out := make([]byte, 0, len(line))
+	out = append(out, "data: "...)
+	out = append(out, r.fn(payload)...)
+	return append(out, eol...)
+}
+
+// sseFramer passes an SSE stream through unchanged, but re-frames a stream
+// of newline-delimited JSON objects, as some nodes send instead of SSE, into
+// "data: {...}" events followed by "data: [DONE]" once the stream ends; a
+// stream cut short by a read error ends with that error instead, so the
+// client does not take it for complete. Which one the stream is
+// is decided from its first non-blank line: SSE field lines ("data:",
+// "event:", "id:", "retry:") and comments (":") mean SSE.
+type sseFramer struct {
+	src     *bufio.Reader
+	decided bool
+	frame   bool // re-framing NDJSON
+	done    bool // [DONE] was sent
+	out     []byte
+	err     error
+}
+
+// newSSEFramer returns a reader that yields src as proper SSE.
+func newSSEFramer(src io.Reader) io.Reader {
+	return &sseFramer{src: bufio.NewReader(src)}
+}
+
+// sseFieldPrefixes start the lines of a stream that is already SSE.
+var sseFieldPrefixes = [][]byte{[]byte("data:"), []byte("event:"), []byte("id:"), []byte("retry:"), []byte(":")}
+
+func (f *sseFramer) Read(p []byte) (int, error) {
+	for len(f.out) == 0 {
+		if f.err != nil {
+			if f.err == io.EOF && f.frame && !f.done {
+				f.done = true
+				f.out = []byte("data: [DONE]\n\n")
+				break
+			}
+			return 0, f.err
+		}
+		line, err := f.src.ReadBytes('\n')
+		f.err = err
+		f.out = f.frameLine(line)
+	}
+	n := copy(p, f.out)
+	f.out = f.out[n:]
+	return n, nil
+}
+
+func (f *sseFramer) frameLine(line []byte) []byte {
+	payload := bytes.TrimSpace(line)
+	if !f.decided {
+		if len(payload) == 0 {
+			return line
+		}
+		f.decided = true
+		f.frame = true
+		for _, prefix := range sseFieldPrefixes {
+			if bytes.HasPrefix(payload, prefix) {
+				f.frame = false
+				break
+			}
+		}
+	}
+	if !f.frame {
+		return line
+	}
+	if len(payload) == 0 {
+		return nil
+	}
+	if bytes.Equal(payload, []byte("[DONE]")) {
+		f.done = true
+	}
+	out := make([]byte, 0, len(payload)+8)
+	out = append(out, "data: "...)
+	out = append(out, payload...)
+	return append(out, "\n\n"...)
+}
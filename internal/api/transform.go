@@ -0,0 +1,476 @@
+package api
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"math"
+	"net/http"
+	"strings"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
+	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+)
+
+// RequestError is an error a RequestTransformer can return to reject a
+// request with a specific OpenAI error code.
+type RequestError struct {
+	Message string
+	Code    string // e.g. "context_length_exceeded"; may be empty
+	Param   string // offending parameter, e.g. "messages[0].role"; may be empty
+	Status  int    // HTTP status; 0 means 400
+}
+
+func (e *RequestError) Error() string { return e.Message }
+
+// RequestTransformer rewrites a chat completions request body before it is
+// forwarded upstream. It may return a derived context to carry per-request
+// state to later transformers and to its own response side. A non-nil error
+// rejects the request, with 400 unless it is a RequestError with a Status.
+type RequestTransformer interface {
+	TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error)
+}
+
+// ResponseTransformer rewrites a complete non-streaming response body. status
+// is the upstream status code; error bodies are passed through the chain too.
+type ResponseTransformer interface {
+	TransformResponse(ctx context.Context, status int, body []byte) []byte
+}
+
+// StreamTransformer rewrites a successful streamed response. sse reports
+// whether upstream answered with text/event-stream. Returning src unchanged
+// leaves the stream alone.
+type StreamTransformer interface {
+	TransformStream(ctx context.Context, src io.Reader, sse bool) io.Reader
+}
+
+// buildChains assembles the transformer chains from the enabled features.
+// Request transformers run in order, followed by opts.RequestTransformers.
+// Response and stream transformers run in the reverse order, so custom ones
+// see the upstream response before the built-in steps undo their rewrites.
+func (h *Handler) buildChains() {
+	var steps []RequestTransformer
+	if len(h.opts.DropRequestFields) > 0 {
+		steps = append(steps, fieldDropper{fields: h.opts.DropRequestFields})
+	}
+	if h.opts.MaxPromptTokens > 0 {
+		steps = append(steps, promptLimit{max: h.opts.MaxPromptTokens})
+	}
+	if h.opts.MaxTokensCeiling > 0 {
+		steps = append(steps, tokenCeiling{max: h.opts.MaxTokensCeiling})
+	}
+	if h.opts.RouteBySeed {
+		steps = append(steps, seedRouter{})
+	}
+	if len(h.opts.ModelAliases) > 0 {
+		steps = append(steps, modelAliaser{aliases: h.opts.ModelAliases})
+	}
+	steps = append(steps, walletRouter{})
+	if h.sanitizer != nil {
+		steps = append(steps, &sanitizeStep{
+			san:        h.sanitizer,
+			bodyReport: h.opts.SanitizeBodyReport,
+			models:     newModelFilter(h.opts.SanitizeModels),
+			failClosed: h.opts.SanitizeFailClosed,
+			audit:      h.opts.AuditSink,
+		})
+	}
+	if h.opts.NativeToolCalls {
+		steps = append(steps, contentNormalizer{})
+	}
+
+	h.requestChain = append(steps, h.opts.RequestTransformers...)
+
+	h.responseChain = append([]ResponseTransformer(nil), h.opts.ResponseTransformers...)
+	for _, t := range h.opts.ResponseTransformers {
+		if st, ok := t.(StreamTransformer); ok {
+			h.streamChain = append(h.streamChain, st)
+		}
+	}
+	for i := len(steps) - 1; i >= 0; i-- {
+		if rt, ok := steps[i].(ResponseTransformer); ok {
+			h.responseChain = append(h.responseChain, rt)
+		}
+		if st, ok := steps[i].(StreamTransformer); ok {
+			h.streamChain = append(h.streamChain, st)
+		}
+	}
+}
+
+// transformRequest runs the request chain over body.
+func (h *Handler) transformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	for _, t := range h.requestChain {
+		var err error
+		ctx, body, err = t.TransformRequest(ctx, body)
+		if err != nil {
+			return ctx, body, err
+		}
+	}
+	return ctx, body, nil
+}
+
+// transformResponse runs the response chain over a non-streaming body.
+func (h *Handler) transformResponse(ctx context.Context, status int, body []byte) []byte {
+	for _, t := range h.responseChain {
+		body = t.TransformResponse(ctx, status, body)
+	}
+	return body
+}
+
+// transformStream wraps a streamed response body in the stream chain.
+func (h *Handler) transformStream(ctx context.Context, src io.Reader, sse bool) io.Reader {
+	for _, t := range h.streamChain {
+		src = t.TransformStream(ctx, src, sse)
+	}
+	return src
+}
+
+type ctxKey int
+
+const (
+	tokenMapCtx ctxKey = iota
+	clientModelCtx
+	requestMetaCtx
+	clampedTokensCtx
+	dryRunCtx
+)
+
+// isDryRun reports whether ctx belongs to a dry run (DryRunHandler), which is
+// never sent upstream.
+func isDryRun(ctx context.Context) bool {
+	dry, _ := ctx.Value(dryRunCtx).(bool)
+	return dry
+}
+
+// tokenMapFrom returns the redaction map recorded by the sanitize step, or nil.
+func tokenMapFrom(ctx context.Context) *sanitize.TokenMap {
+	tm, _ := ctx.Value(tokenMapCtx).(*sanitize.TokenMap)
+	return tm
+}
+
+// clampedTokensFrom returns the completion token limit the client asked for
+// when tokenCeiling lowered it, or 0.
+func clampedTokensFrom(ctx context.Context) int {
+	n, _ := ctx.Value(clampedTokensCtx).(int)
+	return n
+}
+
+// clientModelFrom returns the model alias the client asked for, or "".
+func clientModelFrom(ctx context.Context) string {
+	model, _ := ctx.Value(clientModelCtx).(string)
+	return model
+}
+
+// ---------- built-in transformers ----------
+
+// promptLimit rejects requests whose estimated prompt size exceeds max, so a
+// request that cannot fit the model's context is not paid for.
+type promptLimit struct {
+	max int
+}
+
+func (p promptLimit) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	if n := estimatePromptTokens(body); n > p.max {
+		slog.Info("rejecting oversized prompt", "estimatedTokens", n, "max", p.max)
+		return ctx, body, &RequestError{
+			Message: fmt.Sprintf("prompt is too long: about %d tokens, the limit is %d", n, p.max),
+			Code:    "context_length_exceeded",
+		}
+	}
+	return ctx, body, nil
+}
+
+// estimatePromptTokens roughly estimates the prompt size of a chat request:
+// about one token per four bytes of message text and tool definitions, plus a
+// few tokens of framing per message. It is deliberately simple and can be off
+// by a wide margin, especially for non-English text; it only needs to catch
+// requests that are clearly too large.
+func estimatePromptTokens(body []byte) int {
+	var req struct {
+		Messages []struct {
+			Content json.RawMessage `json:"content"`
+		} `json:"messages"`
+		Tools json.RawMessage `json:"tools"`
+	}
+	if json.Unmarshal(body, &req) != nil {
+		return (len(body) + 3) / 4
+	}
+	const perMessage = 4
+	n := 0
+	for _, m := range req.Messages {
+		n += perMessage + (contentLen(m.Content)+3)/4
+	}
+	return n + (len(req.Tools)+3)/4
+}
+
+// contentLen returns the byte length of the text in a message content, which
+// may be a string or an array of parts.
+func contentLen(raw json.RawMessage) int {
+	var s string
+	if json.Unmarshal(raw, &s) == nil {
+		return len(s)
+	}
+	var parts []struct {
+		Text string `json:"text"`
+	}
+	if json.Unmarshal(raw, &parts) == nil {
+		n := 0
+		for _, p := range parts {
+			n += len(p.Text)
+		}
+		return n
+	}
+	return len(raw)
+}
+
+// tokenCeiling caps the completion length a request may ask for, so a client
+// sending max_tokens: 32000 out of habit cannot run up the wallet bill. Both
+// max_tokens and its newer name max_completion_tokens are lowered to max; a
+// request with neither is left to the node's default.
+type tokenCeiling struct {
+	max int
+}
+
+func (c tokenCeiling) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ctx, body, nil
+	}
+	requested := 0
+	for _, f := range []string{"max_tokens", "max_completion_tokens"} {
+		raw, ok := req[f]
+		if !ok || string(raw) == "null" {
+			continue
+		}
+		var n float64
+		if json.Unmarshal(raw, &n) != nil || n <= float64(c.max) {
+			continue // not a number: left to validation
+		}
+		requested = max(requested, int(min(n, math.MaxInt32)))
+		req[f], _ = json.Marshal(c.max)
+	}
+	if requested == 0 {
+		return ctx, body, nil
+	}
+	out, err := json.Marshal(req)
+	if err != nil {
+		return ctx, body, nil
+	}
+	slog.Info("max_tokens clamped", "requested", requested, "ceiling", c.max)
+	return context.WithValue(ctx, clampedTokensCtx, requested), out, nil
+}
+
+// fieldDropper removes top-level request fields some nodes reject.
+type fieldDropper struct {
+	fields []string
+}
+
+func (d fieldDropper) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ctx, body, nil
+	}
+	var dropped []string
+	for _, f := range d.fields {
+		if _, ok := req[f]; ok {
+			delete(req, f)
+			dropped = append(dropped, f)
+		}
+	}
+	if len(dropped) == 0 {
+		return ctx, body, nil
+	}
+	out, err := json.Marshal(req)
+	if err != nil {
+		return ctx, body, nil
+	}
+	slog.Debug("dropped request fields", "fields", dropped)
+	return ctx, out, nil
+}
+
+// seedRouter pins requests carrying a seed to a seed-derived endpoint.
+type seedRouter struct{}
+
+func (seedRouter) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	if key := seedRoutingKey(body); key != "" {
+		ctx = upstream.WithRoutingKey(ctx, key)
+	}
+	return ctx, body, nil
+}
+
+// modelAliaser rewrites aliased model names to their upstream model and
+// reports the alias back in responses.
+type modelAliaser struct {
+	aliases map[string]string
+}
+
+func (m modelAliaser) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(body, &req); err != nil {
+		return ctx, body, nil
+	}
+	var model string
+	if err := json.Unmarshal(req["model"], &model); err != nil {
+		return ctx, body, nil
+	}
+	target, ok := m.aliases[model]
+	if !ok {
+		return ctx, body, nil
+	}
+	req["model"], _ = json.Marshal(target)
+	out, err := json.Marshal(req)
+	if err != nil {
+		return ctx, body, nil
+	}
+	slog.Info("model alias resolved", "alias", model, "model", target)
+	return context.WithValue(ctx, clientModelCtx, model), out, nil
+}
+
+func (modelAliaser) TransformResponse(ctx context.Context, status int, body []byte) []byte {
+	if status >= 400 {
+		return body
+	}
+	return setModelField(body, clientModelFrom(ctx))
+}
+
+func (modelAliaser) TransformStream(ctx context.Context, src io.Reader, _ bool) io.Reader {
+	model := clientModelFrom(ctx)
+	if model == "" {
+		return src
+	}
+	return newSSERewriter(src, func(payload []byte) []byte {
+		return setModelField(payload, model)
+	})
+}
+
+// walletRouter tells the upstream client which model the request is for, so
+// it can sign with the wallet pinned to that model.
+type walletRouter struct{}
+
+func (walletRouter) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	return upstream.WithModel(ctx, requestModel(body)), body, nil
+}
+
+// sanitizeStep redacts sensitive data from outgoing messages and restores it
+// in responses.
+type sanitizeStep struct {
+	san        *sanitize.Sanitizer
+	bodyReport bool        // see Options.SanitizeBodyReport
+	models     modelFilter // see Options.SanitizeModels
+	failClosed bool        // see Options.SanitizeFailClosed
+	audit      sanitize.AuditSink
+}
+
+func (s *sanitizeStep) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	if model := requestModel(body); !s.models.allows(model, clientModelFrom(ctx)) {
+		slog.Info("sanitize: skipped for model", "model", model)
+		return ctx, body, nil
+	}
+	body, tm := s.san.RedactMessages(ctx, body)
+	if tm != nil && !tm.IsEmpty() {
+		slog.Info("sanitize: redacted tokens in request", "count", tm.Count())
+	}
+	if err := tm.Err(); err != nil && s.failClosed {
+		slog.Error("sanitize: classifier failed, rejecting request", "err", err)
+		return ctx, body, &RequestError{
+			Message: "sanitization is unavailable, request not forwarded",
+			Code:    "sanitization_failed",
+			Status:  http.StatusServiceUnavailable,
+		}
+	}
+	// A rejected request or a dry run sends nothing, so there is nothing to
+	// audit.
+	if s.audit != nil && !tm.IsEmpty() && !isDryRun(ctx) {
+		var id string
+		if meta := requestMetaFrom(ctx); meta != nil {
+			id = meta.id
+		}
+		s.audit.Record(tm.AuditRecord(id, requestModel(body)))
+	}
+	if tm.Degraded() {
+		slog.Warn("sanitize: classifier failed or timed out, redaction is best-effort", "redacted", tm.Count())
+	}
+	return context.WithValue(ctx, tokenMapCtx, tm), body, nil
+}
+
+func (s *sanitizeStep) TransformResponse(ctx context.Context, status int, body []byte) []byte {
+	tm := tokenMapFrom(ctx)
+	if tm == nil {
+		return body
+	}
+	body = s.san.RestoreBytes(body, tm)
+	if s.bodyReport {
+		body = addSanitizeReport(body, status, tm)
+	}
+	return body
+}
+
+// TransformStream restores redacted tokens. SSE payloads are restored per
+// event on decoded JSON so originals are escaped correctly (including inside
+// tool-call arguments); anything else falls back to byte-level restoration.
+func (s *sanitizeStep) TransformStream(ctx context.Context, src io.Reader, sse bool) io.Reader {
+	tm := tokenMapFrom(ctx)
+	if !sse {
+		return sanitize.NewRestoringReader(src, tm)
+	}
+	restorer := sanitize.NewEventRestorer(tm)
+	if restorer == nil {
+		return src
+	}
+	return newSSERewriter(src, restorer.Restore)
+}
+
+// modelFilter is a parsed Options.SanitizeModels list.
+type modelFilter struct {
+	include map[string]bool // nil: every model not excluded
+	exclude map[string]bool
+}
+
+func newModelFilter(entries []string) modelFilter {
+	var f modelFilter
+	for _, e := range entries {
+		if name, ok := strings.CutPrefix(e, "!"); ok {
+			if f.exclude == nil {
+				f.exclude = make(map[string]bool)
+			}
+			f.exclude[name] = true
+			continue
+		}
+		if f.include == nil {
+			f.include = make(map[string]bool)
+		}
+		f.include[e] = true
+	}
+	return f
+}
+
+// allows reports whether a request for the given model names passes the
+// filter. Empty names are ignored.
+func (f modelFilter) allows(names ...string) bool {
+	included := f.include == nil
+	for _, n := range names {
+		if n == "" {
+			continue
+		}
+		if f.exclude[n] {
+			return false
+		}
+		included = included || f.include[n]
+	}
+	return included
+}
+
+// contentNormalizer flattens array message content into plain strings for
+// Gonka nodes when tool calls are forwarded natively.
+type contentNormalizer struct{}
+
+func (contentNormalizer) TransformRequest(ctx context.Context, body []byte) (context.Context, []byte, error) {
+	out, err := normalizeMessageContent(body)
+	if err != nil {
+		slog.Warn("normalizeMessageContent failed, forwarding original body", "err", err)
+		return ctx, body, nil
+	}
+	return ctx, out, nil
+}
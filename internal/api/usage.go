@@ -0,0 +1,113 @@
+package api
+
+import (
+	"bytes"
+	"context"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"io"
+	"log/slog"
+	"net/http"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/upstream"
+)
+
+// requestMeta identifies a chat request for the usage log
+// (Options.UsageLog) and the audit sink (Options.AuditSink).
+type requestMeta struct {
+	id    string
+	start time.Time
+	usage bool   // log usage for this request
+	user  string // the request's "user" field, once the body is read
+}
+
+// withRequestMeta starts timing r for the usage log. The request ID is the
+// client's X-Request-Id header when present, otherwise a random one.
+func withRequestMeta(r *http.Request, usage bool) *http.Request {
+	id := r.Header.Get("X-Request-Id")
+	if id == "" {
+		b := make([]byte, 8)
+		_, _ = rand.Read(b)
+		id = hex.EncodeToString(b)
+	}
+	meta := &requestMeta{id: id, start: time.Now(), usage: usage}
+	return r.WithContext(context.WithValue(r.Context(), requestMetaCtx, meta))
+}
+
+func requestMetaFrom(ctx context.Context) *requestMeta {
+	meta, _ := ctx.Value(requestMetaCtx).(*requestMeta)
+	return meta
+}
+
+// completionInfo is the part of a chat completion (or stream chunk) the usage
+// log reports.
+type completionInfo struct {
+	ID    string `json:"id"`
+	Usage *struct {
+		PromptTokens     int `json:"prompt_tokens"`
+		CompletionTokens int `json:"completion_tokens"`
+		TotalTokens      int `json:"total_tokens"`
+	} `json:"usage"`
+}
+
+// logUsage emits the single "request completed" line that ties a request to
+// the endpoint and wallet that served it, its token usage and its latency, for
+// reconciliation against the Gonka ledger. It is a no-op unless
+// Options.UsageLog is set.
+func logUsage(ctx context.Context, model string, by upstream.Served, status int, stream bool, info completionInfo) {
+	meta := requestMetaFrom(ctx)
+	if meta == nil || !meta.usage {
+		return
+	}
+	attrs := []any{
+		"request_id", meta.id,
+		"completion_id", info.ID,
+		"model", model,
+		"endpoint", by.Endpoint,
+		"wallet", by.Wallet,
+		"attempts", by.Attempts,
+		"status", status,
+		"stream", stream,
+		"latency_ms", time.Since(meta.start).Milliseconds(),
+	}
+	if meta.user != "" {
+		attrs = append(attrs, "user", meta.user)
+	}
+	if u := info.Usage; u != nil {
+		attrs = append(attrs,
+			"prompt_tokens", u.PromptTokens,
+			"completion_tokens", u.CompletionTokens,
+			"total_tokens", u.TotalTokens,
+		)
+	}
+	slog.Info("request completed", attrs...)
+}
+
+// completionInfoOf extracts the completion ID and usage from a response body.
+func completionInfoOf(body []byte) completionInfo {
+	var info completionInfo
+	_ = json.Unmarshal(body, &info)
+	return info
+}
+
+// tapUsage wraps an SSE stream and records the completion ID and the usage
+// reported by any chunk (sent when the client asks for
+// stream_options.include_usage) into info, leaving the stream unchanged.
+func tapUsage(src io.Reader, info *completionInfo) io.Reader {
+	return newSSERewriter(src, func(payload []byte) []byte {
+		if info.ID == "" || bytes.Contains(payload, []byte(`"usage"`)) {
+			var chunk completionInfo
+			if json.Unmarshal(payload, &chunk) == nil {
+				if info.ID == "" {
+					info.ID = chunk.ID
+				}
+				if chunk.Usage != nil {
+					info.Usage = chunk.Usage
+				}
+			}
+		}
+		return payload
+	})
+}
@@ -0,0 +1,86 @@
+package api
+
+import (
+	"encoding/json"
+	"fmt"
+)
+
+// ValidationMode sets how strictly chat requests are checked before they are
+// signed and forwarded (Options.Validation).
+type ValidationMode string
+
+const (
+	// ValidateOff forwards every well-formed JSON body as-is.
+	ValidateOff ValidationMode = "off"
+	// ValidateBasic rejects requests no node can serve: a missing model, an
+	// empty messages array, or messages without a role.
+	ValidateBasic ValidationMode = "basic"
+	// ValidateStrict additionally rejects roles OpenAI does not define and
+	// messages missing the fields their role requires.
+	ValidateStrict ValidationMode = "strict"
+)
+
+// knownRoles are the message roles defined by the OpenAI chat API.
+var knownRoles = map[string]bool{
+	"system":    true,
+	"developer": true,
+	"user":      true,
+	"assistant": true,
+	"tool":      true,
+	"function":  true,
+}
+
+// validateChatRequest checks the structural invariants of a chat completions
+// body at the given strictness. It returns a RequestError naming the
+// offending parameter, or nil.
+func validateChatRequest(body []byte, mode ValidationMode) *RequestError {
+	if mode == "" || mode == ValidateOff {
+		return nil
+	}
+	var req struct {
+		Model    json.RawMessage `json:"model"`
+		Messages json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(body, &req); err != nil {
+		return &RequestError{Message: "request body must be a JSON object"}
+	}
+
+	var model string
+	if json.Unmarshal(req.Model, &model) != nil || model == "" {
+		return &RequestError{Message: "you must provide a model parameter", Param: "model"}
+	}
+
+	var messages []map[string]json.RawMessage
+	if json.Unmarshal(req.Messages, &messages) != nil || len(messages) == 0 {
+		return &RequestError{Message: "messages must be a non-empty array of message objects", Param: "messages"}
+	}
+
+	for i, m := range messages {
+		var role string
+		if json.Unmarshal(m["role"], &role) != nil || role == "" {
+			return &RequestError{Message: "each message must have a string role", Param: fmt.Sprintf("messages[%d].role", i)}
+		}
+		if mode != ValidateStrict {
+			continue
+		}
+		if !knownRoles[role] {
+			return &RequestError{
+				Message: fmt.Sprintf("invalid role %q; expected system, developer, user, assistant, tool or function", role),
+				Param:   fmt.Sprintf("messages[%d].role", i),
+			}
+		}
+		if role == "tool" && isNull(m["tool_call_id"]) {
+			return &RequestError{Message: "tool messages must have a tool_call_id", Param: fmt.Sprintf("messages[%d].tool_call_id", i)}
+		}
+		// Assistant turns that only call tools may omit content.
+		if isNull(m["content"]) && !(role == "assistant" && (!isNull(m["tool_calls"]) || !isNull(m["function_call"]))) {
+			return &RequestError{Message: fmt.Sprintf("%s messages must have content", role), Param: fmt.Sprintf("messages[%d].content", i)}
+		}
+	}
+	return nil
+}
+
+// isNull reports whether a raw JSON field is absent or null.
+func isNull(raw json.RawMessage) bool {
+	return len(raw) == 0 || string(raw) == "null"
+}
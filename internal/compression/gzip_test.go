@@ -0,0 +1,63 @@
+package compression
+
+import (
+	"compress/gzip"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestGzip(t *testing.T) {
+	body := strings.Repeat(`{"content":"hello"}`, 100)
+	h := Gzip(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("X-Sanitize-Redactions", "W10=")
+		if r.URL.Path == "/stream" {
+			w.Header().Set("Content-Type", "text/event-stream")
+		} else {
+			w.Header().Set("Content-Type", "application/json")
+		}
+		_, _ = io.WriteString(w, body)
+	}))
+
+	tests := []struct {
+		path, accept string
+		gzipped      bool
+	}{
+		{"/json", "gzip, deflate", true},
+		{"/json", "", false},
+		{"/json", "gzip;q=0, *", false},
+		{"/json", "br", false},
+		{"/stream", "gzip", false},
+	}
+	for _, tc := range tests {
+		req := httptest.NewRequest(http.MethodGet, tc.path, nil)
+		if tc.accept != "" {
+			req.Header.Set("Accept-Encoding", tc.accept)
+		}
+		rec := httptest.NewRecorder()
+		h.ServeHTTP(rec, req)
+
+		if got := rec.Header().Get("X-Sanitize-Redactions"); got != "W10=" {
+			t.Errorf("%s %q: X-Sanitize-Redactions = %q", tc.path, tc.accept, got)
+		}
+		gzipped := rec.Header().Get("Content-Encoding") == "gzip"
+		if gzipped != tc.gzipped {
+			t.Errorf("%s %q: gzipped = %v, want %v", tc.path, tc.accept, gzipped, tc.gzipped)
+			continue
+		}
+		got := rec.Body.String()
+		if gzipped {
+			zr, err := gzip.NewReader(rec.Body)
+			if err != nil {
+				t.Fatal(err)
+			}
+			b, _ := io.ReadAll(zr)
+			got = string(b)
+		}
+		if got != body {
+			t.Errorf("%s %q: body mismatch", tc.path, tc.accept)
+		}
+	}
+}
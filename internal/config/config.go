@@ -1,9 +1,15 @@
 package config
 
 import (
+	"errors"
 	"fmt"
+	"io/fs"
+	"log/slog"
+	"net/url"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
 	"github.com/joho/godotenv"
 )
@@ -14,6 +20,18 @@ type WalletCfg struct {
 	Address    string // bech32 requester address (derived if empty)
 }
 
+// EndpointCfg is a Gonka node configured by hand instead of discovered.
+type EndpointCfg struct {
+	URL     string // inference URL ending in /v1
+	Address string // bech32 transfer-agent address of the node
+}
+
+// ModelSplitCfg sends Percent of a model's traffic to Target.
+type ModelSplitCfg struct {
+	Target  string
+	Percent int
+}
+
 // Cfg holds all runtime configuration loaded from environment variables.
 type Cfg struct {
 	// Wallets holds one or more signing credentials.
@@ -24,33 +42,283 @@ type Cfg struct {
 	// Falls back to GONKA_ENDPOINT for backward compat.
 	SourceURL string // e.g. http://node2.gonka.ai:8000
 
+	// DisableWhitelist keeps all active participants instead of only the
+	// Transfer Agent whitelist (GONKA_DISABLE_WHITELIST=true; testnets only).
+	DisableWhitelist bool
+
+	// NetworkWhitelist selects transfer agents by the participant list's
+	// supports_transfer_agent flag where present, else by the whitelist
+	// (GONKA_NETWORK_WHITELIST=false).
+	NetworkWhitelist bool
+
+	// EndpointBlocklist drops these transfer-agent addresses at discovery even
+	// when whitelisted. GONKA_ENDPOINT_BLOCKLIST=gonka1...,gonka1...
+	EndpointBlocklist []string
+
+	// Endpoints, when set, replace discovery: only these nodes are used and
+	// the participant list is never fetched.
+	// GONKA_ENDPOINTS=http://node:8000/v1|gonka1...,...
+	Endpoints []EndpointCfg
+
+	// EndpointProbe pings each discovered endpoint at startup: off, warn
+	// (log when none answer) or require (exit when none answer)
+	// (ENDPOINT_PROBE=off). Unreachable endpoints are tried last.
+	EndpointProbe        string
+	EndpointProbeTimeout time.Duration // ENDPOINT_PROBE_TIMEOUT=5s
+
 	// Features
 	SimulateToolCalls bool // rewrite tool-call requests into plain prompts + parse JSON back
 	NativeToolCalls   bool // forward tool_calls natively; normalizes array content for Gonka nodes
+	RouteBySeed       bool // ROUTE_BY_SEED=true pins requests carrying a seed to a seed-derived endpoint
+	StreamErrorsAsSSE bool // STREAM_ERROR_FORMAT=sse reports exhausted stream retries as an SSE error event
+	StreamBufferBytes int  // STREAM_BUFFER_BYTES=4096 read buffer for relaying streamed responses
+	StreamNormalize   bool // STREAM_NORMALIZE_SSE=true re-frames newline-delimited JSON streams as SSE
+
+	// ToolSimSystemPrompt is how simulated tool instructions join existing
+	// system messages: merge, append, or prepend (TOOLSIM_SYSTEM_PROMPT=merge).
+	ToolSimSystemPrompt string
+	// ToolSimContent is how array (multimodal) message content is forwarded
+	// in simulated tool requests: preserve or text (TOOLSIM_CONTENT=preserve).
+	ToolSimContent string
+	// ToolSimDuplicateTools is what happens when tools in one request share
+	// a function name: warn, first, or reject (TOOLSIM_DUPLICATE_TOOLS=warn).
+	ToolSimDuplicateTools string
+	// ToolSimResponseText is what happens to prose the model wrote around
+	// simulated tool calls: drop, or field to keep it in "_gonka_content"
+	// (TOOLSIM_RESPONSE_TEXT=drop).
+	ToolSimResponseText string
+	// ToolSimEmptyContent sends "" instead of null as the content of
+	// messages with simulated tool calls (TOOLSIM_CONTENT_EMPTY_STRING=false).
+	ToolSimEmptyContent bool
+
+	// RequestValidation is how strictly chat requests are checked before
+	// forwarding: off, basic, or strict (REQUEST_VALIDATION=basic).
+	RequestValidation string
+
+	// MaxPromptTokens rejects requests whose estimated prompt is larger
+	// (MAX_PROMPT_TOKENS=0; 0 disables the check).
+	MaxPromptTokens int
+
+	// MaxTokensCeiling caps max_tokens in chat requests
+	// (MAX_TOKENS_CEILING=0; 0 disables the cap).
+	MaxTokensCeiling int
+
+	// MaxRequestTimeout caps the per-request X-Request-Timeout header
+	// (REQUEST_TIMEOUT_MAX=5m; 0 ignores the header).
+	MaxRequestTimeout time.Duration
+
+	// RetryBudget bounds the upstream attempts of one chat request across all
+	// retries (REQUEST_RETRY_BUDGET=0; 0 means no limit beyond 3 per call),
+	// and RetryBudgetTime the time after which no new attempt starts
+	// (REQUEST_RETRY_BUDGET_TIME=0; 0 means no limit).
+	RetryBudget     int
+	RetryBudgetTime time.Duration
+
+	// UsageLog emits a "request completed" log line per chat request with the
+	// serving endpoint, signing wallet, token usage and latency (USAGE_LOG=true).
+	UsageLog bool
+
+	// ForwardHeaders lists upstream response headers passed to clients;
+	// a trailing * matches a prefix. UPSTREAM_RESPONSE_HEADERS=X-Gonka-*,...
+	ForwardHeaders []string
+
+	// ModelAliases maps client-facing model names to upstream models.
+	// MODEL_ALIASES=gpt-4o=Qwen/Qwen3-235B-A22B-Instruct-2507-FP8,...
+	ModelAliases map[string]string
+
+	// DropRequestFields are removed from request bodies before forwarding.
+	// DROP_REQUEST_FIELDS=parallel_tool_calls,logit_bias
+	DropRequestFields []string
+
+	// AllowModelOverride honours X-Model-Override from callers whose bearer
+	// token is AdminToken (ALLOW_MODEL_OVERRIDE=false).
+	AllowModelOverride bool
+	// ModelSplits sends a share of a model's traffic to another model for A/B
+	// tests. MODEL_SPLIT=model=target:percent,...
+	ModelSplits map[string]ModelSplitCfg
+
+	// UpstreamModelsPath is the node path listing models, relative to /v1
+	// (UPSTREAM_MODELS_PATH=/models).
+	UpstreamModelsPath string
+
+	// UpstreamUserAgent overrides the User-Agent sent to nodes
+	// (UPSTREAM_USER_AGENT; empty means opengnk/<version>).
+	UpstreamUserAgent string
+	// InstanceID is sent as X-Opengnk-Instance on upstream requests
+	// (INSTANCE_ID; empty omits the header).
+	InstanceID string
+
+	// FallbackURL is an OpenAI-compatible API used, with FallbackAPIKey as a
+	// bearer token, when every Gonka endpoint fails a request
+	// (FALLBACK_UPSTREAM_URL; empty disables it).
+	FallbackURL    string
+	FallbackAPIKey string // FALLBACK_API_KEY=
+
+	// UpstreamVerifySignedBody logs an error when the body sent upstream
+	// differs from the payload that was signed (UPSTREAM_VERIFY_SIGNED_BODY=false).
+	UpstreamVerifySignedBody bool
+
+	// Hedging of slow non-streaming requests (see upstream.Options.HedgeDelay).
+	HedgeDelay time.Duration // GONKA_HEDGE_DELAY=0 (0 disables)
+	HedgeMax   int           // GONKA_HEDGE_MAX=8 (hedged requests in flight at once; 0 = no cap)
+
+	// AdminToken enables POST /admin/reload for callers sending it as a bearer
+	// token (ADMIN_TOKEN; unset disables the admin endpoints).
+	AdminToken string
+	// DryRun enables POST /admin/dry-run, which answers with the rewritten
+	// body and signed headers of a chat request instead of forwarding it
+	// (DRY_RUN=false; requires AdminToken).
+	DryRun bool
+
+	// SignerSigFormat is the signature encoding, "raw" (r||s, as the Python
+	// SDK) or "der" (ASN.1) (SIGNER_SIG_FORMAT=raw).
+	SignerSigFormat string
+
+	// RejectDuplicateWallets fails startup when two wallets share an address
+	// instead of warning (WALLET_REJECT_DUPLICATES=false).
+	RejectDuplicateWallets bool
+
+	// Local quota per wallet (requester address), see
+	// wallet.Options.RequestsPerMinute.
+	WalletRateLimitPerMinute int // WALLET_RATE_LIMIT_PER_MINUTE=0 (0 disables)
+	WalletRateLimitBurst     int // WALLET_RATE_LIMIT_BURST=0 (0 = same as the per-minute rate)
+
+	// WalletAffinity signs each client's requests with one wallet chosen by
+	// hashing its user / API key, instead of round-robin (WALLET_AFFINITY=true).
+	WalletAffinity bool
+
+	// ModelWallets pins models to the wallet that signs their requests; other
+	// models use round-robin. MODEL_WALLET_MAP=big-model=gonka1...,...
+	ModelWallets map[string]string
 
 	// Sanitization middleware
-	SanitizeEnabled bool // SANITIZE=true enables request/response redaction
+	SanitizeEnabled       bool // SANITIZE=true enables request/response redaction
+	SanitizeMinSpanLen    int  // SANITIZE_MIN_SPAN_LEN=2 (spans shorter than this many runes are ignored)
+	SanitizeMaxRedactions int  // SANITIZE_MAX_REDACTIONS=1000 (distinct values per request; 0 = no cap)
+	SanitizeBodyReport    bool // SANITIZE_BODY_REPORT=true adds "_gonka_sanitize" to non-streaming JSON responses
+	SanitizeFailClosed    bool // SANITIZE_FAIL_CLOSED=true rejects requests with 503 when a classifier fails
+	// SanitizeRequired lists the classifier layers (ner, webhook, llm) that
+	// must succeed for a redaction to count as complete; failures of the
+	// others only mark it degraded. Empty means all of them.
+	// SANITIZE_REQUIRED_CLASSIFIERS=ner
+	SanitizeRequired     []string
+	SanitizeCrossMessage bool // SANITIZE_CROSS_MESSAGE=true classifies all messages together with every layer
+	SanitizeTypedTokens  bool // SANITIZE_TYPED_TOKENS=true names placeholders after their label («PER_1»)
+	SanitizeTokenNonce   bool // SANITIZE_TOKEN_NONCE=true puts a random per-request nonce in every placeholder
+	SanitizeNormalize    bool // SANITIZE_NORMALIZE=true classifies an NFKC copy of the text without zero-width characters
+	SanitizeJSONContent  bool // SANITIZE_JSON_CONTENT=true classifies JSON message contents by their leaf values
+	// SanitizeCodeBlocks is what is redacted inside fenced code blocks:
+	// everything (""), nothing ("skip"), or only credentials ("credentials")
+	// (SANITIZE_SKIP_CODE_BLOCKS=false|true|credentials).
+	SanitizeCodeBlocks string
+	// SanitizeProgress is how long sanitization of a streamed request may run
+	// before the response starts with progress comments, repeated at the same
+	// interval (SANITIZE_PROGRESS_INTERVAL=0 disables).
+	SanitizeProgress time.Duration
+
+	// SanitizeSampleRate is the fraction of classified texts whose classifier
+	// outputs (hashed input, span labels and offsets; never the text) are
+	// appended to SanitizeSampleFile (SANITIZE_SAMPLE_RATE=0 disables).
+	SanitizeSampleRate float64
+	SanitizeSampleFile string // SANITIZE_SAMPLE_FILE=sanitize-samples.jsonl
+
+	// Audit trail of redactions, originals included: a JSON-lines file or a
+	// webhook (at most one). Both empty disables auditing.
+	SanitizeAuditFile         string // SANITIZE_AUDIT_FILE=
+	SanitizeAuditWebhook      string // SANITIZE_AUDIT_WEBHOOK=
+	SanitizeAuditWebhookToken string // SANITIZE_AUDIT_WEBHOOK_TOKEN= (sent as a bearer token)
+
+	// SanitizeModels limits sanitization by model: plain names are an
+	// allowlist, "!name" excludes a model. SANITIZE_MODELS=public-a,!internal-b
+	SanitizeModels []string
 
 	// NER sidecar layer
 	SanitizeNER    bool   // SANITIZE_NER=true enables NER sidecar
 	SanitizeNERURL string // SANITIZE_NER_URL=http://sanitize-ner:8001
+	// SanitizeNERProto is how the sidecar is called: http (JSON) or grpc
+	// (classifier.proto; SANITIZE_NER_URL is then host:port).
+	SanitizeNERProto string // SANITIZE_NER_PROTO=http
+
+	// Custom webhook classifier layer, speaking the NER sidecar's HTTP API
+	SanitizeWebhookURL     string        // SANITIZE_WEBHOOK_URL= (empty disables it)
+	SanitizeWebhookToken   string        // SANITIZE_WEBHOOK_TOKEN= (sent as a bearer token)
+	SanitizeWebhookTimeout time.Duration // SANITIZE_WEBHOOK_TIMEOUT=10s
 
 	// LLM semantic classifier layer
 	SanitizeLLM          bool    // SANITIZE_LLM=true enables LLM classifier
 	SanitizeLLMURL       string  // SANITIZE_LLM_URL=http://ollama:11434
 	SanitizeLLMModel     string  // SANITIZE_LLM_MODEL=qwen3:4b-instruct-2507-q4_K_M
 	SanitizeLLMThreshold float32 // SANITIZE_LLM_THRESHOLD=0 (0 = accept all)
+	SanitizeLLMWarmup    bool    // SANITIZE_LLM_WARMUP=true loads the model in the background at startup
+	// SanitizeLLMReasoningFallback parses the answer out of the reasoning
+	// field when a reasoning model returns empty content.
+	SanitizeLLMReasoningFallback bool // SANITIZE_LLM_REASONING_FALLBACK=true
+	SanitizeLLMMaxTokens         int  // SANITIZE_LLM_MAX_TOKENS=10000
+	SanitizeLLMRetryMaxTokens    int  // SANITIZE_LLM_RETRY_MAX_TOKENS=20000 (one retry after truncation; 0 disables)
+	SanitizeLLMWindow            int  // SANITIZE_LLM_WINDOW=8000 bytes per classified window (0 = whole text)
+	// SanitizeLLMViaGonka, when set, is a Gonka model the LLM classifier
+	// runs on through the proxy's own upstream client instead of
+	// SANITIZE_LLM_URL.
+	SanitizeLLMViaGonka string // SANITIZE_LLM_VIA_GONKA=
+	// SanitizeLLMPrescreen skips the LLM classifier for texts a cheap
+	// pattern check finds nothing in: "" (off), "conservative" or
+	// "aggressive" (SANITIZE_LLM_PRESCREEN=off).
+	SanitizeLLMPrescreen string
+
+	// LLM circuit breaker: after this many consecutive failures the LLM layer
+	// is skipped (NER only) for the cooldown. 0 disables the breaker.
+	SanitizeLLMBreakerFailures int           // SANITIZE_LLM_BREAKER_FAILURES=3
+	SanitizeLLMBreakerCooldown time.Duration // SANITIZE_LLM_BREAKER_COOLDOWN=1m
+
+	// SanitizeShadowModel, when set, runs this LLM classifier model in
+	// shadow mode next to the active classifiers and reports how its findings
+	// differ, without applying them (SANITIZE_SHADOW_LLM_MODEL=).
+	SanitizeShadowModel       string
+	SanitizeShadowURL         string // SANITIZE_SHADOW_LLM_URL= (empty = SANITIZE_LLM_URL)
+	SanitizeShadowConcurrency int    // SANITIZE_SHADOW_CONCURRENCY=2 shadow calls in flight at most
+
+	// Per-client rate limiting for chat completions (see
+	// api.Options.RateLimiter), and per end user within a client (see
+	// api.Options.UserRateLimiter)
+	RateLimitPerMinute     int // RATE_LIMIT_PER_MINUTE=0 (0 disables)
+	RateLimitBurst         int // RATE_LIMIT_BURST=0 (0 = same as the per-minute rate)
+	RateLimitUserPerMinute int // RATE_LIMIT_USER_PER_MINUTE=0 (0 disables)
+	RateLimitUserBurst     int // RATE_LIMIT_USER_BURST=0 (0 = same as the per-minute rate)
+
+	// Concurrency limit for chat completions across all clients (see
+	// api.Options.Gate). Requests over it wait up to QueueMaxWait for a slot.
+	MaxConcurrentRequests int           // MAX_CONCURRENT_REQUESTS=0 (0 disables)
+	QueueMaxWait          time.Duration // QUEUE_MAX_WAIT=0 (0 rejects at once with 503)
+
+	// Idempotency-Key response cache (non-streaming requests only)
+	Idempotency           bool          // IDEMPOTENCY=true enables the cache
+	IdempotencyTTL        time.Duration // IDEMPOTENCY_TTL=10m
+	IdempotencyMaxEntries int           // IDEMPOTENCY_MAX_ENTRIES=1000
 
 	// Server
-	ListenAddr string // e.g. :8080
+	ListenAddr          string // e.g. :8080
+	ResponseCompression bool   // RESPONSE_COMPRESSION=true gzips JSON responses for clients that accept it
+	ReadinessGate       bool   // READINESS_GATE=true answers 503 until models are loaded
 }
 
+// processEnv holds the names of the variables set in the process
+// environment before .env was loaded, which win over the file; see
+// ReloadWallets. nil until Load runs.
+var processEnv map[string]bool
+
 // Load reads .env (if present) then environment variables and returns Cfg.
 func Load() (*Cfg, error) {
+	if processEnv == nil {
+		processEnv = make(map[string]bool)
+		for _, kv := range os.Environ() {
+			name, _, _ := strings.Cut(kv, "=")
+			processEnv[name] = true
+		}
+	}
 	// Best-effort: load .env from current directory
 	_ = godotenv.Load()
 
-	wallets, err := loadWallets()
+	wallets, err := loadWallets(os.Getenv)
 	if err != nil {
 		return nil, err
 	}
@@ -67,12 +335,171 @@ func Load() (*Cfg, error) {
 	sourceURL = strings.TrimRight(sourceURL, "/")
 	sourceURL = strings.TrimSuffix(sourceURL, "/v1")
 
+	wlRaw := strings.TrimSpace(os.Getenv("GONKA_DISABLE_WHITELIST"))
+	disableWhitelist := wlRaw == "1" || strings.EqualFold(wlRaw, "true")
+	netWLRaw := strings.TrimSpace(os.Getenv("GONKA_NETWORK_WHITELIST"))
+	networkWhitelist := netWLRaw == "1" || strings.EqualFold(netWLRaw, "true")
+
+	endpointBlocklist := parseList(os.Getenv("GONKA_ENDPOINT_BLOCKLIST"))
+
+	endpoints, err := parseEndpoints(os.Getenv("GONKA_ENDPOINTS"))
+	if err != nil {
+		return nil, err
+	}
+
+	forwardHeaders := parseList(os.Getenv("UPSTREAM_RESPONSE_HEADERS"))
+
+	signerSigFormat := strings.ToLower(strings.TrimSpace(os.Getenv("SIGNER_SIG_FORMAT")))
+	switch signerSigFormat {
+	case "":
+		signerSigFormat = "raw"
+	case "raw", "der":
+	default:
+		return nil, fmt.Errorf("SIGNER_SIG_FORMAT must be raw or der, got %q", signerSigFormat)
+	}
+
+	rejectDupRaw := strings.TrimSpace(os.Getenv("WALLET_REJECT_DUPLICATES"))
+	rejectDuplicateWallets := rejectDupRaw == "1" || strings.EqualFold(rejectDupRaw, "true")
+
+	affinityRaw := strings.TrimSpace(os.Getenv("WALLET_AFFINITY"))
+	walletAffinity := affinityRaw == "1" || strings.EqualFold(affinityRaw, "true")
+
+	usageRaw := strings.TrimSpace(os.Getenv("USAGE_LOG"))
+	usageLog := usageRaw == "1" || strings.EqualFold(usageRaw, "true")
+
 	simTools := strings.TrimSpace(os.Getenv("SIMULATE_TOOL_CALLS"))
 	simulateToolCalls := simTools == "1" || strings.EqualFold(simTools, "true")
 
 	nativeTools := strings.TrimSpace(os.Getenv("NATIVE_TOOL_CALLS"))
 	nativeToolCalls := nativeTools == "1" || strings.EqualFold(nativeTools, "true")
 
+	seedRaw := strings.TrimSpace(os.Getenv("ROUTE_BY_SEED"))
+	routeBySeed := seedRaw == "1" || strings.EqualFold(seedRaw, "true")
+
+	compressRaw := strings.TrimSpace(os.Getenv("RESPONSE_COMPRESSION"))
+	responseCompression := compressRaw == "1" || strings.EqualFold(compressRaw, "true")
+
+	gateRaw := strings.TrimSpace(os.Getenv("READINESS_GATE"))
+	readinessGate := gateRaw == "1" || strings.EqualFold(gateRaw, "true")
+
+	var streamErrorsAsSSE bool
+	switch f := strings.ToLower(strings.TrimSpace(os.Getenv("STREAM_ERROR_FORMAT"))); f {
+	case "", "json":
+	case "sse":
+		streamErrorsAsSSE = true
+	default:
+		return nil, fmt.Errorf("STREAM_ERROR_FORMAT must be json or sse, got %q", f)
+	}
+
+	toolSimSystemPrompt := strings.ToLower(strings.TrimSpace(os.Getenv("TOOLSIM_SYSTEM_PROMPT")))
+	switch toolSimSystemPrompt {
+	case "":
+		toolSimSystemPrompt = "merge"
+	case "merge", "append", "prepend":
+	default:
+		return nil, fmt.Errorf("TOOLSIM_SYSTEM_PROMPT must be merge, append or prepend, got %q", toolSimSystemPrompt)
+	}
+	toolSimContent := strings.ToLower(strings.TrimSpace(os.Getenv("TOOLSIM_CONTENT")))
+	switch toolSimContent {
+	case "":
+		toolSimContent = "preserve"
+	case "preserve", "text":
+	default:
+		return nil, fmt.Errorf("TOOLSIM_CONTENT must be preserve or text, got %q", toolSimContent)
+	}
+
+	toolSimDuplicateTools := strings.ToLower(strings.TrimSpace(os.Getenv("TOOLSIM_DUPLICATE_TOOLS")))
+	switch toolSimDuplicateTools {
+	case "":
+		toolSimDuplicateTools = "warn"
+	case "warn", "first", "reject":
+	default:
+		return nil, fmt.Errorf("TOOLSIM_DUPLICATE_TOOLS must be warn, first or reject, got %q", toolSimDuplicateTools)
+	}
+
+	toolSimResponseText := strings.ToLower(strings.TrimSpace(os.Getenv("TOOLSIM_RESPONSE_TEXT")))
+	switch toolSimResponseText {
+	case "":
+		toolSimResponseText = "drop"
+	case "drop", "field":
+	default:
+		return nil, fmt.Errorf("TOOLSIM_RESPONSE_TEXT must be drop or field, got %q", toolSimResponseText)
+	}
+
+	emptyContentRaw := strings.TrimSpace(os.Getenv("TOOLSIM_CONTENT_EMPTY_STRING"))
+	toolSimEmptyContent := emptyContentRaw == "1" || strings.EqualFold(emptyContentRaw, "true")
+
+	requestValidation := strings.ToLower(strings.TrimSpace(os.Getenv("REQUEST_VALIDATION")))
+	switch requestValidation {
+	case "":
+		requestValidation = "basic"
+	case "off", "basic", "strict":
+	default:
+		return nil, fmt.Errorf("REQUEST_VALIDATION must be off, basic or strict, got %q", requestValidation)
+	}
+
+	endpointProbe := strings.ToLower(strings.TrimSpace(os.Getenv("ENDPOINT_PROBE")))
+	switch endpointProbe {
+	case "":
+		endpointProbe = "off"
+	case "off", "warn", "require":
+	default:
+		return nil, fmt.Errorf("ENDPOINT_PROBE must be off, warn or require, got %q", endpointProbe)
+	}
+	endpointProbeTimeout, err := envDuration("ENDPOINT_PROBE_TIMEOUT", 5*time.Second)
+	if err != nil {
+		return nil, err
+	}
+
+	modelAliases, err := parseModelAliases(strings.TrimSpace(os.Getenv("MODEL_ALIASES")))
+	if err != nil {
+		return nil, err
+	}
+	modelWallets, err := parseModelWalletMap(strings.TrimSpace(os.Getenv("MODEL_WALLET_MAP")))
+	if err != nil {
+		return nil, err
+	}
+	modelSplits, err := parseModelSplits(strings.TrimSpace(os.Getenv("MODEL_SPLIT")))
+	if err != nil {
+		return nil, err
+	}
+
+	upstreamModelsPath := strings.TrimSpace(os.Getenv("UPSTREAM_MODELS_PATH"))
+	if upstreamModelsPath == "" {
+		upstreamModelsPath = "/models"
+	} else if !strings.HasPrefix(upstreamModelsPath, "/") {
+		upstreamModelsPath = "/" + upstreamModelsPath
+	}
+
+	verifySignedRaw := strings.TrimSpace(os.Getenv("UPSTREAM_VERIFY_SIGNED_BODY"))
+	upstreamVerifySignedBody := verifySignedRaw == "1" || strings.EqualFold(verifySignedRaw, "true")
+
+	hedgeDelay, err := envDuration("GONKA_HEDGE_DELAY", 0)
+	if err != nil {
+		return nil, err
+	}
+	hedgeMax, err := envInt("GONKA_HEDGE_MAX", 8)
+	if err != nil {
+		return nil, err
+	}
+
+	fallbackURL := strings.TrimRight(strings.TrimSpace(os.Getenv("FALLBACK_UPSTREAM_URL")), "/")
+	if fallbackURL != "" && !strings.HasPrefix(fallbackURL, "http://") && !strings.HasPrefix(fallbackURL, "https://") {
+		return nil, fmt.Errorf("FALLBACK_UPSTREAM_URL must be an http:// or https:// URL, got %q", fallbackURL)
+	}
+
+	adminToken := strings.TrimSpace(os.Getenv("ADMIN_TOKEN"))
+	overrideRaw := strings.TrimSpace(os.Getenv("ALLOW_MODEL_OVERRIDE"))
+	allowModelOverride := overrideRaw == "1" || strings.EqualFold(overrideRaw, "true")
+	if allowModelOverride && adminToken == "" {
+		return nil, fmt.Errorf("ALLOW_MODEL_OVERRIDE requires ADMIN_TOKEN, which callers must present to override the model")
+	}
+	dryRunRaw := strings.TrimSpace(os.Getenv("DRY_RUN"))
+	dryRun := dryRunRaw == "1" || strings.EqualFold(dryRunRaw, "true")
+	if dryRun && adminToken == "" {
+		return nil, fmt.Errorf("DRY_RUN requires ADMIN_TOKEN, which callers must present to use /admin/dry-run")
+	}
+
 	port := strings.TrimSpace(os.Getenv("PORT"))
 	if port == "" {
 		port = "8080"
@@ -81,12 +508,84 @@ func Load() (*Cfg, error) {
 	sanitizeRaw := strings.TrimSpace(os.Getenv("SANITIZE"))
 	sanitizeEnabled := sanitizeRaw == "1" || strings.EqualFold(sanitizeRaw, "true")
 
+	sanitizeMinSpanLen, err := envInt("SANITIZE_MIN_SPAN_LEN", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	sanitizeMaxRedactions, err := envInt("SANITIZE_MAX_REDACTIONS", 1000)
+	if err != nil {
+		return nil, err
+	}
+	failClosedRaw := strings.TrimSpace(os.Getenv("SANITIZE_FAIL_CLOSED"))
+	sanitizeFailClosed := failClosedRaw == "1" || strings.EqualFold(failClosedRaw, "true")
+	crossMessageRaw := strings.TrimSpace(os.Getenv("SANITIZE_CROSS_MESSAGE"))
+	sanitizeCrossMessage := crossMessageRaw == "1" || strings.EqualFold(crossMessageRaw, "true")
+	typedTokensRaw := strings.TrimSpace(os.Getenv("SANITIZE_TYPED_TOKENS"))
+	sanitizeTypedTokens := typedTokensRaw == "1" || strings.EqualFold(typedTokensRaw, "true")
+
+	jsonContentRaw := strings.TrimSpace(os.Getenv("SANITIZE_JSON_CONTENT"))
+	sanitizeJSONContent := jsonContentRaw == "1" || strings.EqualFold(jsonContentRaw, "true")
+
+	tokenNonceRaw := strings.TrimSpace(os.Getenv("SANITIZE_TOKEN_NONCE"))
+	sanitizeTokenNonce := tokenNonceRaw == "1" || strings.EqualFold(tokenNonceRaw, "true")
+	normalizeRaw := strings.TrimSpace(os.Getenv("SANITIZE_NORMALIZE"))
+	sanitizeNormalize := normalizeRaw == "1" || strings.EqualFold(normalizeRaw, "true")
+	var sanitizeCodeBlocks string
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("SANITIZE_SKIP_CODE_BLOCKS"))); raw {
+	case "", "0", "false":
+	case "1", "true":
+		sanitizeCodeBlocks = "skip"
+	case "credentials":
+		sanitizeCodeBlocks = "credentials"
+	default:
+		return nil, fmt.Errorf("SANITIZE_SKIP_CODE_BLOCKS must be true, false or credentials, got %q", raw)
+	}
+
+	var sanitizeSampleRate float64
+	if raw := strings.TrimSpace(os.Getenv("SANITIZE_SAMPLE_RATE")); raw != "" {
+		sanitizeSampleRate, err = strconv.ParseFloat(raw, 64)
+		if err != nil || sanitizeSampleRate < 0 || sanitizeSampleRate > 1 {
+			return nil, fmt.Errorf("SANITIZE_SAMPLE_RATE must be a number between 0 and 1, got %q", raw)
+		}
+	}
+	sanitizeAuditFile := strings.TrimSpace(os.Getenv("SANITIZE_AUDIT_FILE"))
+	sanitizeAuditWebhook := strings.TrimSpace(os.Getenv("SANITIZE_AUDIT_WEBHOOK"))
+	if sanitizeAuditFile != "" && sanitizeAuditWebhook != "" {
+		return nil, fmt.Errorf("set only one of SANITIZE_AUDIT_FILE and SANITIZE_AUDIT_WEBHOOK")
+	}
+	sanitizeSampleFile := strings.TrimSpace(os.Getenv("SANITIZE_SAMPLE_FILE"))
+	if sanitizeSampleFile == "" {
+		sanitizeSampleFile = "sanitize-samples.jsonl"
+	}
+
+	sanitizeModels := parseList(os.Getenv("SANITIZE_MODELS"))
+
+	bodyReportRaw := strings.TrimSpace(os.Getenv("SANITIZE_BODY_REPORT"))
+	sanitizeBodyReport := bodyReportRaw == "1" || strings.EqualFold(bodyReportRaw, "true")
+
 	nerRaw := strings.TrimSpace(os.Getenv("SANITIZE_NER"))
 	sanitizeNER := nerRaw == "1" || strings.EqualFold(nerRaw, "true")
 	sanitizeNERURL := strings.TrimSpace(os.Getenv("SANITIZE_NER_URL"))
 	if sanitizeNERURL == "" {
 		sanitizeNERURL = "http://sanitize-ner:8001"
 	}
+	sanitizeNERProto := strings.ToLower(strings.TrimSpace(os.Getenv("SANITIZE_NER_PROTO")))
+	switch sanitizeNERProto {
+	case "":
+		sanitizeNERProto = "http"
+	case "http", "grpc":
+	default:
+		return nil, fmt.Errorf("SANITIZE_NER_PROTO must be http or grpc, got %q", sanitizeNERProto)
+	}
+	sanitizeWebhookTimeout, err := envDuration("SANITIZE_WEBHOOK_TIMEOUT", 10*time.Second)
+	if err != nil {
+		return nil, err
+	}
+	sanitizeProgress, err := envDuration("SANITIZE_PROGRESS_INTERVAL", 0)
+	if err != nil {
+		return nil, err
+	}
 
 	llmRaw := strings.TrimSpace(os.Getenv("SANITIZE_LLM"))
 	sanitizeLLM := llmRaw == "1" || strings.EqualFold(llmRaw, "true")
@@ -106,19 +605,259 @@ func Load() (*Cfg, error) {
 		}
 	}
 
+	// Layers SANITIZE_REQUIRED_CLASSIFIERS may name, and whether each is on.
+	sanitizeLayers := map[string]bool{
+		"ner":     sanitizeNER,
+		"webhook": strings.TrimSpace(os.Getenv("SANITIZE_WEBHOOK_URL")) != "",
+		"llm":     sanitizeLLM,
+	}
+	var sanitizeRequired []string
+	for _, layer := range parseList(os.Getenv("SANITIZE_REQUIRED_CLASSIFIERS")) {
+		layer = strings.ToLower(layer)
+		on, known := sanitizeLayers[layer]
+		if !known {
+			return nil, fmt.Errorf("SANITIZE_REQUIRED_CLASSIFIERS entries must be ner, webhook or llm, got %q", layer)
+		}
+		if !on {
+			return nil, fmt.Errorf("SANITIZE_REQUIRED_CLASSIFIERS lists %s, which is not enabled", layer)
+		}
+		sanitizeRequired = append(sanitizeRequired, layer)
+	}
+
+	var sanitizeLLMPrescreen string
+	switch raw := strings.ToLower(strings.TrimSpace(os.Getenv("SANITIZE_LLM_PRESCREEN"))); raw {
+	case "", "off":
+	case "conservative", "aggressive":
+		sanitizeLLMPrescreen = raw
+	default:
+		return nil, fmt.Errorf("SANITIZE_LLM_PRESCREEN must be off, conservative or aggressive, got %q", raw)
+	}
+	warmupRaw := strings.TrimSpace(os.Getenv("SANITIZE_LLM_WARMUP"))
+	sanitizeLLMWarmup := warmupRaw == "1" || strings.EqualFold(warmupRaw, "true")
+	sanitizeLLMReasoningFallback := true
+	if raw := strings.TrimSpace(os.Getenv("SANITIZE_LLM_REASONING_FALLBACK")); raw != "" {
+		sanitizeLLMReasoningFallback = raw == "1" || strings.EqualFold(raw, "true")
+	}
+
+	streamBufferBytes, err := envInt("STREAM_BUFFER_BYTES", 4096)
+	if err != nil {
+		return nil, err
+	}
+	streamNormalizeRaw := strings.TrimSpace(os.Getenv("STREAM_NORMALIZE_SSE"))
+	streamNormalize := streamNormalizeRaw == "1" || strings.EqualFold(streamNormalizeRaw, "true")
+
+	maxPromptTokens, err := envInt("MAX_PROMPT_TOKENS", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxTokensCeiling, err := envInt("MAX_TOKENS_CEILING", 0)
+	if err != nil {
+		return nil, err
+	}
+	maxRequestTimeout, err := envDuration("REQUEST_TIMEOUT_MAX", 5*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	retryBudget, err := envInt("REQUEST_RETRY_BUDGET", 0)
+	if err != nil {
+		return nil, err
+	}
+	retryBudgetTime, err := envDuration("REQUEST_RETRY_BUDGET_TIME", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	sanitizeLLMMaxTokens, err := envInt("SANITIZE_LLM_MAX_TOKENS", 10000)
+	if err != nil {
+		return nil, err
+	}
+	if sanitizeLLMMaxTokens == 0 {
+		return nil, fmt.Errorf("SANITIZE_LLM_MAX_TOKENS must be positive")
+	}
+	sanitizeLLMRetryMaxTokens, err := envInt("SANITIZE_LLM_RETRY_MAX_TOKENS", 20000)
+	if err != nil {
+		return nil, err
+	}
+	sanitizeLLMWindow, err := envInt("SANITIZE_LLM_WINDOW", 8000)
+	if err != nil {
+		return nil, err
+	}
+	if sanitizeLLMWindow != 0 && sanitizeLLMWindow < 64 {
+		return nil, fmt.Errorf("SANITIZE_LLM_WINDOW must be 0 or at least 64 bytes, got %d", sanitizeLLMWindow)
+	}
+
+	sanitizeLLMBreakerFailures, err := envInt("SANITIZE_LLM_BREAKER_FAILURES", 3)
+	if err != nil {
+		return nil, err
+	}
+	sanitizeLLMBreakerCooldown, err := envDuration("SANITIZE_LLM_BREAKER_COOLDOWN", time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	sanitizeShadowURL := strings.TrimSpace(os.Getenv("SANITIZE_SHADOW_LLM_URL"))
+	if sanitizeShadowURL == "" {
+		sanitizeShadowURL = sanitizeLLMURL
+	}
+	sanitizeShadowConcurrency, err := envInt("SANITIZE_SHADOW_CONCURRENCY", 2)
+	if err != nil {
+		return nil, err
+	}
+
+	rateLimitPerMinute, err := envInt("RATE_LIMIT_PER_MINUTE", 0)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitBurst, err := envInt("RATE_LIMIT_BURST", 0)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitBurst == 0 {
+		rateLimitBurst = rateLimitPerMinute
+	}
+	rateLimitUserPerMinute, err := envInt("RATE_LIMIT_USER_PER_MINUTE", 0)
+	if err != nil {
+		return nil, err
+	}
+	rateLimitUserBurst, err := envInt("RATE_LIMIT_USER_BURST", 0)
+	if err != nil {
+		return nil, err
+	}
+	if rateLimitUserBurst == 0 {
+		rateLimitUserBurst = rateLimitUserPerMinute
+	}
+	walletRateLimitPerMinute, err := envInt("WALLET_RATE_LIMIT_PER_MINUTE", 0)
+	if err != nil {
+		return nil, err
+	}
+	walletRateLimitBurst, err := envInt("WALLET_RATE_LIMIT_BURST", 0)
+	if err != nil {
+		return nil, err
+	}
+	if walletRateLimitBurst == 0 {
+		walletRateLimitBurst = walletRateLimitPerMinute
+	}
+
+	maxConcurrentRequests, err := envInt("MAX_CONCURRENT_REQUESTS", 0)
+	if err != nil {
+		return nil, err
+	}
+	queueMaxWait, err := envDuration("QUEUE_MAX_WAIT", 0)
+	if err != nil {
+		return nil, err
+	}
+
+	idemRaw := strings.TrimSpace(os.Getenv("IDEMPOTENCY"))
+	idempotency := idemRaw == "1" || strings.EqualFold(idemRaw, "true")
+	idempotencyTTL, err := envDuration("IDEMPOTENCY_TTL", 10*time.Minute)
+	if err != nil {
+		return nil, err
+	}
+	idempotencyMaxEntries, err := envInt("IDEMPOTENCY_MAX_ENTRIES", 1000)
+	if err != nil {
+		return nil, err
+	}
+
 	return &Cfg{
-		Wallets:              wallets,
-		SourceURL:            sourceURL,
-		SimulateToolCalls:    simulateToolCalls,
-		NativeToolCalls:      nativeToolCalls,
-		SanitizeEnabled:      sanitizeEnabled,
-		SanitizeNER:          sanitizeNER,
-		SanitizeNERURL:       sanitizeNERURL,
-		SanitizeLLM:          sanitizeLLM,
-		SanitizeLLMURL:       sanitizeLLMURL,
-		SanitizeLLMModel:     sanitizeLLMModel,
-		SanitizeLLMThreshold: sanitizeLLMThreshold,
-		ListenAddr:           ":" + port,
+		Wallets:                      wallets,
+		SourceURL:                    sourceURL,
+		DisableWhitelist:             disableWhitelist,
+		NetworkWhitelist:             networkWhitelist,
+		EndpointBlocklist:            endpointBlocklist,
+		Endpoints:                    endpoints,
+		EndpointProbe:                endpointProbe,
+		EndpointProbeTimeout:         endpointProbeTimeout,
+		SimulateToolCalls:            simulateToolCalls,
+		NativeToolCalls:              nativeToolCalls,
+		RouteBySeed:                  routeBySeed,
+		StreamErrorsAsSSE:            streamErrorsAsSSE,
+		StreamBufferBytes:            streamBufferBytes,
+		StreamNormalize:              streamNormalize,
+		ToolSimSystemPrompt:          toolSimSystemPrompt,
+		ToolSimContent:               toolSimContent,
+		ToolSimDuplicateTools:        toolSimDuplicateTools,
+		ToolSimResponseText:          toolSimResponseText,
+		ToolSimEmptyContent:          toolSimEmptyContent,
+		RequestValidation:            requestValidation,
+		MaxPromptTokens:              maxPromptTokens,
+		MaxTokensCeiling:             maxTokensCeiling,
+		MaxRequestTimeout:            maxRequestTimeout,
+		RetryBudget:                  retryBudget,
+		RetryBudgetTime:              retryBudgetTime,
+		ForwardHeaders:               forwardHeaders,
+		UsageLog:                     usageLog,
+		ModelAliases:                 modelAliases,
+		ModelWallets:                 modelWallets,
+		SignerSigFormat:              signerSigFormat,
+		RejectDuplicateWallets:       rejectDuplicateWallets,
+		AdminToken:                   adminToken,
+		DryRun:                       dryRun,
+		AllowModelOverride:           allowModelOverride,
+		ModelSplits:                  modelSplits,
+		DropRequestFields:            parseList(os.Getenv("DROP_REQUEST_FIELDS")),
+		UpstreamUserAgent:            strings.TrimSpace(os.Getenv("UPSTREAM_USER_AGENT")),
+		UpstreamModelsPath:           upstreamModelsPath,
+		InstanceID:                   strings.TrimSpace(os.Getenv("INSTANCE_ID")),
+		FallbackURL:                  fallbackURL,
+		UpstreamVerifySignedBody:     upstreamVerifySignedBody,
+		HedgeDelay:                   hedgeDelay,
+		HedgeMax:                     hedgeMax,
+		FallbackAPIKey:               strings.TrimSpace(os.Getenv("FALLBACK_API_KEY")),
+		WalletAffinity:               walletAffinity,
+		SanitizeEnabled:              sanitizeEnabled,
+		SanitizeMinSpanLen:           sanitizeMinSpanLen,
+		SanitizeMaxRedactions:        sanitizeMaxRedactions,
+		SanitizeSampleRate:           sanitizeSampleRate,
+		SanitizeSampleFile:           sanitizeSampleFile,
+		SanitizeAuditFile:            sanitizeAuditFile,
+		SanitizeAuditWebhook:         sanitizeAuditWebhook,
+		SanitizeAuditWebhookToken:    strings.TrimSpace(os.Getenv("SANITIZE_AUDIT_WEBHOOK_TOKEN")),
+		SanitizeBodyReport:           sanitizeBodyReport,
+		SanitizeFailClosed:           sanitizeFailClosed,
+		SanitizeRequired:             sanitizeRequired,
+		SanitizeCrossMessage:         sanitizeCrossMessage,
+		SanitizeTypedTokens:          sanitizeTypedTokens,
+		SanitizeTokenNonce:           sanitizeTokenNonce,
+		SanitizeNormalize:            sanitizeNormalize,
+		SanitizeJSONContent:          sanitizeJSONContent,
+		SanitizeCodeBlocks:           sanitizeCodeBlocks,
+		SanitizeProgress:             sanitizeProgress,
+		SanitizeModels:               sanitizeModels,
+		SanitizeNER:                  sanitizeNER,
+		SanitizeNERURL:               sanitizeNERURL,
+		SanitizeNERProto:             sanitizeNERProto,
+		SanitizeWebhookURL:           strings.TrimSpace(os.Getenv("SANITIZE_WEBHOOK_URL")),
+		SanitizeWebhookToken:         strings.TrimSpace(os.Getenv("SANITIZE_WEBHOOK_TOKEN")),
+		SanitizeWebhookTimeout:       sanitizeWebhookTimeout,
+		SanitizeLLM:                  sanitizeLLM,
+		SanitizeLLMURL:               sanitizeLLMURL,
+		SanitizeLLMModel:             sanitizeLLMModel,
+		SanitizeLLMThreshold:         sanitizeLLMThreshold,
+		SanitizeLLMWarmup:            sanitizeLLMWarmup,
+		SanitizeLLMReasoningFallback: sanitizeLLMReasoningFallback,
+		SanitizeLLMMaxTokens:         sanitizeLLMMaxTokens,
+		SanitizeLLMRetryMaxTokens:    sanitizeLLMRetryMaxTokens,
+		SanitizeLLMWindow:            sanitizeLLMWindow,
+		SanitizeLLMViaGonka:          strings.TrimSpace(os.Getenv("SANITIZE_LLM_VIA_GONKA")),
+		SanitizeLLMPrescreen:         sanitizeLLMPrescreen,
+		SanitizeLLMBreakerFailures:   sanitizeLLMBreakerFailures,
+		SanitizeLLMBreakerCooldown:   sanitizeLLMBreakerCooldown,
+		SanitizeShadowModel:          strings.TrimSpace(os.Getenv("SANITIZE_SHADOW_LLM_MODEL")),
+		SanitizeShadowURL:            sanitizeShadowURL,
+		SanitizeShadowConcurrency:    sanitizeShadowConcurrency,
+		RateLimitPerMinute:           rateLimitPerMinute,
+		RateLimitBurst:               rateLimitBurst,
+		RateLimitUserPerMinute:       rateLimitUserPerMinute,
+		RateLimitUserBurst:           rateLimitUserBurst,
+		WalletRateLimitPerMinute:     walletRateLimitPerMinute,
+		WalletRateLimitBurst:         walletRateLimitBurst,
+		MaxConcurrentRequests:        maxConcurrentRequests,
+		QueueMaxWait:                 queueMaxWait,
+		Idempotency:                  idempotency,
+		IdempotencyTTL:               idempotencyTTL,
+		IdempotencyMaxEntries:        idempotencyMaxEntries,
+		ListenAddr:                   ":" + port,
+		ResponseCompression:          responseCompression,
+		ReadinessGate:                readinessGate,
 	}, nil
 }
 
@@ -134,40 +873,82 @@ func Load() (*Cfg, error) {
 // Single-wallet fallback (backward compat):
 //
 //	GONKA_PRIVATE_KEY=... GONKA_ADDRESS=...
-func loadWallets() ([]WalletCfg, error) {
-	multi := strings.TrimSpace(os.Getenv("GONKA_WALLETS"))
+func loadWallets(getenv func(string) string) ([]WalletCfg, error) {
+	multi := strings.TrimSpace(getenv("GONKA_WALLETS"))
 	if multi != "" {
 		return parseMultiWallets(multi)
 	}
 
 	// Fallback: single wallet from GONKA_PRIVATE_KEY
-	pk := strings.TrimSpace(os.Getenv("GONKA_PRIVATE_KEY"))
+	pk := strings.TrimSpace(getenv("GONKA_PRIVATE_KEY"))
 	if pk == "" {
 		return nil, fmt.Errorf("either GONKA_WALLETS or GONKA_PRIVATE_KEY must be set")
 	}
-	addr := strings.TrimSpace(os.Getenv("GONKA_ADDRESS"))
+	addr := strings.TrimSpace(getenv("GONKA_ADDRESS"))
 	return []WalletCfg{{PrivateKey: pk, Address: addr}}, nil
 }
 
+// ReloadWallets re-reads the wallet list for a running process with the
+// precedence Load used: a variable set in the process environment at start
+// wins, anything else is read afresh from the .env file. A missing .env leaves
+// the process environment alone.
+func ReloadWallets() ([]WalletCfg, error) {
+	return reloadWallets(".env")
+}
+
+func reloadWallets(path string) ([]WalletCfg, error) {
+	file, err := godotenv.Read(path)
+	if err != nil && !errors.Is(err, fs.ErrNotExist) {
+		return nil, fmt.Errorf("reading .env: %w", err)
+	}
+	return loadWallets(func(key string) string {
+		// Without Load the whole environment counts as the process's own.
+		if processEnv == nil || processEnv[key] {
+			if v, ok := os.LookupEnv(key); ok {
+				return v
+			}
+		}
+		return file[key]
+	})
+}
+
 // parseMultiWallets parses "key1:addr1,key2:addr2,key3" into WalletCfg slices.
+// Entries are numbered from 1 by their position in the list, and errors never
+// echo the private key. Trailing commas are tolerated; an empty entry between
+// two others is an error since it usually means a key went missing. A private
+// key listed twice is logged as a warning.
 func parseMultiWallets(raw string) ([]WalletCfg, error) {
 	parts := strings.Split(raw, ",")
+	for len(parts) > 0 && strings.TrimSpace(parts[len(parts)-1]) == "" {
+		parts = parts[:len(parts)-1]
+	}
 	var wallets []WalletCfg
+	seen := make(map[string]int)
 	for i, part := range parts {
+		n := i + 1
 		part = strings.TrimSpace(part)
 		if part == "" {
-			continue
-		}
-		// Split on first colon only (private keys may have 0x prefix but no colons)
-		var pk, addr string
-		if idx := strings.Index(part, ":"); idx >= 0 {
-			pk = strings.TrimSpace(part[:idx])
-			addr = strings.TrimSpace(part[idx+1:])
-		} else {
-			pk = part
+			return nil, fmt.Errorf("GONKA_WALLETS entry %d is empty (stray comma?)", n)
 		}
+		// Hex keys and bech32 addresses never contain colons, so an entry has
+		// at most one.
+		pk, addr, hasAddr := strings.Cut(part, ":")
+		pk = strings.TrimSpace(pk)
+		addr = strings.TrimSpace(addr)
 		if pk == "" {
-			return nil, fmt.Errorf("wallet entry %d has empty private key", i+1)
+			return nil, fmt.Errorf("GONKA_WALLETS entry %d has an empty private key", n)
+		}
+		if strings.Contains(addr, ":") {
+			return nil, fmt.Errorf("GONKA_WALLETS entry %d has more than one ':'; want private_key or private_key:address", n)
+		}
+		if hasAddr && addr == "" {
+			return nil, fmt.Errorf("GONKA_WALLETS entry %d has an empty address after ':'", n)
+		}
+		norm := strings.ToLower(strings.TrimPrefix(pk, "0x"))
+		if first, ok := seen[norm]; ok {
+			slog.Warn("GONKA_WALLETS lists the same private key twice", "entry", n, "firstEntry", first)
+		} else {
+			seen[norm] = n
 		}
 		wallets = append(wallets, WalletCfg{PrivateKey: pk, Address: addr})
 	}
@@ -176,3 +957,175 @@ func parseMultiWallets(raw string) ([]WalletCfg, error) {
 	}
 	return wallets, nil
 }
+
+// parseEndpoints parses GONKA_ENDPOINTS, a comma-separated list of
+// url|address entries. A URL may be given with or without its /v1 suffix;
+// the address must be a well-formed gonka1 bech32 address, and each may be
+// listed once.
+func parseEndpoints(raw string) ([]EndpointCfg, error) {
+	var eps []EndpointCfg
+	seen := make(map[string]int)
+	for i, part := range parseList(raw) {
+		n := i + 1
+		rawURL, addr, ok := strings.Cut(part, "|")
+		rawURL, addr = strings.TrimSpace(rawURL), strings.TrimSpace(addr)
+		if !ok || rawURL == "" || addr == "" {
+			return nil, fmt.Errorf("GONKA_ENDPOINTS entry %d must be url|address, got %q", n, part)
+		}
+		u, err := url.Parse(rawURL)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.RawQuery != "" || u.Fragment != "" {
+			return nil, fmt.Errorf("GONKA_ENDPOINTS entry %d: %q is not an http(s) URL", n, rawURL)
+		}
+		if err := checkBech32(addr, "gonka"); err != nil {
+			return nil, fmt.Errorf("GONKA_ENDPOINTS entry %d: address %q: %w", n, addr, err)
+		}
+		if first, dup := seen[addr]; dup {
+			return nil, fmt.Errorf("GONKA_ENDPOINTS entries %d and %d share address %s", first, n, addr)
+		}
+		seen[addr] = n
+		eps = append(eps, EndpointCfg{
+			URL:     strings.TrimSuffix(strings.TrimRight(rawURL, "/"), "/v1") + "/v1",
+			Address: addr,
+		})
+	}
+	return eps, nil
+}
+
+// checkBech32 reports why addr is not a bech32 address with the given human
+// readable prefix, checksum included, or nil when it is one.
+func checkBech32(addr, hrp string) error {
+	const charset = "qpzry9x8gf2tvdw0s3jn54khce6mua7l"
+	if strings.ToLower(addr) != addr {
+		return errors.New("must be lowercase")
+	}
+	sep := strings.LastIndexByte(addr, '1')
+	if sep < 0 || addr[:sep] != hrp {
+		return fmt.Errorf("must start with %s1", hrp)
+	}
+	data := addr[sep+1:]
+	if len(data) < 6 || len(addr) > 90 {
+		return errors.New("wrong length")
+	}
+	gen := [5]uint32{0x3b6a57b2, 0x26508e6d, 0x1ea119fa, 0x3d4233dd, 0x2a1462b3}
+	chk := uint32(1)
+	step := func(v uint32) {
+		top := chk >> 25
+		chk = (chk&0x1ffffff)<<5 ^ v
+		for i, g := range gen {
+			if top>>i&1 == 1 {
+				chk ^= g
+			}
+		}
+	}
+	for i := 0; i < len(hrp); i++ {
+		step(uint32(hrp[i]) >> 5)
+	}
+	step(0)
+	for i := 0; i < len(hrp); i++ {
+		step(uint32(hrp[i]) & 31)
+	}
+	for _, r := range data {
+		v := strings.IndexRune(charset, r)
+		if v < 0 {
+			return fmt.Errorf("invalid character %q", r)
+		}
+		step(uint32(v))
+	}
+	if chk != 1 {
+		return errors.New("bad checksum (typo?)")
+	}
+	return nil
+}
+
+// parseModelAliases parses "alias1=model1,alias2=model2" into a map.
+func parseModelAliases(raw string) (map[string]string, error) {
+	return parsePairs("MODEL_ALIASES", raw, "alias=model")
+}
+
+// parseModelWalletMap parses "model1=address1,model2=address2" into a map.
+func parseModelWalletMap(raw string) (map[string]string, error) {
+	return parsePairs("MODEL_WALLET_MAP", raw, "model=address")
+}
+
+// parseModelSplits parses "model1=target1:10,model2=target2:50" into a map.
+func parseModelSplits(raw string) (map[string]ModelSplitCfg, error) {
+	pairs, err := parsePairs("MODEL_SPLIT", raw, "model=target:percent")
+	if err != nil || pairs == nil {
+		return nil, err
+	}
+	splits := make(map[string]ModelSplitCfg, len(pairs))
+	for model, v := range pairs {
+		i := strings.LastIndex(v, ":")
+		if i < 0 {
+			return nil, fmt.Errorf("MODEL_SPLIT entry for %s: want model=target:percent, got %q", model, v)
+		}
+		target := strings.TrimSpace(v[:i])
+		percent, err := strconv.Atoi(strings.TrimSpace(v[i+1:]))
+		if err != nil || percent < 0 || percent > 100 || target == "" {
+			return nil, fmt.Errorf("MODEL_SPLIT entry for %s: want target:percent with percent 0-100, got %q", model, v)
+		}
+		splits[model] = ModelSplitCfg{Target: target, Percent: percent}
+	}
+	return splits, nil
+}
+
+// parsePairs parses a comma-separated list of key=value entries for the named
+// variable. form describes an entry in error messages.
+func parsePairs(name, raw, form string) (map[string]string, error) {
+	if raw == "" {
+		return nil, nil
+	}
+	pairs := make(map[string]string)
+	for i, part := range strings.Split(raw, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		key, value, ok := strings.Cut(part, "=")
+		key, value = strings.TrimSpace(key), strings.TrimSpace(value)
+		if !ok || key == "" || value == "" {
+			return nil, fmt.Errorf("%s entry %d must be %s, got %q", name, i+1, form, part)
+		}
+		pairs[key] = value
+	}
+	return pairs, nil
+}
+
+// parseList splits a comma-separated list, dropping empty entries.
+func parseList(raw string) []string {
+	var out []string
+	for _, part := range strings.Split(raw, ",") {
+		if part = strings.TrimSpace(part); part != "" {
+			out = append(out, part)
+		}
+	}
+	return out
+}
+
+// envInt reads a non-negative integer from the named variable, returning def
+// when it is unset.
+func envInt(name string, def int) (int, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	n, err := strconv.Atoi(raw)
+	if err != nil || n < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative integer, got %q", name, raw)
+	}
+	return n, nil
+}
+
+// envDuration reads a Go duration (e.g. "30s", "10m") from the named variable,
+// returning def when it is unset.
+func envDuration(name string, def time.Duration) (time.Duration, error) {
+	raw := strings.TrimSpace(os.Getenv(name))
+	if raw == "" {
+		return def, nil
+	}
+	d, err := time.ParseDuration(raw)
+	if err != nil || d < 0 {
+		return 0, fmt.Errorf("%s must be a non-negative duration like 30s or 10m, got %q", name, raw)
+	}
+	return d, nil
+}
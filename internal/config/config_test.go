@@ -0,0 +1,156 @@
+package config
+
+import (
+	"bytes"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestParseMultiWallets(t *testing.T) {
+	const k1, k2 = "0xaaaa", "bbbb"
+	tests := []struct {
+		name    string
+		raw     string
+		want    []WalletCfg
+		wantErr string
+	}{
+		{name: "key only", raw: k1, want: []WalletCfg{{PrivateKey: k1}}},
+		{name: "key and address", raw: k1 + ":gonka1a," + k2, want: []WalletCfg{{k1, "gonka1a"}, {PrivateKey: k2}}},
+		{name: "whitespace", raw: "  " + k1 + " : gonka1a ,\t" + k2 + " ", want: []WalletCfg{{k1, "gonka1a"}, {PrivateKey: k2}}},
+		{name: "trailing comma", raw: k1 + "," + k2 + ",", want: []WalletCfg{{PrivateKey: k1}, {PrivateKey: k2}}},
+		{name: "trailing blanks", raw: k1 + ", , ", want: []WalletCfg{{PrivateKey: k1}}},
+		{name: "interior empty entry", raw: k1 + ", ," + k2, wantErr: "entry 2 is empty"},
+		{name: "leading comma", raw: "," + k1, wantErr: "entry 1 is empty"},
+		{name: "empty key", raw: k1 + ",:gonka1b", wantErr: "entry 2 has an empty private key"},
+		{name: "empty address", raw: k1 + ":", wantErr: "entry 1 has an empty address"},
+		{name: "two colons", raw: k1 + "," + k2 + ":gonka1b:x", wantErr: "entry 2 has more than one ':'"},
+		{name: "only commas", raw: " , ,", wantErr: "no valid entries"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got, err := parseMultiWallets(tt.raw)
+			if tt.wantErr != "" {
+				if err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+					t.Fatalf("err = %v, want one containing %q", err, tt.wantErr)
+				}
+				if strings.Contains(err.Error(), k2) {
+					t.Fatalf("error %q leaks a private key", err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestParseMultiWalletsWarnsOnDuplicateKeys(t *testing.T) {
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	// The same key with and without 0x, in different case.
+	got, err := parseMultiWallets("0xABCD:gonka1a,abcd:gonka1b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 2 {
+		t.Fatalf("got %d wallets, want both entries kept", len(got))
+	}
+	if !strings.Contains(logs.String(), "same private key twice") || !strings.Contains(logs.String(), "entry=2 firstEntry=1") {
+		t.Fatalf("no duplicate-key warning in logs: %s", logs.String())
+	}
+	if strings.Contains(strings.ToLower(logs.String()), "abcd") {
+		t.Fatalf("warning leaks the private key: %s", logs.String())
+	}
+}
+
+func TestParseModelSplits(t *testing.T) {
+	got, err := parseModelSplits("a=org/b:10, c=d:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]ModelSplitCfg{"a": {"org/b", 10}, "c": {"d", 0}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+	for _, bad := range []string{"a=b", "a=b:101", "a=b:-1", "a=:10", "a=b:x"} {
+		if _, err := parseModelSplits(bad); err == nil {
+			t.Errorf("parseModelSplits(%q) succeeded", bad)
+		}
+	}
+}
+
+func TestParseEndpoints(t *testing.T) {
+	const a1 = "gonka1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le"
+	const a2 = "gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp"
+	got, err := parseEndpoints(" http://10.0.0.1:8000|" + a1 + ", https://node.example/v1/|" + a2 + ",")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []EndpointCfg{{"http://10.0.0.1:8000/v1", a1}, {"https://node.example/v1", a2}}
+	if !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	tests := []struct {
+		raw     string
+		wantErr string
+	}{
+		{"http://a", "must be url|address"},
+		{"http://a|", "must be url|address"},
+		{"node:8000|" + a1, "not an http(s) URL"},
+		{"ftp://a|" + a1, "not an http(s) URL"},
+		{"http://a|" + strings.ToUpper(a1), "must be lowercase"},
+		{"http://a|cosmos1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le", "must start with gonka1"},
+		{"http://a|" + a1[:len(a1)-1] + "a", "bad checksum"},
+		{"http://a|gonka1b", "wrong length"},
+		{"http://a|" + a1 + ",http://b|" + a1, "entries 1 and 2 share address"},
+	}
+	for _, tt := range tests {
+		if _, err := parseEndpoints(tt.raw); err == nil || !strings.Contains(err.Error(), tt.wantErr) {
+			t.Errorf("parseEndpoints(%q) = %v, want an error containing %q", tt.raw, err, tt.wantErr)
+		}
+	}
+}
+
+func TestReloadWalletsPrecedence(t *testing.T) {
+	prev := processEnv
+	t.Cleanup(func() { processEnv = prev })
+	// GONKA_PRIVATE_KEY came from the process environment; GONKA_ADDRESS was
+	// put there from .env at start and has since been edited in the file.
+	processEnv = map[string]bool{"GONKA_PRIVATE_KEY": true}
+	t.Setenv("GONKA_WALLETS", "")
+	t.Setenv("GONKA_PRIVATE_KEY", "envkey")
+	t.Setenv("GONKA_ADDRESS", "gonka1old")
+
+	path := filepath.Join(t.TempDir(), ".env")
+	if err := os.WriteFile(path, []byte("GONKA_PRIVATE_KEY=filekey\nGONKA_ADDRESS=gonka1new\n"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	got, err := reloadWallets(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := []WalletCfg{{PrivateKey: "envkey", Address: "gonka1new"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("got %+v, want %+v", got, want)
+	}
+
+	// Without the file, what it had set is gone and the environment stands.
+	got, err = reloadWallets(filepath.Join(t.TempDir(), ".env"))
+	if err != nil {
+		t.Fatalf("missing .env: %v", err)
+	}
+	if want := []WalletCfg{{PrivateKey: "envkey"}}; !reflect.DeepEqual(got, want) {
+		t.Fatalf("missing .env: got %+v, want %+v", got, want)
+	}
+}
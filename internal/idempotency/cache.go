@@ -0,0 +1,157 @@
+// Package idempotency caches completed responses by client-supplied
+// Idempotency-Key so that a retried request is answered from memory instead
+// of being sent (and charged) upstream a second time.
+package idempotency
+
+import (
+	"container/list"
+	"context"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// Response is a fully buffered HTTP response.
+type Response struct {
+	Status int
+	Header http.Header
+	Body   []byte
+
+	// RequestHash identifies the request body that produced the response,
+	// so a key reused for a different request can be told apart.
+	RequestHash string
+}
+
+type entry struct {
+	key     string
+	resp    Response
+	expires time.Time
+}
+
+// Cache is a size-bounded, TTL-based response cache.
+// It is safe for concurrent use.
+type Cache struct {
+	ttl        time.Duration
+	maxEntries int
+
+	mu       sync.Mutex
+	items    map[string]*list.Element
+	order    *list.List               // oldest at the front
+	inflight map[string]chan struct{} // keys being served, closed when done
+	now      func() time.Time
+}
+
+// New creates a Cache that keeps each response for ttl and holds at most
+// maxEntries responses, evicting the oldest first.
+func New(ttl time.Duration, maxEntries int) *Cache {
+	if maxEntries < 1 {
+		maxEntries = 1
+	}
+	return &Cache{
+		ttl:        ttl,
+		maxEntries: maxEntries,
+		items:      make(map[string]*list.Element),
+		order:      list.New(),
+		inflight:   make(map[string]chan struct{}),
+		now:        time.Now,
+	}
+}
+
+// Get returns the cached response for key if it exists and has not expired.
+func (c *Cache) Get(key string) (Response, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.get(key)
+}
+
+// get is Get with c.mu held.
+func (c *Cache) get(key string) (Response, bool) {
+	el, ok := c.items[key]
+	if !ok {
+		return Response{}, false
+	}
+	e := el.Value.(*entry)
+	if c.now().After(e.expires) {
+		c.remove(el)
+		return Response{}, false
+	}
+	return e.resp, true
+}
+
+// Claim returns the cached response for key if there is one. Otherwise it
+// makes the caller the one request serving key: a concurrent Claim of the
+// same key waits until the caller calls done, then looks again, so
+// simultaneous retries go upstream once. The caller must call done after
+// Put, or after giving up without a response to cache. err is ctx's error
+// when ctx ends while waiting.
+func (c *Cache) Claim(ctx context.Context, key string) (cached Response, ok bool, done func(), err error) {
+	for {
+		c.mu.Lock()
+		if resp, ok := c.get(key); ok {
+			c.mu.Unlock()
+			return resp, true, nil, nil
+		}
+		wait, busy := c.inflight[key]
+		if !busy {
+			ch := make(chan struct{})
+			c.inflight[key] = ch
+			c.mu.Unlock()
+			return Response{}, false, func() {
+				c.mu.Lock()
+				delete(c.inflight, key)
+				c.mu.Unlock()
+				close(ch)
+			}, nil
+		}
+		c.mu.Unlock()
+		select {
+		case <-wait:
+		case <-ctx.Done():
+			return Response{}, false, nil, ctx.Err()
+		}
+	}
+}
+
+// Put stores resp under key, replacing any previous value.
+func (c *Cache) Put(key string, resp Response) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if el, ok := c.items[key]; ok {
+		c.remove(el)
+	}
+	c.evictExpired()
+	for c.order.Len() >= c.maxEntries {
+		c.remove(c.order.Front())
+	}
+	c.items[key] = c.order.PushBack(&entry{
+		key:     key,
+		resp:    resp,
+		expires: c.now().Add(c.ttl),
+	})
+}
+
+// Len returns the number of entries currently held, including expired ones
+// that have not been purged yet.
+func (c *Cache) Len() int {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	return c.order.Len()
+}
+
+// evictExpired drops expired entries from the front of the queue. Entries are
+// inserted in expiry order, so it can stop at the first live one.
+func (c *Cache) evictExpired() {
+	now := c.now()
+	for el := c.order.Front(); el != nil; el = c.order.Front() {
+		if now.Before(el.Value.(*entry).expires) {
+			return
+		}
+		c.remove(el)
+	}
+}
+
+func (c *Cache) remove(el *list.Element) {
+	delete(c.items, el.Value.(*entry).key)
+	c.order.Remove(el)
+}
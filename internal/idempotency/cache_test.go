@@ -0,0 +1,85 @@
+package idempotency
+
+import (
+	"context"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+func TestCacheTTL(t *testing.T) {
+	c := New(time.Minute, 10)
+	now := time.Unix(1000, 0)
+	c.now = func() time.Time { return now }
+
+	c.Put("a", Response{Status: 200, Body: []byte("x")})
+	if resp, ok := c.Get("a"); !ok || string(resp.Body) != "x" {
+		t.Fatalf("Get = %+v, %v; want the cached response", resp, ok)
+	}
+	now = now.Add(time.Minute + time.Second)
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("expired response still returned")
+	}
+	if n := c.Len(); n != 0 {
+		t.Fatalf("%d entries after expiry, want 0", n)
+	}
+}
+
+func TestCacheEvictsOldest(t *testing.T) {
+	c := New(time.Minute, 2)
+	c.Put("a", Response{Status: 200})
+	c.Put("b", Response{Status: 200})
+	c.Put("c", Response{Status: 200})
+	if _, ok := c.Get("a"); ok {
+		t.Fatal("oldest entry not evicted")
+	}
+	for _, k := range []string{"b", "c"} {
+		if _, ok := c.Get(k); !ok {
+			t.Fatalf("%s evicted", k)
+		}
+	}
+
+	// Replacing a key does not count twice.
+	c.Put("c", Response{Status: 201})
+	if resp, _ := c.Get("c"); resp.Status != 201 || c.Len() != 2 {
+		t.Fatalf("after replace: status %d, %d entries", resp.Status, c.Len())
+	}
+}
+
+func TestClaimServesKeyOnce(t *testing.T) {
+	c := New(time.Minute, 10)
+	var served atomic.Int32
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			_, ok, done, err := c.Claim(context.Background(), "k")
+			if err != nil || ok {
+				return
+			}
+			served.Add(1)
+			time.Sleep(10 * time.Millisecond)
+			c.Put("k", Response{Status: 200})
+			done()
+		}()
+	}
+	wg.Wait()
+	if n := served.Load(); n != 1 {
+		t.Fatalf("key served %d times, want once", n)
+	}
+
+	// A claim given up without a response lets the next one through, and
+	// a waiter leaves when its context ends.
+	_, _, done, _ := c.Claim(context.Background(), "failed")
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Millisecond)
+	defer cancel()
+	if _, _, _, err := c.Claim(ctx, "failed"); err != context.DeadlineExceeded {
+		t.Fatalf("waiting Claim = %v, want DeadlineExceeded", err)
+	}
+	done()
+	if _, ok, done, err := c.Claim(context.Background(), "failed"); err != nil || ok || done == nil {
+		t.Fatalf("Claim after a failed attempt: ok %v, err %v", ok, err)
+	}
+}
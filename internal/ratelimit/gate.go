@@ -0,0 +1,87 @@
+package ratelimit
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"sync/atomic"
+	"time"
+)
+
+// ErrBusy is returned by Gate.Acquire when no slot freed up in time.
+var ErrBusy = errors.New("ratelimit: too many requests in flight")
+
+// Gate bounds how many requests are served at once. A request arriving while
+// every slot is taken waits in line for up to maxWait, then gives up; with a
+// maxWait of zero it is turned away at once. It is safe for concurrent use.
+type Gate struct {
+	slots   chan struct{}
+	maxWait time.Duration
+
+	queued   atomic.Int64
+	rejected atomic.Int64 // turned away at once or after waiting maxWait
+}
+
+// NewGate creates a Gate with limit slots (at least 1).
+func NewGate(limit int, maxWait time.Duration) *Gate {
+	return &Gate{slots: make(chan struct{}, max(limit, 1)), maxWait: maxWait}
+}
+
+// Acquire takes a slot, waiting up to maxWait for one when all are taken. The
+// wait also ends with ctx, whose error is then returned. On success the
+// caller must call release once it is done.
+func (g *Gate) Acquire(ctx context.Context) (release func(), err error) {
+	release = func() { <-g.slots }
+	select {
+	case g.slots <- struct{}{}:
+		return release, nil
+	default:
+	}
+	if g.maxWait <= 0 {
+		g.rejected.Add(1)
+		return nil, ErrBusy
+	}
+
+	g.queued.Add(1)
+	defer g.queued.Add(-1)
+	t := time.NewTimer(g.maxWait)
+	defer t.Stop()
+	select {
+	case g.slots <- struct{}{}:
+		return release, nil
+	case <-t.C:
+		g.rejected.Add(1)
+		return nil, ErrBusy
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+// GateStatus is a snapshot of a Gate, served by StatusHandler.
+type GateStatus struct {
+	Limit     int   `json:"limit"`
+	InFlight  int   `json:"in_flight"`
+	Queued    int64 `json:"queued"`
+	MaxWaitMs int64 `json:"max_wait_ms"`
+	Rejected  int64 `json:"rejected"`
+}
+
+// Status returns the current state of g.
+func (g *Gate) Status() GateStatus {
+	return GateStatus{
+		Limit:     cap(g.slots),
+		InFlight:  len(g.slots),
+		Queued:    g.queued.Load(),
+		MaxWaitMs: g.maxWait.Milliseconds(),
+		Rejected:  g.rejected.Load(),
+	}
+}
+
+// StatusHandler serves Status as JSON.
+func (g *Gate) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(g.Status())
+	})
+}
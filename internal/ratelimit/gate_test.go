@@ -0,0 +1,73 @@
+package ratelimit
+
+import (
+	"context"
+	"testing"
+	"time"
+)
+
+func TestGateRejectsWithoutQueue(t *testing.T) {
+	g := NewGate(1, 0)
+	release, err := g.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire(context.Background()); err != ErrBusy {
+		t.Fatalf("second Acquire = %v, want ErrBusy", err)
+	}
+	release()
+	if release, err := g.Acquire(context.Background()); err != nil {
+		t.Fatalf("Acquire after release: %v", err)
+	} else {
+		release()
+	}
+	if st := g.Status(); st.Rejected != 1 || st.InFlight != 0 {
+		t.Fatalf("status %+v, want 1 rejected and none in flight", st)
+	}
+}
+
+func TestGateQueuesUntilSlotOrTimeout(t *testing.T) {
+	g := NewGate(1, time.Second)
+	release, err := g.Acquire(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// A queued request is admitted when the slot frees up.
+	admitted := make(chan error, 1)
+	go func() {
+		r, err := g.Acquire(context.Background())
+		if err == nil {
+			r()
+		}
+		admitted <- err
+	}()
+	for g.Status().Queued != 1 {
+		time.Sleep(time.Millisecond)
+	}
+	release()
+	if err := <-admitted; err != nil {
+		t.Fatalf("queued Acquire = %v, want admitted", err)
+	}
+
+	// One that waits out maxWait, or its own deadline, is not.
+	g = NewGate(1, 20*time.Millisecond)
+	if _, err := g.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire(context.Background()); err != ErrBusy {
+		t.Fatalf("Acquire past maxWait = %v, want ErrBusy", err)
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Millisecond)
+	defer cancel()
+	g = NewGate(1, time.Minute)
+	if _, err := g.Acquire(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := g.Acquire(ctx); err != context.DeadlineExceeded {
+		t.Fatalf("Acquire past ctx deadline = %v, want DeadlineExceeded", err)
+	}
+	if st := g.Status(); st.Queued != 0 {
+		t.Fatalf("%d still queued", st.Queued)
+	}
+}
@@ -0,0 +1,74 @@
+package ratelimit
+
+import (
+	"testing"
+	"time"
+)
+
+func TestLimiterPerKeyBurstAndRefill(t *testing.T) {
+	l := New(60, 2) // one token per second
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < 2; i++ {
+		if ok, _ := l.Allow("a"); !ok {
+			t.Fatalf("request %d within burst rejected", i+1)
+		}
+	}
+	ok, wait := l.Allow("a")
+	if ok {
+		t.Fatal("request over burst allowed")
+	}
+	if wait <= 0 || wait > time.Second {
+		t.Fatalf("wait %s, want (0, 1s]", wait)
+	}
+
+	// Other keys have their own bucket.
+	if ok, _ := l.Allow("b"); !ok {
+		t.Fatal("separate key throttled")
+	}
+
+	now = now.Add(time.Second)
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("token not refilled after one second")
+	}
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("only one token should have refilled")
+	}
+}
+
+func TestLimiterRefund(t *testing.T) {
+	l := New(60, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("first request rejected")
+	}
+	l.Refund("a")
+	if ok, _ := l.Allow("a"); !ok {
+		t.Fatal("refunded token not available")
+	}
+	// A full bucket stays at the burst.
+	l.Refund("a")
+	l.Refund("a")
+	l.Allow("a")
+	if ok, _ := l.Allow("a"); ok {
+		t.Fatal("refunds grew the bucket past the burst")
+	}
+}
+
+func TestLimiterSweepsIdleBuckets(t *testing.T) {
+	l := New(60, 1)
+	now := time.Unix(1000, 0)
+	l.now = func() time.Time { return now }
+
+	for i := 0; i < maxIdleBuckets; i++ {
+		l.Allow(string(rune('a'+i%26)) + time.Duration(i).String())
+	}
+	now = now.Add(time.Minute)
+	l.Allow("new")
+	if n := len(l.buckets); n != 1 {
+		t.Fatalf("%d buckets after sweep, want 1", n)
+	}
+}
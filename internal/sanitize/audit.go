@@ -0,0 +1,201 @@
+package sanitize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"log/slog"
+	"net/http"
+	"os"
+	"sync"
+	"time"
+)
+
+// AuditRecord lists what was redacted from one request, originals included,
+// for a compliance store. It is the only place the proxy emits original
+// values other than restoring them into the client's own response; logs and
+// samples never contain them.
+type AuditRecord struct {
+	Time       time.Time        `json:"time"`
+	RequestID  string           `json:"request_id"`
+	Model      string           `json:"model,omitempty"`
+	Redactions []AuditRedaction `json:"redactions"`
+}
+
+// AuditRedaction is one redacted value.
+type AuditRedaction struct {
+	Token    string `json:"token"`
+	Original string `json:"original"`
+	Label    string `json:"label"` // see Redaction.Label
+}
+
+// AuditSink receives one AuditRecord per request that had redactions.
+// Record is called on the request path and must not block for long.
+// Implementations must be safe for concurrent use.
+type AuditSink interface {
+	Record(AuditRecord)
+}
+
+// AuditRecord builds the audit record for the values redacted into m.
+func (m *TokenMap) AuditRecord(requestID, model string) AuditRecord {
+	rec := AuditRecord{
+		Time:       time.Now().UTC(),
+		RequestID:  requestID,
+		Model:      model,
+		Redactions: make([]AuditRedaction, 0, len(m.fromToken)),
+	}
+	for _, r := range m.Redactions() {
+		rec.Redactions = append(rec.Redactions, AuditRedaction{Token: r.Token, Original: r.Original, Label: r.Label})
+	}
+	return rec
+}
+
+// FileAuditSink appends audit records to a file as JSON lines. The file is
+// created with mode 0600; restrict access to its directory as well.
+type FileAuditSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFileAuditSink opens (or creates) path for appending.
+func NewFileAuditSink(path string) (*FileAuditSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("sanitize: audit file: %w", err)
+	}
+	return &FileAuditSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes r as one line and syncs it to disk. A failed write is
+// logged, without the originals.
+func (fs *FileAuditSink) Record(r AuditRecord) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	err := fs.enc.Encode(r)
+	if err == nil {
+		err = fs.f.Sync()
+	}
+	if err != nil {
+		slog.Error("sanitize: audit record lost", "request_id", r.RequestID, "err", err)
+	}
+}
+
+// Close closes the underlying file.
+func (fs *FileAuditSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
+
+// WebhookAuditSink POSTs each audit record as JSON to a URL. Records are
+// queued and sent in the background so a slow store does not delay
+// requests; each is tried up to webhookAttempts times.
+type WebhookAuditSink struct {
+	url   string
+	token string
+	http  *http.Client
+	queue chan AuditRecord
+	done  chan struct{}
+
+	mu     sync.Mutex // guards closed and sends on queue
+	closed bool
+}
+
+// webhookQueueSize bounds the records waiting to be sent. When the queue is
+// full further records are dropped and logged, rather than blocking
+// requests behind an unavailable store.
+const webhookQueueSize = 1024
+
+// webhookAttempts is how many times one record is sent before it is dropped.
+const webhookAttempts = 3
+
+// NewWebhookAuditSink starts a sink posting to url. A non-empty token is
+// sent as "Authorization: Bearer <token>". Call Close to flush the queue.
+func NewWebhookAuditSink(url, token string) *WebhookAuditSink {
+	s := &WebhookAuditSink{
+		url:   url,
+		token: token,
+		http:  &http.Client{Timeout: 10 * time.Second},
+		queue: make(chan AuditRecord, webhookQueueSize),
+		done:  make(chan struct{}),
+	}
+	go s.run()
+	return s
+}
+
+// Record queues r for sending. A record arriving after Close, from a
+// handler that outlived shutdown, is dropped and logged.
+func (s *WebhookAuditSink) Record(r AuditRecord) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	if s.closed {
+		slog.Error("sanitize: audit sink closed, record dropped", "request_id", r.RequestID)
+		return
+	}
+	select {
+	case s.queue <- r:
+	default:
+		slog.Error("sanitize: audit queue full, record dropped", "request_id", r.RequestID)
+	}
+}
+
+// Close stops accepting records and waits until the queued ones are sent or
+// ctx is done. Calling Close more than once is safe.
+func (s *WebhookAuditSink) Close(ctx context.Context) error {
+	s.mu.Lock()
+	if !s.closed {
+		s.closed = true
+		close(s.queue)
+	}
+	s.mu.Unlock()
+	select {
+	case <-s.done:
+		return nil
+	case <-ctx.Done():
+		return fmt.Errorf("sanitize: audit webhook: %d records unsent: %w", len(s.queue), ctx.Err())
+	}
+}
+
+func (s *WebhookAuditSink) run() {
+	defer close(s.done)
+	for r := range s.queue {
+		var err error
+		for attempt := 0; attempt < webhookAttempts; attempt++ {
+			if attempt > 0 {
+				time.Sleep(time.Duration(attempt) * time.Second)
+			}
+			if err = s.send(r); err == nil {
+				break
+			}
+		}
+		if err != nil {
+			slog.Error("sanitize: audit record lost", "request_id", r.RequestID, "err", err)
+		}
+	}
+}
+
+func (s *WebhookAuditSink) send(r AuditRecord) error {
+	body, err := json.Marshal(r)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequest(http.MethodPost, s.url, bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if s.token != "" {
+		req.Header.Set("Authorization", "Bearer "+s.token)
+	}
+	resp, err := s.http.Do(req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode/100 != 2 {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return nil
+}
@@ -0,0 +1,127 @@
+package sanitize
+
+import (
+	"encoding/json"
+	"errors"
+	"log/slog"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// ErrBreakerOpen is returned by a Breaker that is skipping its classifier.
+var ErrBreakerOpen = errors.New("sanitize: classifier circuit open")
+
+// Breaker is a circuit breaker around a Classifier. After threshold
+// consecutive failures it stops calling the classifier for cooldown and fails
+// fast with ErrBreakerOpen instead, so requests fall back to the remaining
+// classifiers without waiting on a dead backend. Once the cooldown has passed
+// a single call is let through as a probe: success closes the breaker, failure
+// opens it for another cooldown.
+//
+// Failing fast still counts as a classifier error, so the request is reported
+// as degraded.
+type Breaker struct {
+	name      string
+	inner     Classifier
+	threshold int
+	cooldown  time.Duration
+
+	mu        sync.Mutex
+	failures  int       // consecutive failures
+	openUntil time.Time // zero while closed
+	probing   bool      // a probe call is in flight
+	lastErr   string
+}
+
+// BreakerStatus is a snapshot of a Breaker for diagnostics.
+type BreakerStatus struct {
+	Name      string     `json:"name"`
+	State     string     `json:"state"` // closed, open, or half-open
+	Failures  int        `json:"consecutive_failures"`
+	OpenUntil *time.Time `json:"open_until,omitempty"`
+	LastError string     `json:"last_error,omitempty"`
+}
+
+// NewBreaker wraps c in a Breaker. name identifies it in logs and status.
+// A threshold below 1 is treated as 1.
+func NewBreaker(name string, c Classifier, threshold int, cooldown time.Duration) *Breaker {
+	if threshold < 1 {
+		threshold = 1
+	}
+	return &Breaker{name: name, inner: c, threshold: threshold, cooldown: cooldown}
+}
+
+// Name returns the name the breaker was created with.
+func (b *Breaker) Name() string { return b.name }
+
+// Classify calls the wrapped classifier unless the breaker is open.
+func (b *Breaker) Classify(text string) ([]Span, error) {
+	if !b.allow() {
+		return nil, ErrBreakerOpen
+	}
+	spans, err := b.inner.Classify(text)
+	b.record(err)
+	return spans, err
+}
+
+// allow reports whether a call may go through, claiming the probe slot when
+// the cooldown has just elapsed.
+func (b *Breaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.openUntil.IsZero() {
+		return true
+	}
+	if b.probing || time.Now().Before(b.openUntil) {
+		return false
+	}
+	b.probing = true
+	return true
+}
+
+func (b *Breaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	b.probing = false
+	if err == nil {
+		if !b.openUntil.IsZero() {
+			slog.Info("sanitize: classifier recovered, circuit closed", "classifier", b.name)
+		}
+		b.failures = 0
+		b.openUntil = time.Time{}
+		b.lastErr = ""
+		return
+	}
+	b.failures++
+	b.lastErr = err.Error()
+	if b.failures >= b.threshold {
+		b.openUntil = time.Now().Add(b.cooldown)
+		slog.Warn("sanitize: classifier failing, circuit open",
+			"classifier", b.name, "failures", b.failures, "cooldown", b.cooldown, "err", err)
+	}
+}
+
+// Status returns the breaker's current state.
+func (b *Breaker) Status() BreakerStatus {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	st := BreakerStatus{Name: b.name, State: "closed", Failures: b.failures, LastError: b.lastErr}
+	if !b.openUntil.IsZero() {
+		until := b.openUntil
+		st.OpenUntil = &until
+		st.State = "open"
+		if b.probing || !time.Now().Before(until) {
+			st.State = "half-open"
+		}
+	}
+	return st
+}
+
+// StatusHandler returns an http.Handler that reports Status as JSON.
+func (b *Breaker) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(b.Status())
+	})
+}
@@ -0,0 +1,88 @@
+package sanitize
+
+import (
+	"context"
+	"errors"
+	"sync/atomic"
+	"testing"
+	"time"
+)
+
+// flakyClassifier fails while down is set and counts its calls.
+type flakyClassifier struct {
+	down  atomic.Bool
+	calls atomic.Int32
+}
+
+func (c *flakyClassifier) Classify(string) ([]Span, error) {
+	c.calls.Add(1)
+	if c.down.Load() {
+		return nil, errors.New("connection refused")
+	}
+	return []Span{{Start: 0, End: 4, Label: "LLM"}}, nil
+}
+
+func TestBreakerOpensAfterThresholdAndRecovers(t *testing.T) {
+	inner := &flakyClassifier{}
+	inner.down.Store(true)
+	b := NewBreaker("llm", inner, 2, 50*time.Millisecond)
+
+	for i := 0; i < 2; i++ {
+		if _, err := b.Classify("text"); err == nil || errors.Is(err, ErrBreakerOpen) {
+			t.Fatalf("call %d: want the inner error, got %v", i+1, err)
+		}
+	}
+	if st := b.Status(); st.State != "open" || st.Failures != 2 {
+		t.Fatalf("after threshold: %+v", st)
+	}
+
+	// While open the backend is not called at all.
+	if _, err := b.Classify("text"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("open breaker: want ErrBreakerOpen, got %v", err)
+	}
+	if n := inner.calls.Load(); n != 2 {
+		t.Fatalf("open breaker called the classifier: %d calls", n)
+	}
+
+	// After the cooldown a failed probe re-opens it...
+	time.Sleep(60 * time.Millisecond)
+	if _, err := b.Classify("text"); err == nil || errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("probe: want the inner error, got %v", err)
+	}
+	if _, err := b.Classify("text"); !errors.Is(err, ErrBreakerOpen) {
+		t.Fatalf("failed probe must re-open the breaker, got %v", err)
+	}
+
+	// ...and a successful one closes it.
+	inner.down.Store(false)
+	time.Sleep(60 * time.Millisecond)
+	if spans, err := b.Classify("text"); err != nil || len(spans) != 1 {
+		t.Fatalf("probe after recovery: spans %v, err %v", spans, err)
+	}
+	if st := b.Status(); st.State != "closed" || st.Failures != 0 || st.OpenUntil != nil {
+		t.Fatalf("after recovery: %+v", st)
+	}
+}
+
+func TestOpenBreakerFallsBackAndMarksDegraded(t *testing.T) {
+	llm := &flakyClassifier{}
+	llm.down.Store(true)
+	s := NewWithClassifiers([]Classifier{
+		fixedClassifier{{Start: 3, End: 9, Label: "PER"}},
+		NewBreaker("llm", llm, 1, time.Minute),
+	})
+
+	body := []byte(`{"messages":[{"role":"user","content":"my secret"}]}`)
+	for i := 0; i < 3; i++ {
+		_, tm := s.RedactMessages(context.Background(), body)
+		if tm.Count() != 1 {
+			t.Fatalf("request %d: the other classifier's span must still apply, got %d", i+1, tm.Count())
+		}
+		if !tm.Degraded() {
+			t.Fatalf("request %d: skipped LLM layer must mark the request degraded", i+1)
+		}
+	}
+	if n := llm.calls.Load(); n != 1 {
+		t.Fatalf("LLM called %d times, want 1 before the breaker opened", n)
+	}
+}
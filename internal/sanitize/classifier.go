@@ -1,11 +1,20 @@
 package sanitize
 
+import (
+	"fmt"
+	"strings"
+)
+
 // Span describes a sensitive substring detected within a text.
 type Span struct {
 	Start int     // byte offset of the first character (UTF-8)
 	End   int     // byte offset one past the last character
 	Label string  // e.g. "PER", "ORG", "MONEY", "CREDENTIAL", "CONFIDENTIAL"
 	Score float32 // confidence in [0,1]; 1.0 for rule-based detectors
+
+	// Text is the matched value as the classifier saw it. Optional; when set,
+	// spans whose offsets do not select exactly this text are discarded.
+	Text string
 }
 
 // Classifier detects sensitive spans in a text string.
@@ -13,3 +22,47 @@ type Span struct {
 type Classifier interface {
 	Classify(text string) ([]Span, error)
 }
+
+// StatusError is returned by a classifier whose backend answered with an
+// unexpected HTTP status. It carries no response body, which may echo the
+// classified text.
+type StatusError struct {
+	Source string // e.g. "ner: presidio"
+	Code   int
+}
+
+func (e *StatusError) Error() string {
+	return fmt.Sprintf("%s returned status %d", e.Source, e.Code)
+}
+
+// StaticClassifier flags every occurrence of a fixed set of values, e.g. a
+// deny-list of known secrets. It is also useful as a deterministic classifier
+// in tests.
+type StaticClassifier struct {
+	Values []string
+	Label  string // defaults to "STATIC"
+}
+
+// Classify returns a span for each non-overlapping occurrence of each value.
+func (c StaticClassifier) Classify(text string) ([]Span, error) {
+	label := c.Label
+	if label == "" {
+		label = "STATIC"
+	}
+	var spans []Span
+	for _, v := range c.Values {
+		if v == "" {
+			continue
+		}
+		for start := 0; ; {
+			i := strings.Index(text[start:], v)
+			if i < 0 {
+				break
+			}
+			abs := start + i
+			spans = append(spans, Span{Start: abs, End: abs + len(v), Label: label, Score: 1, Text: v})
+			start = abs + len(v)
+		}
+	}
+	return spans, nil
+}
@@ -0,0 +1,97 @@
+package sanitize
+
+import "strings"
+
+// CodeBlockMode says how findings inside fenced code blocks (``` or ~~~) are
+// treated (Options.CodeBlocks). Classifiers tend to read identifiers as
+// names and string literals as secrets, and redacting them garbles the code.
+type CodeBlockMode string
+
+const (
+	// CodeBlocksRedact redacts code like any other text.
+	CodeBlocksRedact CodeBlockMode = ""
+	// CodeBlocksSkip redacts nothing inside code blocks.
+	CodeBlocksSkip CodeBlockMode = "skip"
+	// CodeBlocksCredentials redacts only credential findings inside code
+	// blocks (see codeBlockLabels), dropping names, emails and the like.
+	CodeBlocksCredentials CodeBlockMode = "credentials"
+)
+
+// codeBlockLabels are the labels CodeBlocksCredentials still redacts in code.
+var codeBlockLabels = map[string]bool{"CREDENTIAL": true, "CONFIDENTIAL": true}
+
+// dropCodeSpans removes the spans that opts.CodeBlocks exempts because they
+// touch a fenced code block of text.
+func (s *Sanitizer) dropCodeSpans(text string, spans []Span) []Span {
+	if s.opts.CodeBlocks == CodeBlocksRedact || len(spans) == 0 {
+		return spans
+	}
+	blocks := codeBlocks(text)
+	if len(blocks) == 0 {
+		return spans
+	}
+	kept := spans[:0:0]
+	for _, sp := range spans {
+		if s.opts.CodeBlocks == CodeBlocksCredentials && codeBlockLabels[sp.Label] || !overlapsAny(sp, blocks) {
+			kept = append(kept, sp)
+		}
+	}
+	return kept
+}
+
+func overlapsAny(sp Span, blocks [][2]int) bool {
+	for _, b := range blocks {
+		if sp.Start < b[1] && b[0] < sp.End {
+			return true
+		}
+	}
+	return false
+}
+
+// codeBlocks returns the byte ranges of the fenced code blocks in text, each
+// from the start of its opening fence line to the end of its closing one.
+// A fence is a line of at least three backticks or tildes, indented by at
+// most three spaces; it is closed by a fence of the same character at least
+// as long. Unlike Markdown, a fence left open starts no block: one stray
+// fence must not exempt the rest of the text from redaction.
+func codeBlocks(text string) [][2]int {
+	var blocks [][2]int
+	var fence string // the opening fence while inside a block
+	start := 0
+	for off := 0; off < len(text); {
+		end := strings.IndexByte(text[off:], '\n')
+		if end < 0 {
+			end = len(text)
+		} else {
+			end += off + 1
+		}
+		line := strings.TrimRight(text[off:end], "\r\n")
+		if f := fenceOf(line); f != "" {
+			switch {
+			case fence == "":
+				fence, start = f, off
+			case f[0] == fence[0] && len(f) >= len(fence) && strings.TrimSpace(line) == f:
+				blocks = append(blocks, [2]int{start, end})
+				fence = ""
+			}
+		}
+		off = end
+	}
+	return blocks
+}
+
+// fenceOf returns the fence line opens with, or "".
+func fenceOf(line string) string {
+	trimmed := strings.TrimLeft(line, " ")
+	if len(line)-len(trimmed) > 3 || len(trimmed) < 3 || (trimmed[0] != '`' && trimmed[0] != '~') {
+		return ""
+	}
+	n := 0
+	for n < len(trimmed) && trimmed[n] == trimmed[0] {
+		n++
+	}
+	if n < 3 {
+		return ""
+	}
+	return trimmed[:n]
+}
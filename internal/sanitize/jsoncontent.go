@@ -0,0 +1,144 @@
+package sanitize
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"strings"
+)
+
+// jsonLeaf is a string or number value in a JSON text.
+type jsonLeaf struct {
+	start, end int    // the literal in the raw text, quotes included
+	key        string // object key the value sits under, "" at the top level
+	value      string // decoded value
+	view       int    // offset of value in the classifier view
+}
+
+// redactJSON redacts text, when it is a JSON object or array, by classifying
+// its leaf values rather than the serialized text (Options.JSONContent).
+// Classifiers see one "key: value" line per leaf, so escaped values
+// ("john\u0040example.com") read as the values they are and each value keeps
+// the key that gives it meaning; spans are clipped to the value they fall in,
+// so keys are never redacted. A redacted value is written back as a JSON
+// string, numbers included, leaving the rest of the text byte for byte as it
+// was. ok is false when text is not JSON or has no leaves, for the caller to
+// redact it as plain text.
+func (s *Sanitizer) redactJSON(ctx context.Context, text string, classifiers []Classifier, tm *TokenMap) (out string, ok bool) {
+	leaves := jsonLeaves(text)
+	if len(leaves) == 0 {
+		return text, false
+	}
+	var view strings.Builder
+	for i := range leaves {
+		if leaves[i].key != "" {
+			view.WriteString(leaves[i].key)
+			view.WriteString(": ")
+		}
+		leaves[i].view = view.Len()
+		view.WriteString(leaves[i].value)
+		view.WriteByte('\n')
+	}
+	spans, err, bestEffort := s.runClassifiers(ctx, view.String(), classifiers)
+	tm.noteErr(err, bestEffort)
+	if len(spans) == 0 {
+		return text, true
+	}
+
+	out = text
+	for i := len(leaves) - 1; i >= 0; i-- {
+		l := leaves[i]
+		var local []Span
+		for _, sp := range spans {
+			lo, hi := max(sp.Start, l.view), min(sp.End, l.view+len(l.value))
+			if lo >= hi {
+				continue
+			}
+			local = append(local, Span{Start: lo - l.view, End: hi - l.view, Label: sp.Label, Score: sp.Score})
+		}
+		if len(local) == 0 {
+			continue
+		}
+		redacted := s.applySpans(l.value, local, tm)
+		if redacted == l.value {
+			continue
+		}
+		var buf bytes.Buffer
+		enc := json.NewEncoder(&buf)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(redacted)
+		out = out[:l.start] + strings.TrimRight(buf.String(), "\n") + out[l.end:]
+	}
+	return out, true
+}
+
+// jsonLeaves returns the string and number values of text in order, or nil
+// when text is not a JSON object or array.
+func jsonLeaves(text string) []jsonLeaf {
+	trimmed := strings.TrimSpace(text)
+	if trimmed == "" || (trimmed[0] != '{' && trimmed[0] != '[') || !json.Valid([]byte(text)) {
+		return nil
+	}
+	type frame struct {
+		object    bool
+		expectKey bool
+		key       string // last key read, for an object
+	}
+	var stack []frame
+	var leaves []jsonLeaf
+	dec := json.NewDecoder(strings.NewReader(text))
+	dec.UseNumber()
+	for {
+		before := dec.InputOffset()
+		tok, err := dec.Token()
+		if err != nil {
+			return leaves
+		}
+		var top *frame
+		if len(stack) > 0 {
+			top = &stack[len(stack)-1]
+		}
+		var value string
+		switch t := tok.(type) {
+		case json.Delim:
+			if t == '{' || t == '[' {
+				stack = append(stack, frame{object: t == '{', expectKey: t == '{'})
+				continue
+			}
+			stack = stack[:len(stack)-1]
+			if len(stack) > 0 && stack[len(stack)-1].object {
+				stack[len(stack)-1].expectKey = true
+			}
+			continue
+		case string:
+			if top != nil && top.object && top.expectKey {
+				top.key, top.expectKey = t, false
+				continue
+			}
+			value = t
+		case json.Number:
+			value = t.String()
+		}
+		if top != nil && top.object {
+			top.expectKey = true
+		}
+		switch tok.(type) {
+		case string, json.Number:
+		default:
+			continue // true, false or null
+		}
+		// The literal starts after the separators the decoder skipped.
+		end := int(dec.InputOffset())
+		start := int(before) + strings.IndexFunc(text[before:end], func(r rune) bool {
+			return !strings.ContainsRune(" \t\r\n,:", r)
+		})
+		l := jsonLeaf{start: start, end: end, value: value}
+		for i := len(stack) - 1; i >= 0; i-- {
+			if stack[i].object {
+				l.key = stack[i].key
+				break
+			}
+		}
+		leaves = append(leaves, l)
+	}
+}
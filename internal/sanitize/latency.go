@@ -0,0 +1,122 @@
+package sanitize
+
+import (
+	"encoding/json"
+	"net/http"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// LatencyRecorder keeps how long each classifier took on its recent calls,
+// so the cost of a layer (say the LLM next to NER) can be judged at the
+// percentile level. Classifiers are keyed by name as in samples (see Named).
+// It is safe for concurrent use.
+type LatencyRecorder struct {
+	window int
+
+	mu     sync.Mutex
+	byName map[string]*latencyWindow
+}
+
+// latencyWindow holds the latest durations of one classifier in a ring.
+type latencyWindow struct {
+	recent []time.Duration
+	next   int
+	calls  uint64
+	errors uint64
+}
+
+// ClassifierLatency summarizes one classifier's recent calls. Percentiles
+// cover the last window calls; Calls and Errors count since startup.
+type ClassifierLatency struct {
+	Name   string  `json:"name"`
+	Calls  uint64  `json:"calls"`
+	Errors uint64  `json:"errors"`
+	P50MS  float64 `json:"p50_ms"`
+	P90MS  float64 `json:"p90_ms"`
+	P99MS  float64 `json:"p99_ms"`
+	MaxMS  float64 `json:"max_ms"`
+}
+
+// defaultLatencyWindow is the window of a LatencyRecorder created with a
+// window below 1.
+const defaultLatencyWindow = 1024
+
+// NewLatencyRecorder creates a recorder computing percentiles over the last
+// window calls of each classifier.
+func NewLatencyRecorder(window int) *LatencyRecorder {
+	if window < 1 {
+		window = defaultLatencyWindow
+	}
+	return &LatencyRecorder{window: window, byName: make(map[string]*latencyWindow)}
+}
+
+// Record notes one call of the named classifier. Calls that failed count
+// towards the percentiles too: a timing-out backend is exactly what they
+// should show.
+func (l *LatencyRecorder) Record(name string, d time.Duration, err error) {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	w := l.byName[name]
+	if w == nil {
+		w = &latencyWindow{}
+		l.byName[name] = w
+	}
+	if len(w.recent) < l.window {
+		w.recent = append(w.recent, d)
+	} else {
+		w.recent[w.next] = d
+		w.next = (w.next + 1) % l.window
+	}
+	w.calls++
+	if err != nil {
+		w.errors++
+	}
+}
+
+// Snapshot returns the latency of every classifier seen so far, by name.
+func (l *LatencyRecorder) Snapshot() []ClassifierLatency {
+	l.mu.Lock()
+	out := make([]ClassifierLatency, 0, len(l.byName))
+	sorted := make(map[string][]time.Duration, len(l.byName))
+	for name, w := range l.byName {
+		out = append(out, ClassifierLatency{Name: name, Calls: w.calls, Errors: w.errors})
+		sorted[name] = slices.Clone(w.recent)
+	}
+	l.mu.Unlock()
+
+	sort.Slice(out, func(i, j int) bool { return out[i].Name < out[j].Name })
+	for i := range out {
+		d := sorted[out[i].Name]
+		slices.Sort(d)
+		out[i].P50MS = ms(percentile(d, 50))
+		out[i].P90MS = ms(percentile(d, 90))
+		out[i].P99MS = ms(percentile(d, 99))
+		out[i].MaxMS = ms(d[len(d)-1])
+	}
+	return out
+}
+
+// percentile returns the p-th percentile of the sorted, non-empty d by the
+// nearest-rank method.
+func percentile(d []time.Duration, p int) time.Duration {
+	rank := (len(d)*p + 99) / 100
+	if rank < 1 {
+		rank = 1
+	}
+	return d[rank-1]
+}
+
+func ms(d time.Duration) float64 {
+	return float64(d.Microseconds()) / 1000
+}
+
+// StatusHandler returns an http.Handler that reports Snapshot as JSON.
+func (l *LatencyRecorder) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(l.Snapshot())
+	})
+}
@@ -11,12 +11,14 @@ import (
 	"bytes"
 	"context"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"log/slog"
 	"net/http"
 	"strings"
 	"time"
+	"unicode/utf8"
 
 	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
 )
@@ -35,6 +37,7 @@ Sensitive data includes:
 Do NOT flag: «TOKEN_» placeholders, city names alone, common words, dates, regular numbers.
 
 Return ONLY a valid JSON array of the exact sensitive strings. No explanation.
+If you think before answering, end with a line "Answer:" followed by the array.
 
 Examples:
 Input: "my api key is sk-abc123xyz789"
@@ -53,16 +56,56 @@ Output: []`
 type Classifier struct {
 	url   string
 	model string
+	opts  Options
 	http  *http.Client
 }
 
-// New creates a Classifier.
+// Upstream sends an OpenAI chat completion request body and returns the
+// response status and body.
+type Upstream func(ctx context.Context, body []byte) (status int, respBody []byte, err error)
+
+// Options configures a Classifier.
+type Options struct {
+	// MaxTokens is the completion token limit per request. 0 means 10000.
+	MaxTokens int
+
+	// RetryMaxTokens is the token limit for one retry of a response that
+	// was truncated by MaxTokens. 0, or a value not above MaxTokens,
+	// disables the retry.
+	RetryMaxTokens int
+
+	// Upstream, when set, sends classification requests through another
+	// transport instead of to the classifier's URL, e.g. the proxy's own
+	// Gonka client so the classifier model runs on the network.
+	Upstream Upstream
+
+	// WindowSize splits texts longer than this many bytes into overlapping
+	// windows that are classified separately, so long inputs do not produce
+	// answers longer than the token limit. 0 sends every text whole.
+	WindowSize int
+
+	// ReasoningFallback parses the answer out of the reasoning field when
+	// the content is empty, which is what small reasoning models (Qwen3 via
+	// Ollama) return when they run out of tokens before answering.
+	ReasoningFallback bool
+}
+
+// New creates a Classifier with the reasoning fallback enabled.
 // baseURL is the Ollama (or any OpenAI-compatible) server, e.g. "http://ollama:11434".
 // threshold is not used currently but kept for interface compatibility.
 func New(baseURL, model string, threshold float32) *Classifier {
+	return NewWithOptions(baseURL, model, Options{ReasoningFallback: true})
+}
+
+// NewWithOptions is like New but applies opts.
+func NewWithOptions(baseURL, model string, opts Options) *Classifier {
+	if opts.MaxTokens <= 0 {
+		opts.MaxTokens = 10000
+	}
 	return &Classifier{
 		url:   strings.TrimRight(baseURL, "/") + "/v1/chat/completions",
 		model: model,
+		opts:  opts,
 		http: &http.Client{
 			Timeout: 125 * time.Second,
 		},
@@ -75,8 +118,9 @@ type openAIRequest struct {
 	Temperature float64   `json:"temperature"`
 	MaxTokens   int       `json:"max_tokens"`
 	// Hint to disable chain-of-thought thinking (Qwen3 and some others support this).
-	// stripThinkBlock handles models that ignore it.
-	Think bool `json:"think"`
+	// stripThinkBlock handles models that ignore it. Ollama-specific, so it
+	// is left out when classifying through Options.Upstream.
+	Think *bool `json:"think,omitempty"`
 }
 
 type message struct {
@@ -96,13 +140,100 @@ type openAIResponse struct {
 }
 
 // Classify sends text to the LLM and returns sensitive spans.
-// It is safe for concurrent use.
+// It returns an error when the LLM cannot be reached, answers with a non-200
+// status, or gives no answer it can parse (ErrNoAnswer): a missing answer
+// is not a clean text. It is safe for concurrent use.
 func (c *Classifier) Classify(text string) ([]sanitize.Span, error) {
 	if strings.TrimSpace(text) == "" {
 		return nil, nil
 	}
 	slog.Info("llmclassifier: classifying", "url", c.url, "model", c.model, "text_len", len(text))
 
+	// Windows are classified one after another: the LLM is usually a single
+	// local model and parallel calls would only queue up there.
+	var sensitiveValues []string
+	ws := windows(text, c.opts.WindowSize, windowOverlap)
+	for _, w := range ws {
+		values, err := c.classifyWindow(w)
+		if err != nil {
+			return nil, err
+		}
+		sensitiveValues = append(sensitiveValues, values...)
+	}
+	if len(sensitiveValues) == 0 {
+		return nil, nil
+	}
+
+	// Find every occurrence of each sensitive value in the original text.
+	// Skip matches that land in the middle of a longer word. Values found
+	// in any window are searched in the whole text.
+	var spans []sanitize.Span
+	seen := make(map[string]bool)
+	for _, val := range sensitiveValues {
+		val = strings.TrimSpace(val)
+		if val == "" || seen[val] {
+			continue
+		}
+		seen[val] = true
+		if strings.HasPrefix(val, "«TOKEN_") {
+			continue
+		}
+		start := 0
+		for {
+			idx := strings.Index(text[start:], val)
+			if idx < 0 {
+				break
+			}
+			abs := start + idx
+			end := abs + len(val)
+			if isInsideToken(text, abs, end) {
+				start = end
+				continue
+			}
+			spans = append(spans, sanitize.Span{
+				Start: abs,
+				End:   end,
+				Label: "LLM",
+				Score: 1.0,
+				Text:  val,
+			})
+			start = end
+		}
+	}
+
+	if len(spans) > 0 {
+		slog.Info("llmclassifier: detected sensitive spans", "count", len(spans), "values", len(sensitiveValues), "windows", len(ws))
+	}
+	return spans, nil
+}
+
+// classifyWindow asks the LLM for the sensitive values in text. A response
+// cut off by the token limit may have lost values, or the whole answer, so
+// it is retried once with RetryMaxTokens and the values of both answers are
+// returned.
+func (c *Classifier) classifyWindow(text string) ([]string, error) {
+	values, truncated, err := c.complete(text, c.opts.MaxTokens)
+	if !truncated || err != nil && !errors.Is(err, ErrNoAnswer) {
+		return values, err
+	}
+	if c.opts.RetryMaxTokens <= c.opts.MaxTokens {
+		slog.Warn("llmclassifier: response truncated by token limit, increase SANITIZE_LLM_MAX_TOKENS or set SANITIZE_LLM_RETRY_MAX_TOKENS", "max_tokens", c.opts.MaxTokens)
+		return values, err
+	}
+	slog.Warn("llmclassifier: response truncated by token limit, retrying", "max_tokens", c.opts.MaxTokens, "retry_max_tokens", c.opts.RetryMaxTokens)
+	more, truncated, err := c.complete(text, c.opts.RetryMaxTokens)
+	if err != nil {
+		return nil, err
+	}
+	if truncated {
+		slog.Warn("llmclassifier: response truncated again, detections may be incomplete", "max_tokens", c.opts.RetryMaxTokens)
+	}
+	return append(values, more...), nil
+}
+
+// complete sends one classification request and parses the answer.
+// truncated reports finish_reason "length".
+func (c *Classifier) complete(text string, maxTokens int) (values []string, truncated bool, err error) {
 	reqBody := openAIRequest{
 		Model: c.model,
 		Messages: []message{
@@ -111,134 +242,268 @@ func (c *Classifier) Classify(text string) ([]sanitize.Span, error) {
 			{Role: "user", Content: "Text to classify:\n" + text + "\n/no_think"},
 		},
 		Temperature: 0,
-		MaxTokens:   10000,
-		Think:       false,
+		MaxTokens:   maxTokens,
+	}
+	if c.opts.Upstream == nil {
+		noThink := false
+		reqBody.Think = &noThink
 	}
 
 	body, err := json.Marshal(reqBody)
 	if err != nil {
-		return nil, fmt.Errorf("llmclassifier: marshal: %w", err)
+		return nil, false, fmt.Errorf("llmclassifier: marshal: %w", err)
 	}
 
 	ctx, cancel := context.WithTimeout(context.Background(), 120*time.Second)
 	defer cancel()
 
-	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	status, rawBody, err := c.post(ctx, body)
 	if err != nil {
-		return nil, fmt.Errorf("llmclassifier: request: %w", err)
+		return nil, false, err
 	}
-	req.Header.Set("Content-Type", "application/json")
-
-	resp, err := c.http.Do(req)
-	if err != nil {
-		slog.Warn("llmclassifier: LLM unreachable, skipping", "err", err)
-		return nil, nil
+	if status != http.StatusOK {
+		// The status only: an error body can echo the prompt, and this error
+		// reaches the logs and the breaker state.
+		return nil, false, &sanitize.StatusError{Source: "llmclassifier: LLM", Code: status}
 	}
-	defer resp.Body.Close()
-
-	if resp.StatusCode != http.StatusOK {
-		var errBody [512]byte
-		n, _ := resp.Body.Read(errBody[:])
-		slog.Warn("llmclassifier: unexpected status", "code", resp.StatusCode, "body", string(errBody[:n]))
-		return nil, nil
-	}
-
-	rawBody, err := io.ReadAll(resp.Body)
-	if err != nil {
-		slog.Warn("llmclassifier: read body", "err", err)
-		return nil, nil
-	}
-	slog.Info("llmclassifier: full response body", "body", string(rawBody))
 
 	var oaiResp openAIResponse
 	if err := json.Unmarshal(rawBody, &oaiResp); err != nil {
-		slog.Warn("llmclassifier: decode response", "err", err)
-		return nil, nil
+		return nil, false, fmt.Errorf("llmclassifier: decode response: %w", err)
 	}
 
 	if len(oaiResp.Choices) == 0 {
-		return nil, nil
+		return nil, false, fmt.Errorf("%w: response has no choices", ErrNoAnswer)
 	}
 
 	choice := oaiResp.Choices[0]
 	msg := choice.Message
+	// Lengths only: the answer holds the sensitive values, which must not
+	// reach the logs (see sanitize.AuditSink).
 	slog.Info("llmclassifier: raw response",
-		"content", msg.Content,
-		"reasoning", msg.Reasoning,
+		"content_len", len(msg.Content),
+		"reasoning_len", len(msg.Reasoning)+len(msg.ReasoningContent),
 		"finish_reason", choice.FinishReason,
 	)
 
-	if choice.FinishReason == "length" {
-		slog.Warn("llmclassifier: response truncated by token limit, increase MaxTokens or shorten prompt")
+	truncated = choice.FinishReason == "length"
+	values, ok := c.parseAnswer(msg.Content, msg.Reasoning, msg.ReasoningContent)
+	if !ok {
+		return nil, truncated, fmt.Errorf("%w (finish_reason %q)", ErrNoAnswer, choice.FinishReason)
 	}
+	return values, truncated, nil
+}
 
-	// Qwen3 via Ollama puts thinking in "reasoning" and the answer in "content".
-	// If content is empty the model ran out of tokens before answering; fall
-	// back to the reasoning field and dig the JSON array out of it.
-	raw := strings.TrimSpace(msg.Content)
-	if raw == "" {
-		raw = strings.TrimSpace(msg.Reasoning)
-		if raw == "" {
-			raw = strings.TrimSpace(msg.ReasoningContent)
+// post sends a chat completion request body to the LLM, through
+// Options.Upstream when set, and returns the response status and body.
+func (c *Classifier) post(ctx context.Context, body []byte) (int, []byte, error) {
+	if c.opts.Upstream != nil {
+		status, respBody, err := c.opts.Upstream(ctx, body)
+		if err != nil {
+			return 0, nil, fmt.Errorf("llmclassifier: upstream: %w", err)
 		}
+		return status, respBody, nil
 	}
 
-	content := stripThinkBlock(raw)
-	content = stripCodeFence(content)
-	// Last resort: try to pull a JSON array out of wherever it is in the text.
-	if !strings.Contains(content, "[") {
-		content = extractJSONArray(content)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, nil, fmt.Errorf("llmclassifier: request: %w", err)
 	}
-	slog.Info("llmclassifier: parsed content", "content", content)
+	req.Header.Set("Content-Type", "application/json")
 
-	// Parse the array of sensitive strings.
-	var sensitiveValues []string
-	if err := json.Unmarshal([]byte(content), &sensitiveValues); err != nil {
-		slog.Warn("llmclassifier: could not parse LLM output", "content", content, "err", err)
-		return nil, nil
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return 0, nil, fmt.Errorf("llmclassifier: LLM unreachable: %w", err)
+	}
+	defer resp.Body.Close()
+
+	rawBody, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return 0, nil, fmt.Errorf("llmclassifier: read body: %w", err)
 	}
+	return resp.StatusCode, rawBody, nil
+}
 
-	if len(sensitiveValues) == 0 {
-		return nil, nil
+// windowOverlap is how many bytes consecutive windows share, so a value
+// cut by one window boundary is still seen whole in the other window.
+const windowOverlap = 256
+
+// windows splits text into pieces of at most size bytes that overlap by
+// overlap bytes, cutting at whitespace where possible and never inside a
+// UTF-8 sequence. size <= 0, or a text that fits, yields text itself. A
+// window always holds at least one whole character, so with a size below
+// the length of a character it can exceed size.
+func windows(text string, size, overlap int) []string {
+	if size <= 0 || len(text) <= size {
+		return []string{text}
+	}
+	if overlap >= size/2 {
+		overlap = size / 2
 	}
+	var out []string
+	for start := 0; ; {
+		end := start + size
+		if end >= len(text) {
+			return append(out, text[start:])
+		}
+		// Prefer the last whitespace in the overlap zone, so the next
+		// window starts on a word.
+		if i := strings.LastIndexAny(text[end-overlap:end], " \t\n\r"); i >= 0 {
+			end = end - overlap + i + 1
+		}
+		for end > start && !utf8.RuneStart(text[end]) {
+			end--
+		}
+		if end == start {
+			// size is smaller than the character at start: take it whole.
+			_, n := utf8.DecodeRuneInString(text[start:])
+			if end = start + n; end == len(text) {
+				return append(out, text[start:])
+			}
+		}
+		out = append(out, text[start:end])
+		next := end - overlap
+		for next > start && !utf8.RuneStart(text[next]) {
+			next--
+		}
+		if next <= start {
+			next = end
+		}
+		start = next
+	}
+}
 
-	// Find every occurrence of each sensitive value in the original text.
-	// Skip matches that land in the middle of a longer word.
-	var spans []sanitize.Span
-	for _, val := range sensitiveValues {
-		val = strings.TrimSpace(val)
-		if val == "" {
-			continue
+// Warmup sends a minimal completion to the LLM so the server loads the model
+// into memory before the first real Classify call has to pay for it.
+// It blocks until the model answers or ctx is done. With Options.Upstream it
+// does nothing: network models are always loaded, and every request costs.
+func (c *Classifier) Warmup(ctx context.Context) error {
+	if c.opts.Upstream != nil {
+		return nil
+	}
+	body, err := json.Marshal(openAIRequest{
+		Model:     c.model,
+		Messages:  []message{{Role: "user", Content: "ok /no_think"}},
+		MaxTokens: 1,
+	})
+	if err != nil {
+		return fmt.Errorf("llmclassifier: warmup marshal: %w", err)
+	}
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
+	if err != nil {
+		return fmt.Errorf("llmclassifier: warmup request: %w", err)
+	}
+	req.Header.Set("Content-Type", "application/json")
+
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return fmt.Errorf("llmclassifier: warmup: %w", err)
+	}
+	defer resp.Body.Close()
+	_, _ = io.Copy(io.Discard, resp.Body)
+
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("llmclassifier: warmup: status %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// ErrNoAnswer is returned when the LLM's output holds no answer that can be
+// parsed, for example when it ran out of tokens while thinking.
+var ErrNoAnswer = errors.New("llmclassifier: no answer in LLM output")
+
+// answerMarker introduces the answer in text that is not a bare array; the
+// system prompt asks for it. Arrays before it, such as the prompt's own
+// examples quoted while thinking, are never taken for the answer.
+const answerMarker = "answer:"
+
+// parseAnswer extracts the array of sensitive strings from a response.
+// Qwen3 via Ollama puts thinking in "reasoning" (or "reasoning_content") and
+// the answer in "content". If content is empty the model ran out of tokens
+// before answering; with ReasoningFallback the array is then taken from
+// after the answer marker in the reasoning instead. ok is false when no
+// answer could be found.
+func (c *Classifier) parseAnswer(content, reasoning, reasoningContent string) (values []string, ok bool) {
+	if strings.TrimSpace(content) != "" {
+		values, ok = parseValues(content)
+		if !ok {
+			slog.Warn("llmclassifier: could not parse LLM output", "content_len", len(content))
 		}
-		if strings.HasPrefix(val, "«TOKEN_") {
+		return values, ok
+	}
+	if !c.opts.ReasoningFallback {
+		slog.Warn("llmclassifier: empty answer and reasoning fallback disabled")
+		return nil, false
+	}
+	for _, r := range []string{reasoning, reasoningContent} {
+		if strings.TrimSpace(r) == "" {
 			continue
 		}
-		start := 0
-		for {
-			idx := strings.Index(text[start:], val)
-			if idx < 0 {
-				break
-			}
-			abs := start + idx
-			end := abs + len(val)
-			if isInsideToken(text, abs, end) {
-				start = end
-				continue
-			}
-			spans = append(spans, sanitize.Span{
-				Start: abs,
-				End:   end,
-				Label: "LLM",
-				Score: 1.0,
-			})
-			start = end
+		// The reasoning is prose, often quoting the prompt's examples, so
+		// only an array after the answer marker counts.
+		if values, ok = markedArray(r); ok {
+			slog.Info("llmclassifier: answer taken from reasoning", "values", len(values))
+			return values, true
 		}
 	}
+	slog.Warn("llmclassifier: empty answer and no marked answer in reasoning")
+	return nil, false
+}
 
-	if len(spans) > 0 {
-		slog.Info("llmclassifier: detected sensitive spans", "count", len(spans), "values", len(sensitiveValues))
+// parseValues parses a model answer: a JSON array of strings, possibly
+// after a <think> block or inside a code fence, else the array after the
+// answer marker, else the last array in the text. Unlike reasoning, content
+// seldom quotes the prompt's examples, and small non-reasoning models often
+// wrap the answer in prose ("Here they are: [...]") without a marker.
+func parseValues(s string) ([]string, bool) {
+	s = stripCodeFence(stripThinkBlock(s))
+	var values []string
+	if err := json.Unmarshal([]byte(s), &values); err == nil {
+		return values, true
 	}
-	return spans, nil
+	if values, ok := markedArray(s); ok {
+		return values, true
+	}
+	return lastStringArray(s)
+}
+
+// lastStringArray returns the last JSON array of strings embedded in s.
+// Candidates start at each '[' from the end; the first that decodes as
+// []string wins. A '[' inside a string value or prose like "[1]" simply
+// fails to decode and the search moves on.
+func lastStringArray(s string) ([]string, bool) {
+	for end := len(s); end > 0; {
+		i := strings.LastIndexByte(s[:end], '[')
+		if i < 0 {
+			break
+		}
+		var values []string
+		if err := json.NewDecoder(strings.NewReader(s[i:])).Decode(&values); err == nil {
+			return values, true
+		}
+		end = i
+	}
+	return nil, false
+}
+
+// markedArray returns the JSON array of strings that follows the last
+// answer marker in s, optionally inside a code fence. ok is false when there
+// is no marker, or what follows it is not a complete array of strings.
+func markedArray(s string) ([]string, bool) {
+	i := strings.LastIndex(strings.ToLower(s), answerMarker)
+	if i < 0 {
+		return nil, false
+	}
+	rest := strings.TrimSpace(s[i+len(answerMarker):])
+	if strings.HasPrefix(rest, "```") {
+		rest = stripCodeFence(rest)
+	}
+	var values []string
+	if err := json.NewDecoder(strings.NewReader(rest)).Decode(&values); err != nil {
+		return nil, false
+	}
+	return values, true
 }
 
 // isInsideToken reports whether span [start,end) sits inside a larger word.
@@ -262,19 +527,6 @@ func isBoundary(b byte) bool {
 	return false
 }
 
-// extractJSONArray finds the first [...] substring in s.
-func extractJSONArray(s string) string {
-	start := strings.Index(s, "[")
-	if start < 0 {
-		return s
-	}
-	end := strings.LastIndex(s, "]")
-	if end < start {
-		return s
-	}
-	return s[start : end+1]
-}
-
 // stripThinkBlock removes Qwen3's <think>...</think> block that appears before
 // the actual answer when thinking mode is active.
 func stripThinkBlock(s string) string {
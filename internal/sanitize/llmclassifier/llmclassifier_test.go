@@ -0,0 +1,325 @@
+package llmclassifier
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+	"unicode/utf8"
+)
+
+// serveFixture answers every request with the response body in testdata/name.
+// The fixtures are synthetic: hand-written /v1/chat/completions responses in
+// the shape Ollama returns (synthetic-reasoning-content.json in the shape of
+// servers that use reasoning_content), not captures, so their ids,
+// timestamps and usage figures are made up. The reasoning ones mimic qwen3
+// spending its token budget thinking and never writing the answer to content.
+func serveFixture(t *testing.T, name string) string {
+	t.Helper()
+	body, err := os.ReadFile(filepath.Join("testdata", name))
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		w.Write(body)
+	}))
+	t.Cleanup(srv.Close)
+	return srv.URL
+}
+
+func TestClassifyParsesAnswers(t *testing.T) {
+	tests := []struct {
+		fixture string
+		text    string
+		noFall  bool // disable the reasoning fallback
+		want    []string
+		wantErr bool // no answer: ErrNoAnswer
+	}{
+		{fixture: "synthetic-ollama-content.json", text: "my key is sk-abc123xyz789", want: []string{"sk-abc123xyz789"}},
+		{fixture: "synthetic-ollama-content-think.json", text: "my key is sk-abc123xyz789", want: []string{"sk-abc123xyz789"}},
+		{fixture: "synthetic-ollama-content-prose.json", text: "mail john@example.com or call", want: []string{"john@example.com"}},
+		{
+			// The thoughts quote the prompt's examples and reach an array,
+			// but were cut off before the answer marker: no answer, not [].
+			fixture: "synthetic-ollama-reasoning-truncated.json",
+			text:    "call John Smith at +79997899900, key sk-live-42x",
+			wantErr: true,
+		},
+		{fixture: "synthetic-ollama-reasoning-prose.json", text: "my password is hunter2", want: []string{"hunter2"}},
+		{fixture: "synthetic-reasoning-content.json", text: "token ghp_xyz789 here", want: []string{"ghp_xyz789"}},
+		{fixture: "synthetic-ollama-reasoning-no-array.json", text: "We met with the team", wantErr: true},
+		{fixture: "synthetic-ollama-reasoning-prose.json", text: "my password is hunter2", noFall: true, wantErr: true},
+	}
+	for _, tt := range tests {
+		t.Run(tt.fixture, func(t *testing.T) {
+			c := NewWithOptions(serveFixture(t, tt.fixture), "qwen3:4b", Options{ReasoningFallback: !tt.noFall})
+			spans, err := c.Classify(tt.text)
+			if tt.wantErr {
+				if !errors.Is(err, ErrNoAnswer) {
+					t.Fatalf("err = %v, spans %+v; want ErrNoAnswer", err, spans)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, sp := range spans {
+				if tt.text[sp.Start:sp.End] != sp.Text {
+					t.Fatalf("span %+v does not select its text", sp)
+				}
+				got = append(got, sp.Text)
+			}
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %q, want %q", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestLastStringArray(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{`["a", "b"]`, []string{"a", "b"}, true},
+		{`so: ["a"] then [1] and ["b"] done`, []string{"b"}, true},
+		{`answer ["x[1]"] end`, []string{"x[1]"}, true},
+		{`empty [] here`, []string{}, true},
+		{`truncated ["a", "b`, nil, false},
+		{`no array`, nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := lastStringArray(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("lastStringArray(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+func TestMarkedArray(t *testing.T) {
+	tests := []struct {
+		in   string
+		want []string
+		ok   bool
+	}{
+		{"Answer: [\"a\", \"b\"]", []string{"a", "b"}, true},
+		{"Output: [] ... answer: [\"x[1]\"] done", []string{"x[1]"}, true},
+		{"ANSWER:\n```json\n[\"a\"]\n```\nok", []string{"a"}, true},
+		{"Answer: []", []string{}, true},
+		{"answer: [] or maybe. Answer: [\"b\"]", []string{"b"}, true},
+		// Arrays without a marker, like quoted examples, never count.
+		{"Output: [] and so [\"a\"]", nil, false},
+		{"Answer: [\"a\", \"b", nil, false},
+		{"Answer: I think [1]", nil, false},
+		{"no array", nil, false},
+	}
+	for _, tt := range tests {
+		got, ok := markedArray(tt.in)
+		if ok != tt.ok || !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("markedArray(%q) = %q, %v; want %q, %v", tt.in, got, ok, tt.want, tt.ok)
+		}
+	}
+}
+
+// completion builds an Ollama-style response with the given content.
+func completion(content, finish string) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"choices": []map[string]any{{
+			"message":       map[string]string{"role": "assistant", "content": content},
+			"finish_reason": finish,
+		}},
+	})
+	return b
+}
+
+func TestClassifyRetriesTruncatedResponse(t *testing.T) {
+	var limits []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		limits = append(limits, req.MaxTokens)
+		if req.MaxTokens < 100 {
+			// Cut off in the middle of the second value.
+			w.Write(completion(`["sk-abc123xyz789", "John Sm`, "length"))
+			return
+		}
+		w.Write(completion(`["sk-abc123xyz789", "John Smith"]`, "stop"))
+	}))
+	defer srv.Close()
+
+	text := "key sk-abc123xyz789 from John Smith"
+	c := NewWithOptions(srv.URL, "m", Options{MaxTokens: 50, RetryMaxTokens: 200})
+	spans, err := c.Classify(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(limits, []int{50, 200}) {
+		t.Fatalf("max_tokens sent = %v, want [50 200]", limits)
+	}
+	if len(spans) != 2 || spans[1].Text != "John Smith" {
+		t.Fatalf("spans = %+v", spans)
+	}
+
+	// Without a retry limit the truncated answer is all there is, and a cut
+	// off array is no answer.
+	limits = nil
+	spans, err = NewWithOptions(srv.URL, "m", Options{MaxTokens: 50}).Classify(text)
+	if len(limits) != 1 || !errors.Is(err, ErrNoAnswer) {
+		t.Fatalf("no-retry: %d requests, spans %+v, err %v", len(limits), spans, err)
+	}
+}
+
+func TestClassifyWindowsLongText(t *testing.T) {
+	var mu sync.Mutex
+	var sizes []int
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var req openAIRequest
+		json.NewDecoder(r.Body).Decode(&req)
+		text := req.Messages[1].Content
+		mu.Lock()
+		sizes = append(sizes, len(text))
+		mu.Unlock()
+		// Flag every whole word starting with sk- that this window sees.
+		var found []string
+		for _, f := range strings.Fields(text) {
+			if strings.HasPrefix(f, "sk-") && len(f) == len("sk-0000000000") {
+				found = append(found, f)
+			}
+		}
+		b, _ := json.Marshal(found)
+		w.Write(completion(string(b), "stop"))
+	}))
+	defer srv.Close()
+
+	var words []string
+	for i := 0; i < 2000; i++ {
+		if i%97 == 0 {
+			words = append(words, fmt.Sprintf("sk-%010d", i))
+		} else {
+			words = append(words, "lorem")
+		}
+	}
+	text := strings.Join(words, " ")
+	c := NewWithOptions(srv.URL, "m", Options{WindowSize: 1000})
+	spans, err := c.Classify(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := (2000 + 96) / 97; len(spans) != want {
+		t.Fatalf("found %d secrets, want %d", len(spans), want)
+	}
+	if len(sizes) < len(text)/1000 {
+		t.Fatalf("text of %d bytes sent in %d requests", len(text), len(sizes))
+	}
+	for _, n := range sizes {
+		if n > 1000+len("Text to classify:\n\n/no_think") {
+			t.Fatalf("window of %d bytes exceeds the window size", n)
+		}
+	}
+}
+
+func TestWindowsCoverText(t *testing.T) {
+	var b strings.Builder
+	for i := 0; i < 300; i++ {
+		fmt.Fprintf(&b, "слово%d ", i)
+	}
+	text := b.String()
+	ws := windows(text, 500, 64)
+	if len(ws) < 2 {
+		t.Fatalf("got %d windows", len(ws))
+	}
+	prevEnd := 0
+	for i, w := range ws {
+		if !utf8.ValidString(w) || len(w) > 500 {
+			t.Fatalf("window %d invalid or too long (%d bytes)", i, len(w))
+		}
+		start := strings.Index(text, w)
+		if start < 0 || start > prevEnd || (i > 0 && start == prevEnd) {
+			t.Fatalf("window %d starts at %d, previous ended at %d: want an overlap", i, start, prevEnd)
+		}
+		prevEnd = start + len(w)
+	}
+	if prevEnd != len(text) {
+		t.Fatalf("windows end at %d of %d bytes", prevEnd, len(text))
+	}
+	if got := windows("short", 500, 64); len(got) != 1 || got[0] != "short" {
+		t.Fatalf("short text split: %q", got)
+	}
+}
+
+func TestWindowsTinySizeMultibyte(t *testing.T) {
+	text := "日本語のテキスト 😀 ñandú"
+	for size := 1; size <= 8; size++ {
+		done := make(chan []string, 1)
+		go func() { done <- windows(text, size, windowOverlap) }()
+		var ws []string
+		select {
+		case ws = <-done:
+		case <-time.After(time.Second):
+			t.Fatalf("size %d: windows did not return", size)
+		}
+		start, end := -1, 0
+		for i, w := range ws {
+			if w == "" || !utf8.ValidString(w) {
+				t.Fatalf("size %d: window %d is %q", size, i, w)
+			}
+			next := strings.Index(text[start+1:], w)
+			if next < 0 || start+1+next > end {
+				t.Fatalf("size %d: window %d %q does not follow on", size, i, w)
+			}
+			start = start + 1 + next
+			end = start + len(w)
+		}
+		covered := end
+		if covered != len(text) {
+			t.Fatalf("size %d: windows cover %d of %d bytes", size, covered, len(text))
+		}
+	}
+}
+
+func TestClassifyThroughUpstream(t *testing.T) {
+	var sent map[string]any
+	up := func(ctx context.Context, body []byte) (int, []byte, error) {
+		json.Unmarshal(body, &sent)
+		return http.StatusOK, completion(`["hunter2"]`, "stop"), nil
+	}
+	// The URL is never dialled when an upstream is set.
+	c := NewWithOptions("http://127.0.0.1:1", "Qwen/Qwen3-32B-FP8", Options{Upstream: up})
+	spans, err := c.Classify("pw hunter2")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 || spans[0].Text != "hunter2" {
+		t.Fatalf("spans = %+v", spans)
+	}
+	if _, ok := sent["think"]; ok || sent["model"] != "Qwen/Qwen3-32B-FP8" {
+		t.Fatalf("request = %v", sent)
+	}
+	if err := c.Warmup(context.Background()); err != nil {
+		t.Fatalf("warmup through upstream: %v", err)
+	}
+
+	// The error body echoes the prompt; only the status may reach the error.
+	failing := NewWithOptions("", "m", Options{Upstream: func(context.Context, []byte) (int, []byte, error) {
+		return http.StatusBadGateway, []byte(`{"error":"bad input: pw hunter2"}`), nil
+	}})
+	_, err = failing.Classify("pw hunter2")
+	if err == nil || !strings.Contains(err.Error(), "502") {
+		t.Fatalf("err = %v, want the upstream status", err)
+	}
+	if strings.Contains(err.Error(), "hunter2") {
+		t.Fatalf("err = %v, leaks the response body", err)
+	}
+}
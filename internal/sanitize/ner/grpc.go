@@ -0,0 +1,222 @@
+package ner
+
+import (
+	"context"
+	"fmt"
+	"log/slog"
+	"math"
+	"strings"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/credentials/insecure"
+	"google.golang.org/protobuf/encoding/protowire"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/sanitize"
+)
+
+// classifyMethod is the full gRPC method name from classifier.proto.
+const classifyMethod = "/opengnk.sanitize.v1.Classifier/Classify"
+
+// GRPCClient calls a sidecar implementing classifier.proto over gRPC, which
+// avoids JSON encoding overhead at high volume. It is a drop-in alternative
+// to Client.
+type GRPCClient struct {
+	conn *grpc.ClientConn
+}
+
+// NewGRPC creates a GRPCClient for target ("host:port"; an http:// prefix is
+// ignored). The connection is established lazily on first use.
+func NewGRPC(target string) (*GRPCClient, error) {
+	target = strings.TrimPrefix(strings.TrimPrefix(target, "http://"), "grpc://")
+	conn, err := grpc.NewClient(target, grpc.WithTransportCredentials(insecure.NewCredentials()))
+	if err != nil {
+		return nil, fmt.Errorf("ner: grpc dial %s: %w", target, err)
+	}
+	return &GRPCClient{conn: conn}, nil
+}
+
+// Close closes the underlying connection.
+func (c *GRPCClient) Close() error {
+	return c.conn.Close()
+}
+
+// Classify sends text to the sidecar and returns sensitive spans.
+// It is safe for concurrent use.
+func (c *GRPCClient) Classify(text string) ([]sanitize.Span, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+
+	var resp pbClassifyResponse
+	if err := c.conn.Invoke(ctx, classifyMethod, &pbClassifyRequest{Text: text}, &resp, grpc.ForceCodec(wireCodec{})); err != nil {
+		return nil, fmt.Errorf("ner: grpc classify: %w", err)
+	}
+
+	byteOff := runeToByteOffsets(text)
+	spans := make([]sanitize.Span, 0, len(resp.Spans))
+	for _, s := range resp.Spans {
+		if s.Start < 0 || int(s.End) >= len(byteOff) || s.Start > s.End {
+			slog.Warn("sanitize-ner: span out of range, skipping", "start", s.Start, "end", s.End)
+			continue
+		}
+		score := s.Score
+		if score == 0 {
+			score = 1
+		}
+		spans = append(spans, sanitize.Span{
+			Start: byteOff[s.Start],
+			End:   byteOff[s.End],
+			Label: s.Label,
+			Score: score,
+			Text:  s.Text,
+		})
+	}
+	return spans, nil
+}
+
+// The messages below are hand-encoded with protowire so no generated code is
+// needed; field numbers must match classifier.proto.
+
+type pbClassifyRequest struct {
+	Text string
+}
+
+func (m *pbClassifyRequest) marshal() []byte {
+	var b []byte
+	if m.Text != "" {
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendString(b, m.Text)
+	}
+	return b
+}
+
+func (m *pbClassifyRequest) unmarshal(b []byte) error {
+	return walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) {
+		if num == 1 && typ == protowire.BytesType {
+			m.Text = string(v)
+		}
+	})
+}
+
+type pbSpan struct {
+	Start, End  int32
+	Label, Text string
+	Score       float32
+}
+
+type pbClassifyResponse struct {
+	Spans []pbSpan
+}
+
+func (m *pbClassifyResponse) marshal() []byte {
+	var b []byte
+	for _, s := range m.Spans {
+		var sb []byte
+		sb = protowire.AppendTag(sb, 1, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.Start))
+		sb = protowire.AppendTag(sb, 2, protowire.VarintType)
+		sb = protowire.AppendVarint(sb, uint64(s.End))
+		sb = protowire.AppendTag(sb, 3, protowire.BytesType)
+		sb = protowire.AppendString(sb, s.Label)
+		sb = protowire.AppendTag(sb, 4, protowire.BytesType)
+		sb = protowire.AppendString(sb, s.Text)
+		sb = protowire.AppendTag(sb, 5, protowire.Fixed32Type)
+		sb = protowire.AppendFixed32(sb, math.Float32bits(s.Score))
+		b = protowire.AppendTag(b, 1, protowire.BytesType)
+		b = protowire.AppendBytes(b, sb)
+	}
+	return b
+}
+
+func (m *pbClassifyResponse) unmarshal(b []byte) error {
+	var spanErr error
+	err := walkFields(b, func(num protowire.Number, typ protowire.Type, v []byte, _ uint64) {
+		if num != 1 || typ != protowire.BytesType {
+			return
+		}
+		var s pbSpan
+		err := walkFields(v, func(num protowire.Number, typ protowire.Type, v []byte, n uint64) {
+			switch {
+			case num == 1 && typ == protowire.VarintType:
+				s.Start = int32(n)
+			case num == 2 && typ == protowire.VarintType:
+				s.End = int32(n)
+			case num == 3 && typ == protowire.BytesType:
+				s.Label = string(v)
+			case num == 4 && typ == protowire.BytesType:
+				s.Text = string(v)
+			case num == 5 && typ == protowire.Fixed32Type:
+				s.Score = math.Float32frombits(uint32(n))
+			}
+		})
+		if err != nil && spanErr == nil {
+			spanErr = err
+		}
+		m.Spans = append(m.Spans, s)
+	})
+	if err != nil {
+		return err
+	}
+	return spanErr
+}
+
+// walkFields calls fn for each field in b. Length-delimited values are passed
+// as v, varint and fixed values as n; unknown fields are skipped.
+func walkFields(b []byte, fn func(num protowire.Number, typ protowire.Type, v []byte, n uint64)) error {
+	for len(b) > 0 {
+		num, typ, l := protowire.ConsumeTag(b)
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		var v []byte
+		var n uint64
+		switch typ {
+		case protowire.VarintType:
+			n, l = protowire.ConsumeVarint(b)
+		case protowire.Fixed32Type:
+			var x uint32
+			x, l = protowire.ConsumeFixed32(b)
+			n = uint64(x)
+		case protowire.Fixed64Type:
+			n, l = protowire.ConsumeFixed64(b)
+		case protowire.BytesType:
+			v, l = protowire.ConsumeBytes(b)
+		default:
+			l = protowire.ConsumeFieldValue(num, typ, b)
+		}
+		if l < 0 {
+			return protowire.ParseError(l)
+		}
+		b = b[l:]
+		fn(num, typ, v, n)
+	}
+	return nil
+}
+
+// wireCodec is a gRPC codec for the hand-encoded messages above. It reports
+// itself as "proto", so servers see ordinary application/grpc+proto traffic.
+type wireCodec struct{}
+
+type wireMessage interface {
+	marshal() []byte
+	unmarshal([]byte) error
+}
+
+func (wireCodec) Marshal(v any) ([]byte, error) {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return nil, fmt.Errorf("ner: cannot encode %T", v)
+	}
+	return m.marshal(), nil
+}
+
+func (wireCodec) Unmarshal(data []byte, v any) error {
+	m, ok := v.(wireMessage)
+	if !ok {
+		return fmt.Errorf("ner: cannot decode into %T", v)
+	}
+	return m.unmarshal(data)
+}
+
+func (wireCodec) Name() string { return "proto" }
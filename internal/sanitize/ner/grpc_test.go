@@ -0,0 +1,111 @@
+package ner
+
+import (
+	"context"
+	"net"
+	"strings"
+	"testing"
+
+	"google.golang.org/grpc"
+)
+
+// fakeClassifier flags every occurrence of "Иван" (code-point offsets, like
+// the Python sidecar).
+type fakeClassifier struct{}
+
+func (fakeClassifier) classify(_ context.Context, req *pbClassifyRequest) (*pbClassifyResponse, error) {
+	var resp pbClassifyResponse
+	runes := []rune(req.Text)
+	target := []rune("Иван")
+	for i := 0; i+len(target) <= len(runes); i++ {
+		if string(runes[i:i+len(target)]) == string(target) {
+			resp.Spans = append(resp.Spans, pbSpan{Start: int32(i), End: int32(i + len(target)), Label: "PER", Text: "Иван"})
+		}
+	}
+	// Out-of-range spans must be skipped, not crash the client.
+	resp.Spans = append(resp.Spans, pbSpan{Start: 0, End: int32(len(runes) + 5), Label: "BAD", Score: 0.5})
+	return &resp, nil
+}
+
+func startFakeServer(t *testing.T) string {
+	t.Helper()
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	srv := grpc.NewServer(grpc.ForceServerCodec(wireCodec{}))
+	srv.RegisterService(&grpc.ServiceDesc{
+		ServiceName: "opengnk.sanitize.v1.Classifier",
+		HandlerType: (*any)(nil),
+		Methods: []grpc.MethodDesc{{
+			MethodName: "Classify",
+			Handler: func(_ any, ctx context.Context, dec func(any) error, _ grpc.UnaryServerInterceptor) (any, error) {
+				var req pbClassifyRequest
+				if err := dec(&req); err != nil {
+					return nil, err
+				}
+				return fakeClassifier{}.classify(ctx, &req)
+			},
+		}},
+	}, struct{}{})
+	go func() { _ = srv.Serve(lis) }()
+	t.Cleanup(srv.Stop)
+	return lis.Addr().String()
+}
+
+func TestGRPCClientClassify(t *testing.T) {
+	c, err := NewGRPC(startFakeServer(t))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+
+	text := "Привет, Иван! Bye Иван"
+	spans, err := c.Classify(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 2 {
+		t.Fatalf("got %d spans, want 2: %+v", len(spans), spans)
+	}
+	for _, sp := range spans {
+		if text[sp.Start:sp.End] != "Иван" || sp.Label != "PER" || sp.Score != 1 {
+			t.Fatalf("bad span %+v selects %q", sp, text[sp.Start:sp.End])
+		}
+	}
+	if !strings.HasSuffix(text[:spans[1].End], "Bye Иван") {
+		t.Fatalf("second span ends at %d", spans[1].End)
+	}
+}
+
+func TestGRPCClientUnreachable(t *testing.T) {
+	lis, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := lis.Addr().String()
+	lis.Close()
+
+	c, err := NewGRPC(addr)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer c.Close()
+	if _, err := c.Classify("hello"); err == nil {
+		t.Fatal("Classify against a closed port succeeded")
+	}
+}
+
+func TestWireMessagesRoundTrip(t *testing.T) {
+	in := pbClassifyResponse{Spans: []pbSpan{{Start: 1, End: 4, Label: "ORG", Text: "ACME", Score: 0.75}, {Start: -1}}}
+	var out pbClassifyResponse
+	if err := out.unmarshal(in.marshal()); err != nil {
+		t.Fatal(err)
+	}
+	if len(out.Spans) != 2 || out.Spans[0] != in.Spans[0] || out.Spans[1] != in.Spans[1] {
+		t.Fatalf("round trip: got %+v, want %+v", out, in)
+	}
+	if err := out.unmarshal([]byte{0x0a, 0x05, 0x01}); err == nil {
+		t.Fatal("truncated message decoded without error")
+	}
+}
@@ -1,6 +1,10 @@
 // Package ner provides a Classifier that calls the sanitize-ner Python sidecar
-// over HTTP. If the sidecar is unreachable, it logs a warning and returns no
-// spans so the rest of the sanitization pipeline can still run.
+// over HTTP. If the sidecar is unreachable it returns an error; the rest of the
+// sanitization pipeline still runs and the request is marked degraded (or
+// rejected under SANITIZE_FAIL_CLOSED).
+//
+// The same client also calls custom detection webhooks that speak the
+// sidecar's JSON protocol (see NewWebhook).
 package ner
 
 import (
@@ -17,21 +21,52 @@ import (
 
 // Client calls the NER sidecar's /classify endpoint.
 type Client struct {
-	url  string
-	http *http.Client
+	url     string
+	token   string        // sent as a bearer token when set
+	timeout time.Duration // per call
+	service string        // names the callee in errors
+	http    *http.Client
 }
 
 // New creates a NER Client pointing at the given base URL
 // (e.g. "http://sanitize-ner:8001").
 func New(baseURL string) *Client {
+	return newClient(baseURL+"/classify", "", 10*time.Second, "sidecar")
+}
+
+func newClient(url, token string, timeout time.Duration, service string) *Client {
 	return &Client{
-		url: baseURL + "/classify",
+		url:     url,
+		token:   token,
+		timeout: timeout,
+		service: service,
 		http: &http.Client{
-			Timeout: 10 * time.Second,
+			Timeout: timeout,
 		},
 	}
 }
 
+// Webhook is a Client for a user-provided detection service: it POSTs
+// {"text": "..."} to a URL and expects the sidecar's response shape,
+// {"spans": [{"start", "end", "label", "text"}]}, with offsets in code
+// points. It lets detection logic that is not a NER model plug in without
+// Go code.
+type Webhook struct {
+	*Client
+}
+
+// NewWebhook creates a Webhook posting to url as is. A non-empty token is
+// sent as "Authorization: Bearer <token>". A timeout of zero means 10s.
+func NewWebhook(url, token string, timeout time.Duration) *Webhook {
+	if timeout <= 0 {
+		timeout = 10 * time.Second
+	}
+	return &Webhook{newClient(url, token, timeout, "webhook")}
+}
+
+// Name identifies the webhook in samples and latency reports.
+func (w *Webhook) Name() string { return "webhook" }
+
 type classifyRequest struct {
 	Text string `json:"text"`
 }
@@ -47,15 +82,15 @@ type nerSpan struct {
 	Text  string `json:"text"`
 }
 
-// Classify sends text to the NER sidecar and returns sensitive spans.
-// It is safe for concurrent use.
+// Classify sends text to the NER sidecar (or webhook) and returns sensitive
+// spans. It is safe for concurrent use.
 func (c *Client) Classify(text string) ([]sanitize.Span, error) {
 	body, err := json.Marshal(classifyRequest{Text: text})
 	if err != nil {
 		return nil, fmt.Errorf("ner: marshal: %w", err)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	ctx, cancel := context.WithTimeout(context.Background(), c.timeout)
 	defer cancel()
 
 	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, bytes.NewReader(body))
@@ -63,17 +98,18 @@ func (c *Client) Classify(text string) ([]sanitize.Span, error) {
 		return nil, fmt.Errorf("ner: request: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	if c.token != "" {
+		req.Header.Set("Authorization", "Bearer "+c.token)
+	}
 
 	resp, err := c.http.Do(req)
 	if err != nil {
-		slog.Warn("sanitize-ner: sidecar unreachable, skipping NER layer", "err", err)
-		return nil, nil
+		return nil, fmt.Errorf("ner: %s unreachable: %w", c.service, err)
 	}
 	defer resp.Body.Close()
 
 	if resp.StatusCode != http.StatusOK {
-		slog.Warn("sanitize-ner: unexpected status", "code", resp.StatusCode)
-		return nil, nil
+		return nil, &sanitize.StatusError{Source: "ner: " + c.service, Code: resp.StatusCode}
 	}
 
 	var result classifyResponse
@@ -81,14 +117,31 @@ func (c *Client) Classify(text string) ([]sanitize.Span, error) {
 		return nil, fmt.Errorf("ner: decode: %w", err)
 	}
 
+	// The sidecar reports Python string offsets (code points); Spans use bytes.
+	byteOff := runeToByteOffsets(text)
 	spans := make([]sanitize.Span, 0, len(result.Spans))
 	for _, s := range result.Spans {
+		if s.Start < 0 || s.End >= len(byteOff) || s.Start > s.End {
+			slog.Warn("sanitize-ner: span out of range, skipping", "start", s.Start, "end", s.End)
+			continue
+		}
 		spans = append(spans, sanitize.Span{
-			Start: s.Start,
-			End:   s.End,
+			Start: byteOff[s.Start],
+			End:   byteOff[s.End],
 			Label: s.Label,
 			Score: 1.0,
+			Text:  s.Text,
 		})
 	}
 	return spans, nil
 }
+
+// runeToByteOffsets maps each code-point offset in text (including the
+// end-of-text offset) to its byte offset.
+func runeToByteOffsets(text string) []int {
+	offs := make([]int, 0, len(text)+1)
+	for i := range text {
+		offs = append(offs, i)
+	}
+	return append(offs, len(text))
+}
@@ -0,0 +1,50 @@
+package ner
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestWebhookClassify(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/detect" || r.Header.Get("Authorization") != "Bearer s3cret" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		var req classifyRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.Contains(req.Text, "slow") {
+			time.Sleep(200 * time.Millisecond)
+		}
+		// "Иван" at code points 4-8, as a Python service would report it.
+		_, _ = w.Write([]byte(`{"spans":[{"start":4,"end":8,"label":"PER","text":"Иван"},{"start":0,"end":99,"label":"BAD"}]}`))
+	}))
+	defer srv.Close()
+
+	wh := NewWebhook(srv.URL+"/detect", "s3cret", 50*time.Millisecond)
+	text := "Hi, Иван!"
+	spans, err := wh.Classify(text)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(spans) != 1 || text[spans[0].Start:spans[0].End] != "Иван" || spans[0].Label != "PER" {
+		t.Fatalf("want one PER span on Иван, got %+v", spans)
+	}
+	if wh.Name() != "webhook" {
+		t.Fatalf("Name() = %q", wh.Name())
+	}
+
+	if _, err := NewWebhook(srv.URL+"/detect", "wrong", 0).Classify(text); err == nil || !strings.Contains(err.Error(), "webhook returned status 403") {
+		t.Fatalf("want a status error, got %v", err)
+	}
+	if _, err := wh.Classify("slow " + text); err == nil {
+		t.Fatal("want a timeout error")
+	}
+}
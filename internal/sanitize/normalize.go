@@ -0,0 +1,108 @@
+package sanitize
+
+import (
+	"log/slog"
+	"strings"
+	"unicode/utf8"
+
+	"golang.org/x/text/unicode/norm"
+)
+
+// spanMap maps byte offsets in a normalized text (see normalizeText) back to
+// the original: byte i of the normalized text was produced by the original
+// bytes [from[i], to[i]).
+type spanMap struct {
+	from, to []int
+	origLen  int
+}
+
+// normalizeText returns text as classifiers see it with Options.Normalize:
+// NFKC-normalized, so fullwidth letters, ligatures, NBSP and the other
+// unicode spaces fold to their plain forms, and without zero-width
+// characters, which can be slipped between the characters of a value to hide
+// it. The map is nil when normalization changed nothing.
+func normalizeText(text string) (string, *spanMap) {
+	if isASCII(text) {
+		return text, nil
+	}
+	var b strings.Builder
+	b.Grow(len(text))
+	m := &spanMap{from: make([]int, 0, len(text)), to: make([]int, 0, len(text)), origLen: len(text)}
+	var it norm.Iter
+	it.InitString(norm.NFKC, text)
+	for !it.Done() {
+		start := it.Pos()
+		seg := it.Next()
+		end := it.Pos()
+		for i := 0; i < len(seg); {
+			r, n := utf8.DecodeRune(seg[i:])
+			if !isZeroWidth(r) {
+				b.Write(seg[i : i+n])
+				for k := 0; k < n; k++ {
+					m.from = append(m.from, start)
+					m.to = append(m.to, end)
+				}
+			}
+			i += n
+		}
+	}
+	if b.Len() == len(text) && b.String() == text {
+		return text, nil
+	}
+	return b.String(), m
+}
+
+// spans maps spans found in the normalized text back to the original. A span
+// covering part of what one original character became (the "f" of "ﬁ")
+// widens to that whole character, and one next to stripped zero-width
+// characters takes them in, so they cannot split it from a delimiter. Spans
+// with invalid offsets, or whose Text does not match the normalized text, are
+// dropped. A nil map returns spans unchanged.
+func (m *spanMap) spans(normalized string, spans []Span) []Span {
+	if m == nil || len(spans) == 0 {
+		return spans
+	}
+	out := make([]Span, 0, len(spans))
+	for _, sp := range spans {
+		if sp.Start < 0 || sp.End > len(normalized) || sp.Start >= sp.End {
+			continue
+		}
+		if sp.Text != "" && normalized[sp.Start:sp.End] != sp.Text {
+			slog.Warn("sanitize: span offsets do not match its text, skipping", "label", sp.Label, "start", sp.Start, "end", sp.End)
+			continue
+		}
+		// Stripped characters leave a gap between the original bytes of
+		// neighbouring normalized bytes; extend into it.
+		start, end := 0, m.origLen
+		if sp.Start > 0 {
+			start = min(m.from[sp.Start], m.to[sp.Start-1])
+		}
+		if sp.End < len(normalized) {
+			end = max(m.to[sp.End-1], m.from[sp.End])
+		}
+		sp.Start, sp.End = start, end
+		sp.Text = "" // checked above; the original may differ
+		out = append(out, sp)
+	}
+	return out
+}
+
+// isZeroWidth reports whether r is an invisible character normalizeText
+// strips: zero-width space, non-joiner and joiner, word joiner, BOM, soft
+// hyphen and the Mongolian vowel separator.
+func isZeroWidth(r rune) bool {
+	switch r {
+	case '\u200b', '\u200c', '\u200d', '\u2060', '\ufeff', '\u00ad', '\u180e':
+		return true
+	}
+	return false
+}
+
+func isASCII(s string) bool {
+	for i := 0; i < len(s); i++ {
+		if s[i] >= utf8.RuneSelf {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,131 @@
+package sanitize
+
+import (
+	"log/slog"
+	"regexp"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// PrescreenMode sets how eagerly a Prescreen lets text through to the
+// classifier it guards.
+type PrescreenMode string
+
+const (
+	// PrescreenOff passes every text on.
+	PrescreenOff PrescreenMode = ""
+	// PrescreenConservative skips only texts without any capitalized word
+	// past the start of a sentence, acronym, number, mixed letter-digit
+	// token of 6+ characters, or credential, email or phone pattern.
+	PrescreenConservative PrescreenMode = "conservative"
+	// PrescreenAggressive also lets single capitalized words, shorter
+	// numbers and mixed tokens under 12 characters pass as clean: only
+	// capitalized runs of two or more words ("John Smith", "Acme Corp")
+	// count as candidates. Faster, but a lone first name is missed.
+	PrescreenAggressive PrescreenMode = "aggressive"
+)
+
+// prescreenRe matches patterns that always make a text a candidate: emails,
+// phone, card and account numbers, URLs with credentials, and words that
+// introduce secrets.
+var prescreenRe = regexp.MustCompile(`(?i)` + strings.Join([]string{
+	`[\w.+-]+@[\w-]+\.\w`,
+	`\+?\d[\d ().-]{5,}\d`,
+	`://[^/\s:@]+:[^/\s@]+@`,
+	`\b(?:passw(?:or)?d|passcode|pwd|pin|secret|token|api[ _-]?key|bearer|credentials?|private key|ssh-\w+|ssn|iban)\b`,
+}, "|"))
+
+// Prescreen guards an expensive classifier, typically the LLM layer, with a
+// cheap check for anything that looks sensitive. Texts without a single
+// candidate are not sent to it at all and are left to the other classifiers
+// (NER); the rest are classified as usual. Most chat messages contain
+// nothing sensitive, so this takes the LLM round trip off the typical
+// request at the cost of the few values only the LLM would have spotted in
+// otherwise unremarkable text. BenchmarkPrescreen measures both.
+type Prescreen struct {
+	inner Classifier
+	mode  PrescreenMode
+}
+
+// NewPrescreen wraps c in a Prescreen. With PrescreenOff it classifies every
+// text with c.
+func NewPrescreen(c Classifier, mode PrescreenMode) *Prescreen {
+	return &Prescreen{inner: c, mode: mode}
+}
+
+// Name reports the wrapped classifier's name, so latency and samples stay
+// keyed as before.
+func (p *Prescreen) Name() string { return ClassifierName(p.inner) }
+
+// Classify calls the wrapped classifier unless text has no candidates.
+func (p *Prescreen) Classify(text string) ([]Span, error) {
+	if p.mode != PrescreenOff && !p.candidate(text) {
+		slog.Debug("sanitize: prescreen found nothing, skipping classifier", "classifier", p.Name(), "len", len(text))
+		return nil, nil
+	}
+	return p.inner.Classify(text)
+}
+
+// candidate reports whether text has anything p.inner should look at.
+func (p *Prescreen) candidate(text string) bool {
+	if prescreenRe.MatchString(text) {
+		return true
+	}
+	aggressive := p.mode == PrescreenAggressive
+	mixedLen := 6
+	if aggressive {
+		mixedLen = 12
+	}
+
+	sentenceStart := true // the next word begins a sentence
+	capitalRun := 0       // consecutive capitalized words so far
+	for _, word := range strings.FieldsFunc(text, unicode.IsSpace) {
+		letters, digits, upper, uncased := 0, 0, 0, false
+		for _, r := range word {
+			switch {
+			case unicode.IsDigit(r):
+				digits++
+			case unicode.IsLetter(r):
+				letters++
+				if unicode.IsUpper(r) {
+					upper++
+				} else if !unicode.IsLower(r) {
+					uncased = true
+				}
+			}
+		}
+		if uncased {
+			// Scripts without case (CJK, Arabic, ...) cannot be judged.
+			return true
+		}
+		if letters > 0 && digits > 0 && utf8.RuneCountInString(word) >= mixedLen {
+			return true
+		}
+		if !aggressive && digits >= 4 {
+			return true
+		}
+
+		core := strings.TrimFunc(word, func(r rune) bool { return !unicode.IsLetter(r) && !unicode.IsDigit(r) })
+		first, _ := utf8.DecodeRuneInString(core)
+		// The pronoun "I" (and "I'm", "I'll", ...) is no name.
+		capitalized := unicode.IsUpper(first) && core != "I" && !strings.HasPrefix(core, "I'") && !strings.HasPrefix(core, "I’")
+		switch {
+		case !capitalized:
+			capitalRun = 0
+		case aggressive:
+			capitalRun++
+			if capitalRun >= 2 {
+				return true
+			}
+		case !sentenceStart || upper > 1 && upper == letters:
+			// A name mid-sentence, or an acronym.
+			return true
+		}
+		sentenceStart = strings.ContainsAny(word[len(word)-1:], ".!?:")
+		if sentenceStart {
+			capitalRun = 0
+		}
+	}
+	return false
+}
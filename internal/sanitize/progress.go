@@ -0,0 +1,31 @@
+package sanitize
+
+import (
+	"context"
+	"sync/atomic"
+)
+
+// Progress counts classifier findings while a request is redacted, so a
+// caller can report on long-running sanitization from another goroutine.
+type Progress struct {
+	spans atomic.Int64
+}
+
+type progressKey struct{}
+
+// WithProgress returns a context under which Redact calls add their
+// classifier findings to p.
+func WithProgress(ctx context.Context, p *Progress) context.Context {
+	return context.WithValue(ctx, progressKey{}, p)
+}
+
+func progressFrom(ctx context.Context) *Progress {
+	p, _ := ctx.Value(progressKey{}).(*Progress)
+	return p
+}
+
+// Spans returns the spans classifiers have reported so far. A value flagged
+// by several classifiers, or in several texts, counts each time.
+func (p *Progress) Spans() int64 {
+	return p.spans.Load()
+}
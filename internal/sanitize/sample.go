@@ -0,0 +1,141 @@
+package sanitize
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// Sample is one classifier's raw output for one input text, stripped of the
+// text itself: the input is identified only by a keyed hash and its length,
+// and spans carry offsets and labels but not the values they cover. Samples
+// are meant for offline tuning of classifier prompts and thresholds.
+type Sample struct {
+	Time       time.Time    `json:"time"`
+	InputHash  string       `json:"input_hash"`
+	InputLen   int          `json:"input_len"`
+	Classifier string       `json:"classifier"`
+	DurationMS int64        `json:"duration_ms"`
+	Spans      []SampleSpan `json:"spans"`
+	Error      string       `json:"error,omitempty"` // class only, see sampleError
+}
+
+// SampleSpan is a Span without its text.
+type SampleSpan struct {
+	Label string  `json:"label"`
+	Start int     `json:"start"`
+	End   int     `json:"end"`
+	Score float32 `json:"score"`
+}
+
+// SampleSink receives classifier samples (Options.SampleSink). Record is
+// called from classifier goroutines and must be safe for concurrent use.
+type SampleSink interface {
+	Record(Sample)
+}
+
+// Named is implemented by classifiers that report a name in samples.
+// Others are identified by their Go type.
+type Named interface {
+	Name() string
+}
+
+// ClassifierName returns the name c is reported under in samples, latency
+// and Options.Required: its Name if it is Named, else its Go type.
+func ClassifierName(c Classifier) string {
+	if n, ok := c.(Named); ok {
+		return n.Name()
+	}
+	return fmt.Sprintf("%T", c)
+}
+
+// sampleKey keys input hashes. It is random per process, so hashes group
+// identical inputs within a run but cannot be matched against guessed
+// values (names, card numbers) offline.
+var sampleKey = func() []byte {
+	k := make([]byte, 32)
+	_, _ = rand.Read(k)
+	return k
+}()
+
+func hashInput(text string) string {
+	mac := hmac.New(sha256.New, sampleKey)
+	mac.Write([]byte(text))
+	return hex.EncodeToString(mac.Sum(nil)[:16])
+}
+
+func newSample(text, classifier string, spans []Span, err error, took time.Duration) Sample {
+	s := Sample{
+		Time:       time.Now().UTC(),
+		InputHash:  hashInput(text),
+		InputLen:   len(text),
+		Classifier: classifier,
+		DurationMS: took.Milliseconds(),
+		Spans:      make([]SampleSpan, 0, len(spans)),
+	}
+	for _, sp := range spans {
+		s.Spans = append(s.Spans, SampleSpan{Label: sp.Label, Start: sp.Start, End: sp.End, Score: sp.Score})
+	}
+	if err != nil {
+		s.Error = sampleError(err)
+	}
+	return s
+}
+
+// sampleError reduces a classifier error to its class: "circuit_open",
+// "timeout", "canceled", "status_<code>" or "error". Error messages are not
+// recorded, as they can carry a backend's response and so the input text.
+func sampleError(err error) string {
+	var se *StatusError
+	switch {
+	case errors.Is(err, ErrBreakerOpen):
+		return "circuit_open"
+	case errors.Is(err, context.DeadlineExceeded):
+		return "timeout"
+	case errors.Is(err, context.Canceled):
+		return "canceled"
+	case errors.As(err, &se):
+		return "status_" + strconv.Itoa(se.Code)
+	}
+	return "error"
+}
+
+// FileSampleSink appends samples to a file as JSON lines.
+type FileSampleSink struct {
+	mu  sync.Mutex
+	f   *os.File
+	enc *json.Encoder
+}
+
+// NewFileSampleSink opens (or creates) path for appending.
+func NewFileSampleSink(path string) (*FileSampleSink, error) {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_APPEND|os.O_WRONLY, 0o600)
+	if err != nil {
+		return nil, fmt.Errorf("sanitize: sample file: %w", err)
+	}
+	return &FileSampleSink{f: f, enc: json.NewEncoder(f)}, nil
+}
+
+// Record writes s as one line. Write errors are dropped; sampling is best
+// effort.
+func (fs *FileSampleSink) Record(s Sample) {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	_ = fs.enc.Encode(s)
+}
+
+// Close closes the underlying file.
+func (fs *FileSampleSink) Close() error {
+	fs.mu.Lock()
+	defer fs.mu.Unlock()
+	return fs.f.Close()
+}
@@ -7,20 +7,29 @@
 // Usage:
 //
 //	s := sanitize.New()
-//	body, tm := s.RedactMessages(body)
+//	body, tm := s.RedactMessages(ctx, body)
 //	// send body to upstream
 //	respBody = s.RestoreBytes(respBody, tm)
 package sanitize
 
 import (
 	"context"
+	crand "crypto/rand"
+	"encoding/base32"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"log/slog"
+	"math/rand"
+	"reflect"
 	"regexp"
+	"slices"
+	"sort"
 	"strings"
 	"sync/atomic"
 	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // globalCounter generates unique token IDs across all requests in the process.
@@ -32,28 +41,140 @@ var globalCounter atomic.Uint64
 type TokenMap struct {
 	toToken   map[string]string // original value → «TOKEN_XXXX»
 	fromToken map[string]string // «TOKEN_XXXX» → original value
+	labels    map[string]string // «TOKEN_XXXX» → highest-priority label it was flagged with
+	typed     bool              // name tokens after their label (Options.TypedTokens)
+	nonce     string            // random part of every token, or "" (Options.TokenNonce)
+	counters  map[string]int    // typed token name → last number used
+	reserved  map[string]bool   // typed tokens already present in the input
+	degraded  bool              // a classifier failed or missed the budget, or the cap was hit
+	err       error             // classifier failures, joined
 }
 
 func newTokenMap() *TokenMap {
 	return &TokenMap{
 		toToken:   make(map[string]string),
 		fromToken: make(map[string]string),
+		labels:    make(map[string]string),
 	}
 }
 
 // register records a mapping and returns the placeholder token.
 // If the original was already registered, the existing token is returned.
-func (m *TokenMap) register(original string) string {
-	if tok, ok := m.toToken[original]; ok {
-		return tok
-	}
-	id := globalCounter.Add(1)
-	tok := fmt.Sprintf("«TOKEN_%06d»", id)
-	m.toToken[original] = tok
-	m.fromToken[tok] = original
+// A value flagged with several labels keeps the highest-priority one (see
+// labelPriority); a typed token keeps the name of the label it was first
+// registered with.
+func (m *TokenMap) register(original, label string) string {
+	tok, ok := m.toToken[original]
+	if !ok {
+		if m.typed {
+			name := tokenName(label)
+			if m.counters == nil {
+				m.counters = make(map[string]int)
+			}
+			for {
+				m.counters[name]++
+				if m.nonce != "" {
+					tok = fmt.Sprintf("«%s_%s_%d»", name, m.nonce, m.counters[name])
+				} else {
+					tok = fmt.Sprintf("«%s_%d»", name, m.counters[name])
+				}
+				if !m.reserved[tok] {
+					break
+				}
+			}
+		} else if m.nonce != "" {
+			tok = fmt.Sprintf("«TOKEN_%s_%06d»", m.nonce, globalCounter.Add(1))
+		} else {
+			tok = fmt.Sprintf("«TOKEN_%06d»", globalCounter.Add(1))
+		}
+		m.toToken[original] = tok
+		m.fromToken[tok] = original
+	}
+	if old, seen := m.labels[tok]; !seen || labelRank(label) > labelRank(old) {
+		m.labels[tok] = label
+	}
 	return tok
 }
 
+// reserve marks the placeholder-shaped text in texts as taken, so a typed
+// token never coincides with text the client sent and restoration stays
+// exact. Untyped tokens are numbered process-wide and need no reservation.
+func (m *TokenMap) reserve(texts ...string) {
+	if !m.typed {
+		return
+	}
+	for _, text := range texts {
+		for _, tok := range tokenPlaceholderRe.FindAllString(text, -1) {
+			if m.reserved == nil {
+				m.reserved = make(map[string]bool)
+			}
+			m.reserved[tok] = true
+		}
+	}
+}
+
+// maxTokenName bounds the label part of a typed token.
+const maxTokenName = 24
+
+// tokenNonceLen is the length of a token nonce: 8 base32 characters, 40
+// random bits, enough that a model reproducing one by chance is out of the
+// question while placeholders stay short for the model to copy.
+const tokenNonceLen = 8
+
+// newTokenNonce returns a random nonce of tokenNonceLen characters from the
+// token alphabet (A-Z, 2-7).
+func newTokenNonce() string {
+	var b [5]byte
+	_, _ = crand.Read(b[:])
+	return base32.StdEncoding.EncodeToString(b[:])
+}
+
+// tokenName turns a span label into the name part of a typed token: the
+// label upper-cased and reduced to letters and digits, or TOKEN for empty
+// and generic labels, which say nothing about the value.
+func tokenName(label string) string {
+	var b strings.Builder
+	for _, c := range strings.ToUpper(label) {
+		if b.Len() < maxTokenName && ('A' <= c && c <= 'Z' || '0' <= c && c <= '9') {
+			b.WriteRune(c)
+		}
+	}
+	if b.Len() == 0 || genericLabels[b.String()] {
+		return "TOKEN"
+	}
+	return b.String()
+}
+
+// labelPriority orders span labels from most to least specific. When one
+// value is flagged with several labels (say PER by NER and LLM by the LLM
+// classifier), the one listed first is reported.
+var labelPriority = []string{
+	"CREDENTIAL", "CONFIDENTIAL", "EMAIL", "PHONE",
+	"PER", "PERSON", "ORG", "NORP", "GPE", "LOC",
+	"MONEY", "DATE", "TIME", "CARDINAL",
+}
+
+// genericLabels say only which classifier flagged a value, so any other
+// label beats them.
+var genericLabels = map[string]bool{"LLM": true, "STATIC": true, "MISC": true}
+
+// labelRank scores a label for labelPriority: listed labels rank by
+// position, unlisted ones below them, generic ones lower, empty lowest.
+func labelRank(label string) int {
+	for i, l := range labelPriority {
+		if l == label {
+			return 100 + len(labelPriority) - i
+		}
+	}
+	switch {
+	case label == "":
+		return 0
+	case genericLabels[label]:
+		return 1
+	}
+	return 2
+}
+
 // Restore replaces all placeholder tokens in text with their original values.
 func (m *TokenMap) Restore(text string) string {
 	for tok, orig := range m.fromToken {
@@ -67,6 +188,35 @@ func (m *TokenMap) IsEmpty() bool {
 	return len(m.toToken) == 0
 }
 
+// Degraded reports whether any classifier errored or missed the budget while
+// this map was being filled, so the redaction is best-effort and sensitive
+// data may have been forwarded unredacted.
+func (m *TokenMap) Degraded() bool {
+	return m != nil && m.degraded
+}
+
+// Err returns the errors (including missed budgets) of required classifiers
+// (see Options.Required) recorded while this map was being filled, joined,
+// or nil. A map can be Degraded with a nil Err when only best-effort
+// classifiers failed or only the MaxRedactions cap was hit.
+func (m *TokenMap) Err() error {
+	if m == nil {
+		return nil
+	}
+	return m.err
+}
+
+// noteErr records classifier failures: err of required classifiers, which
+// fail the redaction, and bestEffort of the others, which only degrade it.
+func (m *TokenMap) noteErr(err, bestEffort error) {
+	if err != nil || bestEffort != nil {
+		m.degraded = true
+	}
+	if err != nil {
+		m.err = errors.Join(m.err, err)
+	}
+}
+
 // Count returns the number of distinct values that were redacted.
 func (m *TokenMap) Count() int {
 	return len(m.toToken)
@@ -74,8 +224,9 @@ func (m *TokenMap) Count() int {
 
 // Redaction describes a single redacted value for UI display.
 type Redaction struct {
-	Token    string `json:"token"`    // e.g. «TOKEN_000001»
-	Original string `json:"original"` // the actual sensitive value
+	Token    string `json:"token"`           // e.g. «TOKEN_000001», or «PER_1» with typed tokens
+	Original string `json:"original"`        // the actual sensitive value
+	Label    string `json:"label,omitempty"` // e.g. PER, CREDENTIAL; see labelPriority
 }
 
 // Redactions returns all recorded replacements, ordered by token name.
@@ -83,7 +234,7 @@ type Redaction struct {
 func (m *TokenMap) Redactions() []Redaction {
 	out := make([]Redaction, 0, len(m.fromToken))
 	for tok, orig := range m.fromToken {
-		out = append(out, Redaction{Token: tok, Original: orig})
+		out = append(out, Redaction{Token: tok, Original: orig, Label: m.labels[tok]})
 	}
 	for i := 1; i < len(out); i++ {
 		for j := i; j > 0 && out[j].Token < out[j-1].Token; j-- {
@@ -93,13 +244,88 @@ func (m *TokenMap) Redactions() []Redaction {
 	return out
 }
 
-// tokenPlaceholderRe matches our own «TOKEN_XXXXXX» markers so we never
-// re-redact an already-replaced placeholder.
-var tokenPlaceholderRe = regexp.MustCompile(`«TOKEN_\d+»`)
+// tokenPlaceholderRe matches our own «TOKEN_XXXXXX» and typed «PER_1»
+// markers so we never re-redact an already-replaced placeholder.
+var tokenPlaceholderRe = regexp.MustCompile(`«[A-Z0-9_]+_\d+»`)
 
 // Sanitizer is the top-level object created once at startup.
 type Sanitizer struct {
 	classifiers []Classifier
+	opts        Options
+}
+
+// Options tunes span validation and redaction behaviour.
+// The zero value disables every optional filter.
+type Options struct {
+	// MinSpanLen drops spans shorter than this many runes (e.g. a stray
+	// initial returned by NER). 0 keeps spans of any length.
+	MinSpanLen int
+
+	// MaxRedactions caps the distinct values redacted per request. Further
+	// matches are forwarded as-is and the request is marked degraded.
+	// 0 means no cap.
+	MaxRedactions int
+
+	// SampleRate is the fraction (0-1) of classified texts whose raw
+	// classifier outputs are sent to SampleSink. 0 or a nil sink disables
+	// sampling.
+	SampleRate float64
+	SampleSink SampleSink
+
+	// CrossMessage makes RedactMessages classify all message texts together
+	// with every classifier instead of only the last user message, and apply
+	// each detected value across all messages. Slower: the LLM classifier
+	// then reads the whole conversation on every request.
+	CrossMessage bool
+
+	// TypedTokens names placeholders after the span label and numbers them
+	// per label within the request («PER_1», «EMAIL_2») instead of the
+	// opaque «TOKEN_000001», so the model knows what kind of value was
+	// removed. Unlabelled and LLM-only findings become «TOKEN_1».
+	TypedTokens bool
+
+	// TokenNonce puts a random nonce, drawn per request, into every
+	// placeholder («TOKEN_K5QX2A7M_000001», «PER_K5QX2A7M_1»), so text that
+	// merely looks like a placeholder, in the client's messages or the
+	// model's output, never matches one and is left alone on restore.
+	TokenNonce bool
+
+	// Latency, when set, records how long every classifier call took.
+	Latency *LatencyRecorder
+
+	// Shadow, when set, evaluates a candidate classifier on the texts the
+	// active classifiers see, without applying its findings.
+	Shadow *Shadow
+
+	// CodeBlocks exempts findings inside fenced code blocks from redaction,
+	// entirely or all but credentials. Empty redacts code like prose.
+	CodeBlocks CodeBlockMode
+
+	// LLM is the layer, one of the classifiers, that RedactMessages skips
+	// for history messages to avoid paying its latency on old turns. It is
+	// matched by identity, so it must be the same comparable value (say a
+	// pointer) as in the classifier list. Nil runs every classifier on
+	// history too.
+	LLM Classifier
+
+	// Required names the classifiers (by ClassifierName) whose failure
+	// fails the redaction, as reported by TokenMap.Err. The failure of any
+	// other classifier only marks the redaction degraded. Empty means every
+	// classifier is required.
+	Required []string
+
+	// Normalize has classifiers read an NFKC-normalized copy of each text
+	// with zero-width characters removed, so values disguised with
+	// fullwidth letters, unusual spaces or invisible characters are still
+	// detected. Findings are mapped back to and redacted in the original.
+	Normalize bool
+
+	// JSONContent has message contents that are JSON objects or arrays (a
+	// tool result, a pasted API response) classified by their leaf values,
+	// one "key: value" line each, instead of as serialized text, and only
+	// those values redacted. Costs a JSON parse per such text. With
+	// CrossMessage, JSON contents are classified on their own.
+	JSONContent bool
 }
 
 // New creates a Sanitizer that relies solely on the provided classifiers.
@@ -110,105 +336,223 @@ func New() *Sanitizer {
 // NewWithClassifiers creates a Sanitizer with an ordered list of classifiers
 // (e.g. NER sidecar, LLM classifier).
 func NewWithClassifiers(classifiers []Classifier) *Sanitizer {
-	return &Sanitizer{classifiers: classifiers}
+	return NewWithOptions(classifiers, Options{})
+}
+
+// NewWithOptions is like NewWithClassifiers but also applies opts.
+func NewWithOptions(classifiers []Classifier, opts Options) *Sanitizer {
+	return &Sanitizer{classifiers: classifiers, opts: opts}
 }
 
 // classifierBudget is the maximum time we wait for all classifiers to finish.
 // Classifiers that miss the deadline are skipped; their goroutines keep running
 // in the background but their results are discarded.
-// Set high enough to cover a small LLM running on CPU.
-const classifierBudget = 120 * time.Second
+// Set high enough to cover a small LLM running on CPU. The effective budget is
+// shorter when the request context has an earlier deadline. It is a variable
+// only so tests can shorten it.
+var classifierBudget = 120 * time.Second
 
 // runClassifiers runs all Classify calls concurrently and merges results.
-// Returns after all classifiers finish or classifierBudget elapses.
-func (s *Sanitizer) runClassifiers(text string, classifiers []Classifier) []Span {
+// err joins the errors of classifiers that failed or had not answered in time;
+// the spans of the others are still returned.
+// Returns after all classifiers finish, classifierBudget elapses, or ctx is
+// done, whichever comes first.
+// bestEffort joins the errors of classifiers that are not required (see
+// Options.Required) instead.
+// When every classifier answered, Options.Shadow is started on text in the
+// background, compared against the baseline it was given.
+// With Options.Normalize classifiers see the normalized text, but the spans
+// returned are offsets into text.
+func (s *Sanitizer) runClassifiers(ctx context.Context, text string, classifiers []Classifier) (spans []Span, err, bestEffort error) {
 	if len(classifiers) == 0 {
-		return nil
+		return nil, nil, nil
+	}
+	var m *spanMap // set when classifiers see a normalized text
+	if s.opts.Normalize {
+		text, m = normalizeText(text)
 	}
 
 	type result struct {
+		name  string
 		spans []Span
+		err   error
 	}
 	ch := make(chan result, len(classifiers))
+	sample := s.opts.SampleSink != nil && s.opts.SampleRate > 0 && rand.Float64() < s.opts.SampleRate
 
 	for _, clf := range classifiers {
 		go func(c Classifier) {
+			start := time.Now()
 			spans, err := c.Classify(text)
+			if s.opts.Latency != nil {
+				s.opts.Latency.Record(ClassifierName(c), time.Since(start), err)
+			}
+			if sample {
+				// Recorded even when the budget has already run out, since
+				// late answers are useful for tuning too.
+				s.opts.SampleSink.Record(newSample(text, ClassifierName(c), spans, err, time.Since(start)))
+			}
 			if err != nil {
 				slog.Warn("sanitize: classifier error", "err", err)
-				ch <- result{}
+				ch <- result{name: ClassifierName(c), err: err}
 				return
 			}
-			ch <- result{spans: spans}
+			ch <- result{name: ClassifierName(c), spans: spans}
 		}(clf)
 	}
 
-	ctx, cancel := context.WithTimeout(context.Background(), classifierBudget)
+	ctx, cancel := context.WithTimeout(ctx, classifierBudget)
 	defer cancel()
 
-	var all []Span
+	var all, baseline []Span
+	shadowed := false                                 // the shadow's baseline answered
+	pending := make(map[string]int, len(classifiers)) // classifiers yet to answer, by name
+	for _, c := range classifiers {
+		pending[ClassifierName(c)]++
+	}
+	progress := progressFrom(ctx)
 	for range classifiers {
 		select {
 		case r := <-ch:
+			pending[r.name]--
 			all = append(all, r.spans...)
+			if progress != nil {
+				progress.spans.Add(int64(len(r.spans)))
+			}
+			if s.required(r.name) {
+				err = errors.Join(err, r.err)
+			} else {
+				bestEffort = errors.Join(bestEffort, r.err)
+			}
+			if sh := s.opts.Shadow; sh != nil && sh.baseline != "" && r.name == sh.baseline && r.err == nil {
+				baseline, shadowed = r.spans, true
+			}
 		case <-ctx.Done():
-			slog.Warn("sanitize: classifier budget exceeded, using partial results")
-			return all
+			slog.Warn("sanitize: classifier budget exceeded, using partial results", "err", ctx.Err())
+			budgetErr := fmt.Errorf("sanitize: classifier budget exceeded: %w", ctx.Err())
+			missedRequired := false
+			for name, n := range pending {
+				missedRequired = missedRequired || n > 0 && s.required(name)
+			}
+			if missedRequired {
+				err = errors.Join(err, budgetErr)
+			} else {
+				bestEffort = errors.Join(bestEffort, budgetErr)
+			}
+			return m.spans(text, all), err, bestEffort
+		}
+	}
+	if sh := s.opts.Shadow; sh != nil {
+		if sh.baseline == "" && err == nil && bestEffort == nil && len(classifiers) == len(s.classifiers) {
+			baseline, shadowed = all, true
+		}
+		if shadowed {
+			sh.observe(text, baseline, s.opts.Latency)
 		}
 	}
-	return all
+	return m.spans(text, all), err, bestEffort
+}
+
+// required reports whether the classifier named name is in Options.Required.
+func (s *Sanitizer) required(name string) bool {
+	return len(s.opts.Required) == 0 || slices.Contains(s.opts.Required, name)
 }
 
 // redactText runs all classifiers concurrently on the original text and
 // applies the detected spans as placeholder replacements.
-func (s *Sanitizer) redactText(original string, tm *TokenMap) string {
-	allSpans := s.runClassifiers(original, s.classifiers)
-	if len(allSpans) == 0 {
-		return original
-	}
-
-	allSpans = validSpans(original, allSpans)
-	sortSpansDesc(allSpans)
-	allSpans = deduplicateSpans(allSpans)
-
-	text := original
-	for _, sp := range allSpans {
-		matched := text[sp.Start:sp.End]
-		tok := tm.register(matched)
-		slog.Debug("sanitize: redacted", "label", sp.Label, "token", tok)
-		text = text[:sp.Start] + tok + text[sp.End:]
-	}
-	return text
+func (s *Sanitizer) redactText(ctx context.Context, original string, tm *TokenMap) string {
+	return s.redactWith(ctx, original, s.classifiers, tm)
 }
 
-// redactTextWithNER runs all classifiers except the LLM (always last).
+// redactTextWithNER runs all classifiers except Options.LLM.
 // Used for history messages to avoid paying full LLM latency on old turns.
-func (s *Sanitizer) redactTextWithNER(original string, tm *TokenMap) string {
+func (s *Sanitizer) redactTextWithNER(ctx context.Context, original string, tm *TokenMap) string {
 	classifiers := s.classifiers
-	// LLM classifier is always appended last; skip it for history messages.
-	if len(classifiers) > 1 {
-		classifiers = classifiers[:len(classifiers)-1]
-	} else {
-		classifiers = nil
+	if s.opts.LLM != nil {
+		classifiers = slices.DeleteFunc(slices.Clone(classifiers), func(c Classifier) bool {
+			return sameClassifier(c, s.opts.LLM)
+		})
 	}
+	return s.redactWith(ctx, original, classifiers, tm)
+}
 
-	allSpans := s.runClassifiers(original, classifiers)
+// sameClassifier reports whether a and b are the same classifier. Values of
+// types that cannot be compared, such as StaticClassifier, are never the
+// same.
+func sameClassifier(a, b Classifier) bool {
+	t := reflect.TypeOf(a)
+	return t == reflect.TypeOf(b) && t.Comparable() && a == b
+}
+
+// redactWith redacts original with the given classifiers, as JSON when
+// Options.JSONContent is set and it is JSON (see redactJSON).
+func (s *Sanitizer) redactWith(ctx context.Context, original string, classifiers []Classifier, tm *TokenMap) string {
+	if s.opts.JSONContent {
+		if out, ok := s.redactJSON(ctx, original, classifiers, tm); ok {
+			return out
+		}
+	}
+	allSpans, err, bestEffort := s.runClassifiers(ctx, original, classifiers)
+	tm.noteErr(err, bestEffort)
 	if len(allSpans) == 0 {
 		return original
 	}
 
-	allSpans = validSpans(original, allSpans)
-	sortSpansDesc(allSpans)
-	allSpans = deduplicateSpans(allSpans)
+	return s.applySpans(original, allSpans, tm)
+}
+
+// applySpans validates and merges spans computed against original, then
+// replaces each with its placeholder, back to front so earlier offsets stay
+// valid. Spans whose offsets do not match their text are dropped by
+// validSpans beforehand.
+func (s *Sanitizer) applySpans(original string, spans []Span, tm *TokenMap) string {
+	spans = validSpans(original, spans, s.opts.MinSpanLen)
+	spans = s.dropCodeSpans(original, spans)
+	spans = deduplicateSpans(spans)
+	spans = s.capSpans(original, spans, tm)
 
 	text := original
-	for _, sp := range allSpans {
-		tok := tm.register(text[sp.Start:sp.End])
+	for _, sp := range spans {
+		tok := tm.register(text[sp.Start:sp.End], sp.Label)
+		slog.Debug("sanitize: redacted", "label", sp.Label, "token", tok)
 		text = text[:sp.Start] + tok + text[sp.End:]
 	}
 	return text
 }
 
+// capSpans drops spans that would take tm past opts.MaxRedactions distinct
+// values, keeping the earliest ones in the text. spans is sorted descending
+// by Start, as returned by deduplicateSpans.
+func (s *Sanitizer) capSpans(original string, spans []Span, tm *TokenMap) []Span {
+	limit := s.opts.MaxRedactions
+	if limit <= 0 || tm.Count()+len(spans) <= limit {
+		return spans
+	}
+	seen := make(map[string]bool)
+	kept := make([]Span, 0, len(spans))
+	dropped := 0
+	for i := len(spans) - 1; i >= 0; i-- {
+		val := original[spans[i].Start:spans[i].End]
+		_, known := tm.toToken[val]
+		if !known && !seen[val] {
+			if tm.Count()+len(seen) >= limit {
+				dropped++
+				continue
+			}
+			seen[val] = true
+		}
+		kept = append(kept, spans[i])
+	}
+	if dropped > 0 {
+		tm.degraded = true
+		slog.Warn("sanitize: redaction cap reached, forwarding further matches as-is", "max", limit, "dropped", dropped)
+	}
+	for i, j := 0, len(kept)-1; i < j; i, j = i+1, j-1 {
+		kept[i], kept[j] = kept[j], kept[i]
+	}
+	return kept
+}
+
 // wordBoundaryBytes are bytes that delimit tokens/words.
 var wordBoundaryBytes = func() [256]bool {
 	var t [256]bool
@@ -220,9 +564,29 @@ var wordBoundaryBytes = func() [256]bool {
 
 func isWordBoundaryByte(b byte) bool { return wordBoundaryBytes[b] }
 
+// isWordBoundaryBefore reports whether the character ending at text[i] is a
+// delimiter: a wordBoundaryBytes byte or a unicode space such as NBSP.
+func isWordBoundaryBefore(text string, i int) bool {
+	if isWordBoundaryByte(text[i-1]) {
+		return true
+	}
+	r, _ := utf8.DecodeLastRuneInString(text[:i])
+	return r >= utf8.RuneSelf && unicode.IsSpace(r)
+}
+
+// isWordBoundaryAfter is isWordBoundaryBefore for the character at text[i].
+func isWordBoundaryAfter(text string, i int) bool {
+	if isWordBoundaryByte(text[i]) {
+		return true
+	}
+	r, _ := utf8.DecodeRuneInString(text[i:])
+	return r >= utf8.RuneSelf && unicode.IsSpace(r)
+}
+
 // validSpans filters out spans with invalid offsets, TOKEN placeholders,
-// or spans that land in the middle of a larger word (partial NER matches).
-func validSpans(text string, spans []Span) []Span {
+// spans shorter than minLen runes, or spans that land in the middle of a
+// larger word (partial NER matches).
+func validSpans(text string, spans []Span, minLen int) []Span {
 	out := make([]Span, 0, len(spans))
 	for _, sp := range spans {
 		if sp.Start < 0 || sp.End > len(text) || sp.Start >= sp.End {
@@ -231,15 +595,23 @@ func validSpans(text string, spans []Span) []Span {
 		if !isRuneBoundary(text, sp.Start) || !isRuneBoundary(text, sp.End) {
 			continue
 		}
+		if sp.Text != "" && text[sp.Start:sp.End] != sp.Text {
+			// Offsets were computed on a differently normalised text.
+			slog.Warn("sanitize: span offsets do not match its text, skipping", "label", sp.Label, "start", sp.Start, "end", sp.End)
+			continue
+		}
 		if tokenPlaceholderRe.MatchString(text[sp.Start:sp.End]) {
 			continue
 		}
+		if minLen > 0 && utf8.RuneCountInString(text[sp.Start:sp.End]) < minLen {
+			continue
+		}
 		// Reject partial word matches. If the character immediately before or
 		// after the span is not a delimiter, it is a substring of a longer token.
-		if sp.Start > 0 && !isWordBoundaryByte(text[sp.Start-1]) {
+		if sp.Start > 0 && !isWordBoundaryBefore(text, sp.Start) {
 			continue
 		}
-		if sp.End < len(text) && !isWordBoundaryByte(text[sp.End]) {
+		if sp.End < len(text) && !isWordBoundaryAfter(text, sp.End) {
 			continue
 		}
 		out = append(out, sp)
@@ -247,15 +619,43 @@ func validSpans(text string, spans []Span) []Span {
 	return out
 }
 
-// deduplicateSpans removes overlapping spans (assumes sorted descending by Start).
+// deduplicateSpans resolves overlapping spans so every byte covered by any
+// input span is covered by exactly one output span. Nested spans collapse into
+// the outer one; partially overlapping spans are merged into their union
+// (keeping the label of the earlier span); adjacent spans stay separate.
+// Identical spans keep the highest-priority label (see labelPriority).
+// Input order does not matter. The result is sorted descending by Start so
+// it can be applied back to front without shifting offsets.
 func deduplicateSpans(spans []Span) []Span {
-	out := make([]Span, 0, len(spans))
-	lastStart := -1
-	for _, sp := range spans {
-		if lastStart == -1 || sp.End <= lastStart {
-			out = append(out, sp)
-			lastStart = sp.Start
+	if len(spans) == 0 {
+		return nil
+	}
+	sorted := make([]Span, len(spans))
+	copy(sorted, spans)
+	sort.Slice(sorted, func(i, j int) bool {
+		if sorted[i].Start != sorted[j].Start {
+			return sorted[i].Start < sorted[j].Start
+		}
+		return sorted[i].End > sorted[j].End // wider first
+	})
+
+	out := make([]Span, 0, len(sorted))
+	for _, sp := range sorted {
+		if n := len(out); n > 0 && sp.Start < out[n-1].End {
+			if sp.Start == out[n-1].Start && sp.End == out[n-1].End && labelRank(sp.Label) > labelRank(out[n-1].Label) {
+				out[n-1].Label = sp.Label // same value from another classifier
+			}
+			if sp.End > out[n-1].End {
+				out[n-1].End = sp.End
+				out[n-1].Text = "" // no longer the text of either input
+			}
+			continue
 		}
+		out = append(out, sp)
+	}
+
+	for i, j := 0, len(out)-1; i < j; i, j = i+1, j-1 {
+		out[i], out[j] = out[j], out[i]
 	}
 	return out
 }
@@ -267,25 +667,51 @@ func isRuneBoundary(s string, i int) bool {
 	return s[i]&0xC0 != 0x80
 }
 
-func sortSpansDesc(spans []Span) {
-	for i := 1; i < len(spans); i++ {
-		for j := i; j > 0 && spans[j].Start > spans[j-1].Start; j-- {
-			spans[j], spans[j-1] = spans[j-1], spans[j]
-		}
+// tokenMap returns an empty TokenMap for one request.
+func (s *Sanitizer) tokenMap() *TokenMap {
+	tm := newTokenMap()
+	tm.typed = s.opts.TypedTokens
+	if s.opts.TokenNonce {
+		tm.nonce = newTokenNonce()
 	}
+	return tm
 }
 
-// RedactMessages parses the OpenAI-format JSON body and redacts sensitive data.
-// History messages (all but the last user message) use NER only for speed.
-// The last user message runs the full classifier pipeline.
-func (s *Sanitizer) RedactMessages(body []byte) ([]byte, *TokenMap) {
-	tm := newTokenMap()
+// RedactText redacts a single text with the full classifier pipeline, for
+// callers whose input is not a chat request (completion prompts, embedding
+// inputs). Restore the response with RestoreBytes and the returned map.
+func (s *Sanitizer) RedactText(ctx context.Context, text string) (string, *TokenMap) {
+	tm := s.tokenMap()
+	tm.reserve(text)
+	return s.redactText(ctx, text, tm), tm
+}
 
+// RedactTexts is RedactText for a batch. The texts share one TokenMap, so a
+// value appearing in several of them gets the same placeholder in each.
+func (s *Sanitizer) RedactTexts(ctx context.Context, texts []string) ([]string, *TokenMap) {
+	tm := s.tokenMap()
+	tm.reserve(texts...)
+	out := make([]string, len(texts))
+	for i, text := range texts {
+		out[i] = s.redactText(ctx, text, tm)
+	}
+	return out, tm
+}
+
+// RedactMessages parses the OpenAI-format JSON body and redacts sensitive data.
+// History messages (all but the last user message) skip Options.LLM for speed.
+// The last user message runs the full classifier pipeline. With
+// Options.CrossMessage every message text is instead classified together;
+// see redactAcrossMessages.
+// Classifiers are given at most until ctx's deadline; pass the request
+// context so sanitization never outlives the client.
+func (s *Sanitizer) RedactMessages(ctx context.Context, body []byte) ([]byte, *TokenMap) {
 	var req map[string]json.RawMessage
 	if err := json.Unmarshal(body, &req); err != nil {
-		redacted := s.redactText(string(body), tm)
+		redacted, tm := s.RedactText(ctx, string(body))
 		return []byte(redacted), tm
 	}
+	tm := s.tokenMap()
 
 	messagesRaw, ok := req["messages"]
 	if !ok {
@@ -311,36 +737,33 @@ func (s *Sanitizer) RedactMessages(body []byte) ([]byte, *TokenMap) {
 		}
 	}
 
-	changed := false
+	// Collect every text: string content, or the text parts of array content
+	// (vision / multi-modal messages).
+	type textRef struct {
+		msg, part int // part is -1 for string content
+	}
+	var refs []textRef
+	var texts []string
+	parts := make(map[int][]map[string]json.RawMessage)
 	for i, msg := range messages {
 		contentRaw, ok := msg["content"]
 		if !ok {
 			continue
 		}
 
-		redactFn := s.redactTextWithNER
-		if i == lastUserIdx {
-			redactFn = s.redactText
-		}
-
 		var strContent string
 		if err := json.Unmarshal(contentRaw, &strContent); err == nil {
-			redacted := redactFn(strContent, tm)
-			if redacted != strContent {
-				b, _ := json.Marshal(redacted)
-				messages[i]["content"] = b
-				changed = true
-			}
+			refs = append(refs, textRef{i, -1})
+			texts = append(texts, strContent)
 			continue
 		}
 
-		// Array content (vision / multi-modal messages).
-		var parts []map[string]json.RawMessage
-		if err := json.Unmarshal(contentRaw, &parts); err != nil {
+		var msgParts []map[string]json.RawMessage
+		if err := json.Unmarshal(contentRaw, &msgParts); err != nil {
 			continue
 		}
-		partsChanged := false
-		for j, part := range parts {
+		parts[i] = msgParts
+		for j, part := range msgParts {
 			textRaw, ok := part["text"]
 			if !ok {
 				continue
@@ -349,18 +772,44 @@ func (s *Sanitizer) RedactMessages(body []byte) ([]byte, *TokenMap) {
 			if err := json.Unmarshal(textRaw, &text); err != nil {
 				continue
 			}
-			redacted := redactFn(text, tm)
-			if redacted != text {
-				b, _ := json.Marshal(redacted)
-				parts[j]["text"] = b
-				partsChanged = true
+			refs = append(refs, textRef{i, j})
+			texts = append(texts, text)
+		}
+	}
+
+	tm.reserve(texts...)
+	var redacted []string
+	if s.opts.CrossMessage {
+		redacted = s.redactAcrossMessages(ctx, texts, tm)
+	} else {
+		redacted = make([]string, len(texts))
+		for k, text := range texts {
+			if refs[k].msg == lastUserIdx {
+				redacted[k] = s.redactText(ctx, text, tm)
+			} else {
+				redacted[k] = s.redactTextWithNER(ctx, text, tm)
 			}
 		}
-		if partsChanged {
-			b, _ := json.Marshal(parts)
-			messages[i]["content"] = b
-			changed = true
+	}
+
+	changed := false
+	partsChanged := make(map[int]bool)
+	for k, ref := range refs {
+		if redacted[k] == texts[k] {
+			continue
+		}
+		b, _ := json.Marshal(redacted[k])
+		if ref.part < 0 {
+			messages[ref.msg]["content"] = b
+		} else {
+			parts[ref.msg][ref.part]["text"] = b
+			partsChanged[ref.msg] = true
 		}
+		changed = true
+	}
+	for i := range partsChanged {
+		b, _ := json.Marshal(parts[i])
+		messages[i]["content"] = b
 	}
 
 	if !changed {
@@ -376,11 +825,91 @@ func (s *Sanitizer) RedactMessages(body []byte) ([]byte, *TokenMap) {
 	return out, tm
 }
 
+// messageSeparator joins message texts for cross-message classification.
+const messageSeparator = "\n\n"
+
+// redactAcrossMessages runs the full classifier pipeline once on all texts
+// joined together, so history gets the same detection as the last user
+// message and a value split across two consecutive messages is still seen
+// whole. A span crossing a message boundary redacts its piece in each
+// message. Every value detected whole is then also redacted wherever else
+// it appears as a word, even where the classifiers did not flag it.
+func (s *Sanitizer) redactAcrossMessages(ctx context.Context, texts []string, tm *TokenMap) []string {
+	out := make([]string, len(texts))
+	copy(out, texts)
+	if len(texts) == 0 {
+		return out
+	}
+	if s.opts.JSONContent {
+		// JSON is classified on its own (see redactJSON); an empty text
+		// stands in for it below.
+		plain := make([]string, len(texts))
+		for i, text := range texts {
+			if redacted, ok := s.redactJSON(ctx, text, s.classifiers, tm); ok {
+				out[i] = redacted
+				continue
+			}
+			plain[i] = text
+		}
+		texts = plain
+	}
+
+	joined := strings.Join(texts, messageSeparator)
+	spans, err, bestEffort := s.runClassifiers(ctx, joined, s.classifiers)
+	tm.noteErr(err, bestEffort)
+	spans = validSpans(joined, spans, s.opts.MinSpanLen)
+	if len(spans) == 0 {
+		return out
+	}
+
+	starts := make([]int, len(texts))
+	for i, off := 0, 0; i < len(texts); i++ {
+		starts[i] = off
+		off += len(texts[i]) + len(messageSeparator)
+	}
+
+	perText := make([][]Span, len(texts))
+	values := make(map[string]Span)
+	for _, sp := range spans {
+		for i, text := range texts {
+			lo, hi := max(sp.Start, starts[i]), min(sp.End, starts[i]+len(text))
+			if lo >= hi {
+				continue
+			}
+			perText[i] = append(perText[i], Span{Start: lo - starts[i], End: hi - starts[i], Label: sp.Label, Score: sp.Score})
+			if lo == sp.Start && hi == sp.End {
+				values[joined[lo:hi]] = sp
+			}
+		}
+	}
+	for i, text := range texts {
+		for v, sp := range values {
+			for from := 0; ; {
+				j := strings.Index(text[from:], v)
+				if j < 0 {
+					break
+				}
+				abs := from + j
+				perText[i] = append(perText[i], Span{Start: abs, End: abs + len(v), Label: sp.Label, Score: sp.Score, Text: v})
+				from = abs + len(v)
+			}
+		}
+	}
+
+	for i, text := range texts {
+		if len(perText[i]) > 0 {
+			out[i] = s.applySpans(text, perText[i], tm)
+		}
+	}
+	return out
+}
+
 // RestoreBytes scans respBody for placeholder tokens and replaces them with
-// their original values using the provided TokenMap.
+// their original values using the provided TokenMap. It works on the bytes
+// as they are, so a body that is not valid UTF-8 keeps every other byte.
 func (s *Sanitizer) RestoreBytes(respBody []byte, tm *TokenMap) []byte {
 	if tm == nil || tm.IsEmpty() {
 		return respBody
 	}
-	return []byte(tm.Restore(string(respBody)))
+	return tm.appendRestored(make([]byte, 0, len(respBody)), respBody)
 }
@@ -0,0 +1,924 @@
+package sanitize
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"regexp"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+// slowClassifier simulates a classifier backend that is slower than the
+// budget: Classify sleeps for delay and then returns spans. done, if set,
+// counts the calls that have returned.
+type slowClassifier struct {
+	delay time.Duration
+	spans []Span
+	done  *atomic.Int32
+}
+
+func (c slowClassifier) Classify(string) ([]Span, error) {
+	time.Sleep(c.delay)
+	if c.done != nil {
+		c.done.Add(1)
+	}
+	return c.spans, nil
+}
+
+// withBudget shortens classifierBudget for the duration of a test.
+func withBudget(t *testing.T, d time.Duration) {
+	t.Helper()
+	old := classifierBudget
+	classifierBudget = d
+	t.Cleanup(func() { classifierBudget = old })
+}
+
+func TestRunClassifiersReturnsPartialResultsOnBudget(t *testing.T) {
+	withBudget(t, 50*time.Millisecond)
+	fast := Span{Start: 0, End: 4, Label: "FAST"}
+	slow := Span{Start: 5, End: 9, Label: "SLOW"}
+	s := NewWithClassifiers([]Classifier{
+		slowClassifier{delay: 2 * time.Second, spans: []Span{slow}},
+		fixedClassifier{fast},
+	})
+
+	start := time.Now()
+	got, err, _ := s.runClassifiers(context.Background(), "abcd efgh", s.classifiers)
+	if err == nil {
+		t.Fatal("a classifier missing the budget must mark the result degraded")
+	}
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("runClassifiers outlived the budget: took %s", took)
+	}
+	if len(got) != 1 || got[0] != fast {
+		t.Fatalf("want only the fast classifier's span, got %+v", got)
+	}
+}
+
+func TestRunClassifiersLateGoroutinesExit(t *testing.T) {
+	withBudget(t, 10*time.Millisecond)
+	var done atomic.Int32
+	const n = 20
+	classifiers := make([]Classifier, n)
+	for i := range classifiers {
+		classifiers[i] = slowClassifier{delay: 100 * time.Millisecond, spans: []Span{{Start: 0, End: 4}}, done: &done}
+	}
+	s := NewWithClassifiers(classifiers)
+
+	before := runtime.NumGoroutine()
+	if got, _, _ := s.runClassifiers(context.Background(), "abcd", classifiers); len(got) != 0 {
+		t.Fatalf("late results must be discarded, got %+v", got)
+	}
+
+	// Abandoned classifiers must still be able to deliver their result and
+	// exit rather than block forever on the results channel.
+	deadline := time.Now().Add(5 * time.Second)
+	for done.Load() < n || runtime.NumGoroutine() > before {
+		if time.Now().After(deadline) {
+			t.Fatalf("goroutines leaked: %d of %d classifiers returned, %d goroutines (started with %d)",
+				done.Load(), n, runtime.NumGoroutine(), before)
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+func TestRedactMessagesHonoursContextDeadline(t *testing.T) {
+	s := NewWithClassifiers([]Classifier{slowClassifier{
+		delay: 2 * time.Second,
+		spans: []Span{{Start: 3, End: 9, Label: "TEST", Score: 1}},
+	}})
+
+	ctx, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+	defer cancel()
+
+	body := []byte(`{"messages":[{"role":"user","content":"my secret"}]}`)
+	start := time.Now()
+	out, tm := s.RedactMessages(ctx, body)
+	if took := time.Since(start); took > time.Second {
+		t.Fatalf("RedactMessages outlived the request deadline: took %s", took)
+	}
+	if !tm.IsEmpty() || string(out) != string(body) {
+		t.Fatalf("late classifier results must be discarded, got %s", out)
+	}
+	if !tm.Degraded() {
+		t.Fatal("a classifier that missed the deadline must mark the map degraded")
+	}
+}
+
+func TestDeduplicateSpans(t *testing.T) {
+	tests := []struct {
+		name string
+		in   []Span
+		want []Span // descending by Start
+	}{
+		{
+			name: "disjoint",
+			in:   []Span{{Start: 0, End: 3}, {Start: 10, End: 12}},
+			want: []Span{{Start: 10, End: 12}, {Start: 0, End: 3}},
+		},
+		{
+			name: "adjacent spans are both kept",
+			in:   []Span{{Start: 5, End: 8}, {Start: 0, End: 5}},
+			want: []Span{{Start: 5, End: 8}, {Start: 0, End: 5}},
+		},
+		{
+			name: "nested inner after outer",
+			in:   []Span{{Start: 0, End: 10}, {Start: 3, End: 6}},
+			want: []Span{{Start: 0, End: 10}},
+		},
+		{
+			name: "nested inner before outer",
+			in:   []Span{{Start: 3, End: 6}, {Start: 0, End: 10}},
+			want: []Span{{Start: 0, End: 10}},
+		},
+		{
+			name: "same start keeps the wider span",
+			in:   []Span{{Start: 0, End: 3}, {Start: 0, End: 9}},
+			want: []Span{{Start: 0, End: 9}},
+		},
+		{
+			name: "partial overlap is merged",
+			in:   []Span{{Start: 4, End: 9}, {Start: 0, End: 6}},
+			want: []Span{{Start: 0, End: 9}},
+		},
+		{
+			name: "chain of overlaps",
+			in:   []Span{{Start: 8, End: 12}, {Start: 0, End: 5}, {Start: 4, End: 9}, {Start: 20, End: 21}},
+			want: []Span{{Start: 20, End: 21}, {Start: 0, End: 12}},
+		},
+		{
+			name: "identical spans",
+			in:   []Span{{Start: 2, End: 4}, {Start: 2, End: 4}},
+			want: []Span{{Start: 2, End: 4}},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := deduplicateSpans(tt.in)
+			if len(got) != len(tt.want) {
+				t.Fatalf("want %v, got %v", tt.want, got)
+			}
+			for i := range got {
+				if got[i].Start != tt.want[i].Start || got[i].End != tt.want[i].End {
+					t.Fatalf("want %v, got %v", tt.want, got)
+				}
+			}
+		})
+	}
+}
+
+func TestRedactNestedSpansLeavesNothingBehind(t *testing.T) {
+	text := "call John Smith now"
+	// NER finds the full name, another classifier only the surname.
+	s := NewWithClassifiers([]Classifier{
+		fixedClassifier{{Start: 10, End: 15}},
+		fixedClassifier{{Start: 5, End: 15}},
+	})
+	tm := newTokenMap()
+	out := s.redactText(context.Background(), text, tm)
+	if strings.Contains(out, "John") || strings.Contains(out, "Smith") {
+		t.Fatalf("name leaked: %q", out)
+	}
+	if got := tm.Restore(out); got != text {
+		t.Fatalf("round trip: want %q, got %q", text, got)
+	}
+}
+
+// fixedClassifier returns the same spans for every text.
+type fixedClassifier []Span
+
+func (c fixedClassifier) Classify(string) ([]Span, error) { return c, nil }
+
+func TestApplySpansSkipsMisalignedSpans(t *testing.T) {
+	text := "Привет, Иван Петров, как дела?"
+	s := New()
+	tm := newTokenMap()
+
+	// Code-point offsets (as a Python service would report) instead of bytes.
+	misaligned := Span{Start: 8, End: 19, Label: "PER", Text: "Иван Петров"}
+	if out := s.applySpans(text, []Span{misaligned}, tm); out != text || !tm.IsEmpty() {
+		t.Fatalf("misaligned span must be skipped, got %q", out)
+	}
+
+	start := strings.Index(text, "Иван")
+	aligned := Span{Start: start, End: start + len("Иван Петров"), Label: "PER", Text: "Иван Петров"}
+	out := s.applySpans(text, []Span{aligned}, tm)
+	if strings.Contains(out, "Иван") || tm.Restore(out) != text {
+		t.Fatalf("aligned span not redacted correctly: %q", out)
+	}
+}
+
+// emailClassifier flags every whitespace-separated word containing "@".
+type emailClassifier struct{}
+
+func (emailClassifier) Classify(text string) ([]Span, error) {
+	var spans []Span
+	start := 0
+	for _, w := range strings.SplitAfter(text, " ") {
+		word := strings.TrimSpace(w)
+		if strings.Contains(word, "@") {
+			spans = append(spans, Span{Start: start, End: start + len(word), Label: "EMAIL"})
+		}
+		start += len(w)
+	}
+	return spans, nil
+}
+
+func TestMaxRedactionsCapsAndMarksDegraded(t *testing.T) {
+	var emails []string
+	for i := 0; i < 500; i++ {
+		emails = append(emails, fmt.Sprintf("user%d@example.com", i))
+	}
+	text := strings.Join(emails, " ")
+	s := NewWithOptions([]Classifier{emailClassifier{}}, Options{MaxRedactions: 10})
+
+	tm := newTokenMap()
+	out := s.redactText(context.Background(), text, tm)
+
+	if tm.Count() != 10 {
+		t.Fatalf("redacted %d values, want the cap of 10", tm.Count())
+	}
+	if !tm.Degraded() {
+		t.Fatal("hitting the cap must mark the request degraded")
+	}
+	// The earliest matches are the ones redacted.
+	if strings.Contains(out, "user0@example.com") || !strings.Contains(out, "user10@example.com") {
+		t.Fatalf("unexpected redaction order: %.200s", out)
+	}
+	if got := strings.Count(out, "«TOKEN_"); got != 10 {
+		t.Fatalf("%d placeholders in output, want 10", got)
+	}
+
+	// Repeats of already-redacted values are still replaced at the cap.
+	out = s.redactText(context.Background(), "again user3@example.com", tm)
+	if strings.Contains(out, "user3@example.com") {
+		t.Fatalf("known value not redacted at the cap: %q", out)
+	}
+}
+
+type memorySink struct {
+	mu      sync.Mutex
+	samples []Sample
+}
+
+func (m *memorySink) Record(s Sample) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.samples = append(m.samples, s)
+}
+
+// classifierFunc adapts a function to Classifier.
+type classifierFunc func(text string) ([]Span, error)
+
+func (f classifierFunc) Classify(text string) ([]Span, error) { return f(text) }
+
+func TestSampleSinkRecordsMetadataOnly(t *testing.T) {
+	sink := &memorySink{}
+	clf := NewBreaker("static", StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"}, 3, time.Minute)
+	s := NewWithOptions([]Classifier{clf}, Options{SampleRate: 1, SampleSink: sink})
+
+	body := []byte(`{"messages":[{"role":"user","content":"my password is hunter2"}]}`)
+	s.RedactMessages(context.Background(), body)
+	s.RedactMessages(context.Background(), body)
+
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.samples) != 2 {
+		t.Fatalf("got %d samples, want 2", len(sink.samples))
+	}
+	got := sink.samples[0]
+	if got.Classifier != "static" || got.InputLen != len("my password is hunter2") || len(got.Spans) != 1 {
+		t.Fatalf("unexpected sample %+v", got)
+	}
+	if sp := got.Spans[0]; sp.Label != "CREDENTIAL" || sp.Start != 15 || sp.End != 22 {
+		t.Fatalf("unexpected span %+v", sp)
+	}
+	if got.InputHash == "" || got.InputHash != sink.samples[1].InputHash {
+		t.Fatalf("identical inputs hashed to %q and %q", got.InputHash, sink.samples[1].InputHash)
+	}
+	raw, _ := json.Marshal(sink.samples)
+	if strings.Contains(string(raw), "hunter2") || strings.Contains(string(raw), "password") {
+		t.Fatalf("sample leaks input text: %s", raw)
+	}
+
+	// A failure is recorded by class, never by a message that could quote
+	// the input.
+	failing := &memorySink{}
+	leaky := classifierFunc(func(text string) ([]Span, error) {
+		return nil, fmt.Errorf("llm: bad request: %w", &StatusError{Source: "echo " + text, Code: 400})
+	})
+	NewWithOptions([]Classifier{leaky}, Options{SampleRate: 1, SampleSink: failing}).RedactMessages(context.Background(), body)
+	if len(failing.samples) != 1 || failing.samples[0].Error != "status_400" {
+		t.Fatalf("failed call sampled as %+v, want error class status_400", failing.samples)
+	}
+
+	// Rate 0 records nothing.
+	quiet := &memorySink{}
+	NewWithOptions([]Classifier{clf}, Options{SampleSink: quiet}).RedactMessages(context.Background(), body)
+	if len(quiet.samples) != 0 {
+		t.Fatalf("rate 0 recorded %d samples", len(quiet.samples))
+	}
+}
+
+func TestLatencyRecorderTimesEachClassifier(t *testing.T) {
+	lat := NewLatencyRecorder(4)
+	slow := NewBreaker("slow", slowClassifier{delay: 20 * time.Millisecond}, 3, time.Minute)
+	s := NewWithOptions([]Classifier{slow, fixedClassifier{}}, Options{Latency: lat})
+
+	for i := 0; i < 6; i++ {
+		s.RedactText(context.Background(), "some text")
+	}
+
+	got := lat.Snapshot()
+	if len(got) != 2 || got[0].Name != "sanitize.fixedClassifier" || got[1].Name != "slow" {
+		t.Fatalf("want one entry per classifier, got %+v", got)
+	}
+	for _, l := range got {
+		if l.Calls != 6 || l.Errors != 0 {
+			t.Fatalf("%s: want 6 calls without errors, got %+v", l.Name, l)
+		}
+	}
+	if l := got[1]; l.P50MS < 20 || l.P99MS < l.P50MS || l.MaxMS < l.P99MS {
+		t.Fatalf("slow classifier latency not recorded: %+v", l)
+	}
+	if got[0].P99MS >= got[1].P50MS {
+		t.Fatalf("fixed classifier timed as slow as the slow one: %+v", got)
+	}
+}
+
+func TestShadowReportsDifferencesWithoutApplying(t *testing.T) {
+	baseline := NewBreaker("llm", StaticClassifier{Values: []string{"hunter2", "Alice"}, Label: "CREDENTIAL"}, 3, time.Minute)
+	ner := StaticClassifier{Values: []string{"Bob"}, Label: "PER"}
+	candidate := StaticClassifier{Values: []string{"hunter2", "Carol"}, Label: "PER"}
+	sh := NewShadow("shadow", candidate, baseline, 1)
+	s := NewWithOptions([]Classifier{ner, baseline}, Options{Shadow: sh})
+
+	out, _ := s.RedactText(context.Background(), "Alice, Bob and Carol share hunter2")
+	if !strings.Contains(out, "Carol") || strings.Contains(out, "Alice") || strings.Contains(out, "Bob") {
+		t.Fatalf("shadow findings must not be applied: %q", out)
+	}
+
+	deadline := time.Now().Add(2 * time.Second)
+	for sh.Report().Compared == 0 && time.Now().Before(deadline) {
+		time.Sleep(time.Millisecond)
+	}
+	got := sh.Report()
+	want := ShadowReport{
+		Name: "shadow", Baseline: "llm", Compared: 1, Differed: 1,
+		Agreed: 1, BaselineOnly: 1, ShadowOnly: 1,
+		Labels: map[string]int{"baseline_only:CREDENTIAL": 1, "shadow_only:PER": 1},
+	}
+	if fmt.Sprint(got) != fmt.Sprint(want) {
+		t.Fatalf("report\n got  %+v\n want %+v", got, want)
+	}
+	raw, _ := json.Marshal(got)
+	if strings.Contains(string(raw), "Alice") || strings.Contains(string(raw), "Carol") {
+		t.Fatalf("report leaks values: %s", raw)
+	}
+}
+
+func TestCodeBlocksExemptFromRedaction(t *testing.T) {
+	classifiers := []Classifier{
+		StaticClassifier{Values: []string{"Alice"}, Label: "PER"},
+		StaticClassifier{Values: []string{"alice@example.com"}, Label: "EMAIL"},
+		StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"},
+	}
+	text := "Alice (alice@example.com) wrote:\n" +
+		"```go\nuser := User{Name: \"Alice\", Email: \"alice@example.com\"}\nlogin(user, \"hunter2\")\n```\n" +
+		"~~~\ngreet(\"Alice\")\n~~~\n" +
+		"    ```\nAlice is indented by four spaces, so this is no fence\n" +
+		"Her password is hunter2\n" +
+		"```\nAlice, unclosed, hunter2" // a stray fence exempts nothing
+
+	for _, tc := range []struct {
+		mode CodeBlockMode
+		want string
+	}{
+		{CodeBlocksRedact, ""},
+		{CodeBlocksSkip, "user := User{Name: \"Alice\", Email: \"alice@example.com\"}\nlogin(user, \"hunter2\")"},
+		{CodeBlocksCredentials, "user := User{Name: \"Alice\", Email: \"alice@example.com\"}\nlogin(user, \"«CREDENTIAL_1»\")"},
+	} {
+		s := NewWithOptions(classifiers, Options{CodeBlocks: tc.mode, TypedTokens: true})
+		out, tm := s.RedactText(context.Background(), text)
+		if !strings.HasPrefix(out, "«PER_1» («EMAIL_1») wrote:") || !strings.Contains(out, "«PER_1» is indented") || !strings.Contains(out, "password is «CREDENTIAL_1»\n") {
+			t.Fatalf("mode %q: prose not redacted: %q", tc.mode, out)
+		}
+		if tc.mode == CodeBlocksRedact {
+			if strings.Contains(out, "Alice") || strings.Contains(out, "hunter2") {
+				t.Fatalf("default mode left values in code: %q", out)
+			}
+			continue
+		}
+		if !strings.Contains(out, tc.want) || !strings.Contains(out, "~~~\ngreet(\"Alice\")\n~~~") || !strings.HasSuffix(out, "```\n«PER_1», unclosed, «CREDENTIAL_1»") {
+			t.Fatalf("mode %q: code blocks not kept:\n%s", tc.mode, out)
+		}
+		if got := tm.Restore(out); got != text {
+			t.Fatalf("mode %q: restore mismatch:\n got  %q\n want %q", tc.mode, got, text)
+		}
+	}
+}
+
+func TestRedactTextAndTexts(t *testing.T) {
+	s := NewWithClassifiers([]Classifier{StaticClassifier{Values: []string{"hunter2", "alice"}}})
+
+	out, tm := s.RedactText(context.Background(), "alice's password is hunter2")
+	if strings.Contains(out, "hunter2") || strings.Contains(out, "alice") || tm.Count() != 2 {
+		t.Fatalf("RedactText = %q (%d redactions)", out, tm.Count())
+	}
+	if got := string(s.RestoreBytes([]byte(out), tm)); got != "alice's password is hunter2" {
+		t.Fatalf("restored %q", got)
+	}
+
+	outs, tm := s.RedactTexts(context.Background(), []string{"hi alice", "nothing here", "bye alice, hunter2"})
+	if outs[1] != "nothing here" || tm.Count() != 2 {
+		t.Fatalf("RedactTexts = %q (%d redactions)", outs, tm.Count())
+	}
+	// The same value maps to the same placeholder across the batch.
+	tok := strings.TrimPrefix(outs[0], "hi ")
+	if !strings.HasPrefix(outs[2], "bye "+tok+", ") {
+		t.Fatalf("placeholder for alice differs across texts: %q", outs)
+	}
+}
+
+func TestHistorySkipsOnlyTheLLM(t *testing.T) {
+	// Without an LLM layer every classifier, the webhook appended after NER
+	// included, runs on history messages.
+	ner := StaticClassifier{Values: []string{"alice"}, Label: "PER"}
+	webhook := StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"}
+	body := []byte(`{"messages":[` +
+		`{"role":"system","content":"the user's password is hunter2"},` +
+		`{"role":"user","content":"alice here"},` +
+		`{"role":"assistant","content":"noted"},` +
+		`{"role":"user","content":"hi"}]}`)
+
+	out, tm := NewWithClassifiers([]Classifier{ner, webhook}).RedactMessages(context.Background(), body)
+	if strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "alice") || tm.Count() != 2 {
+		t.Fatalf("history not redacted by every layer: %s (%d redactions)", out, tm.Count())
+	}
+
+	// Only the marked LLM is skipped, wherever it sits in the list.
+	llm := &StaticClassifier{Values: []string{"noted"}, Label: "LLM"}
+	out, _ = NewWithOptions([]Classifier{llm, ner, webhook}, Options{LLM: llm}).RedactMessages(context.Background(), body)
+	if strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "alice") || !strings.Contains(string(out), "noted") {
+		t.Fatalf("history with LLM layer = %s", out)
+	}
+}
+
+func TestCrossMessageRedactsHistoryAndSplitValues(t *testing.T) {
+	// The LLM is the only one that knows the secret, so by default it is
+	// only found in the last user message.
+	ner := StaticClassifier{Values: []string{"alice"}, Label: "PER"}
+	llm := &StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"}
+	body := []byte(`{"messages":[` +
+		`{"role":"user","content":"alice's password is hunter2"},` +
+		`{"role":"assistant","content":"noted"},` +
+		`{"role":"user","content":"hi"}]}`)
+
+	out, _ := NewWithOptions([]Classifier{ner, llm}, Options{LLM: llm}).RedactMessages(context.Background(), body)
+	if !strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "alice") {
+		t.Fatalf("history unexpectedly classified by the LLM: %s", out)
+	}
+
+	out, tm := NewWithOptions([]Classifier{ner, llm}, Options{CrossMessage: true, LLM: llm}).RedactMessages(context.Background(), body)
+	if strings.Contains(string(out), "hunter2") || strings.Contains(string(out), "alice") || tm.Count() != 2 {
+		t.Fatalf("cross-message redaction = %s (%d redactions)", out, tm.Count())
+	}
+	if got := tm.Restore(string(out)); !strings.Contains(got, "alice's password is hunter2") {
+		t.Fatalf("restored %s", got)
+	}
+
+	// A value split across two messages is flagged on the joined text and
+	// redacted piecewise.
+	first, second := "key: sk-live-12345", "67890 thanks"
+	joined := first + messageSeparator + second
+	split := fixedClassifier{{Start: 5, End: len(joined) - len(" thanks"), Label: "CREDENTIAL"}}
+	texts, tm := []string{first, second}, newTokenMap()
+	got := NewWithOptions([]Classifier{split}, Options{CrossMessage: true}).redactAcrossMessages(context.Background(), texts, tm)
+	if strings.Contains(got[0], "sk-live") || strings.Contains(got[1], "67890") || tm.Count() != 2 {
+		t.Fatalf("split value not redacted: %q (%d redactions)", got, tm.Count())
+	}
+	if tm.Restore(got[0]) != first || tm.Restore(got[1]) != second {
+		t.Fatalf("restored %q, %q", tm.Restore(got[0]), tm.Restore(got[1]))
+	}
+}
+
+func TestCrossMessageKeepsArrayContent(t *testing.T) {
+	s := NewWithOptions([]Classifier{StaticClassifier{Values: []string{"hunter2"}}}, Options{CrossMessage: true})
+	body := []byte(`{"messages":[{"role":"user","content":[{"type":"text","text":"pw hunter2"},{"type":"image_url","image_url":{"url":"x"}}]}]}`)
+	out, tm := s.RedactMessages(context.Background(), body)
+	if strings.Contains(string(out), "hunter2") || !strings.Contains(string(out), "image_url") || tm.Count() != 1 {
+		t.Fatalf("array content = %s", out)
+	}
+}
+
+func TestAuditRecordAndSinks(t *testing.T) {
+	s := NewWithClassifiers([]Classifier{StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"}})
+	_, tm := s.RedactText(context.Background(), "pw hunter2")
+	rec := tm.AuditRecord("req-1", "m")
+	if rec.RequestID != "req-1" || rec.Model != "m" || rec.Time.IsZero() || len(rec.Redactions) != 1 {
+		t.Fatalf("record = %+v", rec)
+	}
+	if r := rec.Redactions[0]; r.Original != "hunter2" || r.Label != "CREDENTIAL" || !strings.HasPrefix(r.Token, "«TOKEN_") {
+		t.Fatalf("redaction = %+v", r)
+	}
+
+	path := filepath.Join(t.TempDir(), "audit.jsonl")
+	fs, err := NewFileAuditSink(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fs.Record(rec)
+	fs.Record(rec)
+	fs.Close()
+	raw, _ := os.ReadFile(path)
+	if lines := strings.Split(strings.TrimSpace(string(raw)), "\n"); len(lines) != 2 || !strings.Contains(lines[0], `"original":"hunter2"`) {
+		t.Fatalf("audit file = %s", raw)
+	}
+	if fi, _ := os.Stat(path); fi.Mode().Perm() != 0o600 {
+		t.Fatalf("audit file mode %v, want 0600", fi.Mode().Perm())
+	}
+
+	var mu sync.Mutex
+	var got []AuditRecord
+	fails := 1 // the first delivery fails and is retried
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		defer mu.Unlock()
+		if r.Header.Get("Authorization") != "Bearer s3cret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		if fails > 0 {
+			fails--
+			w.WriteHeader(http.StatusServiceUnavailable)
+			return
+		}
+		var rec AuditRecord
+		json.NewDecoder(r.Body).Decode(&rec)
+		got = append(got, rec)
+	}))
+	defer srv.Close()
+	ws := NewWebhookAuditSink(srv.URL, "s3cret")
+	ws.Record(rec)
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := ws.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 1 || got[0].RequestID != "req-1" || got[0].Redactions[0].Original != "hunter2" {
+		t.Fatalf("webhook received %+v", got)
+	}
+
+	// A handler still running after shutdown records into a closed sink.
+	ws.Record(rec)
+	if err := ws.Close(ctx); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 {
+		t.Fatalf("record after Close was sent: %+v", got)
+	}
+}
+
+func TestRedactionLabelPriority(t *testing.T) {
+	ner := StaticClassifier{Values: []string{"John Smith"}, Label: "PER"}
+	llm := StaticClassifier{Values: []string{"John Smith", "hunter2"}, Label: "LLM"}
+	for _, order := range [][]Classifier{{ner, llm}, {llm, ner}} {
+		_, tm := NewWithClassifiers(order).RedactText(context.Background(), "John Smith, hunter2")
+		labels := map[string]string{}
+		for _, r := range tm.Redactions() {
+			labels[r.Original] = r.Label
+		}
+		if labels["John Smith"] != "PER" || labels["hunter2"] != "LLM" {
+			t.Fatalf("labels = %v, want PER for the name and LLM for the secret", labels)
+		}
+	}
+
+	// Across texts: a later, more specific label upgrades the token.
+	tm := newTokenMap()
+	tok := tm.register("acme", "LLM")
+	if tm.register("acme", "ORG") != tok || tm.register("acme", "MISC") != tok {
+		t.Fatal("same value got different tokens")
+	}
+	if got := tm.Redactions()[0].Label; got != "ORG" {
+		t.Fatalf("label = %q, want ORG", got)
+	}
+}
+
+func TestTokenNonceAvoidsCollisions(t *testing.T) {
+	classifiers := []Classifier{StaticClassifier{Values: []string{"John Smith"}, Label: "PER"}}
+	for _, typed := range []bool{false, true} {
+		s := NewWithOptions(classifiers, Options{TokenNonce: true, TypedTokens: typed})
+		redacted, tm := s.RedactText(context.Background(), "call John Smith")
+		tok := strings.TrimPrefix(redacted, "call ")
+		if !regexp.MustCompile(`^«(TOKEN|PER)_[A-Z2-7]{8}_\d+»$`).MatchString(tok) {
+			t.Fatalf("typed=%v: token %q has no nonce", typed, tok)
+		}
+		if _, tm2 := s.RedactText(context.Background(), "call John Smith"); tm2.toToken["John Smith"] == tok {
+			t.Fatalf("typed=%v: two requests share token %s", typed, tok)
+		}
+
+		// The model writes a placeholder of its own that only differs in
+		// the nonce: it is not ours and stays as written.
+		nonceless := regexp.MustCompile(`_[A-Z2-7]{8}_`).ReplaceAllString(tok, "_")
+		lookalike := "«PER_1» «TOKEN_000001» " + nonceless
+		resp := tok + " / " + lookalike
+		want := "John Smith / " + lookalike
+		if got := string(s.RestoreBytes([]byte(resp), tm)); got != want {
+			t.Errorf("typed=%v: RestoreBytes = %q, want %q", typed, got, want)
+		}
+		out, err := io.ReadAll(NewRestoringReader(iotest.OneByteReader(strings.NewReader(resp)), tm))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != want {
+			t.Errorf("typed=%v: RestoringReader = %q, want %q", typed, out, want)
+		}
+	}
+}
+
+func TestTypedTokensRestore(t *testing.T) {
+	s := NewWithOptions([]Classifier{
+		StaticClassifier{Values: []string{"John Smith", "Jane Doe"}, Label: "PER"},
+		emailClassifier{},
+		StaticClassifier{Values: []string{"hunter2", "John Smith"}, Label: "LLM"},
+	}, Options{TypedTokens: true})
+	text := "Email John Smith at john@example.com and Jane Doe at jane@example.com with hunter2"
+	redacted, tm := s.RedactText(context.Background(), text)
+
+	for _, tok := range []string{"«PER_1»", "«PER_2»", "«EMAIL_1»", "«EMAIL_2»", "«TOKEN_1»"} {
+		if !strings.Contains(redacted, tok) {
+			t.Errorf("redacted text %q lacks %s", redacted, tok)
+		}
+	}
+	if tm.Count() != 5 {
+		t.Fatalf("count = %d, want 5", tm.Count())
+	}
+	if got := tm.Restore(redacted); got != text {
+		t.Fatalf("Restore = %q, want %q", got, text)
+	}
+
+	// Byte-wise streaming restore, one byte per read.
+	out, err := io.ReadAll(NewRestoringReader(iotest.OneByteReader(strings.NewReader(redacted)), tm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != text {
+		t.Fatalf("RestoringReader = %q, want %q", out, text)
+	}
+
+	// Event-wise streaming restore with tokens split across events.
+	r := NewEventRestorer(tm)
+	runes := []rune(`{"q":"` + redacted + `"}`)
+	var args string
+	for i := 0; i < len(runes); i += 3 {
+		var finish any
+		if i+3 >= len(runes) {
+			finish = "tool_calls"
+		}
+		args += argsOf(t, r.Restore(argsChunk(string(runes[i:min(i+3, len(runes))]), finish)))
+	}
+	if want := `{"q":"` + text + `"}`; args != want {
+		t.Fatalf("EventRestorer = %q, want %q", args, want)
+	}
+
+	// Placeholders the client sent are neither redacted nor reused, and
+	// numbering is per request.
+	again, tm2 := NewWithOptions([]Classifier{StaticClassifier{Values: []string{"«PER_1»", "Jane Doe"}, Label: "PER"}},
+		Options{TypedTokens: true}).RedactText(context.Background(), "«PER_1» and Jane Doe")
+	if again != "«PER_1» and «PER_2»" || tm2.Count() != 1 || tm2.Restore(again) != "«PER_1» and Jane Doe" {
+		t.Fatalf("second request = %q (%d tokens)", again, tm2.Count())
+	}
+}
+
+func TestJSONContentRedactsLeafValues(t *testing.T) {
+	// A tool result with nested values; one email is written with an escape.
+	result := `{"user": {"name": "John Smith", "contact": {"emails": ["john@example.com", "j\u0040example.org"]}},
+ "auth": {"api_key": "sk-live-4f9a8b7c", "expires": 1735689600, "ok": true}, "Smith": null}`
+	body := `{"model":"m","messages":[{"role":"user","content":"look up John"},` +
+		`{"role":"tool","tool_call_id":"c1","content":` + strconv.Quote(result) + `}]}`
+	classifiers := []Classifier{
+		emailClassifier{},
+		StaticClassifier{Values: []string{"Smith", "sk-live-4f9a8b7c"}, Label: "SECRET"},
+		StaticClassifier{}, // the LLM slot, skipped for the tool message unless cross
+	}
+
+	for _, cross := range []bool{false, true} {
+		s := NewWithOptions(classifiers, Options{JSONContent: true, CrossMessage: cross})
+		out, tm := s.RedactMessages(context.Background(), []byte(body))
+		var req struct {
+			Messages []struct {
+				Content string `json:"content"`
+			} `json:"messages"`
+		}
+		if err := json.Unmarshal(out, &req); err != nil {
+			t.Fatal(err)
+		}
+		redacted := req.Messages[1].Content
+		var v map[string]any
+		if err := json.Unmarshal([]byte(redacted), &v); err != nil {
+			t.Fatalf("cross=%v: redacted content is no longer JSON: %v\n%s", cross, err, redacted)
+		}
+		for _, secret := range []string{"john@example.com", `j\u0040example.org`, "sk-live-4f9a8b7c", "John Smith\""} {
+			if strings.Contains(redacted, secret) {
+				t.Errorf("cross=%v: %q left in %s", cross, secret, redacted)
+			}
+		}
+		// Keys, numbers and literals nobody flagged stay byte for byte.
+		for _, kept := range []string{`"Smith": null`, `"expires": 1735689600, "ok": true`, `{"user": {"name": "John «`} {
+			if !strings.Contains(redacted, kept) {
+				t.Errorf("cross=%v: %q changed in %s", cross, kept, redacted)
+			}
+		}
+		if got := tm.Restore(redacted); got != strings.ReplaceAll(result, `j\u0040example.org`, "j@example.org") {
+			t.Errorf("cross=%v: Restore = %s", cross, got)
+		}
+	}
+
+	// Without the option the escaped email is not seen.
+	out, _ := NewWithOptions(classifiers, Options{}).RedactMessages(context.Background(), []byte(body))
+	if !strings.Contains(string(out), `j\\u0040example.org`) {
+		t.Errorf("escaped email redacted without JSONContent: %s", out)
+	}
+}
+
+func TestNormalizeDetectsDisguisedValues(t *testing.T) {
+	classifiers := []Classifier{
+		StaticClassifier{Values: []string{"hunter2"}, Label: "CREDENTIAL"},
+		StaticClassifier{Values: []string{"John Smith"}, Label: "PER"},
+	}
+	// Zero-width space, fullwidth letters, soft hyphen with a trailing
+	// zero-width space, and NBSP.
+	text := "pw hun\u200bter2, \uff48\uff55\uff4e\uff54\uff45\uff52\uff12 and hun\u00adter2\u200b; ask John\u00a0Smith"
+
+	plain, _ := NewWithOptions(classifiers, Options{TypedTokens: true}).RedactText(context.Background(), text)
+	if plain != text {
+		t.Fatalf("disguised values detected without normalization: %q", plain)
+	}
+
+	s := NewWithOptions(classifiers, Options{TypedTokens: true, Normalize: true})
+	out, tm := s.RedactText(context.Background(), text)
+	if strings.Contains(out, "ter2") || strings.Contains(out, "\uff12") || strings.Contains(out, "Smith") || !strings.HasSuffix(out, "; ask «PER_1»") {
+		t.Fatalf("values left in %q", out)
+	}
+	if got := tm.Restore(out); got != text {
+		t.Fatalf("restored %q, want the original %q", got, text)
+	}
+
+	// ASCII text is classified as is.
+	if out, _ := s.RedactText(context.Background(), "pw hunter2"); out != "pw «CREDENTIAL_1»" {
+		t.Fatalf("ascii: %q", out)
+	}
+}
+
+func TestNormalizeTextMapsOffsets(t *testing.T) {
+	text := "a\u00a0\ufb01le\u200bx" // "a", NBSP, the "fi" ligature, "le", ZWSP, "x"
+	got, m := normalizeText(text)
+	if got != "a filex" {
+		t.Fatalf("normalized %q", got)
+	}
+	spans := m.spans(got, []Span{
+		{Start: 2, End: 6, Text: "file"}, // takes in the ZWSP after it
+		{Start: 3, End: 4},               // "i" of the ligature widens to all of it
+		{Start: 0, End: 2, Text: "zz"},   // text mismatch
+		{Start: 5, End: 9},               // out of range
+	})
+	if len(spans) != 2 {
+		t.Fatalf("spans %+v", spans)
+	}
+	if w := text[spans[0].Start:spans[0].End]; w != "\ufb01le\u200b" || spans[0].Text != "" {
+		t.Fatalf("word maps to %q (%+v)", w, spans[0])
+	}
+	if w := text[spans[1].Start:spans[1].End]; w != "\ufb01" {
+		t.Fatalf("ligature part maps to %q", w)
+	}
+	if _, m := normalizeText("plain ascii"); m != nil {
+		t.Fatal("ascii text got a span map")
+	}
+}
+
+// prescreenCorpus is a sample of chat messages, most of them clean, with
+// whether each mode should let them through to the guarded classifier.
+var prescreenCorpus = []struct {
+	text                     string
+	conservative, aggressive bool
+}{
+	{"how do I reverse a linked list in place?", false, false},
+	{"Thanks, that works. Can you make it iterative instead?", false, false},
+	{"explain the difference between a mutex and a semaphore", false, false},
+	{"Write a haiku about autumn leaves.", false, false},
+	{"what's a good name for a cat that likes boxes", false, false},
+	{"Summarize this: the meeting moved to next week because of the holidays.", false, false},
+	{"I think the answer is wrong, try again", false, false},
+	{"Alice called about the invoice.", false, false},
+	{"please ask Alice about the invoice", true, false},
+	{"can you review the PR before lunch", true, false},
+	{"order 4417 never arrived", true, false},
+	{"forward it to John Smith in accounting", true, true},
+	{"my email is alice@example.com", true, true},
+	{"call me at +1 (415) 555-0132", true, true},
+	{"the api key is in the vault", true, true},
+	{"password: hunter2", true, true},
+	{"use this one: 9f8a7b6c5d4e3f2a1b0c", true, true},
+	{"connect to postgres://app:s3cret@db/prod", true, true},
+	{"请把报告发给张伟", true, true},
+}
+
+func TestPrescreenSkipsCleanText(t *testing.T) {
+	for _, mode := range []PrescreenMode{PrescreenOff, PrescreenConservative, PrescreenAggressive} {
+		for _, tc := range prescreenCorpus {
+			var calls atomic.Int32
+			p := NewPrescreen(slowClassifier{done: &calls}, mode)
+			if _, err := p.Classify(tc.text); err != nil {
+				t.Fatal(err)
+			}
+			want := mode == PrescreenOff ||
+				mode == PrescreenConservative && tc.conservative ||
+				mode == PrescreenAggressive && tc.aggressive
+			if got := calls.Load() == 1; got != want {
+				t.Errorf("mode %q, %q: classified %v, want %v", mode, tc.text, got, want)
+			}
+		}
+	}
+	if name := ClassifierName(NewPrescreen(NewBreaker("llm", slowClassifier{}, 3, time.Minute), PrescreenAggressive)); name != "llm" {
+		t.Fatalf("name %q, want the wrapped classifier's", name)
+	}
+}
+
+// BenchmarkPrescreen redacts the corpus with a fast NER-like classifier and
+// a 1ms LLM-like one behind a Prescreen, reporting the share of texts that
+// skipped the LLM.
+func BenchmarkPrescreen(b *testing.B) {
+	for _, mode := range []PrescreenMode{PrescreenOff, PrescreenConservative, PrescreenAggressive} {
+		name := string(mode)
+		if mode == PrescreenOff {
+			name = "off"
+		}
+		b.Run(name, func(b *testing.B) {
+			var calls atomic.Int32
+			s := NewWithClassifiers([]Classifier{
+				StaticClassifier{Values: []string{"Alice", "John Smith"}, Label: "PER"},
+				NewPrescreen(slowClassifier{delay: time.Millisecond, done: &calls}, mode),
+			})
+			for i := 0; i < b.N; i++ {
+				tc := prescreenCorpus[i%len(prescreenCorpus)]
+				s.RedactText(context.Background(), tc.text)
+			}
+			b.ReportMetric(100*(1-float64(calls.Load())/float64(b.N)), "%skipped")
+		})
+	}
+}
+
+func TestRequiredClassifiersPolicy(t *testing.T) {
+	withBudget(t, 50*time.Millisecond)
+	layer := func(name string, down, slow bool) Classifier {
+		if slow {
+			return NewBreaker(name, slowClassifier{delay: time.Second}, 100, time.Minute)
+		}
+		c := &flakyClassifier{}
+		c.down.Store(down)
+		return NewBreaker(name, c, 100, time.Minute)
+	}
+
+	for _, tc := range []struct {
+		name             string
+		required         []string
+		nerDown, llmDown bool
+		llmSlow          bool
+		wantErr          bool
+	}{
+		{name: "all required, llm fails", llmDown: true, wantErr: true},
+		{name: "all required, llm misses budget", llmSlow: true, wantErr: true},
+		{name: "ner required, llm fails", required: []string{"ner"}, llmDown: true},
+		{name: "ner required, llm misses budget", required: []string{"ner"}, llmSlow: true},
+		{name: "ner required, ner fails", required: []string{"ner"}, nerDown: true, wantErr: true},
+		{name: "ner required, both fail", required: []string{"ner"}, nerDown: true, llmDown: true, wantErr: true},
+		{name: "llm required, ner fails", required: []string{"llm"}, nerDown: true},
+		{name: "both required, ner fails", required: []string{"ner", "llm"}, nerDown: true, wantErr: true},
+	} {
+		s := NewWithOptions([]Classifier{layer("ner", tc.nerDown, false), layer("llm", tc.llmDown, tc.llmSlow)}, Options{Required: tc.required})
+		_, tm := s.RedactText(context.Background(), "abcd efgh")
+		if (tm.Err() != nil) != tc.wantErr || !tm.Degraded() {
+			t.Errorf("%s: err %v, degraded %v; want error %v and degraded", tc.name, tm.Err(), tm.Degraded(), tc.wantErr)
+		}
+	}
+
+	// Nothing failed: neither an error nor degraded.
+	s := NewWithOptions([]Classifier{layer("ner", false, false), layer("llm", false, false)}, Options{Required: []string{"ner"}})
+	if _, tm := s.RedactText(context.Background(), "abcd efgh"); tm.Err() != nil || tm.Degraded() {
+		t.Fatalf("healthy classifiers: err %v, degraded %v", tm.Err(), tm.Degraded())
+	}
+}
@@ -0,0 +1,177 @@
+package sanitize
+
+import (
+	"encoding/json"
+	"log/slog"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Shadow runs a candidate classifier next to the active ones for evaluation
+// (Options.Shadow). Its spans are never applied: once the active classifiers
+// have answered, the candidate classifies the same text in the background and
+// its findings are compared, by value, with those of a baseline classifier.
+// Only counts and labels are logged and reported, never the values.
+type Shadow struct {
+	name      string
+	candidate Classifier
+	baseline  string // ClassifierName of the baseline; empty means all active classifiers
+	slots     chan struct{}
+
+	mu     sync.Mutex
+	report ShadowReport
+}
+
+// ShadowReport sums up how a shadow classifier compared with its baseline
+// since startup. Values are counted once per classified text.
+type ShadowReport struct {
+	Name     string `json:"name"`
+	Baseline string `json:"baseline"`
+
+	Compared int `json:"compared"` // texts both classified
+	Differed int `json:"differed"` // texts where the findings differed
+	Skipped  int `json:"skipped"`  // texts not shadowed because the candidate was busy
+	Errors   int `json:"errors"`   // candidate failures
+
+	Agreed       int `json:"agreed"`        // values both flagged
+	BaselineOnly int `json:"baseline_only"` // values only the baseline flagged
+	ShadowOnly   int `json:"shadow_only"`   // values only the candidate flagged
+
+	// Labels counts the disagreements by label, as "baseline_only:PER" or
+	// "shadow_only:CREDENTIAL".
+	Labels map[string]int `json:"labels,omitempty"`
+}
+
+// NewShadow creates a Shadow named name that evaluates candidate against
+// baseline, or against the combined findings of all active classifiers when
+// baseline is nil. At most maxInFlight candidate calls run at once (1 when
+// lower); texts arriving while all are busy are skipped, so a slow
+// candidate cannot pile up work.
+func NewShadow(name string, candidate, baseline Classifier, maxInFlight int) *Shadow {
+	if maxInFlight < 1 {
+		maxInFlight = 1
+	}
+	sh := &Shadow{
+		name:      name,
+		candidate: candidate,
+		slots:     make(chan struct{}, maxInFlight),
+	}
+	sh.report.Name = name
+	sh.report.Baseline = "all"
+	if baseline != nil {
+		sh.baseline = ClassifierName(baseline)
+		sh.report.Baseline = sh.baseline
+	}
+	return sh
+}
+
+// observe classifies text with the candidate in the background and compares
+// the result with baseline, the spans the baseline found in text. latency,
+// if set, also times the candidate.
+func (sh *Shadow) observe(text string, baseline []Span, latency *LatencyRecorder) {
+	select {
+	case sh.slots <- struct{}{}:
+	default:
+		sh.mu.Lock()
+		sh.report.Skipped++
+		sh.mu.Unlock()
+		return
+	}
+	go func() {
+		defer func() { <-sh.slots }()
+		start := time.Now()
+		spans, err := sh.candidate.Classify(text)
+		if latency != nil {
+			latency.Record(sh.name, time.Since(start), err)
+		}
+		if err != nil {
+			slog.Warn("sanitize: shadow classifier error", "shadow", sh.name, "err", err)
+			sh.mu.Lock()
+			sh.report.Errors++
+			sh.mu.Unlock()
+			return
+		}
+		sh.compare(spanValues(text, baseline), spanValues(text, spans))
+	}()
+}
+
+// compare records one text's findings.
+func (sh *Shadow) compare(baseline, shadow map[string]string) {
+	var agreed int
+	var labels []string
+	for v, label := range baseline {
+		if _, ok := shadow[v]; ok {
+			agreed++
+		} else {
+			labels = append(labels, "baseline_only:"+label)
+		}
+	}
+	for v, label := range shadow {
+		if _, ok := baseline[v]; !ok {
+			labels = append(labels, "shadow_only:"+label)
+		}
+	}
+	baselineOnly, shadowOnly := len(baseline)-agreed, len(shadow)-agreed
+
+	sh.mu.Lock()
+	r := &sh.report
+	r.Compared++
+	r.Agreed += agreed
+	r.BaselineOnly += baselineOnly
+	r.ShadowOnly += shadowOnly
+	if len(labels) > 0 {
+		r.Differed++
+		if r.Labels == nil {
+			r.Labels = make(map[string]int)
+		}
+		for _, l := range labels {
+			r.Labels[l]++
+		}
+	}
+	sh.mu.Unlock()
+
+	if len(labels) > 0 {
+		sort.Strings(labels)
+		slog.Info("sanitize: shadow classifier differs",
+			"shadow", sh.name, "baseline", sh.report.Baseline,
+			"agreed", agreed, "baselineOnly", baselineOnly, "shadowOnly", shadowOnly,
+			"labels", strings.Join(labels, ","))
+	}
+}
+
+// spanValues maps the distinct values spans cover in text to their label.
+func spanValues(text string, spans []Span) map[string]string {
+	values := make(map[string]string, len(spans))
+	for _, sp := range validSpans(text, spans, 0) {
+		v := text[sp.Start:sp.End]
+		if old, ok := values[v]; !ok || labelRank(sp.Label) > labelRank(old) {
+			values[v] = sp.Label
+		}
+	}
+	return values
+}
+
+// Report returns the comparison so far.
+func (sh *Shadow) Report() ShadowReport {
+	sh.mu.Lock()
+	defer sh.mu.Unlock()
+	r := sh.report
+	if r.Labels != nil {
+		r.Labels = make(map[string]int, len(sh.report.Labels))
+		for l, n := range sh.report.Labels {
+			r.Labels[l] = n
+		}
+	}
+	return r
+}
+
+// StatusHandler returns an http.Handler that reports Report as JSON.
+func (sh *Shadow) StatusHandler() http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		_ = json.NewEncoder(w).Encode(sh.Report())
+	})
+}
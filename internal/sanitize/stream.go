@@ -1,25 +1,65 @@
 package sanitize
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
 	"io"
+	"strconv"
 	"strings"
+	"unicode/utf8"
 )
 
 // tokenPrefix and tokenSuffix are the delimiters used for placeholder tokens.
-// The restoring reader must handle the case where a token is split across
-// multiple SSE chunks.
-const tokenPrefix = "«TOKEN_"
+// Between them is a name of uppercase letters, digits and underscores:
+// TOKEN_000001, or PER_1 with typed tokens, with a nonce before the number
+// under Options.TokenNonce. The restoring reader must handle
+// the case where a token is split across multiple SSE chunks.
+const tokenPrefix = "«"
 const tokenSuffix = "»"
 
+// maxTokenBody bounds the text between the delimiters of a token, so a
+// trailing "«" followed by a long run of capitals is not held back forever.
+const maxTokenBody = maxTokenName + tokenNonceLen + 22
+
+// isTokenByte reports whether c can appear between a token's delimiters.
+func isTokenByte(c byte) bool {
+	return 'A' <= c && c <= 'Z' || '0' <= c && c <= '9' || c == '_'
+}
+
+// tokenLen returns the length of the token-shaped text at the start of b
+// («, token bytes, »), or 0 if b does not start with one.
+func tokenLen(b []byte) int {
+	if !bytes.HasPrefix(b, tokenPrefixBytes) {
+		return 0
+	}
+	n := len(tokenPrefixBytes)
+	for n < len(b) && n-len(tokenPrefixBytes) < maxTokenBody && isTokenByte(b[n]) {
+		n++
+	}
+	if n == len(tokenPrefixBytes) || !bytes.HasPrefix(b[n:], tokenSuffixBytes) {
+		return 0
+	}
+	return n + len(tokenSuffixBytes)
+}
+
 // RestoringReader wraps an upstream SSE response body and replaces any
 // placeholder tokens with their original values before the bytes reach the
-// client. It handles tokens that are split across chunk boundaries by
-// maintaining a small look-ahead buffer.
+// client. It handles tokens that are split across chunk boundaries by holding
+// back only a trailing fragment that could still grow into a token; everything
+// before it is restored and released as soon as it arrives, so slow streams
+// are not delayed.
+//
+// The reader reuses its internal buffers across reads, so a long stream does
+// not allocate per chunk.
 type RestoringReader struct {
-	src    io.Reader
-	tm     *TokenMap
-	buf    []byte // buffered bytes not yet written to consumer
-	srcEOF bool
+	src     io.Reader
+	tm      *TokenMap
+	scratch []byte // reused buffer for reads from src
+	pending []byte // input not yet restored: a possible partial token
+	outBuf  []byte // reused backing array for out
+	out     []byte // restored bytes not yet returned to the consumer
+	srcErr  error  // terminal error (io.EOF included) from src
 }
 
 // NewRestoringReader wraps src so that all «TOKEN_XXXXXX» markers are replaced
@@ -32,78 +72,350 @@ func NewRestoringReader(src io.Reader, tm *TokenMap) io.Reader {
 	return &RestoringReader{src: src, tm: tm}
 }
 
-// Read implements io.Reader. It reads from the upstream, appends to the
-// internal buffer, restores tokens in the safe portion of the buffer
-// (everything except the last len(tokenPrefix)-1 bytes that might be the
-// start of a split token), and copies the result into p.
+// Read implements io.Reader. It reads from the upstream, restores every token
+// in the input except a trailing partial token (see heldBackLen), and copies
+// the result into p. The held-back fragment is released once more input shows
+// it is not a token, or at the end of the stream.
 func (r *RestoringReader) Read(p []byte) (int, error) {
 	if len(p) == 0 {
 		return 0, nil
 	}
+	for len(r.out) == 0 {
+		if r.srcErr != nil {
+			if len(r.pending) == 0 {
+				return 0, r.srcErr
+			}
+			r.outBuf = r.tm.appendRestored(r.outBuf[:0], r.pending)
+			r.out = r.outBuf
+			r.pending = r.pending[:0]
+			break
+		}
+
+		// Read about as much as the caller asked for, so the stream buffer
+		// size set by the caller also sets the upstream read size.
+		if want := max(len(p), 512); cap(r.scratch) < want {
+			r.scratch = make([]byte, want)
+		}
+		n, err := r.src.Read(r.scratch[:cap(r.scratch)])
+		r.pending = append(r.pending, r.scratch[:n]...)
+		if err != nil {
+			r.srcErr = err
+			continue
+		}
+		safe := len(r.pending) - heldBackLen(r.pending)
+		if safe > 0 {
+			r.outBuf = r.tm.appendRestored(r.outBuf[:0], r.pending[:safe])
+			r.out = r.outBuf
+			r.pending = r.pending[:copy(r.pending, r.pending[safe:])]
+		}
+	}
+	n := copy(p, r.out)
+	r.out = r.out[n:]
+	return n, nil
+}
+
+// heldBackLen returns how many trailing bytes of b could be part of a token
+// that has not fully arrived yet: a « and token bytes without the closing »,
+// possibly followed by the first byte of a split « or ».
+func heldBackLen(b []byte) int {
+	// « and » are both two bytes in UTF-8 and share the first one.
+	split := 0
+	if len(b) > 0 && b[len(b)-1] == tokenSuffix[0] {
+		split = 1
+	}
+	b = b[:len(b)-split]
+	// Only the tail after the last « can matter; avoid converting the rest.
+	if i := bytes.LastIndex(b, tokenPrefixBytes); i >= 0 {
+		return split + partialTokenSuffix(string(b[i:]))
+	}
+	return split
+}
+
+// restoreBytes applies token restoration to a byte slice.
+func restoreBytes(b []byte, tm *TokenMap) []byte {
+	return tm.appendRestored(nil, b)
+}
+
+var (
+	tokenPrefixBytes = []byte(tokenPrefix)
+	tokenSuffixBytes = []byte(tokenSuffix)
+)
+
+// appendRestored appends b to dst with every known token replaced by its
+// original, in a single pass over the bytes. Unknown «…» text is copied
+// unchanged, and so is every other byte, valid UTF-8 or not.
+func (m *TokenMap) appendRestored(dst, b []byte) []byte {
+	return m.appendReplaced(dst, b, false)
+}
+
+// appendReplaced is appendRestored, inserting originals JSON-escaped when
+// escape is set.
+func (m *TokenMap) appendReplaced(dst, b []byte, escape bool) []byte {
+	for {
+		i := bytes.Index(b, tokenPrefixBytes)
+		if i < 0 {
+			return append(dst, b...)
+		}
+		// The map lookup with a converted key does not allocate.
+		if n := tokenLen(b[i:]); n > 0 {
+			if orig, ok := m.fromToken[string(b[i:i+n])]; ok {
+				if escape {
+					orig = jsonEscape(orig)
+				}
+				dst = append(dst, b[:i]...)
+				dst = append(dst, orig...)
+				b = b[i+n:]
+				continue
+			}
+		}
+		// Not one of ours; keep the prefix and look for the next token.
+		dst = append(dst, b[:i+len(tokenPrefixBytes)]...)
+		b = b[i+len(tokenPrefixBytes):]
+	}
+}
+
+// EventRestorer restores placeholder tokens inside SSE data payloads (one
+// JSON chat completion chunk per call). Unlike RestoringReader it works on
+// decoded JSON string values, so originals containing quotes, backslashes or
+// newlines are re-escaped correctly. Tool-call "arguments" strings are JSON
+// text themselves, so inside them originals are escaped once more for that
+// inner JSON.
+//
+// A token may be split across events (e.g. "«TOK" in one delta and
+// "EN_000001»" in the next). For streamed text fields the restorer holds back
+// a trailing partial token and prepends it to the same field of the next
+// event, flushing whatever is left when the choice finishes.
+//
+// An EventRestorer is stateful and must be used for a single stream.
+type EventRestorer struct {
+	tm    *TokenMap
+	carry map[string]string // field path → held-back partial token
+}
+
+// NewEventRestorer returns an EventRestorer for tm, or nil if tm is nil or
+// empty. A nil *EventRestorer returns payloads unchanged.
+func NewEventRestorer(tm *TokenMap) *EventRestorer {
+	if tm == nil || tm.IsEmpty() {
+		return nil
+	}
+	return &EventRestorer{tm: tm, carry: make(map[string]string)}
+}
+
+// streamedFields are the chunk fields whose text arrives in pieces and may
+// therefore contain a token split across events.
+var streamedFields = map[string]bool{
+	"content":           true,
+	"reasoning":         true,
+	"reasoning_content": true,
+	"arguments":         true,
+}
 
-	// If we have buffered output ready, drain it first.
-	if len(r.buf) > 0 {
-		n := copy(p, r.buf)
-		r.buf = r.buf[n:]
-		return n, nil
+// Restore returns payload with every token restored. Payloads that are not
+// JSON are restored byte-wise.
+//
+// So are JSON payloads that are not valid UTF-8: decoding would turn their
+// stray bytes into U+FFFD. Originals are then inserted JSON-escaped, as
+// tokens sit in string literals, but a token split across events is not
+// reassembled and one in tool-call arguments is escaped only once.
+func (r *EventRestorer) Restore(payload []byte) []byte {
+	if r == nil || (len(r.carry) == 0 && !mayContainToken(payload)) {
+		return payload
+	}
+	if !utf8.Valid(payload) {
+		return r.tm.appendReplaced(nil, payload, json.Valid(payload))
 	}
 
-	if r.srcEOF {
-		return 0, io.EOF
+	dec := json.NewDecoder(bytes.NewReader(payload))
+	dec.UseNumber()
+	var v any
+	if err := dec.Decode(&v); err != nil {
+		return restoreBytes(payload, r.tm)
 	}
+	setters := make(map[string]func(string))
+	v = r.restoreValue(v, "", "", setters)
+	r.flushFinished(v, setters)
 
-	// Read a chunk from upstream.
-	tmp := make([]byte, len(p)*2)
-	n, err := r.src.Read(tmp)
-	if err == io.EOF {
-		r.srcEOF = true
-	} else if err != nil {
-		return 0, err
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	if err := enc.Encode(v); err != nil {
+		return restoreBytes(payload, r.tm)
 	}
+	return bytes.TrimRight(buf.Bytes(), "\n")
+}
 
-	chunk := tmp[:n]
+// mayContainToken reports whether payload has a full token or the start of
+// one. The \u00ab form covers upstreams that escape non-ASCII characters.
+func mayContainToken(payload []byte) bool {
+	return bytes.Contains(payload, []byte("TOKEN_")) ||
+		bytes.Contains(payload, []byte("«")) ||
+		bytes.Contains(bytes.ToLower(payload), []byte(`\u00ab`))
+}
 
-	// Restore tokens in the chunk. When we are at EOF we can restore
-	// everything; otherwise we hold back a tail that might be a partial token.
-	var safe []byte
-	if r.srcEOF {
-		safe = chunk
-	} else {
-		// Hold back enough bytes to cover a partial token marker.
-		// Worst case: "«TOKEN_000001" without the closing "»" is about 14 bytes.
-		// Hold back 20 to be safe.
-		const holdBack = 20
-		if len(chunk) <= holdBack {
-			// Too short to split safely; buffer everything and wait for more.
-			r.buf = append(r.buf, chunk...)
-			return r.Read(p)
+// restoreValue walks a decoded JSON value and restores tokens in every
+// string. key is the object key v was found under and path its location,
+// with array elements addressed by their "index" field when present so that
+// deltas for the same choice or tool call share a path across events.
+// setters collects, per streamed field path, a function that overwrites it.
+func (r *EventRestorer) restoreValue(v any, key, path string, setters map[string]func(string)) any {
+	switch t := v.(type) {
+	case map[string]any:
+		for k, child := range t {
+			childPath := k
+			if path != "" {
+				childPath = path + "." + k
+			}
+			t[k] = r.restoreValue(child, k, childPath, setters)
+			if _, ok := t[k].(string); ok && streamedFields[k] {
+				m, k := t, k
+				setters[childPath] = func(s string) { m[k] = s }
+			}
+		}
+		return t
+	case []any:
+		for i, child := range t {
+			t[i] = r.restoreValue(child, "", fmt.Sprintf("%s[%s]", path, elemIndex(child, i)), setters)
 		}
-		safe = chunk[:len(chunk)-holdBack]
-		r.buf = append(r.buf, chunk[len(chunk)-holdBack:]...)
+		return t
+	case string:
+		if !streamedFields[key] {
+			return r.tm.Restore(t)
+		}
+		t = r.carry[path] + t
+		delete(r.carry, path)
+		if n := partialTokenSuffix(t); n > 0 {
+			r.carry[path] = t[len(t)-n:]
+			t = t[:len(t)-n]
+		}
+		return r.restoreField(key, t)
+	default:
+		return v
 	}
+}
 
-	restored := restoreBytes(safe, r.tm)
+func (r *EventRestorer) restoreField(key, s string) string {
+	if key == "arguments" {
+		return restoreJSONText(s, r.tm)
+	}
+	return r.tm.Restore(s)
+}
 
-	// If we are at EOF also restore the held-back buffer.
-	if r.srcEOF && len(r.buf) > 0 {
-		tail := restoreBytes(r.buf, r.tm)
-		r.buf = []byte(tail)
+// flushFinished releases held-back text for every choice in v that carries a
+// finish_reason, since no further deltas will arrive for it. The text is
+// appended to the same field when this event has it, or to delta.content for
+// content fields; otherwise it is dropped, as it can only be an unterminated
+// token fragment.
+func (r *EventRestorer) flushFinished(v any, setters map[string]func(string)) {
+	obj, ok := v.(map[string]any)
+	if !ok || len(r.carry) == 0 {
+		return
 	}
+	choices, _ := obj["choices"].([]any)
+	for i, c := range choices {
+		choice, ok := c.(map[string]any)
+		if !ok || choice["finish_reason"] == nil {
+			continue
+		}
+		prefix := fmt.Sprintf("choices[%s].", elemIndex(choice, i))
+		for path, held := range r.carry {
+			if !strings.HasPrefix(path, prefix) {
+				continue
+			}
+			delete(r.carry, path)
+			key := path[strings.LastIndex(path, ".")+1:]
+			restored := r.restoreField(key, held)
+			if set, ok := setters[path]; ok {
+				set(currentString(choice, strings.TrimPrefix(path, prefix)) + restored)
+				continue
+			}
+			if path == prefix+"delta.content" {
+				delta, ok := choice["delta"].(map[string]any)
+				if !ok {
+					delta = map[string]any{}
+					choice["delta"] = delta
+				}
+				delta["content"] = restored
+			}
+		}
+	}
+}
 
-	copied := copy(p, restored)
-	if copied < len(restored) {
-		// p was too small; prepend the overflow back to the buffer.
-		remainder := []byte(string(restored[copied:]))
-		r.buf = append(remainder, r.buf...)
+// currentString reads the string at a dotted path below obj, or "".
+func currentString(obj map[string]any, path string) string {
+	var cur any = obj
+	for _, part := range strings.Split(path, ".") {
+		name, idx, isElem := strings.Cut(part, "[")
+		m, ok := cur.(map[string]any)
+		if !ok {
+			return ""
+		}
+		cur = m[name]
+		if isElem {
+			idx = strings.TrimSuffix(idx, "]")
+			arr, _ := cur.([]any)
+			cur = nil
+			for i, el := range arr {
+				if elemIndex(el, i) == idx {
+					cur = el
+					break
+				}
+			}
+		}
 	}
-	return copied, nil
+	s, _ := cur.(string)
+	return s
 }
 
-// restoreBytes applies token restoration to a byte slice.
-func restoreBytes(b []byte, tm *TokenMap) []byte {
-	s := string(b)
+// elemIndex returns the identity of an array element: its "index" field for
+// chunk choices and tool-call deltas, or its position otherwise.
+func elemIndex(el any, pos int) string {
+	if m, ok := el.(map[string]any); ok {
+		if idx, ok := m["index"].(json.Number); ok {
+			return idx.String()
+		}
+	}
+	return strconv.Itoa(pos)
+}
+
+// partialTokenSuffix returns the length of the longest suffix of s that is
+// an incomplete placeholder token ("«", "«TOK", "«TOKEN_00", "«PER_", ...),
+// or 0.
+func partialTokenSuffix(s string) int {
+	i := strings.LastIndex(s, tokenPrefix)
+	if i < 0 {
+		return 0
+	}
+	body := s[i+len(tokenPrefix):]
+	if len(body) > maxTokenBody {
+		return 0
+	}
+	for j := 0; j < len(body); j++ {
+		if !isTokenByte(body[j]) {
+			return 0
+		}
+	}
+	return len(s) - i
+}
+
+// restoreJSONText restores tokens inside s, which is (possibly partial) JSON
+// text such as streamed tool-call arguments. Tokens sit inside JSON string
+// literals there, so each original is inserted in its JSON-escaped form.
+func restoreJSONText(s string, tm *TokenMap) string {
 	for tok, orig := range tm.fromToken {
-		s = strings.ReplaceAll(s, tok, orig)
+		if strings.Contains(s, tok) {
+			s = strings.ReplaceAll(s, tok, jsonEscape(orig))
+		}
 	}
-	return []byte(s)
+	return s
+}
+
+// jsonEscape returns s escaped for use inside a JSON string literal, without
+// the surrounding quotes.
+func jsonEscape(s string) string {
+	var buf bytes.Buffer
+	enc := json.NewEncoder(&buf)
+	enc.SetEscapeHTML(false)
+	_ = enc.Encode(s)
+	out := bytes.TrimRight(buf.Bytes(), "\n")
+	return string(out[1 : len(out)-1])
 }
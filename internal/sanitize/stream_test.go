@@ -0,0 +1,339 @@
+package sanitize
+
+import (
+	"context"
+	"encoding/json"
+	"io"
+	"strings"
+	"testing"
+	"testing/iotest"
+	"time"
+)
+
+func TestEventRestorerToolCallArguments(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register(`p"a\ss`, "")
+
+	// The token sits inside a JSON string literal inside the arguments string.
+	args := `{"password":"` + tok + `"}`
+	chunk, _ := json.Marshal(map[string]any{
+		"choices": []any{map[string]any{
+			"index": 0,
+			"delta": map[string]any{
+				"tool_calls": []any{map[string]any{
+					"index":    0,
+					"function": map[string]any{"arguments": args},
+				}},
+			},
+		}},
+	})
+
+	out := NewEventRestorer(tm).Restore(chunk)
+
+	var got struct {
+		Choices []struct {
+			Delta struct {
+				ToolCalls []struct {
+					Function struct {
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("restored chunk is not valid JSON: %v\n%s", err, out)
+	}
+	var parsed map[string]string
+	if err := json.Unmarshal([]byte(got.Choices[0].Delta.ToolCalls[0].Function.Arguments), &parsed); err != nil {
+		t.Fatalf("restored arguments are not valid JSON: %v", err)
+	}
+	if parsed["password"] != `p"a\ss` {
+		t.Fatalf("want original value, got %q", parsed["password"])
+	}
+}
+
+func TestEventRestorerContent(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register("line1\nline\"2", "")
+
+	chunk, _ := json.Marshal(map[string]any{
+		"choices": []any{map[string]any{"delta": map[string]any{"content": "see " + tok}}},
+	})
+	out := NewEventRestorer(tm).Restore(chunk)
+
+	var got struct {
+		Choices []struct {
+			Delta struct {
+				Content string `json:"content"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatalf("restored chunk is not valid JSON: %v\n%s", err, out)
+	}
+	if want := "see line1\nline\"2"; got.Choices[0].Delta.Content != want {
+		t.Fatalf("want %q, got %q", want, got.Choices[0].Delta.Content)
+	}
+}
+
+func TestEventRestorerNoTokens(t *testing.T) {
+	tm := newTokenMap()
+	tm.register("secret", "")
+	in := []byte(`{"b":1,   "a":"plain"}`)
+	if out := NewEventRestorer(tm).Restore(in); string(out) != string(in) {
+		t.Fatalf("payload without tokens should be untouched, got %s", out)
+	}
+}
+
+// argsChunk builds a streamed tool-call delta carrying an arguments fragment.
+func argsChunk(fragment string, finish any) []byte {
+	b, _ := json.Marshal(map[string]any{
+		"choices": []any{map[string]any{
+			"index": 0,
+			"delta": map[string]any{
+				"tool_calls": []any{map[string]any{
+					"index":    0,
+					"function": map[string]any{"arguments": fragment},
+				}},
+			},
+			"finish_reason": finish,
+		}},
+	})
+	return b
+}
+
+func argsOf(t *testing.T, chunk []byte) string {
+	t.Helper()
+	var got struct {
+		Choices []struct {
+			Delta struct {
+				ToolCalls []struct {
+					Function struct {
+						Arguments string `json:"arguments"`
+					} `json:"function"`
+				} `json:"tool_calls"`
+			} `json:"delta"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(chunk, &got); err != nil {
+		t.Fatalf("restored chunk is not valid JSON: %v\n%s", err, chunk)
+	}
+	return got.Choices[0].Delta.ToolCalls[0].Function.Arguments
+}
+
+func TestEventRestorerTokenSplitAcrossEvents(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register(`a"b`, "") // e.g. «TOKEN_000001»
+
+	// Split the token at every character boundary across three events.
+	runes := []rune(tok)
+	for cut1 := 1; cut1 < len(runes); cut1++ {
+		for cut2 := cut1 + 1; cut2 <= len(runes); cut2++ {
+			r := NewEventRestorer(tm)
+			frags := []string{`{"k":"` + string(runes[:cut1]), string(runes[cut1:cut2]), string(runes[cut2:]) + `"}`}
+			var args string
+			for _, f := range frags {
+				args += argsOf(t, r.Restore(argsChunk(f, nil)))
+			}
+			var parsed map[string]string
+			if err := json.Unmarshal([]byte(args), &parsed); err != nil {
+				t.Fatalf("cut %d/%d: arguments %q are not valid JSON: %v", cut1, cut2, args, err)
+			}
+			if parsed["k"] != `a"b` {
+				t.Fatalf("cut %d/%d: want original, got %q", cut1, cut2, parsed["k"])
+			}
+		}
+	}
+}
+
+func TestEventRestorerFlushOnFinish(t *testing.T) {
+	tm := newTokenMap()
+	tm.register("secret", "")
+	r := NewEventRestorer(tm)
+
+	// A trailing "«" looks like the start of a token and is held back ...
+	if got := argsOf(t, r.Restore(argsChunk(`{"q":"«`, nil))); got != `{"q":"` {
+		t.Fatalf("want partial token held back, got %q", got)
+	}
+	// ... and released once the choice finishes.
+	if got := argsOf(t, r.Restore(argsChunk(`x"}`, "tool_calls"))); got != `«x"}` {
+		t.Fatalf("want held text released, got %q", got)
+	}
+}
+
+func TestRestoringReaderTrickle(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register("alice@example.com", "")
+	in := "mail " + tok + " or «TOKEN_x» and " + tok
+
+	out, err := io.ReadAll(NewRestoringReader(iotest.OneByteReader(strings.NewReader(in)), tm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "mail alice@example.com or «TOKEN_x» and alice@example.com"; string(out) != want {
+		t.Fatalf("got %q, want %q", out, want)
+	}
+}
+
+func TestRestoreKeepsInvalidUTF8(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register(`say "hi"`, "")
+	// Stray bytes next to and between tokens, including a lone 0xC2 (the
+	// first byte of « and ») and a truncated «.
+	in := "\xff" + tok + "\xc2 mid \xe2\x82" + tok + "\xc2\xab\xc2"
+	want := "\xff" + `say "hi"` + "\xc2 mid \xe2\x82" + `say "hi"` + "\xc2\xab\xc2"
+
+	if got := (&Sanitizer{}).RestoreBytes([]byte(in), tm); string(got) != want {
+		t.Errorf("RestoreBytes = %q, want %q", got, want)
+	}
+	out, err := io.ReadAll(NewRestoringReader(iotest.OneByteReader(strings.NewReader(in)), tm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Errorf("RestoringReader = %q, want %q", out, want)
+	}
+
+	payload := `{"choices":[{"index":0,"delta":{"content":"` + "\xfe " + tok + `"}}]}`
+	wantPayload := `{"choices":[{"index":0,"delta":{"content":"` + "\xfe " + `say \"hi\""}}]}`
+	if got := NewEventRestorer(tm).Restore([]byte(payload)); string(got) != wantPayload {
+		t.Errorf("EventRestorer = %q, want %q", got, wantPayload)
+	}
+}
+
+func TestRestoringReaderFlushesBeforeStreamPauses(t *testing.T) {
+	tm := newTokenMap()
+	tok := tm.register("secret", "")
+
+	pr, pw := io.Pipe()
+	defer pw.Close()
+	go func() {
+		// Byte by byte, then a partial token, then the stream stalls.
+		for _, b := range []byte("key " + tok + " ok «TOK") {
+			_, _ = pw.Write([]byte{b})
+		}
+	}()
+
+	r := NewRestoringReader(pr, tm)
+	want := "key secret ok "
+	got := make([]byte, len(want))
+	done := make(chan error, 1)
+	go func() {
+		_, err := io.ReadFull(r, got)
+		done <- err
+	}()
+	select {
+	case err := <-done:
+		if err != nil || string(got) != want {
+			t.Fatalf("got %q (err %v), want %q", got, err, want)
+		}
+	case <-time.After(2 * time.Second):
+		t.Fatal("restored text before the partial token was not released while the stream paused")
+	}
+}
+
+// chunkedReader returns at most size bytes per Read.
+type chunkedReader struct {
+	r    io.Reader
+	size int
+}
+
+func (c chunkedReader) Read(p []byte) (int, error) {
+	if len(p) > c.size {
+		p = p[:c.size]
+	}
+	return c.r.Read(p)
+}
+
+// checkRoundTrip redacts text with a StaticClassifier flagging values, echoes
+// the redacted content back as a response, and checks that both RestoreBytes
+// and a RestoringReader fed chunkSize bytes at a time reproduce text.
+func checkRoundTrip(t *testing.T, text string, values []string, chunkSize int) {
+	t.Helper()
+	body, err := json.Marshal(map[string]any{"messages": []any{map[string]any{"role": "user", "content": text}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JSON encoding replaces invalid UTF-8; that normalised text is what the
+	// proxy actually sees.
+	var sent struct {
+		Messages []struct{ Content string } `json:"messages"`
+	}
+	_ = json.Unmarshal(body, &sent)
+	want := sent.Messages[0].Content
+
+	s := NewWithClassifiers([]Classifier{StaticClassifier{Values: values}})
+	redactedBody, tm := s.RedactMessages(context.Background(), body)
+	var got struct {
+		Messages []struct{ Content string } `json:"messages"`
+	}
+	if err := json.Unmarshal(redactedBody, &got); err != nil {
+		t.Fatalf("redacted body is not valid JSON: %v", err)
+	}
+	echo := got.Messages[0].Content
+
+	if restored := string(s.RestoreBytes([]byte(echo), tm)); restored != want {
+		t.Fatalf("RestoreBytes round trip:\n got %q\nwant %q", restored, want)
+	}
+	out, err := io.ReadAll(NewRestoringReader(chunkedReader{strings.NewReader(echo), chunkSize}, tm))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(out) != want {
+		t.Fatalf("RestoringReader round trip (chunks of %d):\n got %q\nwant %q", chunkSize, out, want)
+	}
+}
+
+func TestRedactRestoreRoundTrip(t *testing.T) {
+	cases := []struct {
+		text   string
+		values []string
+	}{
+		{"mail alice@example.com today", []string{"alice@example.com"}},
+		{"Иван Петров и Иван Петров", []string{"Иван Петров"}},
+		{"key sk-abc, again sk-abc; and 東京タワー", []string{"sk-abc", "東京タワー"}},
+		{"quote \"p\\a\nss\" end", []string{"\"p\\a\nss\""}},
+		{"nothing to hide", []string{"absent"}},
+		{"«TOKEN_ lookalike «TOKEN_123» kept", []string{"kept"}},
+	}
+	for _, tc := range cases {
+		for _, size := range []int{1, 2, 3, 7, 64} {
+			checkRoundTrip(t, tc.text, tc.values, size)
+		}
+	}
+}
+
+func FuzzRedactRestoreRoundTrip(f *testing.F) {
+	f.Add("mail alice@example.com today", "alice@example.com", 3)
+	f.Add("Иван Петров, Иван Петров", "Иван Петров", 1)
+	f.Add("token «TOK sk-1", "sk-1", 2)
+	f.Fuzz(func(t *testing.T, text, value string, chunkSize int) {
+		if chunkSize < 1 || chunkSize > 4096 {
+			chunkSize = 1 + (chunkSize&0x7fffffff)%64
+		}
+		checkRoundTrip(t, text, []string{value}, chunkSize)
+	})
+}
+
+func BenchmarkRestoringReader(b *testing.B) {
+	tm := newTokenMap()
+	tok := tm.register("alice@example.com", "")
+	var sb strings.Builder
+	for i := 0; i < 2000; i++ {
+		sb.WriteString(`data: {"choices":[{"delta":{"content":"mail ` + tok + `"}}]}` + "\n\n")
+	}
+	in := sb.String()
+	buf := make([]byte, 4096)
+
+	b.ReportAllocs()
+	b.SetBytes(int64(len(in)))
+	for i := 0; i < b.N; i++ {
+		r := NewRestoringReader(strings.NewReader(in), tm)
+		for {
+			if _, err := r.Read(buf); err != nil {
+				break
+			}
+		}
+	}
+}
@@ -5,6 +5,7 @@ import (
 	"crypto/elliptic"
 	"crypto/hmac"
 	"crypto/sha256"
+	"encoding/asn1"
 	"encoding/base64"
 	"encoding/hex"
 	"fmt"
@@ -18,11 +19,42 @@ import (
 // Signer produces ECDSA-SHA256 signatures over secp256k1, matching the
 // official gonka-openai Python SDK v0.2.4 signing scheme exactly.
 type Signer struct {
-	key *ecdsa.PrivateKey
+	key    *ecdsa.PrivateKey
+	format Format
+}
+
+// Format is the encoding of a signature before base64.
+type Format string
+
+const (
+	// FormatRaw is r||s, 32 bytes each, as the Python SDK sends it.
+	FormatRaw Format = "raw"
+	// FormatDER is an ASN.1 DER SEQUENCE of the INTEGERs r and s, for
+	// verifiers that expect the standard encoding.
+	FormatDER Format = "der"
+)
+
+// Options configures a Signer. The zero value matches New.
+type Options struct {
+	// Format of the signatures; empty means FormatRaw.
+	Format Format
 }
 
 // New creates a Signer from a hex-encoded private key (0x prefix optional).
 func New(hexKey string) (*Signer, error) {
+	return NewWithOptions(hexKey, Options{})
+}
+
+// NewWithOptions is like New with explicit options.
+func NewWithOptions(hexKey string, opts Options) (*Signer, error) {
+	switch opts.Format {
+	case "":
+		opts.Format = FormatRaw
+	case FormatRaw, FormatDER:
+	default:
+		return nil, fmt.Errorf("signer: unknown signature format %q", opts.Format)
+	}
+
 	hexKey = strings.TrimPrefix(hexKey, "0x")
 	raw, err := hex.DecodeString(hexKey)
 	if err != nil {
@@ -35,7 +67,12 @@ func New(hexKey string) (*Signer, error) {
 	if err != nil {
 		return nil, fmt.Errorf("signer: %w", err)
 	}
-	return &Signer{key: key}, nil
+	return &Signer{key: key, format: opts.Format}, nil
+}
+
+// PublicKey returns the signer's public key in compressed form (33 bytes).
+func (s *Signer) PublicKey() []byte {
+	return crypto.CompressPubkey(&s.key.PublicKey)
 }
 
 // Sign returns (base64-encoded signature, timestamp in nanoseconds).
@@ -44,10 +81,17 @@ func New(hexKey string) (*Signer, error) {
 //   1. payload_hash = hex(SHA256(payload_bytes))
 //   2. signature_input = payload_hash + str(timestamp_ns) + transfer_address
 //   3. Sign SHA256(signature_input) with deterministic ECDSA (RFC 6979), low-S normalised
-//   4. Encode r(32 bytes) || s(32 bytes) as base64
+//   4. Encode r(32 bytes) || s(32 bytes) as base64, or with FormatDER the
+//      DER SEQUENCE { INTEGER r, INTEGER s }
 func (s *Signer) Sign(payload []byte, transferAddress string) (sig string, tsNano int64) {
 	ts := time.Now().UnixNano()
+	return s.SignAt(payload, transferAddress, ts), ts
+}
 
+// SignAt is like Sign but uses the given timestamp instead of the current time.
+// Because the nonce is deterministic, SignAt can be used to verify a signature
+// that was produced by Sign for the same payload, address, and timestamp.
+func (s *Signer) SignAt(payload []byte, transferAddress string, ts int64) string {
 	// Step 1: SHA256 hash of payload, then hex encode
 	payloadHash := sha256.Sum256(payload)
 	payloadHex := hex.EncodeToString(payloadHash[:])
@@ -68,42 +112,62 @@ func (s *Signer) Sign(payload []byte, transferAddress string) (sig string, tsNan
 	}
 
 	// Step 4: Encode r||s as 64 bytes (zero-padded to 32 each), base64
+	if s.format == FormatDER {
+		// Marshalling two positive integers cannot fail.
+		der, _ := asn1.Marshal(struct{ R, S *big.Int }{r, sBig})
+		return base64.StdEncoding.EncodeToString(der)
+	}
 	out := make([]byte, 64)
 	rBytes := r.Bytes()
 	sBytes := sBig.Bytes()
 	copy(out[32-len(rBytes):32], rBytes)
 	copy(out[64-len(sBytes):64], sBytes)
 
-	return base64.StdEncoding.EncodeToString(out), ts
+	return base64.StdEncoding.EncodeToString(out)
 }
 
 // rfc6979Sign implements deterministic ECDSA signing per RFC 6979.
 // This matches Python's ecdsa library sign_deterministic with SHA-256.
+// The returned r and s are always in [1, N-1].
 func rfc6979Sign(key *ecdsa.PrivateKey, hash []byte) (*big.Int, *big.Int) {
 	curve := key.Curve
 	N := curve.Params().N
 	D := key.D
+	e := new(big.Int).SetBytes(hash)
 
-	// RFC 6979 deterministic nonce generation
-	k := generateRFC6979K(N, D, hash)
-
-	// Standard ECDSA: (x1, _) = k*G; r = x1 mod n
-	rx, _ := curve.ScalarBaseMult(k.Bytes())
-	r := new(big.Int).Mod(rx, N)
+	// A k giving r = 0 or s = 0 yields a signature no verifier accepts. The
+	// odds are negligible, but RFC 6979 section 3.4 says to move on to the
+	// next k from the same generator rather than emit it, which keeps the
+	// signature deterministic.
+	for attempt := 0; ; attempt++ {
+		// RFC 6979 deterministic nonce generation
+		k := generateRFC6979K(N, D, hash, attempt)
+
+		// Standard ECDSA: (x1, _) = k*G; r = x1 mod n
+		rx, _ := curve.ScalarBaseMult(k.Bytes())
+		r := new(big.Int).Mod(rx, N)
+		if r.Sign() == 0 {
+			continue
+		}
 
-	// s = k^-1 * (hash + r*D) mod n
-	kInv := new(big.Int).ModInverse(k, N)
-	e := new(big.Int).SetBytes(hash)
-	s := new(big.Int).Mul(r, D)
-	s.Add(s, e)
-	s.Mul(s, kInv)
-	s.Mod(s, N)
+		// s = k^-1 * (hash + r*D) mod n
+		kInv := new(big.Int).ModInverse(k, N)
+		s := new(big.Int).Mul(r, D)
+		s.Add(s, e)
+		s.Mul(s, kInv)
+		s.Mod(s, N)
+		if s.Sign() == 0 {
+			continue
+		}
 
-	return r, s
+		return r, s
+	}
 }
 
-// generateRFC6979K generates a deterministic k value per RFC 6979.
-func generateRFC6979K(N, D *big.Int, hash []byte) *big.Int {
+// generateRFC6979K generates a deterministic k value per RFC 6979. skip is
+// the number of suitable candidates to pass over first, for a caller whose
+// earlier k produced a degenerate signature.
+func generateRFC6979K(N, D *big.Int, hash []byte, skip int) *big.Int {
 	qlen := N.BitLen()
 	holen := sha256.Size // 32 bytes for SHA-256
 
@@ -159,7 +223,10 @@ func generateRFC6979K(N, D *big.Int, hash []byte) *big.Int {
 
 		secret := bits2int(t, qlen)
 		if secret.Sign() > 0 && secret.Cmp(N) < 0 {
-			return secret
+			if skip == 0 {
+				return secret
+			}
+			skip--
 		}
 
 		// k is not suitable, update K and V
@@ -0,0 +1,109 @@
+package signer
+
+import (
+	"crypto/ecdsa"
+	"crypto/sha256"
+	"encoding/asn1"
+	"encoding/base64"
+	"encoding/hex"
+	"fmt"
+	"math/big"
+	"testing"
+)
+
+const testKey = "0x4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+func TestSignProducesValidRangeSignatures(t *testing.T) {
+	s, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	N := s.key.Params().N
+	halfOrder := new(big.Int).Rsh(N, 1)
+
+	for i := 0; i < 200; i++ {
+		payload := []byte(fmt.Sprintf(`{"model":"m","messages":[{"role":"user","content":"%d"}]}`, i))
+		ts := int64(1_700_000_000_000_000_000 + i)
+		sig := s.SignAt(payload, "gonka1transfer", ts)
+
+		raw, err := base64.StdEncoding.DecodeString(sig)
+		if err != nil || len(raw) != 64 {
+			t.Fatalf("signature %q: %d bytes, err %v", sig, len(raw), err)
+		}
+		r := new(big.Int).SetBytes(raw[:32])
+		sv := new(big.Int).SetBytes(raw[32:])
+		if r.Sign() <= 0 || r.Cmp(N) >= 0 {
+			t.Fatalf("r = %s out of [1, N-1]", r)
+		}
+		if sv.Sign() <= 0 || sv.Cmp(halfOrder) > 0 {
+			t.Fatalf("s = %s out of [1, N/2]", sv)
+		}
+
+		payloadHash := sha256.Sum256(payload)
+		msgHash := sha256.Sum256([]byte(hex.EncodeToString(payloadHash[:]) + fmt.Sprint(ts) + "gonka1transfer"))
+		if !ecdsa.Verify(&s.key.PublicKey, msgHash[:], r, sv) {
+			t.Fatalf("signature %d does not verify", i)
+		}
+		if again := s.SignAt(payload, "gonka1transfer", ts); again != sig {
+			t.Fatalf("signature %d is not deterministic", i)
+		}
+	}
+}
+
+func TestGenerateRFC6979KSkip(t *testing.T) {
+	s, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	N := s.key.Params().N
+	hash := sha256.Sum256([]byte("payload"))
+
+	k0 := generateRFC6979K(N, s.key.D, hash[:], 0)
+	k1 := generateRFC6979K(N, s.key.D, hash[:], 1)
+	if k0.Cmp(k1) == 0 {
+		t.Fatal("skipping a candidate returned the same k")
+	}
+	if again := generateRFC6979K(N, s.key.D, hash[:], 1); again.Cmp(k1) != 0 {
+		t.Fatal("second candidate is not deterministic")
+	}
+	for _, k := range []*big.Int{k0, k1} {
+		if k.Sign() <= 0 || k.Cmp(N) >= 0 {
+			t.Fatalf("k = %s out of [1, N-1]", k)
+		}
+	}
+}
+
+func TestSignDER(t *testing.T) {
+	raw, err := New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	der, err := NewWithOptions(testKey, Options{Format: FormatDER})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	payload := []byte(`{"model":"m"}`)
+	ts := int64(1_700_000_000_000_000_000)
+	rawSig, _ := base64.StdEncoding.DecodeString(raw.SignAt(payload, "gonka1transfer", ts))
+	derSig, err := base64.StdEncoding.DecodeString(der.SignAt(payload, "gonka1transfer", ts))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var parsed struct{ R, S *big.Int }
+	rest, err := asn1.Unmarshal(derSig, &parsed)
+	if err != nil || len(rest) != 0 {
+		t.Fatalf("DER signature does not parse: %v (%d trailing bytes)", err, len(rest))
+	}
+	if want := new(big.Int).SetBytes(rawSig[:32]); parsed.R.Cmp(want) != 0 {
+		t.Errorf("r = %s, want %s", parsed.R, want)
+	}
+	if want := new(big.Int).SetBytes(rawSig[32:]); parsed.S.Cmp(want) != 0 {
+		t.Errorf("s = %s, want %s", parsed.S, want)
+	}
+
+	if _, err := NewWithOptions(testKey, Options{Format: "pem"}); err == nil {
+		t.Error("unknown format accepted")
+	}
+}
@@ -5,12 +5,16 @@
 package toolsim
 
 import (
+	"bytes"
 	"crypto/rand"
 	"encoding/hex"
 	"encoding/json"
 	"fmt"
 	"log/slog"
+	"regexp"
+	"sort"
 	"strings"
+	"unicode"
 )
 
 // ---------- OpenAI request/response types ----------
@@ -29,10 +33,56 @@ type ChatRequest struct {
 // Message is an OpenAI chat message.
 type Message struct {
 	Role       string          `json:"role"`
-	Content    json.RawMessage `json:"content"` // can be string or null
+	Content    json.RawMessage `json:"content"` // string, null, or an array of content parts
 	Name       string          `json:"name,omitempty"`
 	ToolCalls  []ToolCallMsg   `json:"tool_calls,omitempty"`
 	ToolCallID string          `json:"tool_call_id,omitempty"`
+	// Preserve everything else (e.g. "reasoning" on assistant turns).
+	Extra map[string]json.RawMessage `json:"-"`
+}
+
+// messageFields are the message keys decoded into Message's named fields.
+var messageFields = []string{"role", "content", "name", "tool_calls", "tool_call_id"}
+
+// UnmarshalJSON decodes the known fields and keeps the rest in Extra.
+func (m *Message) UnmarshalJSON(b []byte) error {
+	type plain Message
+	var p plain
+	if err := json.Unmarshal(b, &p); err != nil {
+		return err
+	}
+	var extra map[string]json.RawMessage
+	if err := json.Unmarshal(b, &extra); err != nil {
+		return err
+	}
+	for _, k := range messageFields {
+		delete(extra, k)
+	}
+	if len(extra) > 0 {
+		p.Extra = extra
+	}
+	*m = Message(p)
+	return nil
+}
+
+// MarshalJSON encodes the known fields followed by Extra, so a message
+// survives a decode/encode round trip without losing fields.
+func (m Message) MarshalJSON() ([]byte, error) {
+	type plain Message
+	b, err := json.Marshal(plain(m))
+	if err != nil || len(m.Extra) == 0 {
+		return b, err
+	}
+	var all map[string]json.RawMessage
+	if err := json.Unmarshal(b, &all); err != nil {
+		return nil, err
+	}
+	for k, v := range m.Extra {
+		if _, known := all[k]; !known {
+			all[k] = v
+		}
+	}
+	return json.Marshal(all)
 }
 
 // ToolCallMsg is a tool_call inside an assistant message.
@@ -64,15 +114,30 @@ type FunctionDef struct {
 // ---------- public API ----------
 
 // NeedsSimulation returns true if the request contains tools that need
-// to be simulated.
+// to be simulated, as "tools" or as the deprecated "functions".
 func NeedsSimulation(body []byte) bool {
 	var peek struct {
-		Tools []json.RawMessage `json:"tools"`
+		Tools     []json.RawMessage `json:"tools"`
+		Functions []json.RawMessage `json:"functions"`
+	}
+	if err := json.Unmarshal(body, &peek); err != nil {
+		return false
+	}
+	return len(peek.Tools) > 0 || len(peek.Functions) > 0
+}
+
+// UsesLegacyFunctions reports whether the request declares its tools with
+// the deprecated "functions" field (and no "tools"), so the client expects
+// the answer as a single "function_call" (see LegacyFunctionCall).
+func UsesLegacyFunctions(body []byte) bool {
+	var peek struct {
+		Tools     []json.RawMessage `json:"tools"`
+		Functions []json.RawMessage `json:"functions"`
 	}
 	if err := json.Unmarshal(body, &peek); err != nil {
 		return false
 	}
-	return len(peek.Tools) > 0
+	return len(peek.Tools) == 0 && len(peek.Functions) > 0
 }
 
 // RewriteRequest takes the original request body (with tools) and returns
@@ -80,6 +145,121 @@ func NeedsSimulation(body []byte) bool {
 // instructs the model to respond with tool calls in JSON.
 // It also returns the original tools so we can parse the response later.
 func RewriteRequest(body []byte) (newBody []byte, tools []Tool, wasStream bool, err error) {
+	return RewriteRequestWithOptions(body, Options{})
+}
+
+// SystemPromptMode controls how the tool instructions are combined with
+// system messages the client already sent.
+type SystemPromptMode string
+
+const (
+	// MergeSystemPrompt folds the system messages the conversation starts
+	// with and the tool instructions (last) into one system message, which
+	// keeps the first one's name and other fields. System messages later in
+	// the conversation stay where they are. Default.
+	MergeSystemPrompt SystemPromptMode = "merge"
+	// AppendSystemPrompt appends the tool instructions to the first existing
+	// system message and leaves any others alone.
+	AppendSystemPrompt SystemPromptMode = "append"
+	// PrependSystemPrompt adds the tool instructions as a separate system
+	// message before all others.
+	PrependSystemPrompt SystemPromptMode = "prepend"
+)
+
+// ContentMode controls how array message content (content parts, e.g. text
+// plus images) is forwarded in a rewritten request.
+type ContentMode string
+
+const (
+	// PreserveContent forwards content parts unchanged, images included.
+	// A bare content-part object is wrapped into a one-element array.
+	// Default.
+	PreserveContent ContentMode = "preserve"
+	// TextContent flattens content parts into a plain string of their text
+	// parts, for upstreams that only accept string content. Other parts
+	// (images, audio) are dropped.
+	TextContent ContentMode = "text"
+)
+
+// DuplicateToolsMode controls what happens when several tools in one
+// request share a function name. The simulated model can only answer with a
+// name, so such calls cannot be routed to the intended definition.
+type DuplicateToolsMode string
+
+const (
+	// WarnDuplicateTools logs a warning and describes every definition to
+	// the model, as if the names differed. Default.
+	WarnDuplicateTools DuplicateToolsMode = "warn"
+	// FirstDuplicateTool keeps only the first definition of each name.
+	FirstDuplicateTool DuplicateToolsMode = "first"
+	// RejectDuplicateTools fails the rewrite with a *DuplicateToolError.
+	RejectDuplicateTools DuplicateToolsMode = "reject"
+)
+
+// DuplicateToolError reports a tool whose function name an earlier tool in
+// the same request already uses.
+type DuplicateToolError struct {
+	Name  string
+	Param string // the offending field, e.g. "tools[2].function.name"
+}
+
+func (e *DuplicateToolError) Error() string {
+	return fmt.Sprintf("duplicate tool name %q at %s: tool function names must be unique", e.Name, e.Param)
+}
+
+// ResponseTextMode controls what happens to prose the model wrote around its
+// tool calls ("Let me check." before the JSON array) when a response is
+// rewritten into tool_calls, whose content is null.
+type ResponseTextMode string
+
+const (
+	// DropResponseText discards the prose. Default.
+	DropResponseText ResponseTextMode = "drop"
+	// FieldResponseText keeps it in the message's non-standard
+	// "_gonka_content" field (see responseTextKey).
+	FieldResponseText ResponseTextMode = "field"
+)
+
+// responseTextKey is the message field FieldResponseText fills.
+const responseTextKey = "_gonka_content"
+
+// Options tunes request rewriting and response parsing.
+type Options struct {
+	SystemPrompt   SystemPromptMode   // empty means MergeSystemPrompt
+	Content        ContentMode        // empty means PreserveContent
+	DuplicateTools DuplicateToolsMode // empty means WarnDuplicateTools
+	ResponseText   ResponseTextMode   // empty means DropResponseText
+	EmptyContent   bool               // content "" instead of null next to parsed tool calls
+}
+
+// checkDuplicateTools applies mode to tools that reuse an earlier tool's
+// function name. param formats the field of the tool at an index, for
+// errors and logs.
+func checkDuplicateTools(tools []Tool, param string, mode DuplicateToolsMode) ([]Tool, error) {
+	seen := make(map[string]bool, len(tools))
+	kept := tools[:0:0]
+	for i, t := range tools {
+		name := t.Function.Name
+		if !seen[name] {
+			seen[name] = true
+			kept = append(kept, t)
+			continue
+		}
+		switch mode {
+		case RejectDuplicateTools:
+			return nil, &DuplicateToolError{Name: name, Param: fmt.Sprintf(param, i)}
+		case FirstDuplicateTool:
+			slog.Warn("toolsim: duplicate tool name, keeping the first definition", "name", name, "param", fmt.Sprintf(param, i))
+		default:
+			slog.Warn("toolsim: duplicate tool name, calls to it cannot be told apart", "name", name, "param", fmt.Sprintf(param, i))
+			kept = append(kept, t)
+		}
+	}
+	return kept, nil
+}
+
+// RewriteRequestWithOptions is like RewriteRequest but also applies opts.
+func RewriteRequestWithOptions(body []byte, opts Options) (newBody []byte, tools []Tool, wasStream bool, err error) {
 	// Parse the full request preserving unknown fields.
 	var raw map[string]json.RawMessage
 	if err := json.Unmarshal(body, &raw); err != nil {
@@ -93,9 +273,25 @@ func RewriteRequest(body []byte) (newBody []byte, tools []Tool, wasStream bool,
 			return nil, nil, false, fmt.Errorf("toolsim: unmarshal tools: %w", err)
 		}
 	}
+	// Legacy clients declare plain function definitions instead.
+	param := "tools[%d].function.name"
+	if f, ok := raw["functions"]; ok && len(toolList) == 0 {
+		param = "functions[%d].name"
+		var defs []FunctionDef
+		if err := json.Unmarshal(f, &defs); err != nil {
+			return nil, nil, false, fmt.Errorf("toolsim: unmarshal functions: %w", err)
+		}
+		for _, d := range defs {
+			toolList = append(toolList, Tool{Type: "function", Function: d})
+		}
+	}
 	if len(toolList) == 0 {
 		return body, nil, false, nil // nothing to simulate
 	}
+	toolList, err = checkDuplicateTools(toolList, param, opts.DuplicateTools)
+	if err != nil {
+		return nil, nil, false, err
+	}
 
 	// Extract messages.
 	var messages []Message
@@ -105,6 +301,9 @@ func RewriteRequest(body []byte) (newBody []byte, tools []Tool, wasStream bool,
 		}
 	}
 
+	messages = legacyToToolMessages(messages)
+	messages = normalizeContent(messages, opts.Content)
+
 	// Check stream flag.
 	var stream bool
 	if s, ok := raw["stream"]; ok {
@@ -118,29 +317,28 @@ func RewriteRequest(body []byte) (newBody []byte, tools []Tool, wasStream bool,
 	choiceHint := ""
 	if tc, ok := raw["tool_choice"]; ok {
 		choiceHint = parseToolChoice(tc, toolList)
+	} else if fc, ok := raw["function_call"]; ok {
+		choiceHint = parseToolChoice(fc, toolList)
 	}
 
 	// Build the system instruction.
 	sysPrompt := buildSystemPrompt(toolDesc, choiceHint)
 
-	// Prepend our system message (or merge with existing system message).
-	messages = injectSystemPrompt(messages, sysPrompt)
+	// Add our instructions as or to the system message.
+	messages = injectSystemPrompt(messages, sysPrompt, opts.SystemPrompt)
 
 	// Re-serialize messages.
 	msgBytes, err := json.Marshal(messages)
 	if err != nil {
 		return nil, nil, false, fmt.Errorf("toolsim: marshal messages: %w", err)
 	}
-	raw["messages"] = msgBytes
 
 	// Upstream nodes don't support tools; strip them before forwarding.
-	delete(raw, "tools")
-	delete(raw, "tool_choice")
-
 	// Force non-streaming for tool simulation (we need the full response to parse).
-	raw["stream"] = json.RawMessage("false")
-
-	newBody, err = json.Marshal(raw)
+	// stream_options is only valid alongside stream=true, so drop it too.
+	newBody, err = rewriteFields(body,
+		map[string]json.RawMessage{"messages": msgBytes, "stream": json.RawMessage("false")},
+		"tools", "tool_choice", "functions", "function_call", "stream_options")
 	if err != nil {
 		return nil, nil, false, fmt.Errorf("toolsim: marshal request: %w", err)
 	}
@@ -149,11 +347,81 @@ func RewriteRequest(body []byte) (newBody []byte, tools []Tool, wasStream bool,
 	return newBody, toolList, stream, nil
 }
 
+// rewriteFields re-encodes the JSON object body with the fields in set
+// replaced (or appended in key order when absent) and the fields in
+// drop removed. Every other field keeps its position and its value bytes
+// exactly, so parameters the simulation does not touch reach the upstream
+// as the client wrote them.
+func rewriteFields(body []byte, set map[string]json.RawMessage, drop ...string) ([]byte, error) {
+	dec := json.NewDecoder(bytes.NewReader(body))
+	if tok, err := dec.Token(); err != nil || tok != json.Delim('{') {
+		return nil, fmt.Errorf("request is not a JSON object")
+	}
+	skip := make(map[string]bool, len(drop))
+	for _, k := range drop {
+		skip[k] = true
+	}
+	done := make(map[string]bool, len(set))
+
+	var out bytes.Buffer
+	out.WriteByte('{')
+	write := func(key string, value json.RawMessage) {
+		if out.Len() > 1 {
+			out.WriteByte(',')
+		}
+		enc := json.NewEncoder(&out)
+		enc.SetEscapeHTML(false)
+		_ = enc.Encode(key)
+		out.Truncate(out.Len() - 1) // Encode's trailing newline
+		out.WriteByte(':')
+		out.Write(value)
+	}
+	for dec.More() {
+		tok, err := dec.Token()
+		if err != nil {
+			return nil, err
+		}
+		key, _ := tok.(string)
+		var value json.RawMessage
+		if err := dec.Decode(&value); err != nil {
+			return nil, err
+		}
+		switch {
+		case skip[key] || done[key]:
+		case set[key] != nil:
+			write(key, set[key])
+			done[key] = true
+		default:
+			write(key, value)
+		}
+	}
+	keys := make([]string, 0, len(set))
+	for k := range set {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		if !done[k] {
+			write(k, set[k])
+		}
+	}
+	out.WriteByte('}')
+	return out.Bytes(), nil
+}
+
 // ParseResponse takes the upstream response body and tries to extract
 // tool calls from the assistant's content. Returns a rewritten response
 // with proper tool_calls format, or the original response if no tool
 // calls were found.
 func ParseResponse(respBody []byte, tools []Tool, originalModel string) []byte {
+	return ParseResponseWithOptions(respBody, tools, originalModel, Options{})
+}
+
+// ParseResponseWithOptions is like ParseResponse but also applies opts.
+// Every choice is parsed on its own; only messages whose role is assistant
+// or missing are rewritten, so a choice the model answered in another role
+// is left as it came.
+func ParseResponseWithOptions(respBody []byte, tools []Tool, originalModel string, opts Options) []byte {
 	var resp map[string]json.RawMessage
 	if err := json.Unmarshal(respBody, &resp); err != nil {
 		return respBody
@@ -166,52 +434,69 @@ func ParseResponse(respBody []byte, tools []Tool, originalModel string) []byte {
 		}
 	}
 
-	// Get the message from first choice.
-	var msg map[string]json.RawMessage
-	if m, ok := choices[0]["message"]; ok {
-		if err := json.Unmarshal(m, &msg); err != nil {
-			return respBody
+	parsed := 0
+	for _, choice := range choices {
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(choice["message"], &msg); err != nil || msg == nil {
+			continue
+		}
+		var role string
+		if r, ok := msg["role"]; ok {
+			if err := json.Unmarshal(r, &role); err != nil || (role != "" && role != "assistant") {
+				continue
+			}
 		}
-	}
 
-	// Extract content string.
-	var content string
-	if c, ok := msg["content"]; ok {
-		if err := json.Unmarshal(c, &content); err != nil {
-			return respBody
+		// Extract content string.
+		var content string
+		if c, ok := msg["content"]; ok {
+			if err := json.Unmarshal(c, &content); err != nil {
+				continue
+			}
 		}
-	}
 
-	// Try to extract tool calls from the content.
-	toolCalls := extractToolCalls(content, tools)
-	if len(toolCalls) == 0 {
-		return respBody
-	}
+		// Try to extract tool calls from the content.
+		toolCalls, text := extractToolCallsText(content, tools)
+		if len(toolCalls) == 0 {
+			continue
+		}
+		parsed += len(toolCalls)
 
-	slog.Info("toolsim: parsed tool calls from response", "count", len(toolCalls))
+		// Build proper OpenAI tool_calls response.
+		toolCallMsgs := make([]ToolCallMsg, len(toolCalls))
+		for i, tc := range toolCalls {
+			toolCallMsgs[i] = ToolCallMsg{
+				ID:   generateToolCallID(),
+				Type: "function",
+				Function: FunctionCall{
+					Name:      tc.Name,
+					Arguments: tc.Arguments,
+				},
+			}
+		}
 
-	// Build proper OpenAI tool_calls response.
-	toolCallMsgs := make([]ToolCallMsg, len(toolCalls))
-	for i, tc := range toolCalls {
-		toolCallMsgs[i] = ToolCallMsg{
-			ID:   generateToolCallID(),
-			Type: "function",
-			Function: FunctionCall{
-				Name:      tc.Name,
-				Arguments: tc.Arguments,
-			},
+		// Rewrite the message.
+		msg["role"] = json.RawMessage(`"assistant"`)
+		msg["content"] = json.RawMessage("null")
+		if opts.EmptyContent {
+			// OpenAI sends null, which some clients cannot handle.
+			msg["content"] = json.RawMessage(`""`)
 		}
-	}
+		if text != "" && opts.ResponseText == FieldResponseText {
+			msg[responseTextKey], _ = json.Marshal(text)
+		}
+		tcBytes, _ := json.Marshal(toolCallMsgs)
+		msg["tool_calls"] = json.RawMessage(tcBytes)
 
-	// Rewrite the message.
-	msg["role"] = json.RawMessage(`"assistant"`)
-	msg["content"] = json.RawMessage("null")
-	tcBytes, _ := json.Marshal(toolCallMsgs)
-	msg["tool_calls"] = json.RawMessage(tcBytes)
+		// Rewrite finish_reason.
+		choice["message"], _ = json.Marshal(msg)
+		choice["finish_reason"] = json.RawMessage(`"tool_calls"`)
+	}
+	if parsed == 0 {
+		return respBody
+	}
 
-	// Rewrite finish_reason.
-	choices[0]["message"], _ = json.Marshal(msg)
-	choices[0]["finish_reason"] = json.RawMessage(`"tool_calls"`)
+	slog.Info("toolsim: parsed tool calls from response", "count", parsed)
 
 	resp["choices"], _ = json.Marshal(choices)
 
@@ -222,8 +507,176 @@ func ParseResponse(respBody []byte, tools []Tool, originalModel string) []byte {
 	return out
 }
 
+// LegacyFunctionCall converts the tool calls in a response (as returned by
+// ParseResponse) into the deprecated single "function_call" for clients that
+// sent "functions" (see UsesLegacyFunctions). The format holds one call per
+// message, so only the first is kept. Responses without tool calls are
+// returned unchanged.
+func LegacyFunctionCall(respBody []byte) []byte {
+	var resp map[string]json.RawMessage
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return respBody
+	}
+	var choices []map[string]json.RawMessage
+	if err := json.Unmarshal(resp["choices"], &choices); err != nil {
+		return respBody
+	}
+	changed := false
+	for _, c := range choices {
+		var msg map[string]json.RawMessage
+		if err := json.Unmarshal(c["message"], &msg); err != nil {
+			continue
+		}
+		var calls []ToolCallMsg
+		if err := json.Unmarshal(msg["tool_calls"], &calls); err != nil || len(calls) == 0 {
+			continue
+		}
+		if len(calls) > 1 {
+			slog.Warn("toolsim: legacy function_call holds one call, dropping the rest", "calls", len(calls))
+		}
+		delete(msg, "tool_calls")
+		msg["function_call"] = mustMarshal(calls[0].Function)
+		c["message"] = mustMarshal(msg)
+		c["finish_reason"] = json.RawMessage(`"function_call"`)
+		changed = true
+	}
+	if !changed {
+		return respBody
+	}
+	resp["choices"] = mustMarshal(choices)
+	out, err := json.Marshal(resp)
+	if err != nil {
+		return respBody
+	}
+	return out
+}
+
+// StreamChunks converts a chat.completion response (as returned by
+// ParseResponse) into the chat.completion.chunk payloads a streaming client
+// expects: one chunk per choice carrying the whole message as its delta,
+// followed by one carrying the finish reason. It lets a simulated tool call
+// answer a request that originally asked for stream=true.
+//
+// A choice that is plain prose (the model decided not to call a tool) is
+// instead split into one content delta per word, so the client renders it
+// the way it renders any other streamed answer.
+func StreamChunks(respBody []byte) ([][]byte, error) {
+	var resp struct {
+		ID      string          `json:"id"`
+		Created json.RawMessage `json:"created"`
+		Model   string          `json:"model"`
+		Choices []struct {
+			Index        int             `json:"index"`
+			Message      Message         `json:"message"`
+			FinishReason json.RawMessage `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(respBody, &resp); err != nil {
+		return nil, fmt.Errorf("toolsim: decode response: %w", err)
+	}
+	if len(resp.Choices) == 0 {
+		return nil, fmt.Errorf("toolsim: response has no choices")
+	}
+
+	type toolCallDelta struct {
+		Index int `json:"index"`
+		ToolCallMsg
+	}
+	type delta struct {
+		Role         string          `json:"role,omitempty"`
+		Content      json.RawMessage `json:"content,omitempty"`
+		ToolCalls    []toolCallDelta `json:"tool_calls,omitempty"`
+		FunctionCall json.RawMessage `json:"function_call,omitempty"`  // legacy, see LegacyFunctionCall
+		Text         json.RawMessage `json:"_gonka_content,omitempty"` // see FieldResponseText
+	}
+	type choice struct {
+		Index        int             `json:"index"`
+		Delta        delta           `json:"delta"`
+		FinishReason json.RawMessage `json:"finish_reason"`
+	}
+	chunk := func(c choice) ([]byte, error) {
+		return json.Marshal(map[string]any{
+			"id":      resp.ID,
+			"object":  "chat.completion.chunk",
+			"created": resp.Created,
+			"model":   resp.Model,
+			"choices": []choice{c},
+		})
+	}
+
+	var out [][]byte
+	for _, c := range resp.Choices {
+		d := delta{Role: c.Message.Role}
+		if d.Role == "" {
+			d.Role = "assistant"
+		}
+		if len(c.Message.Content) > 0 && string(c.Message.Content) != "null" {
+			d.Content = c.Message.Content
+		}
+		for i, tc := range c.Message.ToolCalls {
+			d.ToolCalls = append(d.ToolCalls, toolCallDelta{Index: i, ToolCallMsg: tc})
+		}
+		if fc := c.Message.Extra["function_call"]; string(fc) != "null" {
+			d.FunctionCall = fc
+		}
+		d.Text = c.Message.Extra[responseTextKey]
+		pieces := []delta{d}
+		var prose string
+		if len(d.ToolCalls) == 0 && d.FunctionCall == nil && json.Unmarshal(d.Content, &prose) == nil && prose != "" {
+			pieces = pieces[:0]
+			for i, word := range splitWords(prose) {
+				p := delta{Content: mustMarshal(word)}
+				if i == 0 {
+					p.Role = d.Role
+				}
+				pieces = append(pieces, p)
+			}
+		}
+		for _, p := range pieces {
+			b, err := chunk(choice{Index: c.Index, Delta: p, FinishReason: json.RawMessage("null")})
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, b)
+		}
+
+		finish := c.FinishReason
+		if len(finish) == 0 {
+			finish = json.RawMessage(`"stop"`)
+		}
+		b, err := chunk(choice{Index: c.Index, FinishReason: finish})
+		if err != nil {
+			return nil, err
+		}
+		out = append(out, b)
+	}
+	return out, nil
+}
+
 // ---------- internals ----------
 
+// splitWords splits s after each run of whitespace, so every piece is a word
+// with the whitespace that follows it and the pieces concatenate back to s.
+func splitWords(s string) []string {
+	var out []string
+	start := 0
+	inSpace := false
+	for i, r := range s {
+		space := unicode.IsSpace(r)
+		if inSpace && !space {
+			out = append(out, s[start:i])
+			start = i
+		}
+		inSpace = space
+	}
+	return append(out, s[start:])
+}
+
+func mustMarshal(v any) json.RawMessage {
+	b, _ := json.Marshal(v)
+	return b
+}
+
 type parsedToolCall struct {
 	Name      string
 	Arguments string // JSON string
@@ -258,15 +711,22 @@ func parseToolChoice(raw json.RawMessage, tools []Tool) string {
 			return "" // "auto": model decides on its own
 		}
 	}
-	// Could be {"type": "function", "function": {"name": "..."}}
+	// Could be {"type": "function", "function": {"name": "..."}}, or the
+	// legacy function_call form {"name": "..."}.
 	var obj struct {
 		Type     string `json:"type"`
+		Name     string `json:"name"`
 		Function struct {
 			Name string `json:"name"`
 		} `json:"function"`
 	}
-	if json.Unmarshal(raw, &obj) == nil && obj.Function.Name != "" {
-		return fmt.Sprintf("You MUST call the `%s` function.", obj.Function.Name)
+	if json.Unmarshal(raw, &obj) == nil {
+		if obj.Function.Name != "" {
+			return fmt.Sprintf("You MUST call the `%s` function.", obj.Function.Name)
+		}
+		if obj.Name != "" {
+			return fmt.Sprintf("You MUST call the `%s` function.", obj.Name)
+		}
 	}
 	return ""
 }
@@ -292,21 +752,211 @@ func buildSystemPrompt(toolDesc, choiceHint string) string {
 	return sb.String()
 }
 
-func injectSystemPrompt(messages []Message, sysPrompt string) []Message {
-	sysContent, _ := json.Marshal(sysPrompt)
-	sysMsg := Message{
-		Role:    "system",
-		Content: sysContent,
+// injectSystemPrompt adds sysPrompt to messages according to mode. System
+// messages whose content is not text fall back to a separate, prepended
+// system message so nothing the client sent is lost.
+func injectSystemPrompt(messages []Message, sysPrompt string, mode SystemPromptMode) []Message {
+	switch mode {
+	case AppendSystemPrompt:
+		for i, m := range messages {
+			if m.Role != "system" {
+				continue
+			}
+			text, ok := textContent(m.Content)
+			if !ok {
+				break
+			}
+			result := make([]Message, len(messages))
+			copy(result, messages)
+			result[i].Content = joinSystemText(text, sysPrompt)
+			return result
+		}
+	case PrependSystemPrompt:
+	default: // MergeSystemPrompt
+		// Merging stops at a system message whose name or extra fields
+		// would be lost, or whose content is not text; it stays in place.
+		var texts []string
+		n := 0
+		for ; n < len(messages) && messages[n].Role == "system"; n++ {
+			m := messages[n]
+			if n > 0 && (m.Name != "" || len(m.Extra) > 0) {
+				break
+			}
+			text, ok := textContent(m.Content)
+			if !ok {
+				break
+			}
+			texts = append(texts, text)
+		}
+		if n > 0 {
+			merged := messages[0]
+			merged.Content = joinSystemText(append(texts, sysPrompt)...)
+			result := make([]Message, 0, len(messages)-n+1)
+			result = append(result, merged)
+			return append(result, messages[n:]...)
+		}
 	}
+	return prependSystemMessage(messages, sysPrompt)
+}
 
-	// If the first message is already a system message, prepend ours before it.
+// prependSystemMessage puts sysPrompt in its own system message before all
+// others.
+func prependSystemMessage(messages []Message, sysPrompt string) []Message {
+	sysContent, _ := json.Marshal(sysPrompt)
 	result := make([]Message, 0, len(messages)+1)
-	result = append(result, sysMsg)
+	result = append(result, Message{Role: "system", Content: sysContent})
 	result = append(result, messages...)
 	return result
 }
 
+// joinSystemText joins non-empty parts with blank lines into a JSON string.
+func joinSystemText(parts ...string) json.RawMessage {
+	var kept []string
+	for _, p := range parts {
+		if p = strings.TrimSpace(p); p != "" {
+			kept = append(kept, p)
+		}
+	}
+	b, _ := json.Marshal(strings.Join(kept, "\n\n"))
+	return b
+}
+
+// normalizeContent rewrites message content that is not a string or null
+// according to mode. Messages are copied, not modified in place.
+func normalizeContent(messages []Message, mode ContentMode) []Message {
+	out := make([]Message, len(messages))
+	copy(out, messages)
+	dropped := 0
+	for i, m := range out {
+		parts, ok := contentParts(m.Content)
+		if !ok {
+			continue
+		}
+		if mode != TextContent {
+			out[i].Content, _ = json.Marshal(parts)
+			continue
+		}
+		texts := make([]string, 0, len(parts))
+		for _, p := range parts {
+			var part struct {
+				Type string `json:"type"`
+				Text string `json:"text"`
+			}
+			if json.Unmarshal(p, &part) != nil || part.Type != "text" {
+				dropped++
+				continue
+			}
+			texts = append(texts, part.Text)
+		}
+		out[i].Content, _ = json.Marshal(strings.Join(texts, "\n"))
+	}
+	if dropped > 0 {
+		slog.Warn("toolsim: dropped non-text content parts", "parts", dropped)
+	}
+	return out
+}
+
+// legacyToToolMessages rewrites legacy function-calling history (an
+// assistant "function_call" and the "function" message answering it) into
+// tool_calls and "tool" messages, the form nodes accept. Each call gets a
+// synthetic ID that the function message following it refers to. Messages
+// are copied, not modified in place.
+func legacyToToolMessages(messages []Message) []Message {
+	out := make([]Message, len(messages))
+	copy(out, messages)
+	lastID := ""
+	for i, m := range out {
+		if raw, ok := m.Extra["function_call"]; ok && len(m.ToolCalls) == 0 {
+			var call FunctionCall
+			if json.Unmarshal(raw, &call) == nil && call.Name != "" {
+				lastID = fmt.Sprintf("call_legacy_%d", i)
+				out[i].ToolCalls = []ToolCallMsg{{ID: lastID, Type: "function", Function: call}}
+				out[i].Extra = withoutKeys(m.Extra, "function_call")
+			}
+		}
+		if m.Role == "function" {
+			out[i].Role = "tool"
+			if out[i].ToolCallID == "" {
+				out[i].ToolCallID = lastID
+			}
+		}
+	}
+	return out
+}
+
+// withoutKeys returns a copy of fields without keys.
+func withoutKeys(fields map[string]json.RawMessage, keys ...string) map[string]json.RawMessage {
+	out := make(map[string]json.RawMessage, len(fields))
+	for k, v := range fields {
+		out[k] = v
+	}
+	for _, k := range keys {
+		delete(out, k)
+	}
+	return out
+}
+
+// contentParts returns array content, or a bare content-part object as a
+// one-element array. ok is false for strings, null and anything else.
+func contentParts(raw json.RawMessage) (parts []json.RawMessage, ok bool) {
+	if err := json.Unmarshal(raw, &parts); err == nil && parts != nil {
+		return parts, true
+	}
+	var obj map[string]json.RawMessage
+	if err := json.Unmarshal(raw, &obj); err == nil && obj != nil {
+		return []json.RawMessage{raw}, true
+	}
+	return nil, false
+}
+
+// textContent returns message content as plain text. It accepts a string,
+// null, or an array of content parts that are all text.
+func textContent(raw json.RawMessage) (string, bool) {
+	if len(raw) == 0 || string(raw) == "null" {
+		return "", true
+	}
+	var s string
+	if err := json.Unmarshal(raw, &s); err == nil {
+		return s, true
+	}
+	var parts []struct {
+		Type string `json:"type"`
+		Text string `json:"text"`
+	}
+	if err := json.Unmarshal(raw, &parts); err != nil {
+		return "", false
+	}
+	texts := make([]string, 0, len(parts))
+	for _, p := range parts {
+		if p.Type != "text" {
+			return "", false
+		}
+		texts = append(texts, p.Text)
+	}
+	return strings.Join(texts, "\n"), true
+}
+
+// extractToolCalls parses tool calls out of the model's reply. Recognized
+// formats, tried in order:
+//
+//   - a JSON array of {"name", "arguments"} objects (what the prompt asks for)
+//   - the same array embedded in surrounding text
+//   - a single {"name", "arguments"} object
+//   - tag-wrapped calls, see extractTaggedToolCalls
+//
+// Calls naming a function that is not among tools are dropped.
 func extractToolCalls(content string, tools []Tool) []parsedToolCall {
+	calls, _ := extractToolCallsText(content, tools)
+	return calls
+}
+
+// emptyFenceRe matches a code fence left empty once the tool calls inside it
+// are cut out.
+var emptyFenceRe = regexp.MustCompile("```[\\w-]*\\s*```")
+
+// extractToolCallsText is extractToolCalls that also returns the prose the
+// model wrote around the calls, trimmed, or "" when there is none.
+func extractToolCallsText(content string, tools []Tool) ([]parsedToolCall, string) {
 	content = strings.TrimSpace(content)
 
 	// Strip markdown code fences if model wrapped the JSON.
@@ -340,7 +990,7 @@ func extractToolCalls(content string, tools []Tool) []parsedToolCall {
 			})
 		}
 		if len(result) > 0 {
-			return result
+			return result, ""
 		}
 	}
 
@@ -364,7 +1014,12 @@ func extractToolCalls(content string, tools []Tool) []parsedToolCall {
 					Arguments: args,
 				})
 			}
-			return result
+			// An array inside some other structure (e.g. the arguments
+			// of a tag-wrapped call) matches nothing; keep looking.
+			if len(result) > 0 {
+				text := emptyFenceRe.ReplaceAllString(content[:start]+content[end+1:], "")
+				return result, strings.TrimSpace(text)
+			}
 		}
 	}
 
@@ -378,10 +1033,75 @@ func extractToolCalls(content string, tools []Tool) []parsedToolCall {
 		if args == "" || args == "null" {
 			args = "{}"
 		}
-		return []parsedToolCall{{Name: single.Name, Arguments: args}}
+		return []parsedToolCall{{Name: single.Name, Arguments: args}}, ""
 	}
 
-	return nil
+	tagged := extractTaggedToolCalls(content, validNames)
+	if len(tagged) == 0 {
+		return nil, ""
+	}
+	text := toolCallTagRe.ReplaceAllString(content, "")
+	text = functionTagRe.ReplaceAllString(text, "")
+	return tagged, strings.TrimSpace(text)
+}
+
+var (
+	// <tool_call>{"name": ..., "arguments": ...}</tool_call> (Hermes, Qwen)
+	// and <function_call>...</function_call>.
+	toolCallTagRe = regexp.MustCompile(`(?s)<(tool_call|function_call)>(.*?)</(?:tool_call|function_call)>`)
+	// <function=NAME>{...arguments...}</function> (Llama 3.1).
+	functionTagRe = regexp.MustCompile(`(?s)<function=([^>\s]+)>(.*?)</function>`)
+)
+
+// extractTaggedToolCalls handles models fine-tuned to wrap each call in tags
+// instead of returning a JSON array:
+//
+//	<tool_call>{"name": "f", "arguments": {...}}</tool_call>
+//	<function_call>{"name": "f", "arguments": {...}}</function_call>
+//	<function=f>{...}</function>
+//
+// Inside <tool_call> and <function_call>, "parameters" is accepted in place of
+// "arguments", and arguments given as a JSON-encoded string are unwrapped.
+// A reply may contain several tags; malformed ones are skipped.
+func extractTaggedToolCalls(content string, validNames map[string]bool) []parsedToolCall {
+	var result []parsedToolCall
+	for _, m := range toolCallTagRe.FindAllStringSubmatch(content, -1) {
+		var call struct {
+			Name       string          `json:"name"`
+			Arguments  json.RawMessage `json:"arguments"`
+			Parameters json.RawMessage `json:"parameters"`
+		}
+		if err := json.Unmarshal([]byte(strings.TrimSpace(m[2])), &call); err != nil || !validNames[call.Name] {
+			continue
+		}
+		args := call.Arguments
+		if len(args) == 0 {
+			args = call.Parameters
+		}
+		result = append(result, parsedToolCall{Name: call.Name, Arguments: normalizeArguments(args)})
+	}
+	for _, m := range functionTagRe.FindAllStringSubmatch(content, -1) {
+		body := strings.TrimSpace(m[2])
+		if !validNames[m[1]] || (body != "" && !json.Valid([]byte(body))) {
+			continue
+		}
+		result = append(result, parsedToolCall{Name: m[1], Arguments: normalizeArguments(json.RawMessage(body))})
+	}
+	return result
+}
+
+// normalizeArguments returns raw as an arguments JSON string, unwrapping a
+// JSON-encoded string and defaulting to "{}".
+func normalizeArguments(raw json.RawMessage) string {
+	var encoded string
+	if json.Unmarshal(raw, &encoded) == nil && json.Valid([]byte(encoded)) {
+		raw = json.RawMessage(encoded)
+	}
+	args := strings.TrimSpace(string(raw))
+	if args == "" || args == "null" {
+		return "{}"
+	}
+	return args
 }
 
 func stripCodeFences(s string) string {
@@ -0,0 +1,615 @@
+package toolsim
+
+import (
+	"bytes"
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExtractToolCalls(t *testing.T) {
+	tools := []Tool{
+		{Type: "function", Function: FunctionDef{Name: "get_weather"}},
+		{Type: "function", Function: FunctionDef{Name: "search"}},
+	}
+	tests := []struct {
+		name    string
+		content string
+		want    []parsedToolCall
+	}{
+		{
+			name:    "json array",
+			content: `[{"name":"get_weather","arguments":{"city":"Paris"}}]`,
+			want:    []parsedToolCall{{Name: "get_weather", Arguments: `{"city":"Paris"}`}},
+		},
+		{
+			name:    "fenced json array",
+			content: "```json\n[{\"name\":\"search\",\"arguments\":{\"q\":\"go\"}}]\n```",
+			want:    []parsedToolCall{{Name: "search", Arguments: `{"q":"go"}`}},
+		},
+		{
+			name:    "array embedded in text",
+			content: `Sure: [{"name":"search","arguments":{"q":"go"}}] done`,
+			want:    []parsedToolCall{{Name: "search", Arguments: `{"q":"go"}`}},
+		},
+		{
+			name:    "single object",
+			content: `{"name":"get_weather","arguments":{"city":"Oslo"}}`,
+			want:    []parsedToolCall{{Name: "get_weather", Arguments: `{"city":"Oslo"}`}},
+		},
+		{
+			name:    "tool_call tag",
+			content: "<tool_call>\n{\"name\": \"get_weather\", \"arguments\": {\"city\": \"Paris\"}}\n</tool_call>",
+			want:    []parsedToolCall{{Name: "get_weather", Arguments: `{"city": "Paris"}`}},
+		},
+		{
+			name: "several tool_call tags with text around",
+			content: "Let me check.\n<tool_call>{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Paris\"}}</tool_call>\n" +
+				"<tool_call>{\"name\":\"search\",\"arguments\":{\"q\":\"Paris events\"}}</tool_call>",
+			want: []parsedToolCall{
+				{Name: "get_weather", Arguments: `{"city":"Paris"}`},
+				{Name: "search", Arguments: `{"q":"Paris events"}`},
+			},
+		},
+		{
+			name:    "tool_call tag with parameters and array arguments",
+			content: `<tool_call>{"name":"search","parameters":{"filters":[{"k":"v"}]}}</tool_call>`,
+			want:    []parsedToolCall{{Name: "search", Arguments: `{"filters":[{"k":"v"}]}`}},
+		},
+		{
+			name:    "tool_call tag with string-encoded arguments",
+			content: `<tool_call>{"name":"search","arguments":"{\"q\":\"go\"}"}</tool_call>`,
+			want:    []parsedToolCall{{Name: "search", Arguments: `{"q":"go"}`}},
+		},
+		{
+			name:    "function_call tag",
+			content: `<function_call>{"name":"search","arguments":{"q":"go"}}</function_call>`,
+			want:    []parsedToolCall{{Name: "search", Arguments: `{"q":"go"}`}},
+		},
+		{
+			name:    "function= tag",
+			content: `<function=get_weather>{"city": "Berlin"}</function>`,
+			want:    []parsedToolCall{{Name: "get_weather", Arguments: `{"city": "Berlin"}`}},
+		},
+		{
+			name:    "function= tag without arguments",
+			content: `<function=search></function>`,
+			want:    []parsedToolCall{{Name: "search", Arguments: `{}`}},
+		},
+		{
+			name:    "unknown function in tag",
+			content: `<tool_call>{"name":"rm_rf","arguments":{}}</tool_call><function=rm_rf>{}</function>`,
+			want:    nil,
+		},
+		{
+			name:    "malformed tag body",
+			content: `<tool_call>{"name":"search",</tool_call>`,
+			want:    nil,
+		},
+		{
+			name:    "plain answer",
+			content: "It is sunny in Paris.",
+			want:    nil,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := extractToolCalls(tt.content, tools)
+			if !reflect.DeepEqual(got, tt.want) {
+				t.Fatalf("got %+v, want %+v", got, tt.want)
+			}
+		})
+	}
+}
+
+func TestInjectSystemPrompt(t *testing.T) {
+	msg := func(role, content string) Message {
+		b, _ := json.Marshal(content)
+		return Message{Role: role, Content: b}
+	}
+	conversation := []Message{
+		msg("system", "You are terse."),
+		msg("user", "hi"),
+		msg("system", "Answer in French."),
+	}
+	tests := []struct {
+		name     string
+		mode     SystemPromptMode
+		messages []Message
+		want     []Message
+	}{
+		{
+			name:     "merge leaves a mid-conversation system message in place",
+			mode:     MergeSystemPrompt,
+			messages: conversation,
+			want: []Message{
+				msg("system", "You are terse.\n\nTOOLS"),
+				msg("user", "hi"),
+				msg("system", "Answer in French."),
+			},
+		},
+		{
+			name: "merge folds leading system messages and keeps the first's fields",
+			mode: MergeSystemPrompt,
+			messages: []Message{
+				{Role: "system", Content: json.RawMessage(`"You are terse."`), Name: "base", Extra: map[string]json.RawMessage{"cache_control": json.RawMessage(`{"type":"ephemeral"}`)}},
+				msg("system", "Be kind."),
+				{Role: "system", Content: json.RawMessage(`"Answer in French."`), Name: "locale"},
+				msg("user", "hi"),
+			},
+			want: []Message{
+				{Role: "system", Content: json.RawMessage(`"You are terse.\n\nBe kind.\n\nTOOLS"`), Name: "base", Extra: map[string]json.RawMessage{"cache_control": json.RawMessage(`{"type":"ephemeral"}`)}},
+				{Role: "system", Content: json.RawMessage(`"Answer in French."`), Name: "locale"},
+				msg("user", "hi"),
+			},
+		},
+		{
+			name:     "empty mode merges",
+			messages: conversation[:2],
+			want: []Message{
+				msg("system", "You are terse.\n\nTOOLS"),
+				msg("user", "hi"),
+			},
+		},
+		{
+			name:     "append extends the first system message only",
+			mode:     AppendSystemPrompt,
+			messages: conversation,
+			want: []Message{
+				msg("system", "You are terse.\n\nTOOLS"),
+				msg("user", "hi"),
+				msg("system", "Answer in French."),
+			},
+		},
+		{
+			name:     "prepend adds a separate message",
+			mode:     PrependSystemPrompt,
+			messages: conversation[:2],
+			want: []Message{
+				msg("system", "TOOLS"),
+				msg("system", "You are terse."),
+				msg("user", "hi"),
+			},
+		},
+		{
+			name:     "no system message to merge into",
+			mode:     MergeSystemPrompt,
+			messages: []Message{msg("user", "hi")},
+			want:     []Message{msg("system", "TOOLS"), msg("user", "hi")},
+		},
+		{
+			name:     "no system message to append to",
+			mode:     AppendSystemPrompt,
+			messages: []Message{msg("user", "hi")},
+			want:     []Message{msg("system", "TOOLS"), msg("user", "hi")},
+		},
+		{
+			name: "text parts are flattened when merging",
+			mode: MergeSystemPrompt,
+			messages: []Message{
+				{Role: "system", Content: json.RawMessage(`[{"type":"text","text":"Be kind."}]`)},
+				msg("user", "hi"),
+			},
+			want: []Message{msg("system", "Be kind.\n\nTOOLS"), msg("user", "hi")},
+		},
+		{
+			name: "non-text system content falls back to prepend",
+			mode: MergeSystemPrompt,
+			messages: []Message{
+				{Role: "system", Content: json.RawMessage(`[{"type":"image_url","image_url":{"url":"x"}}]`)},
+				msg("user", "hi"),
+			},
+			want: []Message{
+				msg("system", "TOOLS"),
+				{Role: "system", Content: json.RawMessage(`[{"type":"image_url","image_url":{"url":"x"}}]`)},
+				msg("user", "hi"),
+			},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			got := injectSystemPrompt(tt.messages, "TOOLS", tt.mode)
+			gotJSON, _ := json.Marshal(got)
+			wantJSON, _ := json.Marshal(tt.want)
+			if string(gotJSON) != string(wantJSON) {
+				t.Fatalf("got  %s\nwant %s", gotJSON, wantJSON)
+			}
+		})
+	}
+}
+
+func TestRewriteRequestMultimodalContent(t *testing.T) {
+	image := `{"type":"image_url","image_url":{"url":"data:image/png;base64,iVBORw0KGgo=","detail":"high"}}`
+	body := `{"model":"m","tools":[{"type":"function","function":{"name":"describe"}}],"messages":[` +
+		`{"role":"system","content":[{"type":"text","text":"Be brief."},` + image + `]},` +
+		`{"role":"user","content":[{"type":"text","text":"What is this?"},` + image + `]},` +
+		`{"role":"assistant","content":null,"tool_calls":[{"id":"c1","type":"function","function":{"name":"describe","arguments":"{}"}}]},` +
+		`{"role":"tool","tool_call_id":"c1","content":[{"type":"text","text":"a cat"}]},` +
+		`{"role":"user","content":{"type":"text","text":"And now?"}}]}`
+
+	rewrite := func(t *testing.T, opts Options) []map[string]any {
+		t.Helper()
+		out, _, _, err := RewriteRequestWithOptions([]byte(body), opts)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var req struct {
+			Messages []map[string]any `json:"messages"`
+		}
+		if err := json.Unmarshal(out, &req); err != nil {
+			t.Fatal(err)
+		}
+		return req.Messages
+	}
+	var wantImage any
+	json.Unmarshal([]byte(image), &wantImage)
+
+	for _, mode := range []SystemPromptMode{MergeSystemPrompt, AppendSystemPrompt, PrependSystemPrompt} {
+		t.Run(string(mode), func(t *testing.T) {
+			msgs := rewrite(t, Options{SystemPrompt: mode})
+			// The tool instructions go in their own system message: a system
+			// message with an image cannot be merged into text.
+			if len(msgs) != 6 || msgs[0]["role"] != "system" {
+				t.Fatalf("messages = %v", msgs)
+			}
+			for _, i := range []int{1, 2} {
+				parts, ok := msgs[i]["content"].([]any)
+				if !ok || len(parts) != 2 || !reflect.DeepEqual(parts[1], wantImage) {
+					t.Fatalf("message %d content = %#v, want the image part intact", i, msgs[i]["content"])
+				}
+			}
+			if tc := msgs[3]["tool_calls"].([]any); len(tc) != 1 {
+				t.Fatalf("assistant tool_calls = %v", tc)
+			}
+			if parts, ok := msgs[4]["content"].([]any); !ok || len(parts) != 1 || msgs[4]["tool_call_id"] != "c1" {
+				t.Fatalf("tool message = %v", msgs[4])
+			}
+			// A bare content-part object becomes a one-element array.
+			if parts, ok := msgs[5]["content"].([]any); !ok || len(parts) != 1 {
+				t.Fatalf("object content = %#v", msgs[5]["content"])
+			}
+		})
+	}
+
+	t.Run("text content", func(t *testing.T) {
+		msgs := rewrite(t, Options{Content: TextContent})
+		// Flattened, the system message merges with the tool instructions.
+		if len(msgs) != 5 {
+			t.Fatalf("messages = %v", msgs)
+		}
+		want := []any{nil, "What is this?", nil, "a cat", "And now?"}
+		for i, w := range want {
+			if w != nil && msgs[i]["content"] != w {
+				t.Fatalf("message %d content = %#v, want %q", i, msgs[i]["content"], w)
+			}
+		}
+		if sys, _ := msgs[0]["content"].(string); !strings.HasPrefix(sys, "Be brief.\n\n") {
+			t.Fatalf("system = %q", sys)
+		}
+		if msgs[2]["content"] != nil {
+			t.Fatalf("null content changed to %#v", msgs[2]["content"])
+		}
+	})
+}
+
+func FuzzExtractToolCalls(f *testing.F) {
+	tools := []Tool{
+		{Type: "function", Function: FunctionDef{Name: "get_weather"}},
+		{Type: "function", Function: FunctionDef{Name: "search"}},
+	}
+	for _, seed := range []string{
+		`[{"name":"get_weather","arguments":{"city":"Paris"}}]`,
+		"```json\n[{\"name\":\"search\",\"arguments\":{\"q\":\"go\"}}]\n```",
+		`Sure: [{"name":"search","arguments":null}] done`,
+		`{"name":"get_weather","arguments":"{\"city\":\"Oslo\"}"}`,
+		`<tool_call>{"name":"search","parameters":{"q":"x"}}</tool_call>`,
+		`<function=get_weather>{"city":"Rome"}</function>`,
+		`[{"name":"rm_rf","arguments":{}}]`,
+		"```",
+		"][",
+		"",
+	} {
+		f.Add(seed)
+	}
+	valid := map[string]bool{"get_weather": true, "search": true}
+
+	f.Fuzz(func(t *testing.T, content string) {
+		for _, c := range extractToolCalls(content, tools) {
+			if !valid[c.Name] {
+				t.Fatalf("call with unknown name %q from %q", c.Name, content)
+			}
+			if !json.Valid([]byte(c.Arguments)) {
+				t.Fatalf("call %q has invalid JSON arguments %q from %q", c.Name, c.Arguments, content)
+			}
+		}
+	})
+}
+
+func TestRewriteRequestKeepsUnknownMessageFields(t *testing.T) {
+	body := `{"model":"m","tools":[{"type":"function","function":{"name":"f"}}],"messages":[` +
+		`{"role":"user","content":"hi","x_vendor":{"a":[1,2]}},` +
+		`{"role":"assistant","content":"hello","reasoning":"think \"hard\"","reasoning_content":"more","refusal":null}]}`
+
+	out, _, _, err := RewriteRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var req struct {
+		Messages []map[string]json.RawMessage `json:"messages"`
+	}
+	if err := json.Unmarshal(out, &req); err != nil {
+		t.Fatal(err)
+	}
+	if len(req.Messages) != 3 {
+		t.Fatalf("messages = %d, want system + 2", len(req.Messages))
+	}
+	msgs := req.Messages[1:]
+	for i, want := range []map[string]string{
+		{"x_vendor": `{"a":[1,2]}`, "content": `"hi"`},
+		{"reasoning": `"think \"hard\""`, "reasoning_content": `"more"`, "refusal": `null`, "content": `"hello"`},
+	} {
+		for k, v := range want {
+			if string(msgs[i][k]) != v {
+				t.Errorf("message %d %s = %s, want %s", i, k, msgs[i][k], v)
+			}
+		}
+	}
+}
+
+func TestRewriteRequestPreservesTopLevelFieldsExactly(t *testing.T) {
+	fields := []string{
+		`"model": "m"`,
+		`"frequency_penalty": 0.50`,
+		`"presence_penalty":1e-1`,
+		`"response_format": { "type": "json_schema", "json_schema": {"name": "x", "schema": {"type": "object"}} }`,
+		`"stop":["<|end|>", "«&»"]`,
+		`"seed":12345678901234567890`,
+		`"x_vendor_extension":{"nested":[1, 2.0, null, true]}`,
+	}
+	body := `{` + fields[0] + `,"messages":[{"role":"user","content":"hi"}],` +
+		`"tools":[{"type":"function","function":{"name":"f"}}],"tool_choice":"auto",` +
+		strings.Join(fields[1:4], ",") + `,"stream":true,"stream_options":{"include_usage":true},` +
+		strings.Join(fields[4:], ",") + `}`
+
+	out, _, wasStream, err := RewriteRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !wasStream {
+		t.Fatal("stream flag lost")
+	}
+	// Untouched fields keep their exact bytes and their order.
+	last := -1
+	for _, f := range fields {
+		f = strings.Replace(f, `": `, `":`, 1) // only the separator after the key is normalized
+		i := bytes.Index(out, []byte(f))
+		if i < 0 {
+			t.Fatalf("field %s not preserved byte-for-byte in %s", f, out)
+		}
+		if i < last {
+			t.Fatalf("field %s moved in %s", f, out)
+		}
+		last = i
+	}
+	var req map[string]json.RawMessage
+	if err := json.Unmarshal(out, &req); err != nil {
+		t.Fatal(err)
+	}
+	for _, k := range []string{"tools", "tool_choice", "stream_options"} {
+		if _, ok := req[k]; ok {
+			t.Errorf("%s not removed", k)
+		}
+	}
+	if string(req["stream"]) != "false" || len(req) != len(fields)+2 {
+		t.Errorf("unexpected request: %s", out)
+	}
+}
+
+func TestRewriteRequestLegacyFunctions(t *testing.T) {
+	body := `{"model":"m","functions":[{"name":"get_weather","description":"Weather by city"}],` +
+		`"function_call":{"name":"get_weather"},"messages":[` +
+		`{"role":"user","content":"weather?"},` +
+		`{"role":"assistant","content":null,"function_call":{"name":"get_weather","arguments":"{\"city\":\"Paris\"}"}},` +
+		`{"role":"function","name":"get_weather","content":"sunny"},` +
+		`{"role":"user","content":"and Rome?"}]}`
+	if !NeedsSimulation([]byte(body)) || !UsesLegacyFunctions([]byte(body)) {
+		t.Fatal("legacy functions not recognized")
+	}
+
+	out, tools, _, err := RewriteRequest([]byte(body))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tools) != 1 || tools[0].Type != "function" || tools[0].Function.Name != "get_weather" {
+		t.Fatalf("tools = %+v", tools)
+	}
+	var req struct {
+		Functions    json.RawMessage `json:"functions"`
+		FunctionCall json.RawMessage `json:"function_call"`
+		Messages     []Message       `json:"messages"`
+	}
+	if err := json.Unmarshal(out, &req); err != nil {
+		t.Fatal(err)
+	}
+	if req.Functions != nil || req.FunctionCall != nil {
+		t.Fatalf("legacy fields forwarded: %s", out)
+	}
+	if sys, _ := textContent(req.Messages[0].Content); !strings.Contains(sys, "Weather by city") || !strings.Contains(sys, "You MUST call the `get_weather` function.") {
+		t.Fatalf("system prompt = %q", sys)
+	}
+	call, result := req.Messages[2], req.Messages[3]
+	if len(call.ToolCalls) != 1 || call.ToolCalls[0].Function.Arguments != `{"city":"Paris"}` || call.Extra["function_call"] != nil {
+		t.Fatalf("assistant call not converted: %+v", call)
+	}
+	if result.Role != "tool" || result.ToolCallID != call.ToolCalls[0].ID || result.Name != "get_weather" {
+		t.Fatalf("function result not converted: %+v", result)
+	}
+}
+
+func TestRewriteRequestDuplicateToolNames(t *testing.T) {
+	body := `{"model":"m","messages":[{"role":"user","content":"find it"}],"tools":[` +
+		`{"type":"function","function":{"name":"search","description":"Search the web"}},` +
+		`{"type":"function","function":{"name":"lookup"}},` +
+		`{"type":"function","function":{"name":"search","description":"Search the docs"}}]}`
+
+	for _, tc := range []struct {
+		mode  DuplicateToolsMode
+		tools int
+		docs  bool // the second definition is described to the model
+	}{
+		{"", 3, true},
+		{WarnDuplicateTools, 3, true},
+		{FirstDuplicateTool, 2, false},
+	} {
+		out, tools, _, err := RewriteRequestWithOptions([]byte(body), Options{DuplicateTools: tc.mode})
+		if err != nil {
+			t.Fatalf("mode %q: %v", tc.mode, err)
+		}
+		if len(tools) != tc.tools {
+			t.Fatalf("mode %q: got %d tools, want %d", tc.mode, len(tools), tc.tools)
+		}
+		if got := bytes.Contains(out, []byte("Search the docs")); got != tc.docs || !bytes.Contains(out, []byte("Search the web")) {
+			t.Fatalf("mode %q: unexpected tool description: %s", tc.mode, out)
+		}
+	}
+
+	_, _, _, err := RewriteRequestWithOptions([]byte(body), Options{DuplicateTools: RejectDuplicateTools})
+	de, ok := err.(*DuplicateToolError)
+	if !ok || de.Name != "search" || de.Param != "tools[2].function.name" {
+		t.Fatalf("want a DuplicateToolError for tools[2], got %v", err)
+	}
+	legacy := `{"model":"m","messages":[],"functions":[{"name":"f"},{"name":"f"}]}`
+	if _, _, _, err := RewriteRequestWithOptions([]byte(legacy), Options{DuplicateTools: RejectDuplicateTools}); err == nil || err.(*DuplicateToolError).Param != "functions[1].name" {
+		t.Fatalf("want a DuplicateToolError for functions[1], got %v", err)
+	}
+}
+
+func TestLegacyFunctionCallResponse(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: FunctionDef{Name: "get_weather"}}}
+	resp := `{"id":"x","choices":[{"index":0,"message":{"role":"assistant","content":"[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Rome\"}}]"},"finish_reason":"stop"}]}`
+
+	out := LegacyFunctionCall(ParseResponse([]byte(resp), tools, "m"))
+	var got struct {
+		Choices []struct {
+			Message struct {
+				Content      json.RawMessage `json:"content"`
+				ToolCalls    json.RawMessage `json:"tool_calls"`
+				FunctionCall *FunctionCall   `json:"function_call"`
+			} `json:"message"`
+			FinishReason string `json:"finish_reason"`
+		} `json:"choices"`
+	}
+	if err := json.Unmarshal(out, &got); err != nil {
+		t.Fatal(err)
+	}
+	c := got.Choices[0]
+	if c.FinishReason != "function_call" || c.Message.ToolCalls != nil || string(c.Message.Content) != "null" ||
+		c.Message.FunctionCall == nil || c.Message.FunctionCall.Name != "get_weather" || c.Message.FunctionCall.Arguments != `{"city":"Rome"}` {
+		t.Fatalf("unexpected legacy response: %s", out)
+	}
+
+	chunks, err := StreamChunks(out)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(chunks) != 2 || !bytes.Contains(chunks[0], []byte(`"function_call":{"name":"get_weather"`)) ||
+		!bytes.Contains(chunks[1], []byte(`"finish_reason":"function_call"`)) {
+		t.Fatalf("unexpected chunks: %s", chunks)
+	}
+
+	// Prose answers pass through untouched.
+	prose := `{"choices":[{"index":0,"message":{"role":"assistant","content":"no tools needed"},"finish_reason":"stop"}]}`
+	if got := LegacyFunctionCall([]byte(prose)); string(got) != prose {
+		t.Fatalf("prose changed: %s", got)
+	}
+}
+
+func TestParseResponseEmptyContent(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: FunctionDef{Name: "get_weather"}}}
+	resp := `{"choices":[{"index":0,"message":{"role":"assistant","content":"{\"name\":\"get_weather\",\"arguments\":{}}"},"finish_reason":"stop"}]}`
+
+	for _, tc := range []struct {
+		opts Options
+		want string
+	}{
+		{Options{}, "null"},
+		{Options{EmptyContent: true}, `""`},
+	} {
+		var got struct {
+			Choices []struct {
+				Message struct {
+					Content   json.RawMessage `json:"content"`
+					ToolCalls []ToolCallMsg   `json:"tool_calls"`
+				} `json:"message"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(ParseResponseWithOptions([]byte(resp), tools, "m", tc.opts), &got); err != nil {
+			t.Fatal(err)
+		}
+		msg := got.Choices[0].Message
+		if len(msg.ToolCalls) != 1 || string(msg.Content) != tc.want {
+			t.Fatalf("EmptyContent %v: content %s with %d tool calls, want %s", tc.opts.EmptyContent, msg.Content, len(msg.ToolCalls), tc.want)
+		}
+	}
+}
+
+func TestParseResponseTextAndToolCalls(t *testing.T) {
+	tools := []Tool{{Type: "function", Function: FunctionDef{Name: "get_weather"}}}
+	content := "Let me check the forecast.\n```json\n[{\"name\":\"get_weather\",\"arguments\":{\"city\":\"Rome\"}}]\n```"
+	call, _ := json.Marshal(content)
+	resp := `{"id":"x","choices":[` +
+		`{"index":0,"message":{"role":"assistant","content":` + string(call) + `},"finish_reason":"stop"},` +
+		`{"index":1,"message":{"role":"tool","content":` + string(call) + `},"finish_reason":"stop"}]}`
+
+	type message struct {
+		Role      string          `json:"role"`
+		Content   json.RawMessage `json:"content"`
+		ToolCalls []ToolCallMsg   `json:"tool_calls"`
+		Text      *string         `json:"_gonka_content"`
+	}
+	parse := func(opts Options) []message {
+		t.Helper()
+		var got struct {
+			Choices []struct {
+				Message      message `json:"message"`
+				FinishReason string  `json:"finish_reason"`
+			} `json:"choices"`
+		}
+		if err := json.Unmarshal(ParseResponseWithOptions([]byte(resp), tools, "m", opts), &got); err != nil {
+			t.Fatal(err)
+		}
+		first := got.Choices[0]
+		if first.FinishReason != "tool_calls" || string(first.Message.Content) != "null" || len(first.Message.ToolCalls) != 1 ||
+			first.Message.ToolCalls[0].Function.Arguments != `{"city":"Rome"}` {
+			t.Fatalf("assistant choice not rewritten: %+v", first)
+		}
+		// A message in another role is left alone.
+		if second := got.Choices[1]; second.FinishReason != "stop" || second.Message.Role != "tool" || second.Message.ToolCalls != nil {
+			t.Fatalf("tool-role choice rewritten: %+v", second)
+		}
+		return []message{first.Message, got.Choices[1].Message}
+	}
+
+	if msgs := parse(Options{}); msgs[0].Text != nil {
+		t.Fatalf("text kept by default: %q", *msgs[0].Text)
+	}
+	msgs := parse(Options{ResponseText: FieldResponseText})
+	if msgs[0].Text == nil || *msgs[0].Text != "Let me check the forecast." {
+		t.Fatalf("text not kept: %+v", msgs[0])
+	}
+
+	chunks, err := StreamChunks(ParseResponseWithOptions([]byte(resp), tools, "m", Options{ResponseText: FieldResponseText}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Contains(chunks[0], []byte(`"_gonka_content":"Let me check the forecast."`)) {
+		t.Fatalf("text missing from stream: %s", chunks[0])
+	}
+
+	// Tagged calls keep the prose around the tags.
+	calls, text := extractToolCallsText(`Sure. <tool_call>{"name":"get_weather","arguments":{}}</tool_call>`, tools)
+	if len(calls) != 1 || text != "Sure." {
+		t.Fatalf("tagged: %+v, %q", calls, text)
+	}
+}
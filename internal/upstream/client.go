@@ -3,14 +3,22 @@ package upstream
 import (
 	"bytes"
 	"context"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
+	"errors"
 	"fmt"
+	"hash"
+	"hash/fnv"
 	"io"
 	"log/slog"
 	"math/rand"
 	"net/http"
+	"slices"
+	"sort"
 	"strings"
 	"sync"
+	"sync/atomic"
 	"time"
 
 	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
@@ -20,6 +28,11 @@ import (
 type Endpoint struct {
 	URL     string // e.g. http://node2.gonka.ai:8000/v1
 	Address string // bech32 address of this host
+
+	// Optional metadata from the participant list. Empty when the source
+	// node does not report it.
+	Models  []string // models the node serves
+	Version string   // node software version
 }
 
 // allowedTransferAgents is the whitelist of nodes that support the
@@ -42,20 +55,101 @@ var allowedTransferAgents = map[string]bool{
 type Client struct {
 	sourceURL string
 	pool      *wallet.Pool
+	opts      Options
 
 	mu        sync.RWMutex
 	endpoints []Endpoint
+	// unreachable holds addresses whose last probe failed (see
+	// ProbeEndpoints); they are picked only when nothing else is left.
+	unreachable map[string]bool
+
+	hedging atomic.Int64 // hedged requests in flight (Options.HedgeMax)
 
 	http *http.Client
 }
 
+// Options tunes endpoint discovery and request routing.
+type Options struct {
+	// DisableWhitelist keeps every active participant with an inference URL
+	// instead of only the Transfer Agent whitelist. For private networks.
+	DisableWhitelist bool
+
+	// NetworkWhitelist lets participants advertise transfer-agent support
+	// with a "supports_transfer_agent" flag in the participant list: a
+	// participant carrying the flag is kept or dropped by it, one without it
+	// by the built-in whitelist. Keeps discovery current when the network
+	// adds or retires transfer agents. Ignored with DisableWhitelist.
+	NetworkWhitelist bool
+
+	// EndpointBlocklist lists transfer-agent addresses to drop at discovery,
+	// even when they are whitelisted.
+	EndpointBlocklist []string
+
+	// StaticEndpoints, when set, are the endpoints to use, as is: the client
+	// starts with them and DiscoverEndpoints keeps them instead of asking the
+	// source node, so the participant list is never fetched. The whitelist
+	// and blocklist do not apply.
+	StaticEndpoints []Endpoint
+
+	// ModelWallets maps a model name to the address of the wallet that must
+	// sign its requests (see WithModel). Unmapped models use round-robin.
+	ModelWallets map[string]string
+
+	// ModelsPath is the path, relative to an endpoint's /v1 URL, that
+	// FetchModels requests. Empty means "/models".
+	ModelsPath string
+
+	// UserAgent is sent on every upstream request so node operators can tell
+	// this proxy's traffic apart. Empty leaves Go's default.
+	UserAgent string
+
+	// InstanceID, when set, is sent as X-Opengnk-Instance so traffic from one
+	// deployment can be correlated across nodes.
+	InstanceID string
+
+	// FallbackURL is a separate OpenAI-compatible API (e.g.
+	// https://api.example.com/v1) that Do and DoStream send a request to,
+	// unsigned, once every Gonka attempt for it has failed. Empty disables
+	// the fallback.
+	FallbackURL string
+
+	// FallbackAPIKey is sent to FallbackURL as a bearer token.
+	FallbackAPIKey string
+
+	// VerifySignedBody hashes every signed payload and the body bytes the
+	// transport actually sends, and logs an error when they differ, which
+	// the node would reject as a bad signature. A debugging aid against
+	// code that changes the payload after signing; it costs a hash per
+	// request.
+	VerifySignedBody bool
+
+	// HedgeDelay, when positive, makes Do send a second copy of a request
+	// whose endpoint has not answered after this long to another endpoint,
+	// and use whichever answers first; the other is cancelled. It trims tail
+	// latency at the price of load and, since a node may have done (and
+	// charged for) most of the work by the time it is cancelled, of paying
+	// twice for some requests. Streaming requests are never hedged.
+	HedgeDelay time.Duration
+
+	// HedgeMax caps the hedged requests in flight at once, bounding the
+	// extra load when many endpoints are slow together. 0 means no cap.
+	HedgeMax int
+}
+
 // New creates an upstream Client. sourceURL is a bare node URL
 // (e.g. http://node2.gonka.ai:8000) used to discover the participant list.
 // The wallet pool is used to round-robin requests across wallets.
 func New(sourceURL string, pool *wallet.Pool) *Client {
+	return NewWithOptions(sourceURL, pool, Options{})
+}
+
+// NewWithOptions is like New but also applies opts.
+func NewWithOptions(sourceURL string, pool *wallet.Pool, opts Options) *Client {
 	return &Client{
 		sourceURL: strings.TrimRight(sourceURL, "/"),
 		pool:      pool,
+		opts:      opts,
+		endpoints: slices.Clone(opts.StaticEndpoints),
 		http: &http.Client{
 			Timeout: 120 * time.Second,
 			Transport: &http.Transport{
@@ -68,8 +162,23 @@ func New(sourceURL string, pool *wallet.Pool) *Client {
 }
 
 // DiscoverEndpoints fetches the active participant list from sourceURL.
-// Should be called once at startup and optionally periodically.
+// Should be called once at startup and optionally periodically. With
+// Options.StaticEndpoints it only logs them.
 func (c *Client) DiscoverEndpoints(ctx context.Context) error {
+	if len(c.opts.StaticEndpoints) > 0 {
+		var unlisted []string
+		for _, ep := range c.opts.StaticEndpoints {
+			if !allowedTransferAgents[ep.Address] {
+				unlisted = append(unlisted, ep.Address)
+			}
+		}
+		if len(unlisted) > 0 && !c.opts.DisableWhitelist {
+			slog.Warn("static endpoints not on the transfer-agent whitelist", "addresses", unlisted)
+		}
+		slog.Info("using static endpoints; discovery skipped", "count", len(c.opts.StaticEndpoints))
+		return nil
+	}
+
 	url := c.sourceURL + "/v1/epochs/current/participants"
 	slog.Info("discovering endpoints", "url", url)
 
@@ -78,6 +187,7 @@ func (c *Client) DiscoverEndpoints(ctx context.Context) error {
 		return fmt.Errorf("discover: %w", err)
 	}
 	req.Header.Set("Content-Type", "application/json")
+	c.setClientHeaders(req)
 
 	resp, err := c.http.Do(req)
 	if err != nil {
@@ -95,6 +205,13 @@ func (c *Client) DiscoverEndpoints(ctx context.Context) error {
 			Participants []struct {
 				Index        string `json:"index"`
 				InferenceURL string `json:"inference_url"`
+				// Metadata is decoded leniently: an unexpected shape must
+				// not fail discovery.
+				Models  json.RawMessage `json:"models"`
+				Version json.RawMessage `json:"version"`
+				// SupportsTransferAgent is read only with
+				// Options.NetworkWhitelist.
+				SupportsTransferAgent json.RawMessage `json:"supports_transfer_agent"`
 			} `json:"participants"`
 		} `json:"active_participants"`
 	}
@@ -103,19 +220,46 @@ func (c *Client) DiscoverEndpoints(ctx context.Context) error {
 	}
 
 	var eps []Endpoint
+	var blocked []string
+	advertised := 0
 	for _, p := range result.ActiveParticipants.Participants {
 		if p.InferenceURL == "" || p.Index == "" {
 			continue
 		}
-		// Only keep nodes on the Transfer Agent whitelist.
-		if !allowedTransferAgents[p.Index] {
+		// Only keep transfer agents: as advertised by the participant when
+		// NetworkWhitelist is on and it says, else per the whitelist.
+		allowed := allowedTransferAgents[p.Index]
+		if c.opts.NetworkWhitelist {
+			var flag *bool // null counts as absent
+			if json.Unmarshal(p.SupportsTransferAgent, &flag) == nil && flag != nil {
+				allowed = *flag
+				advertised++
+			}
+		}
+		if !c.opts.DisableWhitelist && !allowed {
+			continue
+		}
+		if slices.Contains(c.opts.EndpointBlocklist, p.Index) {
+			blocked = append(blocked, p.Index)
 			continue
 		}
 		url := strings.TrimRight(p.InferenceURL, "/") + "/v1"
-		eps = append(eps, Endpoint{URL: url, Address: p.Index})
+		ep := Endpoint{URL: url, Address: p.Index}
+		_ = json.Unmarshal(p.Models, &ep.Models)
+		_ = json.Unmarshal(p.Version, &ep.Version)
+		eps = append(eps, ep)
+	}
+	if len(blocked) > 0 {
+		slog.Warn("endpoints blocklisted", "addresses", blocked)
 	}
 
 	if len(eps) == 0 {
+		if len(blocked) > 0 {
+			return fmt.Errorf("discover: every usable endpoint is blocklisted")
+		}
+		if c.opts.DisableWhitelist {
+			return fmt.Errorf("discover: no active participants with an inference URL found")
+		}
 		return fmt.Errorf("discover: no whitelisted transfer-agent endpoints found in active participants")
 	}
 
@@ -123,45 +267,320 @@ func (c *Client) DiscoverEndpoints(ctx context.Context) error {
 	c.endpoints = eps
 	c.mu.Unlock()
 
+	if c.opts.DisableWhitelist {
+		slog.Warn("endpoints discovered with transfer-agent whitelist DISABLED", "count", len(eps))
+		return nil
+	}
+	if c.opts.NetworkWhitelist {
+		slog.Info("endpoints discovered", "count", len(eps), "advertised", advertised, "whitelisted", len(allowedTransferAgents))
+		return nil
+	}
 	slog.Info("endpoints discovered", "count", len(eps), "whitelisted", len(allowedTransferAgents))
 	return nil
 }
 
+// ProbeEndpoints sends a cheap GET to every discovered endpoint and records
+// which ones answer; any HTTP response counts as reachable. Unreachable
+// endpoints are only picked once every reachable one has been tried. It returns
+// the number of reachable endpoints, and an error when there are none.
+func (c *Client) ProbeEndpoints(ctx context.Context, timeout time.Duration) (int, error) {
+	eps := c.Endpoints()
+	down := make([]bool, len(eps))
+	var wg sync.WaitGroup
+	for i, ep := range eps {
+		wg.Add(1)
+		go func(i int, ep Endpoint) {
+			defer wg.Done()
+			if err := c.probe(ctx, ep, timeout); err != nil {
+				slog.Warn("endpoint unreachable", "endpoint_addr", ep.Address, "url", ep.URL, "err", err)
+				down[i] = true
+			}
+		}(i, ep)
+	}
+	wg.Wait()
+
+	unreachable := make(map[string]bool)
+	for i, ep := range eps {
+		if down[i] {
+			unreachable[ep.Address] = true
+		}
+	}
+	c.mu.Lock()
+	c.unreachable = unreachable
+	c.mu.Unlock()
+
+	reachable := len(eps) - len(unreachable)
+	slog.Info("endpoints probed", "reachable", reachable, "unreachable", len(unreachable))
+	if reachable == 0 {
+		return 0, fmt.Errorf("probe: none of %d endpoints is reachable", len(eps))
+	}
+	return reachable, nil
+}
+
+func (c *Client) probe(ctx context.Context, ep Endpoint, timeout time.Duration) error {
+	ctx, cancel := context.WithTimeout(ctx, timeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, ep.URL+"/models", nil)
+	if err != nil {
+		return err
+	}
+	c.setClientHeaders(req)
+	resp, err := c.http.Do(req)
+	if err != nil {
+		return err
+	}
+	_, _ = io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+	resp.Body.Close()
+	return nil
+}
+
+// Endpoints returns a copy of the currently discovered endpoints.
+func (c *Client) Endpoints() []Endpoint {
+	c.mu.RLock()
+	defer c.mu.RUnlock()
+	out := make([]Endpoint, len(c.endpoints))
+	copy(out, c.endpoints)
+	return out
+}
+
+type ctxKey int
+
+const (
+	routingKeyCtx ctxKey = iota
+	modelCtx
+	walletKeyCtx
+	budgetCtx
+)
+
+// WithRoutingKey returns a context that makes the client pick endpoints
+// deterministically from key instead of at random, so identical keys land on
+// the same node while the endpoint set is unchanged. Retries still move to a
+// different endpoint. An empty key leaves routing random.
+func WithRoutingKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, routingKeyCtx, key)
+}
+
+func routingKey(ctx context.Context) string {
+	key, _ := ctx.Value(routingKeyCtx).(string)
+	return key
+}
+
+// WithModel returns a context that tells the client which model the request is
+// for, so it can sign with the wallet pinned to that model (Options.ModelWallets).
+func WithModel(ctx context.Context, model string) context.Context {
+	if model == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, modelCtx, model)
+}
+
+// WithWalletKey returns a context that makes the client sign with the wallet
+// derived from key (see wallet.Pool.ForKey) instead of the next one in
+// round-robin order, so requests sharing a key are billed to one wallet. A
+// wallet pinned to the model (Options.ModelWallets) still takes precedence.
+// An empty key leaves selection round-robin.
+func WithWalletKey(ctx context.Context, key string) context.Context {
+	if key == "" {
+		return ctx
+	}
+	return context.WithValue(ctx, walletKeyCtx, key)
+}
+
+// RetryBudget bounds the upstream attempts made for one logical client
+// request, across every Do and DoStream call that uses the context carrying
+// it (see WithRetryBudget), so a request cannot fan out into many upstream
+// calls however many times the handler calls the client.
+type RetryBudget struct {
+	Attempts int           // total attempts; 0 means no limit
+	Time     time.Duration // no attempt starts after this long; 0 means no limit
+}
+
+// ErrBudgetExhausted is returned (wrapped) when a request's retry budget
+// runs out before an attempt succeeds.
+var ErrBudgetExhausted = errors.New("upstream: request retry budget exhausted")
+
+// budget is the state of a RetryBudget for one request.
+type budget struct {
+	mu       sync.Mutex
+	left     int // attempts left; -1 means no limit
+	deadline time.Time
+}
+
+// WithRetryBudget returns a context whose upstream attempts are limited by b,
+// counted from now. A zero budget leaves ctx unchanged.
+func WithRetryBudget(ctx context.Context, b RetryBudget) context.Context {
+	if b.Attempts <= 0 && b.Time <= 0 {
+		return ctx
+	}
+	st := &budget{left: -1}
+	if b.Attempts > 0 {
+		st.left = b.Attempts
+	}
+	if b.Time > 0 {
+		st.deadline = time.Now().Add(b.Time)
+	}
+	return context.WithValue(ctx, budgetCtx, st)
+}
+
+// takeAttempt spends one attempt of the budget carried by ctx. It returns
+// false, without spending, when the attempts or the time are used up.
+func takeAttempt(ctx context.Context) bool {
+	st, _ := ctx.Value(budgetCtx).(*budget)
+	if st == nil {
+		return true
+	}
+	st.mu.Lock()
+	defer st.mu.Unlock()
+	if st.left == 0 || (!st.deadline.IsZero() && time.Now().After(st.deadline)) {
+		return false
+	}
+	if st.left > 0 {
+		st.left--
+	}
+	return true
+}
+
+// budgetErr reports an exhausted budget, with the last attempt's error if
+// there was one.
+func budgetErr(lastErr error) error {
+	if lastErr == nil {
+		return ErrBudgetExhausted
+	}
+	return fmt.Errorf("%w: %w", ErrBudgetExhausted, lastErr)
+}
+
+// pickWallet returns the wallet pinned to the model carried by ctx, else the
+// wallet for the wallet key carried by ctx, else the next wallet from the
+// pool. Wallets in avoid (ones whose signer failed during this request) are
+// skipped; when no others remain the pick fails with wallet.ErrAllExcluded.
+// With per-wallet quotas (wallet.Options) a
+// pinned wallet over its quota fails the pick with a *wallet.LimitedError,
+// a keyed one gives way to round-robin, and round-robin fails only when every
+// wallet is over its quota.
+func (c *Client) pickWallet(ctx context.Context, avoid map[*wallet.Wallet]bool) (*wallet.Wallet, error) {
+	if model, _ := ctx.Value(modelCtx).(string); model != "" {
+		if addr, ok := c.opts.ModelWallets[model]; ok {
+			if w, ok := c.pool.ByAddress(addr); ok && !avoid[w] {
+				if err := c.pool.Allow(w); err != nil {
+					return nil, err
+				}
+				return w, nil
+			} else if !ok {
+				slog.Warn("upstream: wallet pinned to model not in pool, using round-robin", "model", model, "address", addr)
+			}
+		}
+	}
+	if key, _ := ctx.Value(walletKeyCtx).(string); key != "" {
+		if w := c.pool.ForKey(key); !avoid[w] && c.pool.Allow(w) == nil {
+			return w, nil
+		}
+	}
+	return c.pool.NextExcluding(avoid)
+}
+
+// previewWallet returns the wallet pickWallet would start from: the one
+// pinned to the model, else the one for the wallet key, else the next in the
+// round-robin. Quotas are neither checked nor taken, so a wallet over its
+// quota may be returned.
+func (c *Client) previewWallet(ctx context.Context) *wallet.Wallet {
+	if model, _ := ctx.Value(modelCtx).(string); model != "" {
+		if addr, ok := c.opts.ModelWallets[model]; ok {
+			if w, ok := c.pool.ByAddress(addr); ok {
+				return w
+			}
+		}
+	}
+	if key, _ := ctx.Value(walletKeyCtx).(string); key != "" {
+		return c.pool.ForKey(key)
+	}
+	return c.pool.Peek()
+}
+
+// ErrSignerPanic is returned (wrapped) when a wallet's signer panics. The
+// request is retried with another wallet.
+var ErrSignerPanic = errors.New("upstream: signer panicked")
+
+// noteSignerFailure logs a signer panic and marks w to be avoided for the rest
+// of the request. Only the wallet's pool index is logged, never key material.
+func (c *Client) noteSignerFailure(w *wallet.Wallet, err error, avoid map[*wallet.Wallet]bool) {
+	if !errors.Is(err, ErrSignerPanic) {
+		return
+	}
+	slog.Error("upstream: signer panicked, trying another wallet", "wallet_index", c.pool.Index(w), "err", err)
+	avoid[w] = true
+}
+
 // pickEndpoint returns a random active endpoint.
-func (c *Client) pickEndpoint() (Endpoint, error) {
-	return c.pickEndpointExcluding(nil)
+func (c *Client) pickEndpoint(ctx context.Context) (Endpoint, error) {
+	return c.pickEndpointExcluding(ctx, nil)
 }
 
-// pickEndpointExcluding returns a random endpoint not in the excluded set.
-func (c *Client) pickEndpointExcluding(exclude map[string]bool) (Endpoint, error) {
+// pickEndpointExcluding returns an endpoint not in the excluded set, preferring
+// ones the last probe reached. The choice is random unless ctx carries a
+// routing key (see WithRoutingKey).
+func (c *Client) pickEndpointExcluding(ctx context.Context, exclude map[string]bool) (Endpoint, error) {
 	c.mu.RLock()
 	eps := c.endpoints
+	unreachable := c.unreachable
 	c.mu.RUnlock()
 	if len(eps) == 0 {
 		return Endpoint{}, fmt.Errorf("no endpoints available")
 	}
-	var candidates []Endpoint
+	var candidates, fallback []Endpoint
 	for _, ep := range eps {
-		if !exclude[ep.Address] {
+		switch {
+		case exclude[ep.Address]:
+		case unreachable[ep.Address]:
+			fallback = append(fallback, ep)
+		default:
 			candidates = append(candidates, ep)
 		}
 	}
+	if len(candidates) == 0 {
+		candidates = fallback
+	}
 	if len(candidates) == 0 {
 		// All candidates exhausted; fall back to any endpoint.
-		return eps[rand.Intn(len(eps))], nil
+		candidates = eps
+	}
+	if key := routingKey(ctx); key != "" {
+		return pickByKey(candidates, key), nil
 	}
 	return candidates[rand.Intn(len(candidates))], nil
 }
 
-// FetchModels returns the raw model list from upstream.
+// pickByKey maps key onto one of eps. Endpoints are ordered by address first
+// so the result does not depend on the order discovery returned them in.
+func pickByKey(eps []Endpoint, key string) Endpoint {
+	sorted := make([]Endpoint, len(eps))
+	copy(sorted, eps)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Address < sorted[j].Address })
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return sorted[h.Sum32()%uint32(len(sorted))]
+}
+
+// FetchModels returns the raw model list from upstream. Nodes answer either
+// in Gonka's {"models":[...]} shape or OpenAI's {"object":"list","data":[...]};
+// both are accepted.
 func (c *Client) FetchModels(ctx context.Context) ([]json.RawMessage, error) {
-	ep, err := c.pickEndpoint()
+	ep, err := c.pickEndpoint(ctx)
 	if err != nil {
 		return nil, err
 	}
 
-	w := c.pool.Next()
-	resp, err := c.doWith(ctx, ep, w, http.MethodGet, "/models", nil)
+	w, err := c.pickWallet(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	path := c.opts.ModelsPath
+	if path == "" {
+		path = "/models"
+	}
+	resp, err := c.doWith(ctx, ep, w, http.MethodGet, path, nil)
 	if err != nil {
 		return nil, fmt.Errorf("fetch models: %w", err)
 	}
@@ -174,56 +593,261 @@ func (c *Client) FetchModels(ctx context.Context) ([]json.RawMessage, error) {
 
 	var result struct {
 		Models []json.RawMessage `json:"models"`
+		Data   []json.RawMessage `json:"data"`
 	}
 	if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
 		return nil, fmt.Errorf("decode models: %w", err)
 	}
-	return result.Models, nil
+	if len(result.Models) > 0 {
+		return result.Models, nil
+	}
+	return result.Data, nil
 }
 
-// Do sends a signed non-streaming request and returns the full response body.
-// It retries up to 3 times on different endpoints if the request fails.
-func (c *Client) Do(ctx context.Context, method, path string, payload []byte) ([]byte, int, error) {
+// Served says which endpoint and wallet handled a request, for logging,
+// metrics and cost attribution.
+type Served struct {
+	Endpoint string // address of the endpoint that answered
+	Wallet   string // address of the wallet that signed the request
+	Attempts int    // attempts made, including the one that answered
+}
+
+// FallbackEndpoint is the Served.Endpoint of a response from the fallback
+// upstream (see Options.FallbackURL). Such responses have no Served.Wallet.
+const FallbackEndpoint = "fallback"
+
+// Response is a complete upstream response and where it came from.
+type Response struct {
+	Served
+	StatusCode int
+	Header     http.Header
+	Body       []byte
+}
+
+// StreamResponse is a streaming upstream response and where it came from.
+// The caller must close Body.
+type StreamResponse struct {
+	*http.Response
+	Served
+}
+
+// Do sends a signed non-streaming request and returns the full response.
+// It retries up to 3 times on different endpoints if the request fails,
+// within the retry budget carried by ctx (see WithRetryBudget), and then
+// tries the fallback upstream if one is configured.
+func (c *Client) Do(ctx context.Context, method, path string, payload []byte) (*Response, error) {
 	var lastErr error
 	tried := map[string]bool{}
+	badWallets := map[*wallet.Wallet]bool{}
+	attempts := 0
 	for attempt := 0; attempt < 3; attempt++ {
-		ep, err := c.pickEndpointExcluding(tried)
+		ep, err := c.pickEndpointExcluding(ctx, tried)
 		if err != nil {
+			lastErr = err
 			break
 		}
-		tried[ep.Address] = true
-		w := c.pool.Next()
-		resp, err := c.doWith(ctx, ep, w, method, path, payload)
+		w, err := c.pickWallet(ctx, badWallets)
 		if err != nil {
-			slog.Warn("upstream: request failed, retrying with different endpoint", "attempt", attempt+1, "err", err)
 			lastErr = err
+			break
+		}
+		if !takeAttempt(ctx) {
+			return nil, budgetErr(lastErr)
+		}
+		attempts++
+		tried[ep.Address] = true
+		res := c.doHedged(ctx, ep, w, tried, badWallets, &attempts, method, path, payload)
+		if res.readErr != nil {
+			return nil, res.readErr
+		}
+		if res.err != nil {
+			c.noteSignerFailure(res.w, res.err, badWallets)
+			slog.Warn("upstream: request failed, retrying with different endpoint", "attempt", attempt+1, "err", res.err)
+			lastErr = res.err
 			continue
 		}
-		defer resp.Body.Close()
-		b, err := io.ReadAll(resp.Body)
-		return b, resp.StatusCode, err
+		return &Response{
+			Served:     Served{Endpoint: res.ep.Address, Wallet: res.w.Address, Attempts: attempts},
+			StatusCode: res.resp.StatusCode,
+			Header:     res.resp.Header,
+			Body:       res.body,
+		}, nil
+	}
+	if c.opts.FallbackURL == "" {
+		return nil, lastErr
+	}
+	if !takeAttempt(ctx) {
+		return nil, budgetErr(lastErr)
+	}
+	resp, err := c.doFallback(ctx, method, path, payload, false, lastErr)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	b, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return nil, err
 	}
-	return nil, 0, lastErr
+	return &Response{
+		Served:     Served{Endpoint: FallbackEndpoint, Attempts: attempts + 1},
+		StatusCode: resp.StatusCode,
+		Header:     resp.Header,
+		Body:       b,
+	}, nil
 }
 
-// DoStream sends a signed request and returns the raw *http.Response for streaming.
-// It retries up to 3 times on different endpoints. The caller must close resp.Body.
+// attemptResult is the outcome of one request sent by Do, body read in full.
+type attemptResult struct {
+	ep      Endpoint
+	w       *wallet.Wallet
+	resp    *http.Response
+	body    []byte
+	err     error // the request failed; Do moves on to another endpoint
+	readErr error // the response body could not be read; Do gives up
+}
+
+// failed reports whether r is worth waiting on another request for: an error
+// or a 5xx.
+func (r attemptResult) failed() bool {
+	return r.err != nil || r.readErr != nil || r.resp.StatusCode >= 500
+}
+
+// readAttempt sends one signed request and reads its response.
+func (c *Client) readAttempt(ctx context.Context, ep Endpoint, w *wallet.Wallet, method, path string, payload []byte) attemptResult {
+	r := attemptResult{ep: ep, w: w}
+	r.resp, r.err = c.doWith(ctx, ep, w, method, path, payload)
+	if r.err != nil {
+		return r
+	}
+	defer r.resp.Body.Close()
+	r.body, r.readErr = io.ReadAll(r.resp.Body)
+	return r
+}
+
+// doHedged sends one attempt of Do to ep, signed by w. With
+// Options.HedgeDelay set and ep still silent after it, a copy goes to an
+// endpoint not in tried (see hedgeTarget) and the first answer is used,
+// cancelling the other request; an error or 5xx is only used once both
+// requests are done, preferring a response to an error. A hedge is added to
+// tried and counted in attempts.
+func (c *Client) doHedged(ctx context.Context, ep Endpoint, w *wallet.Wallet, tried map[string]bool, badWallets map[*wallet.Wallet]bool, attempts *int, method, path string, payload []byte) attemptResult {
+	if c.opts.HedgeDelay <= 0 {
+		return c.readAttempt(ctx, ep, w, method, path, payload)
+	}
+
+	results := make(chan attemptResult, 2)
+	var cancels []context.CancelFunc
+	defer func() {
+		for _, cancel := range cancels {
+			cancel()
+		}
+	}()
+	launch := func(ep Endpoint, w *wallet.Wallet, done func()) {
+		actx, cancel := context.WithCancel(ctx)
+		cancels = append(cancels, cancel)
+		go func() {
+			defer done()
+			results <- c.readAttempt(actx, ep, w, method, path, payload)
+		}()
+	}
+	launch(ep, w, func() {})
+	pending := 1
+
+	timer := time.NewTimer(c.opts.HedgeDelay)
+	defer timer.Stop()
+	var held *attemptResult
+	for {
+		select {
+		case <-timer.C:
+			hep, hw, ok := c.hedgeTarget(ctx, tried, badWallets)
+			if !ok {
+				continue
+			}
+			slog.Info("upstream: endpoint slow, hedging request", "endpoint_addr", ep.Address, "hedge_addr", hep.Address, "after", c.opts.HedgeDelay)
+			tried[hep.Address] = true
+			*attempts++
+			launch(hep, hw, func() { c.hedging.Add(-1) })
+			pending++
+		case r := <-results:
+			pending--
+			if !r.failed() {
+				return r
+			}
+			if held != nil {
+				// Both requests failed: return a response over an error,
+				// and deal with the other one here.
+				other := *held
+				if other.err == nil && r.err != nil {
+					other, r = r, other
+				}
+				if other.err != nil {
+					c.noteSignerFailure(other.w, other.err, badWallets)
+					slog.Warn("upstream: hedged request failed too", "endpoint_addr", other.ep.Address, "err", other.err)
+				}
+			}
+			if pending == 0 {
+				return r
+			}
+			held = &r
+		}
+	}
+}
+
+// hedgeTarget picks the endpoint and wallet for a hedged request. It reports
+// false, sending nothing, when every endpoint has been tried, no wallet has
+// quota, Options.HedgeMax hedges are in flight, or the retry budget is spent.
+// On success the caller owns one hedging slot.
+func (c *Client) hedgeTarget(ctx context.Context, tried map[string]bool, badWallets map[*wallet.Wallet]bool) (Endpoint, *wallet.Wallet, bool) {
+	ep, err := c.pickEndpointExcluding(ctx, tried)
+	if err != nil || tried[ep.Address] {
+		return Endpoint{}, nil, false
+	}
+	if n := c.hedging.Add(1); c.opts.HedgeMax > 0 && n > int64(c.opts.HedgeMax) {
+		c.hedging.Add(-1)
+		slog.Debug("upstream: hedge limit reached, not hedging", "max", c.opts.HedgeMax)
+		return Endpoint{}, nil, false
+	}
+	w, err := c.pickWallet(ctx, badWallets)
+	if err != nil || !takeAttempt(ctx) {
+		c.hedging.Add(-1)
+		return Endpoint{}, nil, false
+	}
+	return ep, w, true
+}
+
+// DoStream sends a signed request and returns the raw response for streaming.
+// It retries up to 3 times on different endpoints, within the retry budget
+// carried by ctx (see WithRetryBudget), and then tries the fallback upstream
+// if one is configured. The caller must close resp.Body.
 // If a 5xx response is received with the same error body on consecutive attempts the
 // error is deterministic (caused by the payload, not a transient node issue) and
-// retrying is stopped early to prevent retry storms and upstream rate limiting.
-func (c *Client) DoStream(ctx context.Context, method, path string, payload []byte) (*http.Response, error) {
+// retrying is stopped early to prevent retry storms and upstream rate limiting;
+// such a request is not sent to the fallback either.
+func (c *Client) DoStream(ctx context.Context, method, path string, payload []byte) (*StreamResponse, error) {
 	var lastErr error
 	var lastErrBody string
 	tried := map[string]bool{}
+	badWallets := map[*wallet.Wallet]bool{}
+	attempts := 0
 	for attempt := 0; attempt < 3; attempt++ {
-		ep, err := c.pickEndpointExcluding(tried)
+		ep, err := c.pickEndpointExcluding(ctx, tried)
 		if err != nil {
+			lastErr = err
+			break
+		}
+		w, err := c.pickWallet(ctx, badWallets)
+		if err != nil {
+			lastErr = err
 			break
 		}
+		if !takeAttempt(ctx) {
+			return nil, budgetErr(lastErr)
+		}
+		attempts++
 		tried[ep.Address] = true
-		w := c.pool.Next()
 		resp, err := c.doWithNoTimeout(ctx, ep, w, method, path, payload)
 		if err != nil {
+			c.noteSignerFailure(w, err, badWallets)
 			slog.Warn("upstream: stream request failed, retrying with different endpoint", "attempt", attempt+1, "err", err)
 			lastErr = err
 			continue
@@ -242,44 +866,127 @@ func (c *Client) DoStream(ctx context.Context, method, path string, payload []by
 			lastErr = fmt.Errorf("upstream %d: %s", resp.StatusCode, bodyStr)
 			continue
 		}
-		return resp, nil
+		return &StreamResponse{Response: resp, Served: Served{Endpoint: ep.Address, Wallet: w.Address, Attempts: attempt + 1}}, nil
+	}
+	if lastErr == nil {
+		lastErr = fmt.Errorf("upstream: all endpoints exhausted")
 	}
-	if lastErr != nil {
+	if c.opts.FallbackURL == "" {
 		return nil, lastErr
 	}
-	return nil, fmt.Errorf("upstream: all endpoints exhausted")
+	if !takeAttempt(ctx) {
+		return nil, budgetErr(lastErr)
+	}
+	resp, err := c.doFallback(ctx, method, path, payload, true, lastErr)
+	if err != nil {
+		return nil, err
+	}
+	return &StreamResponse{Response: resp, Served: Served{Endpoint: FallbackEndpoint, Attempts: attempts + 1}}, nil
 }
 
-// doWith executes a signed request against a specific endpoint using the given wallet.
-func (c *Client) doWith(ctx context.Context, ep Endpoint, w *wallet.Wallet, method, path string, payload []byte) (*http.Response, error) {
-	url := ep.URL + path
-
-	sig, ts := w.Signer.Sign(payload, ep.Address)
-
+// doFallback sends payload to the fallback upstream with the fallback API
+// key instead of a Gonka signature. gonkaErr is why the Gonka endpoints were
+// given up on; it is logged and kept in the error if the fallback fails too.
+func (c *Client) doFallback(ctx context.Context, method, path string, payload []byte, stream bool, gonkaErr error) (*http.Response, error) {
 	var body io.Reader
 	if payload != nil {
 		body = bytes.NewReader(payload)
 	}
-
-	req, err := http.NewRequestWithContext(ctx, method, url, body)
+	req, err := http.NewRequestWithContext(ctx, method, strings.TrimRight(c.opts.FallbackURL, "/")+path, body)
 	if err != nil {
 		return nil, err
 	}
 	req.Header.Set("Content-Type", "application/json")
-	req.Header.Set("Authorization", sig)
-	req.Header.Set("X-Requester-Address", w.Address)
-	req.Header.Set("X-Timestamp", fmt.Sprintf("%d", ts))
+	if c.opts.FallbackAPIKey != "" {
+		req.Header.Set("Authorization", "Bearer "+c.opts.FallbackAPIKey)
+	}
+	c.setClientHeaders(req)
+
+	slog.Warn("upstream: Gonka endpoints failed, using fallback upstream", "method", method, "path", path, "err", gonkaErr)
+
+	hc := c.http
+	if _, ok := ctx.Deadline(); ok || stream {
+		hc = &http.Client{Transport: c.http.Transport}
+	}
+	resp, err := hc.Do(req)
+	if err != nil {
+		return nil, fmt.Errorf("upstream: fallback failed: %w (gonka: %v)", err, gonkaErr)
+	}
+	return resp, nil
+}
+
+// Prepare builds the signed request that Do or DoStream would send first for
+// payload, picking the endpoint the same way, without sending it. The wallet
+// is the one pickWallet would start from, chosen without taking per-wallet
+// quota (see previewWallet). It is meant for diagnostics such as a dry run;
+// the returned request carries a valid signature, so treat it like a
+// credential.
+func (c *Client) Prepare(ctx context.Context, method, path string, payload []byte) (*http.Request, Served, error) {
+	ep, err := c.pickEndpoint(ctx)
+	if err != nil {
+		return nil, Served{}, err
+	}
+	w := c.previewWallet(ctx)
+	req, err := newSignedRequest(ctx, ep, w, method, path, payload, false)
+	if err != nil {
+		return nil, Served{}, err
+	}
+	c.setClientHeaders(req)
+	return req, Served{Endpoint: ep.Address, Wallet: w.Address, Attempts: 1}, nil
+}
+
+// doWith executes a signed request against a specific endpoint using the given wallet.
+func (c *Client) doWith(ctx context.Context, ep Endpoint, w *wallet.Wallet, method, path string, payload []byte) (*http.Response, error) {
+	req, err := newSignedRequest(ctx, ep, w, method, path, payload, c.opts.VerifySignedBody)
+	if err != nil {
+		return nil, err
+	}
+	c.setClientHeaders(req)
+
+	slog.Info("upstream request", "method", method, "url", req.URL.String(), "endpoint_addr", ep.Address, "wallet", w.Address)
 
-	slog.Info("upstream request", "method", method, "url", url, "endpoint_addr", ep.Address, "wallet", w.Address)
+	// A caller-set deadline (e.g. from X-Request-Timeout) may be longer than
+	// the client's fixed timeout; let the context govern instead.
+	if _, ok := ctx.Deadline(); ok {
+		return (&http.Client{Transport: c.http.Transport}).Do(req)
+	}
 	return c.http.Do(req)
 }
 
 // doWithNoTimeout is like doWith but uses a client without a response-body timeout,
 // suitable for streaming.
 func (c *Client) doWithNoTimeout(ctx context.Context, ep Endpoint, w *wallet.Wallet, method, path string, payload []byte) (*http.Response, error) {
+	req, err := newSignedRequest(ctx, ep, w, method, path, payload, c.opts.VerifySignedBody)
+	if err != nil {
+		return nil, err
+	}
+	c.setClientHeaders(req)
+
+	slog.Info("upstream stream request", "method", method, "url", req.URL.String(), "endpoint_addr", ep.Address, "wallet", w.Address)
+
+	// No overall timeout on the client -- streaming responses can run for a long time.
+	streamClient := &http.Client{
+		Transport: c.http.Transport,
+	}
+	return streamClient.Do(req)
+}
+
+// newSignedRequest builds a request whose body is exactly payload and whose
+// Authorization header is the signature over those same bytes. Keeping both in
+// one place guarantees that what we sign is byte-for-byte what we send; the
+// payload must not be re-encoded after this point. With verify the sent body
+// is checked against the signed bytes (see verifyBody).
+func newSignedRequest(ctx context.Context, ep Endpoint, w *wallet.Wallet, method, path string, payload []byte, verify bool) (*http.Request, error) {
 	url := ep.URL + path
 
-	sig, ts := w.Signer.Sign(payload, ep.Address)
+	var signed [sha256.Size]byte
+	if verify {
+		signed = sha256.Sum256(payload)
+	}
+	sig, ts, err := sign(w, payload, ep.Address)
+	if err != nil {
+		return nil, err
+	}
 
 	var body io.Reader
 	if payload != nil {
@@ -294,12 +1001,75 @@ func (c *Client) doWithNoTimeout(ctx context.Context, ep Endpoint, w *wallet.Wal
 	req.Header.Set("Authorization", sig)
 	req.Header.Set("X-Requester-Address", w.Address)
 	req.Header.Set("X-Timestamp", fmt.Sprintf("%d", ts))
+	if verify {
+		verifyBody(req, signed)
+	}
+	return req, nil
+}
+
+// verifyBody makes the body of req check that the bytes the transport reads
+// from it hash to signed, the hash of the payload as it was signed, and log
+// an error when they do not (Options.VerifySignedBody). The check runs once
+// the whole body has been read, for every (re)send.
+func verifyBody(req *http.Request, signed [sha256.Size]byte) {
+	if req.Body == nil || req.Body == http.NoBody {
+		return
+	}
+	wrap := func(body io.ReadCloser) io.ReadCloser {
+		return &bodyVerifier{ReadCloser: body, hash: sha256.New(), signed: signed, url: req.URL.String()}
+	}
+	req.Body = wrap(req.Body)
+	if getBody := req.GetBody; getBody != nil {
+		req.GetBody = func() (io.ReadCloser, error) {
+			body, err := getBody()
+			if err != nil {
+				return nil, err
+			}
+			return wrap(body), nil
+		}
+	}
+}
 
-	slog.Info("upstream stream request", "method", method, "url", url, "endpoint_addr", ep.Address, "wallet", w.Address)
+// bodyVerifier hashes a request body as it is read; see verifyBody.
+type bodyVerifier struct {
+	io.ReadCloser
+	hash    hash.Hash
+	signed  [sha256.Size]byte
+	url     string
+	checked bool
+}
 
-	// No overall timeout on the client -- streaming responses can run for a long time.
-	streamClient := &http.Client{
-		Transport: c.http.Transport,
+func (b *bodyVerifier) Read(p []byte) (int, error) {
+	n, err := b.ReadCloser.Read(p)
+	b.hash.Write(p[:n])
+	if err == io.EOF && !b.checked {
+		b.checked = true
+		if sent := b.hash.Sum(nil); !bytes.Equal(sent, b.signed[:]) {
+			slog.Error("upstream: request body differs from the signed payload, the signature will be rejected",
+				"url", b.url, "signedSHA256", hex.EncodeToString(b.signed[:]), "sentSHA256", hex.EncodeToString(sent))
+		}
 	}
-	return streamClient.Do(req)
+	return n, err
+}
+
+// setClientHeaders identifies this proxy on an outgoing request.
+func (c *Client) setClientHeaders(req *http.Request) {
+	if c.opts.UserAgent != "" {
+		req.Header.Set("User-Agent", c.opts.UserAgent)
+	}
+	if c.opts.InstanceID != "" {
+		req.Header.Set("X-Opengnk-Instance", c.opts.InstanceID)
+	}
+}
+
+// sign signs payload with w, converting a panic in the signer into an error
+// wrapping ErrSignerPanic so one broken wallet cannot crash the request.
+func sign(w *wallet.Wallet, payload []byte, transferAddress string) (sig string, ts int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			err = fmt.Errorf("%w: %v", ErrSignerPanic, r)
+		}
+	}()
+	sig, ts = w.Signer.Sign(payload, transferAddress)
+	return sig, ts, nil
 }
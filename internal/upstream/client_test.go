@@ -0,0 +1,637 @@
+package upstream
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"math/rand"
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"slices"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/wallet"
+)
+
+const testKey = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+
+// testSigner returns a signer for testKey.
+func testSigner(t *testing.T) *signer.Signer {
+	t.Helper()
+	s, err := signer.New(testKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+// newTestClient returns a client built with opts whose endpoints are the
+// given node names, each served by srv under /<name>/v1 with the address
+// gonka1<name>. It signs with wallets, or with a single wallet gonka1a when
+// wallets is nil.
+func newTestClient(t *testing.T, srv *httptest.Server, wallets []wallet.Wallet, opts Options, names ...string) *Client {
+	t.Helper()
+	if wallets == nil {
+		wallets = []wallet.Wallet{{Signer: testSigner(t), Address: "gonka1a"}}
+	}
+	pool, err := wallet.NewPool(wallets)
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := NewWithOptions(srv.URL, pool, opts)
+	for _, name := range names {
+		c.endpoints = append(c.endpoints, Endpoint{URL: srv.URL + "/" + name + "/v1", Address: "gonka1" + name})
+	}
+	return c
+}
+
+// panickingSigner simulates a signer left in a broken state.
+type panickingSigner struct{}
+
+func (panickingSigner) Sign([]byte, string) (string, int64) {
+	panic("nil key")
+}
+
+func TestSignerPanicRetriesWithAnotherWallet(t *testing.T) {
+	var mu sync.Mutex
+	var requesters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requesters = append(requesters, r.Header.Get("X-Requester-Address"))
+		mu.Unlock()
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	wallets := []wallet.Wallet{
+		{Signer: panickingSigner{}, Address: "gonka1broken"},
+		{Signer: testSigner(t), Address: "gonka1good"},
+	}
+	// Pin the model to the broken wallet so every first attempt hits it.
+	c := newTestClient(t, srv, wallets, Options{ModelWallets: map[string]string{"m": "gonka1broken"}}, "node1", "node2")
+	ctx := WithModel(context.Background(), "m")
+
+	resp, err := c.Do(ctx, http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil || resp.StatusCode != http.StatusOK || string(resp.Body) != `{"ok":true}` {
+		t.Fatalf("Do: %+v, err %v", resp, err)
+	}
+	// The first attempt failed to sign; the second was served.
+	if resp.Wallet != "gonka1good" || resp.Attempts != 2 || resp.Endpoint == "" {
+		t.Fatalf("Do served by %+v, want gonka1good on attempt 2", resp.Served)
+	}
+
+	stream, err := c.DoStream(ctx, http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("DoStream: %v", err)
+	}
+	stream.Body.Close()
+	if stream.Wallet != "gonka1good" || stream.Attempts != 2 {
+		t.Fatalf("DoStream served by %+v, want gonka1good on attempt 2", stream.Served)
+	}
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(requesters) != 2 || requesters[0] != "gonka1good" || requesters[1] != "gonka1good" {
+		t.Fatalf("upstream saw requesters %v, want the healthy wallet twice", requesters)
+	}
+}
+
+func TestSignerPanicFailsWhenNoOtherWalletRemains(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv, []wallet.Wallet{{Signer: panickingSigner{}, Address: "gonka1broken"}}, Options{}, "node1", "node2")
+	if resp, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`)); !errors.Is(err, wallet.ErrAllExcluded) {
+		t.Fatalf("Do = %+v, %v; want wallet.ErrAllExcluded", resp, err)
+	}
+}
+
+func TestPrepareTakesNoWalletQuota(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	pool, err := wallet.NewPoolWithOptions([]wallet.Wallet{{Signer: testSigner(t), Address: "gonka1a"}},
+		wallet.Options{RequestsPerMinute: 1, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	c := New(srv.URL, pool)
+	c.endpoints = []Endpoint{{URL: srv.URL + "/v1", Address: "gonka1node1"}}
+
+	for i := 0; i < 3; i++ {
+		if _, by, err := c.Prepare(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`)); err != nil || by.Wallet != "gonka1a" {
+			t.Fatalf("Prepare %d: %+v, %v", i+1, by, err)
+		}
+	}
+	// The wallet's only request is still there for a real one.
+	if resp, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`)); err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("Do after Prepare: %+v, %v", resp, err)
+	}
+}
+
+// mutatingSigner signs like s, then overwrites the first byte of the payload,
+// like code that reuses a buffer it has already handed over for signing.
+type mutatingSigner struct{ s *signer.Signer }
+
+func (m mutatingSigner) Sign(payload []byte, addr string) (string, int64) {
+	sig, ts := m.s.Sign(payload, addr)
+	payload[0] = ' '
+	return sig, ts
+}
+
+func TestVerifySignedBodyLogsMismatch(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.ContentLength != int64(len(`{"model":"m"}`)) {
+			t.Errorf("verified body sent with Content-Length %d", r.ContentLength)
+		}
+		_, _ = io.Copy(io.Discard, r.Body)
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	good := testSigner(t)
+	for _, tc := range []struct {
+		name     string
+		signer   wallet.Signer
+		mismatch bool
+	}{
+		{"intact", good, false},
+		{"changed after signing", mutatingSigner{good}, true},
+	} {
+		logs.Reset()
+		wallets := []wallet.Wallet{{Signer: tc.signer, Address: "gonka1requester"}}
+		c := newTestClient(t, srv, wallets, Options{VerifySignedBody: true}, "node")
+
+		if _, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{"model":"m"}`)); err != nil {
+			t.Fatalf("%s: Do: %v", tc.name, err)
+		}
+		stream, err := c.DoStream(context.Background(), http.MethodPost, "/chat/completions", []byte(`{"model":"m"}`))
+		if err != nil {
+			t.Fatalf("%s: DoStream: %v", tc.name, err)
+		}
+		stream.Body.Close()
+
+		if got := strings.Count(logs.String(), "request body differs from the signed payload"); got != map[bool]int{false: 0, true: 2}[tc.mismatch] {
+			t.Fatalf("%s: %d mismatch errors logged:\n%s", tc.name, got, logs.String())
+		}
+	}
+}
+
+func TestDiscoverEndpointsDropsBlocklisted(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		_, _ = io.WriteString(w, `{"active_participants":{"participants":[
+			{"index":"gonka1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le","inference_url":"http://a"},
+			{"index":"gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp","inference_url":"http://b"}]}}`)
+	}))
+	defer srv.Close()
+
+	c := NewWithOptions(srv.URL, nil, Options{EndpointBlocklist: []string{"gonka1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le"}})
+	if err := c.DiscoverEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	eps := c.Endpoints()
+	if len(eps) != 1 || eps[0].Address != "gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp" {
+		t.Fatalf("endpoints %+v, want only the non-blocklisted node", eps)
+	}
+}
+
+func TestNetworkWhitelist(t *testing.T) {
+	const (
+		listed   = "gonka1y2a9p56kv044327uycmqdexl7zs82fs5ryv5le" // on the built-in whitelist
+		listed2  = "gonka1dkl4mah5erqggvhqkpc8j3qs5tyuetgdy552cp"
+		unlisted = "gonka1newtransferagent"
+	)
+	flagged := `{"active_participants":{"participants":[
+		{"index":"` + listed + `","inference_url":"http://a","supports_transfer_agent":false},
+		{"index":"` + listed2 + `","inference_url":"http://b","supports_transfer_agent":null},
+		{"index":"` + unlisted + `","inference_url":"http://c","supports_transfer_agent":true}]}}`
+	unflagged := `{"active_participants":{"participants":[
+		{"index":"` + listed + `","inference_url":"http://a"},
+		{"index":"` + unlisted + `","inference_url":"http://c"}]}}`
+
+	for _, tc := range []struct {
+		name    string
+		body    string
+		network bool
+		want    []string
+	}{
+		{"flags decide, absent falls back", flagged, true, []string{listed2, unlisted}},
+		{"no flags", unflagged, true, []string{listed}},
+		{"flags ignored when off", flagged, false, []string{listed, listed2}},
+	} {
+		t.Run(tc.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				_, _ = io.WriteString(w, tc.body)
+			}))
+			defer srv.Close()
+
+			c := NewWithOptions(srv.URL, nil, Options{NetworkWhitelist: tc.network})
+			if err := c.DiscoverEndpoints(context.Background()); err != nil {
+				t.Fatal(err)
+			}
+			var got []string
+			for _, ep := range c.Endpoints() {
+				got = append(got, ep.Address)
+			}
+			if !reflect.DeepEqual(got, tc.want) {
+				t.Fatalf("endpoints %v, want %v", got, tc.want)
+			}
+		})
+	}
+}
+
+func TestStaticEndpointsSkipDiscovery(t *testing.T) {
+	var hits atomic.Int32
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		hits.Add(1)
+		_, _ = io.WriteString(w, `{"active_participants":{"participants":[]}}`)
+	}))
+	defer srv.Close()
+
+	static := []Endpoint{{URL: "http://10.0.0.1:8000/v1", Address: "gonka1static"}}
+	c := NewWithOptions(srv.URL, nil, Options{StaticEndpoints: static})
+	if err := c.DiscoverEndpoints(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if hits.Load() != 0 {
+		t.Fatalf("participant list fetched %d times, want never", hits.Load())
+	}
+	if eps := c.Endpoints(); !reflect.DeepEqual(eps, static) {
+		t.Fatalf("endpoints %+v, want %+v", eps, static)
+	}
+}
+
+func TestWalletKeyPinsWallet(t *testing.T) {
+	var mu sync.Mutex
+	var requesters []string
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requesters = append(requesters, r.Header.Get("X-Requester-Address"))
+		mu.Unlock()
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	s := testSigner(t)
+	wallets := []wallet.Wallet{
+		{Signer: s, Address: "gonka1a"},
+		{Signer: s, Address: "gonka1b"},
+		{Signer: s, Address: "gonka1c"},
+	}
+	c := newTestClient(t, srv, wallets, Options{}, "node1")
+
+	want := c.pool.ForKey("tenant-1").Address
+	ctx := WithWalletKey(context.Background(), "tenant-1")
+	for i := 0; i < 5; i++ {
+		resp, err := c.Do(ctx, http.MethodPost, "/chat/completions", []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if resp.Wallet != want {
+			t.Fatalf("request %d signed by %s, want %s", i, resp.Wallet, want)
+		}
+	}
+
+	// Without a key, selection stays round-robin.
+	seen := map[string]bool{}
+	for i := 0; i < 3; i++ {
+		resp, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+		if err != nil {
+			t.Fatal(err)
+		}
+		seen[resp.Wallet] = true
+	}
+	if len(seen) != 3 {
+		t.Fatalf("round-robin used wallets %v, want all three", seen)
+	}
+}
+
+func TestClientIdentificationHeaders(t *testing.T) {
+	var mu sync.Mutex
+	var got []http.Header
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		got = append(got, r.Header.Clone())
+		mu.Unlock()
+		if r.URL.Path == "/v1/epochs/current/participants" {
+			_, _ = io.WriteString(w, `{"active_participants":{"participants":[]}}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv, nil, Options{UserAgent: "opengnk/1.2.3", InstanceID: "eu-1", DisableWhitelist: true}, "node1")
+	_ = c.DiscoverEndpoints(context.Background()) // no participants; only the headers matter
+
+	if _, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	stream, err := c.DoStream(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	stream.Body.Close()
+
+	mu.Lock()
+	defer mu.Unlock()
+	if len(got) != 3 {
+		t.Fatalf("upstream saw %d requests, want discovery, Do and DoStream", len(got))
+	}
+	for i, h := range got {
+		if h.Get("User-Agent") != "opengnk/1.2.3" || h.Get("X-Opengnk-Instance") != "eu-1" {
+			t.Fatalf("request %d: User-Agent %q, X-Opengnk-Instance %q", i, h.Get("User-Agent"), h.Get("X-Opengnk-Instance"))
+		}
+	}
+}
+
+func TestProbeEndpointsPrefersReachable(t *testing.T) {
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusNotFound) // any response counts as reachable
+	}))
+	defer srv.Close()
+	dead := httptest.NewServer(http.NotFoundHandler())
+	deadURL := dead.URL
+	dead.Close()
+
+	c := NewWithOptions(srv.URL, nil, Options{})
+	c.endpoints = []Endpoint{
+		{URL: deadURL + "/v1", Address: "gonka1dead"},
+		{URL: srv.URL + "/v1", Address: "gonka1live"},
+	}
+	n, err := c.ProbeEndpoints(context.Background(), time.Second)
+	if err != nil || n != 1 {
+		t.Fatalf("ProbeEndpoints = %d, %v; want 1 reachable", n, err)
+	}
+	for i := 0; i < 20; i++ {
+		ep, err := c.pickEndpoint(context.Background())
+		if err != nil || ep.Address != "gonka1live" {
+			t.Fatalf("picked %s, %v; want the reachable endpoint", ep.Address, err)
+		}
+	}
+	// Once the reachable endpoint is excluded, the unreachable one is still
+	// a last resort.
+	ep, err := c.pickEndpointExcluding(context.Background(), map[string]bool{"gonka1live": true})
+	if err != nil || ep.Address != "gonka1dead" {
+		t.Fatalf("fallback picked %s, %v; want gonka1dead", ep.Address, err)
+	}
+
+	c.endpoints = c.endpoints[:1]
+	if _, err := c.ProbeEndpoints(context.Background(), time.Second); err == nil {
+		t.Fatal("ProbeEndpoints succeeded with no reachable endpoints")
+	}
+}
+
+func TestFetchModelsResponseShapes(t *testing.T) {
+	tests := []struct {
+		name, path, body string
+		opts             Options
+	}{
+		{name: "gonka shape", path: "/node1/v1/models", body: `{"models":[{"id":"a"},{"id":"b"}]}`},
+		{name: "openai shape", path: "/node1/v1/models", body: `{"object":"list","data":[{"id":"a","object":"model"},{"id":"b","object":"model"}]}`},
+		{name: "custom path", path: "/node1/v1/inference/models", body: `{"data":[{"id":"a"},{"id":"b"}]}`, opts: Options{ModelsPath: "/inference/models"}},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				if r.URL.Path != tt.path {
+					http.NotFound(w, r)
+					return
+				}
+				_, _ = io.WriteString(w, tt.body)
+			}))
+			defer srv.Close()
+
+			c := newTestClient(t, srv, nil, tt.opts, "node1")
+			models, err := c.FetchModels(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(models) != 2 {
+				t.Fatalf("got %d models, want 2", len(models))
+			}
+		})
+	}
+}
+
+func TestRetryBudgetSpansCalls(t *testing.T) {
+	var mu sync.Mutex
+	hits := 0
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		hits++
+		n := hits
+		mu.Unlock()
+		// A different body each time, so retries are not cut short as a
+		// deterministic failure.
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.WriteString(w, fmt.Sprintf(`{"error":"busy %d"}`, n))
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv, nil, Options{}, "node0", "node1", "node2")
+
+	ctx := WithRetryBudget(context.Background(), RetryBudget{Attempts: 4})
+	if _, err := c.DoStream(ctx, http.MethodPost, "/chat/completions", []byte(`{}`)); err == nil || errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("first call: want a plain upstream error after 3 attempts, got %v", err)
+	}
+	_, err := c.DoStream(ctx, http.MethodPost, "/chat/completions", []byte(`{}`))
+	if !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("second call: want ErrBudgetExhausted, got %v", err)
+	}
+	if _, err := c.Do(ctx, http.MethodPost, "/chat/completions", []byte(`{}`)); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("third call: want ErrBudgetExhausted, got %v", err)
+	}
+	mu.Lock()
+	if hits != 4 {
+		t.Fatalf("upstream saw %d attempts, want the budget of 4", hits)
+	}
+	mu.Unlock()
+
+	// A spent time budget stops attempts before they start.
+	ctx = WithRetryBudget(context.Background(), RetryBudget{Time: time.Nanosecond})
+	time.Sleep(time.Millisecond)
+	if _, err := c.Do(ctx, http.MethodPost, "/chat/completions", []byte(`{}`)); !errors.Is(err, ErrBudgetExhausted) {
+		t.Fatalf("want ErrBudgetExhausted once the time budget is spent, got %v", err)
+	}
+	mu.Lock()
+	defer mu.Unlock()
+	if hits != 4 {
+		t.Fatalf("upstream saw %d attempts after the time budget ran out", hits-4)
+	}
+}
+
+func TestFallbackAfterGonkaEndpointsFail(t *testing.T) {
+	var hits atomic.Int32
+	gonka := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.WriteHeader(http.StatusBadGateway)
+		_, _ = io.WriteString(w, fmt.Sprintf(`{"error":"down %d"}`, hits.Add(1)))
+	}))
+	defer gonka.Close()
+	var auth, requester string
+	fallback := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.URL.Path != "/v1/chat/completions" {
+			http.NotFound(w, r)
+			return
+		}
+		auth, requester = r.Header.Get("Authorization"), r.Header.Get("X-Requester-Address")
+		w.Header().Set("Content-Type", "text/event-stream")
+		_, _ = io.WriteString(w, "data: [DONE]\n\n")
+	}))
+	defer fallback.Close()
+
+	c := newTestClient(t, gonka, nil, Options{FallbackURL: fallback.URL + "/v1/", FallbackAPIKey: "sk-backup"}, "node")
+
+	resp, err := c.DoStream(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Endpoint != FallbackEndpoint || resp.Wallet != "" || resp.Attempts != 4 {
+		t.Fatalf("want a fallback answer after 3 Gonka attempts, got status %d served %+v", resp.StatusCode, resp.Served)
+	}
+	if auth != "Bearer sk-backup" || requester != "" {
+		t.Fatalf("fallback request not authenticated by key alone: Authorization %q, X-Requester-Address %q", auth, requester)
+	}
+
+	// With no Gonka endpoints at all, Do goes straight to the fallback.
+	c.endpoints = nil
+	r, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil || r.Endpoint != FallbackEndpoint || r.Attempts != 1 {
+		t.Fatalf("want a fallback answer, got %+v, %v", r, err)
+	}
+}
+
+func TestHedgeSlowEndpoint(t *testing.T) {
+	var hits atomic.Int32
+	cancelled := make(chan struct{}, 1)
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Reading the body lets the server notice a cancelled request.
+		_, _ = io.Copy(io.Discard, r.Body)
+		// The first request to arrive is the slow one.
+		if hits.Add(1) == 1 {
+			select {
+			case <-r.Context().Done():
+				cancelled <- struct{}{}
+				return
+			case <-time.After(200 * time.Millisecond):
+			}
+		}
+		_, _ = io.WriteString(w, `{"endpoint":"`+strings.Split(r.URL.Path, "/")[1]+`"}`)
+	}))
+	defer srv.Close()
+
+	newClient := func(opts Options) *Client {
+		hits.Store(0)
+		return newTestClient(t, srv, nil, opts, "node0", "node1")
+	}
+
+	c := newClient(Options{HedgeDelay: 20 * time.Millisecond, HedgeMax: 1})
+	resp, err := c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := `{"endpoint":"` + strings.TrimPrefix(resp.Endpoint, "gonka1") + `"}`; string(resp.Body) != want {
+		t.Fatalf("body %s does not come from the reported endpoint %s", resp.Body, resp.Endpoint)
+	}
+	if resp.Attempts != 2 || hits.Load() != 2 {
+		t.Fatalf("attempts %d, upstream hits %d, want a hedge after the slow endpoint", resp.Attempts, hits.Load())
+	}
+	select {
+	case <-cancelled:
+	case <-time.After(time.Second):
+		t.Fatal("slow request was not cancelled once the hedge answered")
+	}
+	if n := c.hedging.Load(); n != 0 {
+		t.Fatalf("%d hedges still counted in flight", n)
+	}
+
+	// With the hedge limit reached, the slow endpoint is waited for.
+	c = newClient(Options{HedgeDelay: 20 * time.Millisecond, HedgeMax: 1})
+	c.hedging.Store(1)
+	resp, err = c.Do(context.Background(), http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Attempts != 1 || hits.Load() != 1 {
+		t.Fatalf("attempts %d, upstream hits %d, want no hedge over HedgeMax", resp.Attempts, hits.Load())
+	}
+}
+
+func TestRoutingKeyPinsEndpoint(t *testing.T) {
+	var mu sync.Mutex
+	failing := ""
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		bad := failing != "" && strings.HasPrefix(r.URL.Path, "/"+strings.TrimPrefix(failing, "gonka1")+"/")
+		mu.Unlock()
+		if bad {
+			w.WriteHeader(http.StatusBadGateway)
+			_, _ = io.WriteString(w, `{"error":"busy"}`)
+			return
+		}
+		_, _ = io.WriteString(w, `{"ok":true}`)
+	}))
+	defer srv.Close()
+
+	c := newTestClient(t, srv, nil, Options{}, "node0", "node1", "node2", "node3")
+	ctx := WithRoutingKey(context.Background(), "seed:m:42")
+	pinned, err := c.pickEndpoint(ctx)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// The same key lands on the same endpoint whatever order discovery
+	// returned the endpoints in.
+	eps := slices.Clone(c.endpoints)
+	for i := 0; i < 10; i++ {
+		rand.Shuffle(len(eps), func(i, j int) { eps[i], eps[j] = eps[j], eps[i] })
+		c.mu.Lock()
+		c.endpoints = slices.Clone(eps)
+		c.mu.Unlock()
+		if ep, _ := c.pickEndpoint(ctx); ep.Address != pinned.Address {
+			t.Fatalf("order %v: picked %s, want %s", eps, ep.Address, pinned.Address)
+		}
+	}
+
+	// Different keys spread across the endpoints.
+	used := map[string]bool{}
+	for seed := 0; seed < 100; seed++ {
+		ep, _ := c.pickEndpoint(WithRoutingKey(context.Background(), fmt.Sprintf("seed:m:%d", seed)))
+		used[ep.Address] = true
+	}
+	if len(used) != len(eps) {
+		t.Fatalf("100 seeds used endpoints %v, want all %d", used, len(eps))
+	}
+
+	// A failed attempt is retried on a different endpoint.
+	mu.Lock()
+	failing = pinned.Address
+	mu.Unlock()
+	resp, err := c.DoStream(ctx, http.MethodPost, "/chat/completions", []byte(`{}`))
+	if err != nil {
+		t.Fatalf("DoStream: %v", err)
+	}
+	resp.Body.Close()
+	if resp.StatusCode != http.StatusOK || resp.Attempts != 2 || resp.Endpoint == pinned.Address {
+		t.Fatalf("served by %+v, want a second attempt away from %s", resp.Served, pinned.Address)
+	}
+}
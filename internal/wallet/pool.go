@@ -1,52 +1,256 @@
 package wallet
 
 import (
+	"errors"
 	"fmt"
+	"hash/fnv"
 	"log/slog"
 	"sync/atomic"
+	"time"
 
-	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+	"github.com/gonkalabs/gonka-proxy-go/internal/ratelimit"
 )
 
+// Signer signs request payloads for a transfer agent. *signer.Signer is the
+// production implementation.
+type Signer interface {
+	Sign(payload []byte, transferAddress string) (sig string, tsNano int64)
+}
+
+// PublicKeyer is implemented by signers that can report their public key,
+// such as *signer.Signer. The pool uses it to spot the same key configured
+// twice.
+type PublicKeyer interface {
+	PublicKey() []byte
+}
+
 // Wallet holds a signer and its associated requester address.
 type Wallet struct {
-	Signer  *signer.Signer
+	Signer  Signer
 	Address string
 }
 
 // Pool manages multiple wallets and routes requests between them
-// using atomic round-robin selection.
+// using atomic round-robin selection. The wallet list can be swapped at
+// runtime with Replace; a *Wallet handed out earlier stays valid, so
+// in-flight requests finish with the wallet they picked.
 type Pool struct {
-	wallets []Wallet
+	wallets atomic.Pointer[[]Wallet]
 	counter atomic.Uint64
+	opts    Options
+	limiter *ratelimit.Limiter // per-address quota; nil without one
+}
+
+// Options tunes pool construction.
+type Options struct {
+	// RejectDuplicates makes NewPoolWithOptions fail when two wallets share a
+	// requester address instead of only logging a warning.
+	RejectDuplicates bool
+
+	// RequestsPerMinute is a local quota per requester address, so the pool
+	// spreads requests instead of running into a node's per-address
+	// throttling. Next skips wallets over it; 0 means no quota. Burst is how
+	// many requests a wallet may take at once (below 1 means 1). Quotas are
+	// kept by address, so they survive Replace.
+	RequestsPerMinute int
+	Burst             int
+}
+
+// LimitedError is returned when every candidate wallet is over its quota
+// (Options.RequestsPerMinute).
+type LimitedError struct {
+	RetryAfter time.Duration // until the first wallet has quota again
+}
+
+func (e *LimitedError) Error() string {
+	return fmt.Sprintf("wallet pool: every wallet is over its rate limit, retry in %s", e.RetryAfter.Round(time.Millisecond))
 }
 
 // NewPool creates a Pool from a list of wallets.
 // At least one wallet is required.
 func NewPool(wallets []Wallet) (*Pool, error) {
-	if len(wallets) == 0 {
-		return nil, fmt.Errorf("wallet pool: at least one wallet is required")
+	return NewPoolWithOptions(wallets, Options{})
+}
+
+// NewPoolWithOptions is NewPool with explicit options.
+func NewPoolWithOptions(wallets []Wallet, opts Options) (*Pool, error) {
+	if err := checkWallets(wallets, opts); err != nil {
+		return nil, err
 	}
 	slog.Info("wallet pool initialised", "wallets", len(wallets))
+	logWallets(wallets)
+	p := &Pool{opts: opts}
+	if opts.RequestsPerMinute > 0 {
+		p.limiter = ratelimit.New(opts.RequestsPerMinute, opts.Burst)
+	}
+	p.wallets.Store(&wallets)
+	return p, nil
+}
+
+// Replace atomically swaps the pool's wallets for a new list, applying the
+// same checks as NewPoolWithOptions. On error the pool is left unchanged.
+// Safe to call concurrently with selection.
+func (p *Pool) Replace(wallets []Wallet) error {
+	if err := checkWallets(wallets, p.opts); err != nil {
+		return err
+	}
+	old := p.wallets.Swap(&wallets)
+	slog.Info("wallet pool replaced", "wallets", len(wallets), "previous", len(*old))
+	logWallets(wallets)
+	return nil
+}
+
+// checkWallets rejects an empty list and reports wallets sharing a signing
+// key or a requester address (usually the same key pasted twice), which add
+// no capacity and skew per-wallet accounting. Keys are compared when the
+// signers report them (PublicKeyer), so a key listed twice without an
+// address is caught too.
+func checkWallets(wallets []Wallet, opts Options) error {
+	if len(wallets) == 0 {
+		return fmt.Errorf("wallet pool: at least one wallet is required")
+	}
+	seen := make(map[string]int, len(wallets))
+	seenKey := make(map[string]int, len(wallets))
+	for i, w := range wallets {
+		if pk, ok := w.Signer.(PublicKeyer); ok {
+			key := string(pk.PublicKey())
+			if first, dup := seenKey[key]; dup {
+				if opts.RejectDuplicates {
+					return fmt.Errorf("wallet pool: wallets %d and %d share a signing key", first, i)
+				}
+				slog.Warn("wallet pool: duplicate wallet key", "index", i, "firstIndex", first, "address", w.Address)
+				continue
+			}
+			seenKey[key] = i
+		}
+		if w.Address == "" {
+			continue
+		}
+		first, dup := seen[w.Address]
+		if !dup {
+			seen[w.Address] = i
+			continue
+		}
+		if opts.RejectDuplicates {
+			return fmt.Errorf("wallet pool: wallets %d and %d share address %s", first, i, w.Address)
+		}
+		slog.Warn("wallet pool: duplicate wallet address", "index", i, "firstIndex", first, "address", w.Address)
+	}
+	return nil
+}
+
+func logWallets(wallets []Wallet) {
 	for i, w := range wallets {
 		slog.Info("wallet registered", "index", i, "address", w.Address)
 	}
-	return &Pool{wallets: wallets}, nil
 }
 
-// Next returns the next wallet using round-robin selection.
+// ErrAllExcluded is returned by NextExcluding when every wallet in the pool
+// is excluded.
+var ErrAllExcluded = errors.New("wallet pool: every wallet is excluded")
+
+// Next returns the next wallet using round-robin selection, skipping wallets
+// over their quota and taking one request from the quota of the wallet it
+// returns. When every wallet is over its quota it returns a *LimitedError.
 // This is safe for concurrent use.
-func (p *Pool) Next() *Wallet {
+func (p *Pool) Next() (*Wallet, error) {
+	return p.NextExcluding(nil)
+}
+
+// NextExcluding is like Next but also skips the wallets in exclude, before
+// their quota is consulted, so no quota is taken from a wallet that is not
+// returned. When only excluded wallets remain it returns ErrAllExcluded.
+func (p *Pool) NextExcluding(exclude map[*Wallet]bool) (*Wallet, error) {
+	wallets := *p.wallets.Load()
+	n := uint64(len(wallets))
 	idx := p.counter.Add(1) - 1
-	return &p.wallets[idx%uint64(len(p.wallets))]
+	var wait time.Duration
+	limited := false
+	for i := range n {
+		w := &wallets[(idx+i)%n]
+		if exclude[w] {
+			continue
+		}
+		if p.limiter == nil {
+			return w, nil
+		}
+		ok, d := p.limiter.Allow(w.Address)
+		if ok {
+			return w, nil
+		}
+		if !limited || d < wait {
+			wait = d
+		}
+		limited = true
+	}
+	if !limited {
+		return nil, ErrAllExcluded
+	}
+	return nil, &LimitedError{RetryAfter: wait}
+}
+
+// Peek returns the wallet Next would try first, without advancing the
+// round-robin or consulting or taking quota. For diagnostics such as a dry
+// run.
+func (p *Pool) Peek() *Wallet {
+	wallets := *p.wallets.Load()
+	return &wallets[p.counter.Load()%uint64(len(wallets))]
+}
+
+// Allow takes one request from the quota of w, a wallet chosen other than by
+// Next (ForKey, ByAddress). When w is over its quota it returns a
+// *LimitedError instead. Without a quota it always returns nil.
+func (p *Pool) Allow(w *Wallet) error {
+	if p.limiter == nil {
+		return nil
+	}
+	if ok, d := p.limiter.Allow(w.Address); !ok {
+		return &LimitedError{RetryAfter: d}
+	}
+	return nil
+}
+
+// ForKey returns the wallet derived from a hash of key, so the same key (e.g.
+// a tenant's API key or a conversation ID) always maps to the same wallet
+// while the pool is unchanged. Next remains the default selection.
+func (p *Pool) ForKey(key string) *Wallet {
+	wallets := *p.wallets.Load()
+	h := fnv.New32a()
+	_, _ = h.Write([]byte(key))
+	return &wallets[h.Sum32()%uint32(len(wallets))]
+}
+
+// ByAddress returns the wallet with the given requester address.
+func (p *Pool) ByAddress(address string) (*Wallet, bool) {
+	wallets := *p.wallets.Load()
+	for i := range wallets {
+		if wallets[i].Address == address {
+			return &wallets[i], true
+		}
+	}
+	return nil, false
+}
+
+// Index returns the position of w in the pool, or -1 if w is not one of the
+// pool's current wallets (e.g. it was selected before a Replace). Useful for
+// logging a wallet without exposing anything secret.
+func (p *Pool) Index(w *Wallet) int {
+	wallets := *p.wallets.Load()
+	for i := range wallets {
+		if &wallets[i] == w {
+			return i
+		}
+	}
+	return -1
 }
 
 // Len returns the number of wallets in the pool.
 func (p *Pool) Len() int {
-	return len(p.wallets)
+	return len(*p.wallets.Load())
 }
 
 // All returns all wallets in the pool (e.g. for health checks or diagnostics).
+// The returned slice must not be modified.
 func (p *Pool) All() []Wallet {
-	return p.wallets
+	return *p.wallets.Load()
 }
@@ -0,0 +1,185 @@
+package wallet
+
+import (
+	"bytes"
+	"errors"
+	"log/slog"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/gonkalabs/gonka-proxy-go/internal/signer"
+)
+
+type nopSigner struct{}
+
+func (nopSigner) Sign([]byte, string) (string, int64) { return "", 0 }
+
+func TestNewPoolDuplicateAddresses(t *testing.T) {
+	wallets := []Wallet{
+		{Signer: nopSigner{}, Address: "gonka1a"},
+		{Signer: nopSigner{}, Address: "gonka1b"},
+		{Signer: nopSigner{}, Address: "gonka1a"},
+	}
+
+	var logs bytes.Buffer
+	prev := slog.Default()
+	slog.SetDefault(slog.New(slog.NewTextHandler(&logs, nil)))
+	defer slog.SetDefault(prev)
+
+	p, err := NewPool(wallets)
+	if err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+	if p.Len() != 3 {
+		t.Fatalf("pool has %d wallets, want 3", p.Len())
+	}
+	if !strings.Contains(logs.String(), "duplicate wallet address") || !strings.Contains(logs.String(), "index=2 firstIndex=0") {
+		t.Fatalf("no duplicate warning logged: %s", logs.String())
+	}
+
+	_, err = NewPoolWithOptions(wallets, Options{RejectDuplicates: true})
+	if err == nil || !strings.Contains(err.Error(), "wallets 0 and 2 share address gonka1a") {
+		t.Fatalf("strict NewPoolWithOptions err = %v", err)
+	}
+
+	// Distinct addresses are fine under strict mode.
+	if _, err := NewPoolWithOptions(wallets[:2], Options{RejectDuplicates: true}); err != nil {
+		t.Fatalf("distinct wallets rejected: %v", err)
+	}
+}
+
+func TestNewPoolDuplicateKeysWithoutAddress(t *testing.T) {
+	const key = "4c0883a69102937d6231471b5dbb6204fe5129617082792ae468d01a3f362318"
+	var wallets []Wallet
+	for range 2 {
+		s, err := signer.New(key)
+		if err != nil {
+			t.Fatal(err)
+		}
+		wallets = append(wallets, Wallet{Signer: s})
+	}
+
+	_, err := NewPoolWithOptions(wallets, Options{RejectDuplicates: true})
+	if err == nil || !strings.Contains(err.Error(), "wallets 0 and 1 share a signing key") {
+		t.Fatalf("strict NewPoolWithOptions err = %v", err)
+	}
+	// Without strict mode the pool starts, with a warning.
+	if _, err := NewPool(wallets); err != nil {
+		t.Fatalf("NewPool: %v", err)
+	}
+}
+
+func TestReplaceDuringSelection(t *testing.T) {
+	p, err := NewPool([]Wallet{{Signer: nopSigner{}, Address: "gonka1old"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	held, _ := p.Next()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 1000; j++ {
+				if w, _ := p.Next(); w.Address == "" {
+					t.Error("Next returned an empty wallet")
+					return
+				}
+				p.ForKey("tenant")
+			}
+		}()
+	}
+	for i := 0; i < 100; i++ {
+		if err := p.Replace([]Wallet{{Signer: nopSigner{}, Address: "gonka1a"}, {Signer: nopSigner{}, Address: "gonka1b"}}); err != nil {
+			t.Fatal(err)
+		}
+	}
+	wg.Wait()
+
+	if held.Address != "gonka1old" {
+		t.Fatalf("wallet selected before Replace changed to %s", held.Address)
+	}
+	if p.Len() != 2 || p.Index(held) != -1 {
+		t.Fatalf("after Replace: Len %d, Index(old) %d", p.Len(), p.Index(held))
+	}
+	if err := p.Replace(nil); err == nil || p.Len() != 2 {
+		t.Fatalf("empty Replace: err %v, Len %d; want error and pool unchanged", err, p.Len())
+	}
+}
+
+func TestNextSkipsWalletsOverQuota(t *testing.T) {
+	// 600 per minute is one request per 100ms.
+	p, err := NewPoolWithOptions([]Wallet{
+		{Signer: nopSigner{}, Address: "gonka1a"},
+		{Signer: nopSigner{}, Address: "gonka1b"},
+	}, Options{RequestsPerMinute: 600, Burst: 2})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// Round-robin continues past a wallet once it is over its quota.
+	if err := p.Allow(&p.All()[0]); err != nil {
+		t.Fatal(err)
+	}
+	got := map[string]int{}
+	for i := 0; i < 3; i++ {
+		w, err := p.Next()
+		if err != nil {
+			t.Fatalf("Next %d: %v", i+1, err)
+		}
+		got[w.Address]++
+	}
+	if got["gonka1a"] != 1 || got["gonka1b"] != 2 {
+		t.Fatalf("picked %v, want gonka1a once and gonka1b twice", got)
+	}
+
+	// Every wallet exhausted: a LimitedError saying when to retry.
+	_, err = p.Next()
+	var limited *LimitedError
+	if !errors.As(err, &limited) {
+		t.Fatalf("Next = %v, want a LimitedError", err)
+	}
+	if limited.RetryAfter <= 0 || limited.RetryAfter > 100*time.Millisecond {
+		t.Fatalf("RetryAfter %s, want (0, 100ms]", limited.RetryAfter)
+	}
+	if err := p.Allow(&p.All()[1]); err == nil {
+		t.Fatal("Allow succeeded for a wallet over its quota")
+	}
+
+	// Quota comes back once RetryAfter has passed.
+	time.Sleep(limited.RetryAfter)
+	if _, err := p.Next(); err != nil {
+		t.Fatalf("Next after RetryAfter: %v", err)
+	}
+}
+
+func TestNextExcludingTakesNoQuotaFromExcludedWallets(t *testing.T) {
+	p, err := NewPoolWithOptions([]Wallet{
+		{Signer: nopSigner{}, Address: "gonka1a"},
+		{Signer: nopSigner{}, Address: "gonka1b"},
+	}, Options{RequestsPerMinute: 1, Burst: 1})
+	if err != nil {
+		t.Fatal(err)
+	}
+	a, _ := p.ByAddress("gonka1a")
+	b, _ := p.ByAddress("gonka1b")
+
+	for i := 0; i < 3; i++ {
+		if w, err := p.NextExcluding(map[*Wallet]bool{b: true}); i == 0 && (err != nil || w != a) {
+			t.Fatalf("NextExcluding = %v, %v; want gonka1a", w, err)
+		} else if i > 0 && !errors.As(err, new(*LimitedError)) {
+			t.Fatalf("NextExcluding %d = %v, %v; want a LimitedError", i+1, w, err)
+		}
+	}
+	// The excluded wallet kept its whole quota.
+	if err := p.Allow(b); err != nil {
+		t.Fatalf("Allow(gonka1b): %v", err)
+	}
+
+	if w, err := p.NextExcluding(map[*Wallet]bool{a: true, b: true}); !errors.Is(err, ErrAllExcluded) {
+		t.Fatalf("NextExcluding(all) = %v, %v; want ErrAllExcluded", w, err)
+	}
+}